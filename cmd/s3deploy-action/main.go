@@ -0,0 +1,77 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Command s3deploy-action is the entrypoint of the s3deploy GitHub Action.
+// It reads the flags from the Action inputs, deploys, and sets the deploy
+// stats as step outputs.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+
+	"github.com/bep/s3deploy/v2/lib"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	if err := run(); err != nil {
+		// Shown as an error annotation in the workflow run.
+		fmt.Printf("::error::%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := lib.ConfigFromArgs(lib.GitHubActionArgs(os.LookupEnv))
+	if err != nil {
+		return err
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		cfg.Version = bi.Main.Version
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stats, err := lib.DeployWithContext(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Silent {
+		fmt.Println(stats.Summary())
+	}
+
+	return writeOutputs(stats)
+}
+
+// writeOutputs sets the step outputs.
+func writeOutputs(stats lib.DeployStats) error {
+	filename := os.Getenv("GITHUB_OUTPUT")
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "uploaded=%d\ndeleted=%d\nskipped=%d\ncopied=%d\nchanged=%d\n",
+		stats.Uploaded, stats.Deleted, stats.Skipped, stats.Copied, stats.FileCountChanged())
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
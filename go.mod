@@ -1,25 +1,34 @@
 module github.com/bep/s3deploy/v2
 
-go 1.18
+go 1.21
 
 require (
 	github.com/aws/aws-sdk-go-v2 v1.18.1
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.22
 	github.com/aws/aws-sdk-go-v2/service/cloudfront v1.26.7
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.35.0
+	github.com/aws/aws-sdk-go-v2/service/sts v1.18.11
+	github.com/aws/smithy-go v1.13.5
 	github.com/bep/helpers v0.5.0
 	github.com/bep/predicate v0.2.0
+	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/dsnet/golib/memfile v1.0.0
 	github.com/frankban/quicktest v1.14.6
+	github.com/klauspost/compress v1.17.9
 	github.com/oklog/ulid/v2 v2.1.0
+	github.com/parquet-go/parquet-go v0.23.0
 	github.com/peterbourgon/ff/v3 v3.4.0
+	github.com/pkg/sftp v1.13.6
 	github.com/rogpeppe/go-internal v1.12.0
+	github.com/tdewolff/minify/v2 v2.12.4
+	golang.org/x/crypto v0.23.0
 	golang.org/x/sync v0.8.0
 	golang.org/x/text v0.19.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream v1.4.10 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/configsources v1.1.34 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.4.28 // indirect
@@ -28,12 +37,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/internal/checksum v1.1.29 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.9.28 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.14.3 // indirect
-	github.com/aws/smithy-go v1.13.5 // indirect
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/segmentio/encoding v0.4.0 // indirect
+	github.com/tdewolff/parse/v2 v2.6.4 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
@@ -0,0 +1,92 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// The suffix of S3 Access Point aliases, which can be used
+	// in place of a bucket name.
+	accessPointAliasSuffix = "-s3alias"
+	// The suffix of Multi-Region Access Point aliases.
+	mrapAliasSuffix = ".mrap"
+)
+
+// isAccessPoint reports whether bucket is an S3 Access Point or
+// Multi-Region Access Point ARN or alias, and not a bucket name.
+func isAccessPoint(bucket string) bool {
+	return arn.IsARN(bucket) || strings.HasSuffix(bucket, accessPointAliasSuffix) || strings.HasSuffix(bucket, mrapAliasSuffix)
+}
+
+// initAccessPoint validates the access point set as the bucket, and sets
+// the region from the ARN if not set.
+func (cfg *Config) initAccessPoint() error {
+	if cfg.CreateBucket {
+		return fmt.Errorf("-create-bucket cannot be used with access point %q", cfg.BucketName)
+	}
+	if cfg.fileConf.Website != nil {
+		return fmt.Errorf("the website configuration cannot be set on access point %q, only on a bucket", cfg.BucketName)
+	}
+
+	if !arn.IsARN(cfg.BucketName) {
+		return nil
+	}
+
+	a, err := arn.Parse(cfg.BucketName)
+	if err != nil {
+		return fmt.Errorf("invalid access point ARN %q: %s", cfg.BucketName, err)
+	}
+	if a.Service != "s3" || !strings.HasPrefix(a.Resource, "accesspoint/") {
+		return fmt.Errorf("invalid access point ARN %q, must be on the form arn:aws:s3:region:account-id:accesspoint/name", cfg.BucketName)
+	}
+	if a.Region == "" {
+		// Multi-Region Access Points have no region.
+		return nil
+	}
+	if cfg.RegionName == "" {
+		cfg.RegionName = a.Region
+	} else if cfg.RegionName != a.Region && !cfg.UseARNRegion {
+		return fmt.Errorf("the region of access point %q is not %s, set -use-arn-region to use it", cfg.BucketName, cfg.RegionName)
+	}
+	return nil
+}
+
+// resolveMRAPAlias replaces a Multi-Region Access Point alias set as the
+// bucket with its ARN, assuming that it's owned by the current account.
+func (cfg *Config) resolveMRAPAlias(ctx context.Context) error {
+	if !strings.HasSuffix(cfg.BucketName, mrapAliasSuffix) || arn.IsARN(cfg.BucketName) {
+		return nil
+	}
+
+	client := cfg.stsClient
+	if client == nil {
+		var err error
+		if client, err = newSTSClient(cfg); err != nil {
+			return err
+		}
+	}
+	out, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("failed to get the account of Multi-Region Access Point %q: %w", cfg.BucketName, err)
+	}
+
+	cfg.BucketName = arn.ARN{
+		Partition: "aws",
+		Service:   "s3",
+		AccountID: aws.ToString(out.Account),
+		Resource:  "accesspoint/" + cfg.BucketName,
+	}.String()
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAccessPointConfig(t *testing.T) {
+	c := qt.New(t)
+
+	init := func(args ...string) (*Config, error) {
+		cfg, err := ConfigFromArgs(append([]string{"-config="}, args...))
+		c.Assert(err, qt.IsNil)
+		return cfg, cfg.Init()
+	}
+
+	c.Assert(isAccessPoint("example.com"), qt.IsFalse)
+	c.Assert(isAccessPoint("my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias"), qt.IsTrue)
+	c.Assert(isAccessPoint("mfzwi23gnjvgw.mrap"), qt.IsTrue)
+
+	// The region is taken from the ARN.
+	cfg, err := init("-bucket=arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.RegionName, qt.Equals, "eu-west-1")
+
+	_, err = init("-bucket=arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "-region=us-east-1")
+	c.Assert(err, qt.ErrorMatches, `the region of access point .* is not us-east-1, set -use-arn-region to use it`)
+	_, err = init("-bucket=arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "-region=us-east-1", "-use-arn-region")
+	c.Assert(err, qt.IsNil)
+
+	// Multi-Region Access Point.
+	cfg, err = init("-bucket=arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap", "-region=us-east-1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.RegionName, qt.Equals, "us-east-1")
+
+	_, err = init("-bucket=arn:aws:iam::123456789012:role/deploy")
+	c.Assert(err, qt.ErrorMatches, `invalid access point ARN .*`)
+	_, err = init("-bucket=my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias", "-region=eu-west-1", "-create-bucket")
+	c.Assert(err, qt.ErrorMatches, `-create-bucket cannot be used with access point .*`)
+	_, err = init("-bucket=my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias", "-website-index-document=index.html")
+	c.Assert(err, qt.ErrorMatches, `the website configuration cannot be set on access point .*`)
+}
+
+func TestResolveMRAPAlias(t *testing.T) {
+	c := qt.New(t)
+	handler := &mockSTSHandler{}
+
+	cfg := &Config{BucketName: "mfzwi23gnjvgw.mrap", stsClient: handler}
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap")
+	c.Assert(handler.calls, qt.Equals, 1)
+
+	// Already resolved.
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(handler.calls, qt.Equals, 1)
+
+	cfg = &Config{BucketName: "example.com", stsClient: handler}
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(handler.calls, qt.Equals, 1)
+}
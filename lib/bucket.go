@@ -0,0 +1,139 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bucketOptions are the settings of a bucket created with -create-bucket.
+type bucketOptions struct {
+	Region string
+	// Enable versioning.
+	Versioning bool
+	// Don't block public access, e.g. for public-read ACLs.
+	Public bool
+	// Keep ACLs enabled, needed when uploading with a canned ACL or grants.
+	ACLs bool
+	// The account ID that must own the bucket, if set.
+	ExpectedOwner string
+}
+
+// remoteBucketCreator is implemented by stores that can create
+// the target bucket if it doesn't exist.
+type remoteBucketCreator interface {
+	CreateBucket(ctx context.Context, opts bucketOptions) (created bool, err error)
+}
+
+type bucketHandler interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error)
+	PutBucketVersioning(ctx context.Context, params *s3.PutBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.PutBucketVersioningOutput, error)
+}
+
+func (s *s3Store) CreateBucket(ctx context.Context, opts bucketOptions) (bool, error) {
+	opts.ACLs = s.acl != "" || len(s.grants) > 0
+	opts.ExpectedOwner = aws.ToString(s.expectedBucketOwner)
+	return createBucket(ctx, s.svc, s.bucket, opts)
+}
+
+func (s *noUpdateStore) CreateBucket(ctx context.Context, opts bucketOptions) (bool, error) {
+	fmt.Printf("\nCreate bucket in %s if missing (versioning: %t, public: %t)\n", opts.Region, opts.Versioning, opts.Public)
+	return false, nil
+}
+
+// createBucket creates bucket with the given options if it doesn't exist.
+// The settings of existing buckets are left alone.
+func createBucket(ctx context.Context, svc bucketHandler, bucket string, opts bucketOptions) (bool, error) {
+	// An empty owner is not sent.
+	expectedOwner := aws.String(opts.ExpectedOwner)
+
+	_, err := svc.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket), ExpectedBucketOwner: expectedOwner})
+	if err == nil {
+		return false, nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return false, err
+	}
+
+	in := &s3.CreateBucketInput{
+		Bucket:          aws.String(bucket),
+		ObjectOwnership: types.ObjectOwnershipBucketOwnerEnforced,
+	}
+	if opts.ACLs {
+		in.ObjectOwnership = types.ObjectOwnershipBucketOwnerPreferred
+	}
+	// us-east-1 is the default and cannot be set as a location constraint.
+	if opts.Region != "" && opts.Region != "us-east-1" {
+		in.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(opts.Region),
+		}
+	}
+	if _, err := svc.CreateBucket(ctx, in); err != nil {
+		return false, err
+	}
+
+	if err := s3.NewBucketExistsWaiter(svc).Wait(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket), ExpectedBucketOwner: expectedOwner}, time.Minute); err != nil {
+		return true, err
+	}
+
+	block := !opts.Public
+	if _, err := svc.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: expectedOwner,
+		PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       block,
+			IgnorePublicAcls:      block,
+			BlockPublicPolicy:     block,
+			RestrictPublicBuckets: block,
+		},
+	}); err != nil {
+		return true, err
+	}
+
+	if opts.Versioning {
+		if _, err := svc.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:              aws.String(bucket),
+			ExpectedBucketOwner: expectedOwner,
+			VersioningConfiguration: &types.VersioningConfiguration{
+				Status: types.BucketVersioningStatusEnabled,
+			},
+		}); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// createBucket creates the target bucket if it doesn't exist (-create-bucket).
+func (d *Deployer) createBucket(ctx context.Context, s remoteStore) error {
+	bc, ok := s.(remoteBucketCreator)
+	if !ok {
+		return errors.New("creating the bucket is not supported by this store")
+	}
+	created, err := bc.CreateBucket(ctx, bucketOptions{
+		Region:     d.cfg.RegionName,
+		Versioning: d.cfg.CreateBucketVersioning,
+		Public:     d.cfg.CreateBucketPublic,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %w", d.cfg.BucketName, err)
+	}
+	if created {
+		d.Printf("Created bucket %s in %s\n", d.cfg.BucketName, d.cfg.RegionName)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCreateBucket(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	h := &bucketTestHandler{}
+	created, err := createBucket(ctx, h, "example.com", bucketOptions{Region: "eu-north-1", Versioning: true, ACLs: true, ExpectedOwner: "123456789012"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(created, qt.IsTrue)
+	c.Assert(h.create, qt.Not(qt.IsNil))
+	c.Assert(*h.create.Bucket, qt.Equals, "example.com")
+	c.Assert(h.create.CreateBucketConfiguration.LocationConstraint, qt.Equals, types.BucketLocationConstraint("eu-north-1"))
+	c.Assert(h.create.ObjectOwnership, qt.Equals, types.ObjectOwnershipBucketOwnerPreferred)
+	c.Assert(h.publicAccessBlock.BlockPublicAcls, qt.IsTrue)
+	c.Assert(h.publicAccessBlock.RestrictPublicBuckets, qt.IsTrue)
+	c.Assert(h.versioning, qt.IsTrue)
+	c.Assert(h.expectedOwners, qt.DeepEquals, []string{"123456789012", "123456789012", "123456789012", "123456789012"})
+
+	// Owned by another account.
+	h = &bucketTestHandler{exists: true, owner: "210987654321"}
+	_, err = createBucket(ctx, h, "example.com", bucketOptions{Region: "eu-north-1", ExpectedOwner: "123456789012"})
+	c.Assert(err, qt.ErrorMatches, "access denied")
+	c.Assert(h.create, qt.IsNil)
+
+	// Already exists.
+	h = &bucketTestHandler{exists: true}
+	created, err = createBucket(ctx, h, "example.com", bucketOptions{Region: "eu-north-1"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(created, qt.IsFalse)
+	c.Assert(h.create, qt.IsNil)
+
+	// us-east-1 has no location constraint.
+	h = &bucketTestHandler{}
+	_, err = createBucket(ctx, h, "example.com", bucketOptions{Region: "us-east-1", Public: true})
+	c.Assert(err, qt.IsNil)
+	c.Assert(h.create.CreateBucketConfiguration, qt.IsNil)
+	c.Assert(h.create.ObjectOwnership, qt.Equals, types.ObjectOwnershipBucketOwnerEnforced)
+	c.Assert(h.publicAccessBlock.BlockPublicAcls, qt.IsFalse)
+	c.Assert(h.publicAccessBlock.BlockPublicPolicy, qt.IsFalse)
+	c.Assert(h.versioning, qt.IsFalse)
+}
+
+func TestDeployCreateBucket(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+	s := &bucketCreatorTestStore{testStore: store.(*testStore)}
+
+	cfg := &Config{
+		BucketName:             "example.com",
+		RegionName:             "eu-west-1",
+		MaxDelete:              300,
+		Silent:                 true,
+		SourcePath:             testSourcePath(),
+		CreateBucket:           true,
+		CreateBucketVersioning: true,
+		baseStore:              s,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.opts, qt.DeepEquals, bucketOptions{Region: "eu-west-1", Versioning: true})
+	c.Assert(stats.Uploaded, qt.Not(qt.Equals), uint64(0))
+	c.Assert(m, qt.Not(qt.HasLen), 0)
+}
+
+type bucketCreatorTestStore struct {
+	*testStore
+	opts bucketOptions
+}
+
+func (s *bucketCreatorTestStore) CreateBucket(ctx context.Context, opts bucketOptions) (bool, error) {
+	s.opts = opts
+	return true, nil
+}
+
+type bucketTestHandler struct {
+	exists bool
+	owner  string
+
+	expectedOwners []string
+
+	create            *s3.CreateBucketInput
+	publicAccessBlock *types.PublicAccessBlockConfiguration
+	versioning        bool
+}
+
+func (h *bucketTestHandler) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	h.expectedOwners = append(h.expectedOwners, aws.ToString(params.ExpectedBucketOwner))
+	if !h.exists {
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	if h.owner != "" && h.owner != aws.ToString(params.ExpectedBucketOwner) {
+		return nil, errors.New("access denied")
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (h *bucketTestHandler) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	h.create = params
+	h.exists = true
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (h *bucketTestHandler) PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error) {
+	h.expectedOwners = append(h.expectedOwners, aws.ToString(params.ExpectedBucketOwner))
+	h.publicAccessBlock = params.PublicAccessBlockConfiguration
+	return &s3.PutPublicAccessBlockOutput{}, nil
+}
+
+func (h *bucketTestHandler) PutBucketVersioning(ctx context.Context, params *s3.PutBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.PutBucketVersioningOutput, error) {
+	h.expectedOwners = append(h.expectedOwners, aws.ToString(params.ExpectedBucketOwner))
+	h.versioning = params.VersioningConfiguration.Status == types.BucketVersioningStatusEnabled
+	return &s3.PutBucketVersioningOutput{}, nil
+}
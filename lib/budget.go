@@ -0,0 +1,46 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// budgetConfig is the budget section of the config file, limits that abort
+// the deploy before anything is uploaded or deleted if exceeded, e.g. when
+// deploying the wrong directory. Zero means no limit.
+type budgetConfig struct {
+	// The maximum total size in bytes of the local files, before compression.
+	MaxBytes int64 `yaml:"maxBytes"`
+	// The maximum number of local files.
+	MaxFiles int `yaml:"maxFiles"`
+	// The maximum number of remote files to delete. Unlike -max-delete,
+	// which deletes up to that many files, this fails the deploy.
+	MaxDeletes int `yaml:"maxDeletes"`
+}
+
+func (b *budgetConfig) init() error {
+	if b.MaxBytes < 0 || b.MaxFiles < 0 || b.MaxDeletes < 0 {
+		return errors.New("budget: maxBytes, maxFiles and maxDeletes must be positive")
+	}
+	return nil
+}
+
+// check returns an error if the deploy of files local files of a total
+// size of bytes, deleting deletes remote files, is over the budget.
+func (b *budgetConfig) check(files int, bytes int64, deletes int) error {
+	if b.MaxFiles > 0 && files > b.MaxFiles {
+		return fmt.Errorf("over budget: %d local files, the maximum is %d (budget.maxFiles)", files, b.MaxFiles)
+	}
+	if b.MaxBytes > 0 && bytes > b.MaxBytes {
+		return fmt.Errorf("over budget: %s of local files, the maximum is %s (budget.maxBytes)", formatBytes(uint64(bytes)), formatBytes(uint64(b.MaxBytes)))
+	}
+	if b.MaxDeletes > 0 && deletes > b.MaxDeletes {
+		return fmt.Errorf("over budget: %d remote files to delete, the maximum is %d (budget.maxDeletes)", deletes, b.MaxDeletes)
+	}
+	return nil
+}
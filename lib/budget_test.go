@@ -0,0 +1,58 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBudgetCheck(t *testing.T) {
+	c := qt.New(t)
+
+	b := &budgetConfig{MaxBytes: 2048, MaxFiles: 10, MaxDeletes: 5}
+	c.Assert(b.init(), qt.IsNil)
+	c.Assert(b.check(10, 2048, 5), qt.IsNil)
+	c.Assert(b.check(11, 0, 0), qt.ErrorMatches, `over budget: 11 local files, the maximum is 10 \(budget.maxFiles\)`)
+	c.Assert(b.check(1, 4096, 0), qt.ErrorMatches, `over budget: 4.0 KiB of local files, the maximum is 2.0 KiB \(budget.maxBytes\)`)
+	c.Assert(b.check(1, 1, 6), qt.ErrorMatches, `over budget: 6 remote files to delete, the maximum is 5 \(budget.maxDeletes\)`)
+
+	// No limits.
+	c.Assert((&budgetConfig{}).check(1000, 1<<40, 1000), qt.IsNil)
+
+	c.Assert((&budgetConfig{MaxFiles: -1}).init(), qt.ErrorMatches, `budget: maxBytes, maxFiles and maxDeletes must be positive`)
+}
+
+func TestDeployBudget(t *testing.T) {
+	c := qt.New(t)
+
+	deploy := func(b *budgetConfig) (map[string]file, error) {
+		store, m := newTestStore(0, "")
+		cfg := &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			baseStore:  store,
+		}
+		cfg.fileConf.Budget = b
+		_, err := Deploy(cfg)
+		return m, err
+	}
+
+	m, err := deploy(&budgetConfig{MaxFiles: 4, MaxDeletes: 1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(m["index.html"], qt.IsNotNil)
+	c.Assert(m["deleteme.txt"], qt.IsNil)
+
+	// Nothing is uploaded or deleted when over budget.
+	m, err = deploy(&budgetConfig{MaxFiles: 3})
+	c.Assert(err, qt.ErrorMatches, `over budget: 4 local files, the maximum is 3 \(budget.maxFiles\)`)
+	c.Assert(m["index.html"], qt.IsNil)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+}
@@ -0,0 +1,87 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// bufferBudget bounds the total size of the local files read into memory
+// and not yet uploaded or skipped (-max-buffer). Reading more files blocks
+// until enough of the files in flight are done with.
+type bufferBudget struct {
+	max int64
+	sem *semaphore.Weighted
+}
+
+func newBufferBudget(max int64) *bufferBudget {
+	return &bufferBudget{max: max, sem: semaphore.NewWeighted(max)}
+}
+
+// acquire waits for room for a file of size bytes and returns the amount
+// to release when done with it. Files larger than the budget are read
+// one at a time.
+func (b *bufferBudget) acquire(ctx context.Context, size int64) (int64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	n := size
+	if n > b.max {
+		n = b.max
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	if err := b.sem.Acquire(ctx, n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (b *bufferBudget) release(n int64) {
+	if b != nil && n > 0 {
+		b.sem.Release(n)
+	}
+}
+
+// releaseBuffer releases the room taken by f in the buffer budget,
+// once it's uploaded or skipped.
+func (d *Deployer) releaseBuffer(f *osFile) {
+	d.buffer.release(f.buffered)
+	f.buffered = 0
+}
+
+// parseBytes parses a size in bytes with an optional unit,
+// e.g. "1024", "256MB" or "1GiB".
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"B", 1},
+	}
+
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a number of bytes with an optional unit, e.g. 256MB", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseBytes(t *testing.T) {
+	c := qt.New(t)
+
+	for s, expect := range map[string]int64{
+		"1024":   1024,
+		"10B":    10,
+		"256MB":  256e6,
+		"256mb":  256e6,
+		"1 GiB":  1 << 30,
+		"512KiB": 512 << 10,
+	} {
+		n, err := parseBytes(s)
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, expect, qt.Commentf(s))
+	}
+
+	for _, s := range []string{"", "MB", "-1MB", "1.5GB", "1TB"} {
+		_, err := parseBytes(s)
+		c.Assert(err, qt.ErrorMatches, `invalid size .*`, qt.Commentf(s))
+	}
+
+	cfg := &Config{BucketName: "example.com", MaxBuffer: "lots"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `-max-buffer: invalid size "lots".*`)
+}
+
+func TestBufferBudget(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	b := newBufferBudget(100)
+	n, err := b.acquire(ctx, 60)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(60))
+
+	// No room until the first file is released.
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.acquire(timeout, 60)
+	c.Assert(err, qt.Equals, context.DeadlineExceeded)
+
+	b.release(n)
+	// Files larger than the budget are read one at a time.
+	n, err = b.acquire(ctx, 1000)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(100))
+	b.release(n)
+
+	var nb *bufferBudget
+	n, err = nb.acquire(ctx, 1000)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(0))
+	nb.release(n)
+}
+
+func TestDeployMaxBuffer(t *testing.T) {
+	c := qt.New(t)
+
+	store, m := newTestStore(0, "")
+	cfg := &Config{
+		BucketName:    "example.com",
+		RegionName:    "eu-west-1",
+		MaxDelete:     300,
+		Silent:        true,
+		SourcePath:    testSourcePath(),
+		MaxBuffer:     "20B",
+		UploadWorkers: 1,
+		baseStore:     store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	assertKeys(t, m, ".s3deploy.yml", "main.css", "index.html", "ab.txt")
+}
@@ -0,0 +1,85 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+var _ remoteCanary = (*canaryClient)(nil)
+
+// remoteCanary is implemented by stores that support canary deploys.
+type remoteCanary interface {
+	// UpdateCanaryTraffic updates the share of the traffic (0-15%) sent
+	// to the canary. A zero percent disables the canary.
+	UpdateCanaryTraffic(ctx context.Context, percent float64) error
+}
+
+type continuousDeploymentHandler interface {
+	GetContinuousDeploymentPolicyConfig(ctx context.Context, params *cloudfront.GetContinuousDeploymentPolicyConfigInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetContinuousDeploymentPolicyConfigOutput, error)
+	UpdateContinuousDeploymentPolicy(ctx context.Context, params *cloudfront.UpdateContinuousDeploymentPolicyInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateContinuousDeploymentPolicyOutput, error)
+}
+
+// canaryClient adjusts a CloudFront continuous deployment policy,
+// sending a share of the traffic to the staging distribution.
+type canaryClient struct {
+	policyID string
+
+	logger printer
+	cf     continuousDeploymentHandler
+}
+
+func newCanaryClient(handler continuousDeploymentHandler, logger printer, cfg *Config) (*canaryClient, error) {
+	if cfg.CanaryPolicyID == "" {
+		return nil, errors.New("must provide a continuous deployment policy ID")
+	}
+	return &canaryClient{
+		policyID: cfg.CanaryPolicyID,
+		logger:   logger,
+		cf:       handler,
+	}, nil
+}
+
+func (c *canaryClient) UpdateCanaryTraffic(ctx context.Context, percent float64) error {
+	out, err := c.cf.GetContinuousDeploymentPolicyConfig(ctx, &cloudfront.GetContinuousDeploymentPolicyConfigInput{
+		Id: aws.String(c.policyID),
+	})
+	if err != nil {
+		return err
+	}
+
+	conf := out.ContinuousDeploymentPolicyConfig
+	if conf == nil {
+		return errors.New("continuous deployment policy has no config")
+	}
+
+	if percent <= 0 {
+		c.logger.Printf("Disable CloudFront continuous deployment policy %s\n", c.policyID)
+		conf.Enabled = aws.Bool(false)
+	} else {
+		c.logger.Printf("Send %.2f%% of the traffic to the canary (CloudFront continuous deployment policy %s)\n", percent, c.policyID)
+		conf.Enabled = aws.Bool(true)
+		conf.TrafficConfig = &types.TrafficConfig{
+			Type: types.ContinuousDeploymentPolicyTypeSingleWeight,
+			SingleWeightConfig: &types.ContinuousDeploymentSingleWeightConfig{
+				Weight: aws.Float32(float32(percent / 100)),
+			},
+		}
+	}
+
+	_, err = c.cf.UpdateContinuousDeploymentPolicy(ctx, &cloudfront.UpdateContinuousDeploymentPolicyInput{
+		Id:                               aws.String(c.policyID),
+		IfMatch:                          out.ETag,
+		ContinuousDeploymentPolicyConfig: conf,
+	})
+
+	return err
+}
@@ -0,0 +1,82 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCanaryUpdateTraffic(t *testing.T) {
+	c := qt.New(t)
+
+	handler := &mockContinuousDeploymentHandler{}
+	client, err := newCanaryClient(handler, newPrinter(io.Discard), &Config{CanaryPolicyID: "policy1"})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(client.UpdateCanaryTraffic(context.Background(), 10), qt.IsNil)
+	c.Assert(*handler.updated.Id, qt.Equals, "policy1")
+	c.Assert(*handler.updated.IfMatch, qt.Equals, "etag1")
+	conf := handler.updated.ContinuousDeploymentPolicyConfig
+	c.Assert(*conf.Enabled, qt.IsTrue)
+	c.Assert(conf.TrafficConfig.Type, qt.Equals, types.ContinuousDeploymentPolicyTypeSingleWeight)
+	c.Assert(*conf.TrafficConfig.SingleWeightConfig.Weight, qt.Equals, float32(0.1))
+
+	c.Assert(client.UpdateCanaryTraffic(context.Background(), 0), qt.IsNil)
+	c.Assert(*handler.updated.ContinuousDeploymentPolicyConfig.Enabled, qt.IsFalse)
+
+	_, err = newCanaryClient(handler, newPrinter(io.Discard), &Config{})
+	c.Assert(err, qt.IsNotNil)
+}
+
+func TestCanaryConfig(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-path=site", "-canary-policy-id=policy1", "-canary-percent=5"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketPath, qt.Equals, "site/canary")
+	c.Assert(cfg.DeleteScope, qt.Equals, "site/canary")
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-path=site", "-canary-policy-id=policy1", "-canary-promote"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketPath, qt.Equals, "site")
+	c.Assert(cfg.shouldKeepRemote("site/canary/index.html"), qt.IsTrue)
+	c.Assert(cfg.shouldKeepRemote("site/index.html"), qt.IsFalse)
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-canary-percent=5"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, ".*continuous deployment policy ID.*")
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-canary-policy-id=policy1", "-canary-percent=20"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, ".*between 0 and 15.*")
+}
+
+type mockContinuousDeploymentHandler struct {
+	updated *cloudfront.UpdateContinuousDeploymentPolicyInput
+}
+
+func (m *mockContinuousDeploymentHandler) GetContinuousDeploymentPolicyConfig(ctx context.Context, params *cloudfront.GetContinuousDeploymentPolicyConfigInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetContinuousDeploymentPolicyConfigOutput, error) {
+	return &cloudfront.GetContinuousDeploymentPolicyConfigOutput{
+		ETag: aws.String("etag1"),
+		ContinuousDeploymentPolicyConfig: &types.ContinuousDeploymentPolicyConfig{
+			Enabled: aws.Bool(false),
+		},
+	}, nil
+}
+
+func (m *mockContinuousDeploymentHandler) UpdateContinuousDeploymentPolicy(ctx context.Context, params *cloudfront.UpdateContinuousDeploymentPolicyInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateContinuousDeploymentPolicyOutput, error) {
+	m.updated = params
+	return &cloudfront.UpdateContinuousDeploymentPolicyOutput{}, nil
+}
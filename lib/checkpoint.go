@@ -0,0 +1,178 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var _ file = (*remoteFileInfo)(nil)
+
+// remoteFileInfo is a snapshot of a remote file.
+type remoteFileInfo struct {
+	K string `json:"key"`
+	S int64  `json:"size"`
+	E string `json:"etag"`
+}
+
+func (f *remoteFileInfo) Key() string {
+	return f.K
+}
+
+func (f *remoteFileInfo) ETag() string {
+	return f.E
+}
+
+func (f *remoteFileInfo) Size() int64 {
+	return f.S
+}
+
+type checkpointHeader struct {
+	Bucket string `json:"bucket"`
+	Path   string `json:"path"`
+	Source string `json:"source"`
+}
+
+// checkpoint is a local file recording the remote file map as listed at the
+// start of a deploy and the uploads completed since, so an interrupted deploy
+// can be resumed without listing the remote again.
+// The file is a JSON header followed by one JSON entry per line, where
+// a later entry for the same key replaces an earlier one.
+type checkpoint struct {
+	filename string
+	header   checkpointHeader
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// checkpointFilename returns the checkpoint filename to use for cfg.
+func checkpointFilename(cfg *Config) (string, error) {
+	if cfg.CheckpointFile != "" {
+		return cfg.CheckpointFile, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	source, err := filepath.Abs(cfg.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(cfg.BucketName + "/" + cfg.BucketPath + "|" + source))
+	return filepath.Join(cacheDir, "s3deploy", "checkpoints", hex.EncodeToString(h[:8])+".jsonl"), nil
+}
+
+func newCheckpoint(cfg *Config) (*checkpoint, error) {
+	filename, err := checkpointFilename(cfg)
+	if err != nil {
+		return nil, err
+	}
+	source, err := filepath.Abs(cfg.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{
+		filename: filename,
+		header:   checkpointHeader{Bucket: cfg.BucketName, Path: cfg.BucketPath, Source: source},
+	}, nil
+}
+
+// load returns the remote file map stored in the checkpoint,
+// or nil if no matching checkpoint exists.
+func (c *checkpoint) load() (map[string]file, error) {
+	f, err := os.Open(c.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+
+	var header checkpointHeader
+	if err := dec.Decode(&header); err != nil || header != c.header {
+		// Not a checkpoint for this deploy.
+		return nil, nil
+	}
+
+	m := make(map[string]file)
+	for dec.More() {
+		var fi remoteFileInfo
+		if err := dec.Decode(&fi); err != nil {
+			// Most likely a partially written line.
+			break
+		}
+		m[fi.K] = &fi
+	}
+
+	return m, nil
+}
+
+// start starts a new checkpoint with the given remote file map.
+func (c *checkpoint) start(m map[string]file) error {
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(c.filename)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.f = f
+	c.enc = json.NewEncoder(f)
+
+	if err := c.enc.Encode(c.header); err != nil {
+		return err
+	}
+	for k, v := range m {
+		if err := c.enc.Encode(remoteFileInfo{K: k, S: v.Size(), E: v.ETag()}); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// uploaded records that f has been uploaded.
+func (c *checkpoint) uploaded(f file) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enc == nil {
+		return errors.New("checkpoint not started")
+	}
+	return c.enc.Encode(remoteFileInfo{K: f.Key(), S: f.Size(), E: f.ETag()})
+}
+
+// close closes the checkpoint file, removing it if the deploy succeeded.
+func (c *checkpoint) close(success bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		if err := c.f.Close(); err != nil {
+			return err
+		}
+		c.f = nil
+		c.enc = nil
+	}
+	if success {
+		if err := os.Remove(c.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxCheckBodySize is the maximum number of bytes read from a
+// response body when looking for the text in check.Contains.
+const maxCheckBodySize = 10 << 20
+
+// check is a smoke test run against the deployed site after the deploy,
+// configured in the checks section of the config file.
+type check struct {
+	// The URL, relative to the -checks-url base URL.
+	URL string `yaml:"url"`
+	// The expected status code, default 200.
+	Status int `yaml:"status"`
+	// The expected response headers.
+	Headers map[string]string `yaml:"headers"`
+	// Text the response body must contain.
+	Contains string `yaml:"contains"`
+}
+
+func (c *check) init() error {
+	if c.URL == "" {
+		return errors.New("check: url must be set")
+	}
+	if c.Status == 0 {
+		c.Status = http.StatusOK
+	}
+	return nil
+}
+
+// run runs the check against baseURL and returns a description
+// of what failed, or an empty string if the check passed.
+func (c *check) run(ctx context.Context, client *verifyClient, baseURL string) (string, error) {
+	rawURL := strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(c.URL, "/")
+	resp, err := client.Do(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var failures []string
+	if resp.StatusCode != c.Status {
+		failures = append(failures, fmt.Sprintf("status %d, expected %d", resp.StatusCode, c.Status))
+	}
+	for k, v := range c.Headers {
+		if got := resp.Header.Get(k); got != v {
+			failures = append(failures, fmt.Sprintf("%s %q, expected %q", http.CanonicalHeaderKey(k), got, v))
+		}
+	}
+	if c.Contains != "" {
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBodySize))
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(string(b), c.Contains) {
+			failures = append(failures, fmt.Sprintf("body does not contain %q", c.Contains))
+		}
+	}
+
+	return strings.Join(failures, ", "), nil
+}
+
+// runChecks runs the checks in the config file against the deployed site.
+func (d *Deployer) runChecks(ctx context.Context) error {
+	checks := d.cfg.fileConf.Checks
+	if len(checks) == 0 || d.cfg.ChecksURL == "" || d.cfg.Try {
+		return nil
+	}
+
+	d.Printf("Running %d check(s) against %s …\n", len(checks), d.cfg.ChecksURL)
+
+	client := newVerifyClient(d.cfg)
+	// Redirects are checked, not followed.
+	client.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var failures []string
+	for _, c := range checks {
+		failure, err := c.run(ctx, client, d.cfg.ChecksURL)
+		if err != nil {
+			failure = err.Error()
+		}
+		if failure != "" {
+			failures = append(failures, c.URL+": "+failure)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d check(s) failed:\n  %s", len(failures), len(checks), strings.Join(failures, "\n  "))
+	}
+
+	return nil
+}
+
+// rollback disables the canary after failed checks (-checks-rollback).
+func (d *Deployer) rollback(ctx context.Context, baseStore remoteStore) error {
+	canary, ok := baseStore.(remoteCanary)
+	if !ok {
+		return errors.New("the remote store does not support canary deploys")
+	}
+	d.Println("Rolling back: disabling the canary …")
+	return canary.UpdateCanaryTraffic(ctx, 0)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func newChecksTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("<h1>Welcome</h1>"))
+		case "/old/":
+			http.Redirect(w, r, "/new/", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestCheckRun(t *testing.T) {
+	c := qt.New(t)
+	srv := newChecksTestServer()
+	defer srv.Close()
+
+	client := newVerifyClient(&Config{})
+	client.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	ctx := context.Background()
+
+	run := func(ch *check) string {
+		c.Assert(ch.init(), qt.IsNil)
+		failure, err := ch.run(ctx, client, srv.URL+"/")
+		c.Assert(err, qt.IsNil)
+		return failure
+	}
+
+	c.Assert(run(&check{URL: "/", Headers: map[string]string{"cache-control": "max-age=60"}, Contains: "Welcome"}), qt.Equals, "")
+	c.Assert(run(&check{URL: "old/", Status: 301}), qt.Equals, "")
+	c.Assert(run(&check{URL: "/missing"}), qt.Equals, "status 404, expected 200")
+	c.Assert(run(&check{URL: "/", Headers: map[string]string{"Cache-Control": "no-cache"}, Contains: "Goodbye"}), qt.Equals, `Cache-Control "max-age=60", expected "no-cache", body does not contain "Goodbye"`)
+
+	c.Assert((&check{}).init(), qt.ErrorMatches, "check: url must be set")
+}
+
+type canaryTestStore struct {
+	*testStore
+	percents []float64
+}
+
+func (s *canaryTestStore) UpdateCanaryTraffic(ctx context.Context, percent float64) error {
+	s.percents = append(s.percents, percent)
+	return nil
+}
+
+func TestDeployChecks(t *testing.T) {
+	c := qt.New(t)
+	srv := newChecksTestServer()
+	defer srv.Close()
+
+	newConfig := func(store remoteStore, checks ...*check) *Config {
+		cfg := &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			ChecksURL:  srv.URL,
+			baseStore:  store,
+		}
+		cfg.fileConf.Checks = checks
+		c.Assert(cfg.fileConf.init(), qt.IsNil)
+		return cfg
+	}
+
+	store, _ := newTestStore(0, "")
+	_, err := Deploy(newConfig(store, &check{URL: "/"}, &check{URL: "/old/", Status: 301}))
+	c.Assert(err, qt.IsNil)
+
+	store, _ = newTestStore(0, "")
+	stats, err := Deploy(newConfig(store, &check{URL: "/"}, &check{URL: "/missing"}))
+	c.Assert(err, qt.ErrorMatches, "1 of 2 check\\(s\\) failed:\n  /missing: status 404, expected 200")
+	c.Assert(stats.Uploaded, qt.Equals, uint64(3))
+
+	// Roll back the canary.
+	ts, _ := newTestStore(0, "canary")
+	canary := &canaryTestStore{testStore: ts.(*testStore)}
+	cfg := newConfig(canary, &check{URL: "/missing"})
+	cfg.CanaryPolicyID = "E123"
+	cfg.CanaryPercent = 5
+	cfg.ChecksRollback = true
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, "(?s)1 of 1 check\\(s\\) failed:.*")
+	c.Assert(canary.percents, qt.DeepEquals, []float64{5, 0})
+}
@@ -0,0 +1,134 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runningInGitHubActions reports whether we're running in a GitHub Actions workflow.
+func runningInGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// maskSecrets tells GitHub Actions to redact the secrets in use from the
+// logs, using workflow commands written to w.
+func (cfg *Config) maskSecrets(w io.Writer) {
+	for _, secret := range []string{cfg.SecretKey, cfg.sessionToken, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), os.Getenv(targetPasswordEnv)} {
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Fprintf(w, "::add-mask::%s\n", line)
+			}
+		}
+	}
+}
+
+// envFileFromArgs returns the value of the env-file flag in args,
+// falling back to the S3DEPLOY_ENV_FILE environment variable.
+func envFileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			// Not a flag.
+			continue
+		}
+		if name == "env-file" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "env-file=") {
+			return strings.TrimPrefix(name, "env-file=")
+		}
+	}
+	return os.Getenv("S3DEPLOY_ENV_FILE")
+}
+
+// loadEnvFile sets the environment variables in filename, one KEY=value
+// per line, not already set. Blank lines and lines starting with # are
+// skipped, and the values may be quoted.
+func loadEnvFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open env file: %w", err)
+	}
+	defer f.Close()
+
+	vars, err := parseEnvFile(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse env file %q: %w", filename, err)
+	}
+
+	for _, kv := range vars {
+		if _, found := os.LookupEnv(kv[0]); found {
+			continue
+		}
+		if err := os.Setenv(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseEnvFile(r io.Reader) ([][2]string, error) {
+	var vars [][2]string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNum)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			value = v
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, scanner.Err()
+}
+
+// GitHubActionArgs returns the flags set as inputs to the s3deploy
+// GitHub Action, read from the INPUT_<FLAG NAME> environment variables
+// using lookup, e.g. INPUT_BUCKET for -bucket.
+func GitHubActionArgs(lookup func(string) (string, bool)) []string {
+	fs := flag.NewFlagSet("s3deploy", flag.ContinueOnError)
+	flagsToConfig(fs)
+
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		v, found := lookup("INPUT_" + strings.ToUpper(f.Name))
+		if !found || strings.TrimSpace(v) == "" {
+			return
+		}
+		args = append(args, "-"+f.Name+"="+v)
+	})
+
+	return args
+}
@@ -0,0 +1,102 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	c := qt.New(t)
+
+	vars, err := parseEnvFile(strings.NewReader(`
+# A comment.
+S3DEPLOY_BUCKET=example.com
+export S3DEPLOY_PATH = "my path"
+S3DEPLOY_DISTRIBUTION_ID="a\nb"
+S3DEPLOY_IGNORE='^\.git'
+EMPTY=
+`))
+	c.Assert(err, qt.IsNil)
+	c.Assert(vars, qt.DeepEquals, [][2]string{
+		{"S3DEPLOY_BUCKET", "example.com"},
+		{"S3DEPLOY_PATH", "my path"},
+		{"S3DEPLOY_DISTRIBUTION_ID", "a\nb"},
+		{"S3DEPLOY_IGNORE", `^\.git`},
+		{"EMPTY", ""},
+	})
+
+	_, err = parseEnvFile(strings.NewReader("A=b\nnope\n"))
+	c.Assert(err, qt.ErrorMatches, "line 2: expected KEY=value")
+}
+
+func TestConfigFromEnvFile(t *testing.T) {
+	c := qt.New(t)
+
+	envFile := filepath.Join(t.TempDir(), "s3deploy.env")
+	c.Assert(os.WriteFile(envFile, []byte("S3DEPLOY_BUCKET=example.com\nS3DEPLOY_REGION=eu-west-1\nS3DEPLOY_DISTRIBUTION_ID=\"a\\nb\\n\"\n"), 0o644), qt.IsNil)
+	t.Cleanup(func() {
+		os.Unsetenv("S3DEPLOY_BUCKET")
+		os.Unsetenv("S3DEPLOY_DISTRIBUTION_ID")
+	})
+	// Already set, so not overridden.
+	t.Setenv("S3DEPLOY_REGION", "us-east-1")
+
+	for _, args := range [][]string{{"-env-file", envFile}, {"--env-file=" + envFile}} {
+		os.Unsetenv("S3DEPLOY_BUCKET")
+		os.Unsetenv("S3DEPLOY_DISTRIBUTION_ID")
+		cfg, err := ConfigFromArgs(args)
+		c.Assert(err, qt.IsNil)
+		c.Assert(cfg.BucketName, qt.Equals, "example.com")
+		c.Assert(cfg.RegionName, qt.Equals, "us-east-1")
+		c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"a", "b"})
+	}
+
+	_, err := ConfigFromArgs([]string{"-env-file", filepath.Join(t.TempDir(), "missing.env")})
+	c.Assert(err, qt.ErrorMatches, "failed to open env file.*")
+}
+
+func TestMaskSecrets(t *testing.T) {
+	c := qt.New(t)
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SESSION_TOKEN", "envtoken")
+	t.Setenv(targetPasswordEnv, "davpassword")
+
+	var buf bytes.Buffer
+	cfg := &Config{AccessKey: "key", SecretKey: "secret"}
+	cfg.maskSecrets(&buf)
+	c.Assert(buf.String(), qt.Equals, "::add-mask::secret\n::add-mask::envtoken\n::add-mask::davpassword\n")
+}
+
+func TestGitHubActionArgs(t *testing.T) {
+	c := qt.New(t)
+
+	inputs := map[string]string{
+		"INPUT_BUCKET":          "example.com",
+		"INPUT_DISTRIBUTION-ID": "a\nb",
+		"INPUT_TRY":             "true",
+		"INPUT_PATH":            "",
+		"INPUT_NOT-A-FLAG":      "foo",
+	}
+	args := GitHubActionArgs(func(k string) (string, bool) {
+		v, found := inputs[k]
+		return v, found
+	})
+	c.Assert(args, qt.DeepEquals, []string{"-bucket=example.com", "-distribution-id=a\nb", "-try=true"})
+
+	cfg, err := ConfigFromArgs(args)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"a", "b"})
+	c.Assert(cfg.Try, qt.IsTrue)
+}
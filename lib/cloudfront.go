@@ -8,11 +8,14 @@ package lib
 import (
 	"context"
 	"errors"
+	"fmt"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 )
@@ -23,12 +26,26 @@ type cloudFrontClient struct {
 	// The CloudFront distribution IDs
 	distributionIDs Strings
 
+	// The origin path per distribution ID, when set with
+	// -distribution-id=ID:/path.
+	originPaths map[string]string
+
 	// Will invalidate the entire cache, e.g. "/*"
 	force      bool
+	bucket     string
 	bucketPath string
 
+	// The page URLs in the sitemap (-invalidate-sitemap), if set.
+	pages sitemapPages
+
 	logger printer
 	cf     cloudfrontHandler
+
+	// The paths invalidated, across all distributions.
+	invalidated []string
+	// Distribution ID => invalidation ID.
+	invalidationIDs map[string]string
+	mu              sync.Mutex
 }
 
 func newCloudFrontClient(
@@ -39,10 +56,32 @@ func newCloudFrontClient(
 	if len(cfg.CDNDistributionIDs) == 0 {
 		return nil, errors.New("must provide one or more distribution ID")
 	}
+	var pages sitemapPages
+	if cfg.InvalidateSitemap != "" {
+		var err error
+		pages, err = loadSitemapPages(cfg.sourceFS(), cfg.InvalidateSitemap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sitemap: %w", err)
+		}
+	}
+	var (
+		ids         Strings
+		originPaths = make(map[string]string)
+	)
+	for _, s := range cfg.CDNDistributionIDs {
+		id, originPath, found := strings.Cut(s, ":")
+		if found {
+			originPaths[id] = originPath
+		}
+		ids = append(ids, id)
+	}
 	return &cloudFrontClient{
-		distributionIDs: cfg.CDNDistributionIDs,
+		distributionIDs: ids,
+		originPaths:     originPaths,
 		force:           cfg.Force,
+		bucket:          cfg.BucketName,
 		bucketPath:      cfg.BucketPath,
+		pages:           pages,
 		logger:          logger,
 		cf:              handler,
 	}, nil
@@ -58,60 +97,144 @@ func (c *cloudFrontClient) InvalidateCDNCache(ctx context.Context, paths ...stri
 		return nil
 	}
 
-	invalidateForID := func(id string) error {
-		dcfg, err := c.cf.GetDistribution(ctx, &cloudfront.GetDistributionInput{
-			Id: &id,
-		})
-		if err != nil {
-			return err
-		}
-
-		originPath := *dcfg.Distribution.DistributionConfig.Origins.Items[0].OriginPath
-		var root string
-		if originPath != "" || c.bucketPath != "" {
-			var subPath string
-			root, subPath = c.determineRootAndSubPath(c.bucketPath, originPath)
-			if subPath != "" {
-				for i, p := range paths {
-					paths[i] = strings.TrimPrefix(p, subPath)
-				}
+	// Invalidate all distributions concurrently, and don't let
+	// one failing distribution stop the others.
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for _, id := range c.distributionIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			// The paths are modified per distribution.
+			if err := c.invalidateForID(ctx, id, append([]string(nil), paths...)); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %s", id, err))
+				mu.Unlock()
 			}
-		}
+		}(id)
+	}
+	wg.Wait()
 
-		// This will try to reduce the number of invaldation paths to maximum 8.
-		// If that isn't possible it will fall back to a full invalidation, e.g. "/*".
-		// CloudFront allows 1000 free invalidations per month. After that they
-		// cost money, so we want to keep this down.
-		paths = c.normalizeInvalidationPaths(root, 8, c.force, paths...)
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("failed to invalidate CloudFront distribution %s", errs[0])
+	default:
+		sort.Strings(errs)
+		return fmt.Errorf("failed to invalidate %d of %d CloudFront distributions:\n  %s", len(errs), len(c.distributionIDs), strings.Join(errs, "\n  "))
+	}
+}
 
-		if len(paths) > 10 {
-			c.logger.Printf("Create CloudFront invalidation request for %d paths", len(paths))
-		} else {
-			c.logger.Printf("Create CloudFront invalidation request for %v", paths)
-		}
+func (c *cloudFrontClient) invalidateForID(ctx context.Context, id string, paths []string) error {
+	dcfg, err := c.cf.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+		Id: &id,
+	})
+	if err != nil {
+		return err
+	}
 
-		in := &cloudfront.CreateInvalidationInput{
-			DistributionId:    &id,
-			InvalidationBatch: c.pathsToInvalidationBatch(time.Now().Format("20060102150405"), paths...),
+	originPath, found := c.originPaths[id]
+	if !found {
+		originPath = c.originPath(dcfg.Distribution)
+	}
+	var root string
+	if originPath != "" || c.bucketPath != "" {
+		var subPath string
+		root, subPath = c.determineRootAndSubPath(c.bucketPath, originPath)
+		if subPath != "" {
+			for i, p := range paths {
+				paths[i] = strings.TrimPrefix(p, subPath)
+			}
 		}
+	}
+
+	if c.pages != nil {
+		paths = c.pages.invalidationPaths(paths)
+	}
 
-		_, err = c.cf.CreateInvalidation(
-			ctx,
-			in,
-		)
+	// This will try to reduce the number of invaldation paths to maximum 8.
+	// If that isn't possible it will fall back to a full invalidation, e.g. "/*".
+	// CloudFront allows 1000 free invalidations per month. After that they
+	// cost money, so we want to keep this down.
+	paths = c.normalizeInvalidationPaths(root, 8, c.force, paths...)
 
+	in := &cloudfront.CreateInvalidationInput{
+		DistributionId:    &id,
+		InvalidationBatch: c.pathsToInvalidationBatch(time.Now().Format("20060102150405"), paths...),
+	}
+
+	out, err := c.cf.CreateInvalidation(
+		ctx,
+		in,
+	)
+	if err != nil {
 		return err
 	}
 
-	for _, id := range c.distributionIDs {
-		if err := invalidateForID(id); err != nil {
-			return err
+	var invalidationID string
+	if out.Invalidation != nil && out.Invalidation.Id != nil {
+		invalidationID = *out.Invalidation.Id
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(paths) > 10 {
+		c.logger.Printf("Created CloudFront invalidation %s in distribution %s for %d paths\n", invalidationID, id, len(paths))
+	} else {
+		c.logger.Printf("Created CloudFront invalidation %s in distribution %s for %v\n", invalidationID, id, paths)
+	}
+
+	if c.invalidationIDs == nil {
+		c.invalidationIDs = make(map[string]string)
+	}
+	c.invalidationIDs[id] = invalidationID
+
+next:
+	for _, p := range paths {
+		for _, pp := range c.invalidated {
+			if p == pp {
+				continue next
+			}
 		}
+		c.invalidated = append(c.invalidated, p)
 	}
 
 	return nil
 }
 
+// originPath returns the origin path of the origin in d serving the
+// bucket, or of the first origin if none of them matches the bucket.
+func (c *cloudFrontClient) originPath(d *types.Distribution) string {
+	if d == nil || d.DistributionConfig == nil || d.DistributionConfig.Origins == nil || len(d.DistributionConfig.Origins.Items) == 0 {
+		return ""
+	}
+	origins := d.DistributionConfig.Origins.Items
+	origin := origins[0]
+	for _, o := range origins {
+		if isBucketOrigin(aws.ToString(o.DomainName), c.bucket) {
+			origin = o
+			break
+		}
+	}
+	return aws.ToString(origin.OriginPath)
+}
+
+// isBucketOrigin reports whether domain is an S3 endpoint for bucket, e.g.
+// "example.com.s3.eu-west-1.amazonaws.com" or the website endpoint
+// "example.com.s3-website-eu-west-1.amazonaws.com".
+func isBucketOrigin(domain, bucket string) bool {
+	if bucket == "" || !strings.HasPrefix(domain, bucket+".") {
+		return false
+	}
+	rest := strings.TrimPrefix(domain, bucket+".")
+	return strings.HasPrefix(rest, "s3.") || strings.HasPrefix(rest, "s3-")
+}
+
 func (*cloudFrontClient) pathsToInvalidationBatch(ref string, paths ...string) *types.InvalidationBatch {
 	cfpaths := &types.Paths{}
 	for _, p := range paths {
@@ -7,9 +7,12 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -115,6 +118,47 @@ func TestNewCloudFrontClient(t *testing.T) {
 	c.Assert(client.force, qt.Equals, true)
 }
 
+func TestCloudFrontOriginPath(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := newCloudFrontClient(&mockCloudfrontHandler{}, newPrinter(io.Discard), &Config{
+		CDNDistributionIDs: Strings{"E1", "E2:/blog"},
+		BucketName:         "example.com",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.distributionIDs, qt.DeepEquals, Strings{"E1", "E2"})
+	c.Assert(client.originPaths, qt.DeepEquals, map[string]string{"E2": "/blog"})
+
+	distribution := func(origins ...types.Origin) *types.Distribution {
+		return &types.Distribution{
+			DistributionConfig: &types.DistributionConfig{
+				Origins: &types.Origins{Items: origins},
+			},
+		}
+	}
+
+	api := types.Origin{DomainName: aws.String("api.example.com"), OriginPath: aws.String("/v1")}
+	bucket := types.Origin{DomainName: aws.String("example.com.s3.eu-west-1.amazonaws.com"), OriginPath: aws.String("/site")}
+	website := types.Origin{DomainName: aws.String("example.com.s3-website-eu-west-1.amazonaws.com"), OriginPath: aws.String("/www")}
+	other := types.Origin{DomainName: aws.String("example.com.au.s3.amazonaws.com"), OriginPath: aws.String("/other")}
+
+	c.Assert(client.originPath(distribution(api, bucket)), qt.Equals, "/site")
+	c.Assert(client.originPath(distribution(api, website)), qt.Equals, "/www")
+	c.Assert(client.originPath(distribution(other, api)), qt.Equals, "/other")
+	c.Assert(client.originPath(distribution(types.Origin{DomainName: aws.String("a.example.com")})), qt.Equals, "")
+	c.Assert(client.originPath(distribution()), qt.Equals, "")
+
+	// Set explicitly.
+	handler := &distributionsHandler{originPaths: map[string]string{"E1": "", "E2": ""}}
+	client.cf = handler
+	client.bucketPath = "blog"
+	c.Assert(client.InvalidateCDNCache(context.Background(), "blog/a.css"), qt.IsNil)
+	c.Assert(handler.invalidations, qt.DeepEquals, map[string][]string{
+		"E1": {"/blog/a.css"},
+		"E2": {"/a.css"},
+	})
+}
+
 func createFiles(root string, differentFolders bool, num int) []string {
 	files := make([]string, num)
 
@@ -142,3 +186,80 @@ func (c *mockCloudfrontHandler) GetDistribution(ctx context.Context, params *clo
 func (c *mockCloudfrontHandler) CreateInvalidation(ctx context.Context, params *cloudfront.CreateInvalidationInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateInvalidationOutput, error) {
 	return &cloudfront.CreateInvalidationOutput{}, nil
 }
+
+// distributionsHandler is a cloudfrontHandler with distributions
+// served from the given origin paths.
+type distributionsHandler struct {
+	originPaths map[string]string
+	fail        map[string]bool
+
+	mu            sync.Mutex
+	invalidations map[string][]string
+}
+
+func (h *distributionsHandler) GetDistribution(ctx context.Context, params *cloudfront.GetDistributionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetDistributionOutput, error) {
+	originPath, found := h.originPaths[*params.Id]
+	if !found {
+		return nil, fmt.Errorf("distribution %s not found", *params.Id)
+	}
+	return &cloudfront.GetDistributionOutput{
+		Distribution: &types.Distribution{
+			DistributionConfig: &types.DistributionConfig{
+				Origins: &types.Origins{
+					Items: []types.Origin{{OriginPath: aws.String(originPath)}},
+				},
+			},
+		},
+	}, nil
+}
+
+func (h *distributionsHandler) CreateInvalidation(ctx context.Context, params *cloudfront.CreateInvalidationInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateInvalidationOutput, error) {
+	id := *params.DistributionId
+	if h.fail[id] {
+		return nil, errors.New("access denied")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.invalidations == nil {
+		h.invalidations = make(map[string][]string)
+	}
+	h.invalidations[id] = params.InvalidationBatch.Paths.Items
+	return &cloudfront.CreateInvalidationOutput{
+		Invalidation: &types.Invalidation{Id: aws.String("I" + id)},
+	}, nil
+}
+
+func TestInvalidateCDNCacheDistributions(t *testing.T) {
+	c := qt.New(t)
+
+	handler := &distributionsHandler{
+		originPaths: map[string]string{"E1": "", "E2": "/blog", "E3": "", "E4": ""},
+		fail:        map[string]bool{"E3": true, "E4": true},
+	}
+	client, err := newCloudFrontClient(handler, newPrinter(io.Discard), &Config{
+		CDNDistributionIDs: Strings{"E1", "E2", "E3", "E4", "E5"},
+		BucketPath:         "blog",
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = client.InvalidateCDNCache(context.Background(), "blog/a.css", "blog/posts/index.html")
+	c.Assert(err, qt.ErrorMatches, `failed to invalidate 3 of 5 CloudFront distributions:
+  E3: access denied
+  E4: access denied
+  E5: distribution E5 not found`)
+
+	// All the other distributions are invalidated, each with their own paths.
+	c.Assert(handler.invalidations, qt.DeepEquals, map[string][]string{
+		"E1": {"/blog/a.css", "/blog/posts/"},
+		"E2": {"/a.css", "/posts/"},
+	})
+	c.Assert(client.invalidationIDs, qt.DeepEquals, map[string]string{"E1": "IE1", "E2": "IE2"})
+	invalidated := append([]string(nil), client.invalidated...)
+	sort.Strings(invalidated)
+	c.Assert(invalidated, qt.DeepEquals, []string{"/a.css", "/blog/a.css", "/blog/posts/", "/posts/"})
+
+	handler.fail = nil
+	client.distributionIDs = Strings{"E1", "E3"}
+	c.Assert(client.InvalidateCDNCache(context.Background(), "blog/a.css"), qt.IsNil)
+	c.Assert(client.invalidationIDs["E3"], qt.Equals, "IE3")
+}
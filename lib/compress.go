@@ -0,0 +1,146 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The supported content encodings.
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+func validateCompression(s string) error {
+	switch s {
+	case "", encodingGzip, encodingZstd:
+		return nil
+	default:
+		return fmt.Errorf("invalid compression %q, must be one of %q or %q", s, encodingGzip, encodingZstd)
+	}
+}
+
+// incompressibleExtensions are file extensions of formats that are
+// already compressed, in case the content type isn't specific enough.
+var incompressibleExtensions = map[string]bool{
+	".7z":    true,
+	".avif":  true,
+	".br":    true,
+	".bz2":   true,
+	".gif":   true,
+	".gz":    true,
+	".heic":  true,
+	".jpeg":  true,
+	".jpg":   true,
+	".m4a":   true,
+	".mp3":   true,
+	".mp4":   true,
+	".ogg":   true,
+	".png":   true,
+	".rar":   true,
+	".tgz":   true,
+	".webm":  true,
+	".webp":  true,
+	".woff":  true,
+	".woff2": true,
+	".xz":    true,
+	".zip":   true,
+	".zst":   true,
+}
+
+// incompressibleContentTypes are media types of formats that are already
+// compressed. Types ending in "/" match everything with that prefix.
+var incompressibleContentTypes = []string{
+	"application/gzip",
+	"application/vnd.rar",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/x-xz",
+	"application/zip",
+	"application/zstd",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"image/",
+	"video/",
+}
+
+// compressibleImageTypes are the image types that are worth compressing.
+var compressibleImageTypes = map[string]bool{
+	"image/bmp":                true,
+	"image/svg+xml":            true,
+	"image/vnd.microsoft.icon": true,
+	"image/x-icon":             true,
+}
+
+// isIncompressible reports whether a file with the given content type
+// and extension is already compressed, so compressing it again would
+// only cost CPU and possibly make it bigger.
+func isIncompressible(contentType, ext string) bool {
+	if incompressibleExtensions[strings.ToLower(ext)] {
+		return true
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if compressibleImageTypes[mediaType] {
+		return false
+	}
+	for _, t := range incompressibleContentTypes {
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(mediaType, t) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compress compresses b using the given encoding.
+// The gzipLevel is only used for gzip.
+func compress(encoding string, gzipLevel int, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch encoding {
+	case encodingGzip:
+		gz, err := gzip.NewWriterLevel(&buf, gzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		// No name, modification time or OS in the header, so the same
+		// content always compresses to the same bytes (and ETag).
+		gz.Header = gzip.Header{OS: 255}
+		if _, err := gz.Write(b); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	case encodingZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -7,20 +7,26 @@ package lib
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/bep/helpers/envhelpers"
 	"github.com/bep/predicate"
+	"github.com/oklog/ulid/v2"
 	"github.com/peterbourgon/ff/v3"
 	"gopkg.in/yaml.v2"
 )
@@ -35,14 +41,26 @@ func ConfigFromArgs(args []string) (*Config, error) {
 	fs := flag.NewFlagSet("s3deploy", flag.ContinueOnError)
 	cfg := flagsToConfig(fs)
 
+	// The env file must be loaded before the flags are read from the environment.
+	if filename := envFileFromArgs(args); filename != "" {
+		if err := loadEnvFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := ff.Parse(fs, args,
 		ff.WithEnvVarPrefix("S3DEPLOY"),
 		ff.WithConfigFileFlag("config"),
-		ff.WithConfigFileParser(parserYAMLConfig),
+		ff.WithConfigFileParser(cfg.parseYAMLConfig),
 		ff.WithAllowMissingConfigFile(true),
 	); err != nil {
 		return nil, err
 	}
+	cfg.Args = fs.Args()
+
+	if runningInGitHubActions() {
+		cfg.maskSecrets(os.Stderr)
+	}
 
 	return cfg, nil
 }
@@ -51,35 +69,317 @@ func ConfigFromArgs(args []string) (*Config, error) {
 type Config struct {
 	fileConf fileConfig
 
+	// Set from Hash, nil for MD5.
+	hasher contentHasher
+
 	AccessKey string
 	SecretKey string
 
 	SourcePath string
+	// SourceFS, if set, is deployed from instead of SourcePath, e.g. an
+	// embed.FS or the in-memory output of a build. Not set from flags.
+	SourceFS   fs.FS
 	BucketName string
 
 	// To have multiple sites in one bucket.
 	BucketPath string
 	RegionName string
 
+	// The URL of a directory or server to deploy to instead of the
+	// bucket, e.g. file:///srv/www or webdavs://user@example.org/site.
+	Target string
+
+	// Use the region of an access point ARN set as the bucket, even
+	// if it's not RegionName.
+	UseARNRegion bool
+
+	// Use the S3 dual-stack (IPv4 and IPv6) endpoints.
+	DualStack bool
+
+	// Use the S3 Transfer Acceleration endpoint, which must be
+	// enabled on the bucket.
+	Accelerate bool
+
+	// Set to "requester" to deploy to a requester-pays bucket.
+	RequestPayer string
+
+	// The account ID that must own the bucket. Requests to a
+	// bucket owned by another account fail.
+	ExpectedBucketOwner string
+
 	// When set, will invalidate the CDN cache(s) for the updated files.
+	// An ID may be followed by the origin path to use, e.g. "EABC123:/blog".
 	CDNDistributionIDs Strings
 
+	// When set, the CloudFront Function with this name is updated with the
+	// redirects in the config file and published before the invalidation.
+	// With CloudFrontFunctionCleanURLs, it also rewrites directory requests
+	// to their index.html.
+	CloudFrontFunction          string
+	CloudFrontFunctionCleanURLs bool
+
+	// When set, changed HTML files listed in this sitemap (relative to
+	// SourcePath) are invalidated by all the page URLs that can serve them.
+	InvalidateSitemap string
+
 	// When set, will override the default AWS endpoint.
 	EndpointURL string
 
 	// Optional configFile
 	ConfigFile string
+	// The age identity file to decrypt an age or SOPS encrypted ConfigFile with.
+	ConfigIdentity string
+	// The environment in the environments section of ConfigFile to deploy,
+	// its settings override the top level ones.
+	Environment string
+	// Optional file with the routes to use instead of those in ConfigFile.
+	RoutesFile string
 
+	// Optional file with environment variables (KEY=value lines),
+	// loaded before the flags are read from the environment.
+	// Variables already set in the environment take precedence.
+	EnvFile string
+
+	// The number of concurrent uploads, the number of concurrent
+	// DeleteObjects requests (of up to 1000 keys each), the number
+	// of prefixes to list concurrently, and the number of local files
+	// to hash concurrently. Zero or less means the default
+	// (the number of CPUs, 4, 1 and the number of CPUs).
+	UploadWorkers   int
+	DeleteWorkers   int
+	ListConcurrency int
+	HashWorkers     int
+
+	// Deprecated: use UploadWorkers.
 	NumberOfWorkers int
-	MaxDelete       int
-	ACL             string
-	PublicReadACL   bool
-	StripIndexHTML  bool
-	Verbose         bool
-	Silent          bool
-	Force           bool
-	Try             bool
-	Ignore          Strings
+
+	MaxDelete      int
+	ACL            string
+	PublicReadACL  bool
+	StripIndexHTML bool
+	Verbose        bool
+	Silent         bool
+	Force          bool
+	Try            bool
+	Ignore         Strings
+
+	// The maximum share (0-100) of the remote files to delete. If more
+	// are to be deleted, none are, e.g. after deploying to the wrong path.
+	// When set, MaxDelete is not used.
+	MaxDeletePercent float64
+
+	// Deploy even if it would delete most of the remote files while
+	// uploading only a few, e.g. to empty the bucket on purpose.
+	ForceDeleteAll bool
+
+	// Fail the deploy if any remote files were left because
+	// of MaxDelete or MaxDeletePercent.
+	FailOnStale bool
+
+	// The maximum number of files to delete with the prune
+	// command, which doesn't use MaxDelete.
+	PruneMaxDelete int
+
+	// Print only the warnings, the files deleted and the summary,
+	// not a line per file uploaded. Verbose takes precedence.
+	Brief bool
+	// Disable the colors in the output, which are only
+	// used when writing to a terminal.
+	NoColor bool
+
+	// One or more regular expressions of the only files to deploy.
+	// Remote files not matching are left alone.
+	Include Strings
+
+	// Upload without ACL, with a warning, if ACLs are disabled on the bucket.
+	ACLFallback bool
+
+	// Store the modification time of the local files in the
+	// object metadata (x-amz-meta-mtime).
+	PreserveMtime bool
+
+	// One or more regular expressions of remote files to never delete,
+	// even if not present in the source.
+	Keep Strings
+
+	// Also upload every <dir>/index.html as <dir>, so extensionless URLs
+	// work with a CloudFront REST (non-website) origin.
+	IndexCopies bool
+
+	// Upload files with the same content only once, and create the
+	// other keys with server side copies.
+	Dedupe bool
+
+	// Copy new files with the same content as a remote file to be deleted
+	// from it server side, e.g. after moving files around, instead of
+	// uploading them.
+	DetectMoves bool
+
+	// The hash algorithm used to detect changed files, one of "md5" (the
+	// default, compared with the remote ETags), "sha256" and "xxhash",
+	// stored in and compared with the object metadata.
+	Hash string
+
+	// Set the S3 static website index and error document, in addition
+	// to the website section of the config file.
+	WebsiteIndexDocument string
+	WebsiteErrorDocument string
+
+	// Create the bucket if it doesn't exist, optionally with versioning
+	// and without blocking public access.
+	CreateBucket           bool
+	CreateBucketVersioning bool
+	CreateBucketPublic     bool
+
+	// Deploy even if the remote freeze marker object is present.
+	OverrideFreeze bool
+
+	// Remote files outside of this prefix will never be deleted.
+	// Defaults to BucketPath.
+	DeleteScope string
+
+	// Only allow deploys inside this weekly time window,
+	// e.g. "Mon-Fri 09:00-17:00 Europe/Oslo".
+	DeployWindow string
+	// Wait for the deploy window to open instead of failing.
+	WaitForWindow bool
+
+	// Experimental canary deploys using a CloudFront continuous deployment policy.
+	// When CanaryPercent is set, the files are deployed to CanaryPrefix below
+	// BucketPath, and the given percentage of the traffic is sent to the
+	// staging distribution (which is expected to use the canary prefix as its origin path).
+	CanaryPolicyID string
+	CanaryPercent  float64
+	CanaryPrefix   string
+	// Deploy to BucketPath and disable the continuous deployment policy.
+	CanaryPromote bool
+
+	// The User-Agent and cache-busting query parameter used in
+	// verification and warm-up requests against the deployed site.
+	VerifyUserAgent   string
+	VerifyCacheBuster string
+
+	// Check the size, ETag and Content-Type of the uploaded files after
+	// the upload, with HeadObject or, if VerifyURL is set, with GET
+	// requests against the deployed site.
+	Verify    bool
+	VerifyURL string
+
+	// Base URL of the deployed site to run the checks in the config file
+	// against after the deploy. With ChecksRollback, the canary is
+	// disabled if the checks fail.
+	ChecksURL      string
+	ChecksRollback bool
+
+	// Read the remote file list from this S3 Inventory report
+	// (s3://bucket/key) instead of listing the bucket.
+	Inventory string
+
+	// Write a local checkpoint of completed uploads, and resume
+	// from it if it exists.
+	Resume bool
+	// Defaults to a file below the user's cache directory.
+	CheckpointFile string
+
+	// Cache the ETags of the local files between deploys, keyed by path,
+	// size and modification time, so unchanged files aren't read again.
+	ETagCache bool
+	// Defaults to a file below the user's cache directory.
+	ETagCacheFile string
+
+	// The default gzip compression level used for routes with gzip enabled.
+	GzipLevel int
+
+	// Look up content types in the system's MIME database before
+	// the table embedded in s3deploy.
+	PreferSystemMIME bool
+
+	// The file written by Snapshot.
+	SnapshotFile string
+	// Also store the Content-Type and Content-Encoding of every
+	// remote file in the snapshot (one HEAD request per file).
+	SnapshotMetadata bool
+
+	// Also print the Content-Type and the other headers of
+	// the remote files with the ls command.
+	ListMetadata bool
+
+	// Identifies this deploy, e.g. in the User-Agent of all AWS requests
+	// and in the STS session name. Defaults to a generated ULID.
+	DeployID string
+
+	// The s3deploy version, used in the User-Agent of all AWS requests.
+	Version string
+
+	// Assume this IAM role (STS AssumeRole) for the deploy, with the
+	// given session tags ("key=value") and source identity.
+	RoleARN        string
+	SessionTags    Strings
+	SourceIdentity string
+
+	// Exchange AccessKey and SecretKey for short-lived session credentials
+	// (STS GetSessionToken) before the deploy, and use only those.
+	MintSession bool
+	// How long the minted session credentials are valid.
+	SessionDuration time.Duration
+
+	// Get the credentials for this AWS SSO profile from the AWS CLI.
+	// If the SSO session has expired, SSOLogin runs the browser based
+	// `aws sso login` when running in a terminal.
+	SSOProfile string
+	SSOLogin   bool
+
+	// Compare the local files against the files in this bucket and path
+	// and copy the unchanged files from there instead of uploading them.
+	// The bucket defaults to BucketName.
+	ReferenceBucket string
+	ReferencePath   string
+
+	// Push deploy metrics to a Prometheus Pushgateway
+	// and/or an OTLP/HTTP endpoint when the deploy is done.
+	MetricsPushgatewayURL string
+	MetricsOTLPURL        string
+	MetricsJob            string
+
+	// Send a trace of all AWS API calls to this OTLP/HTTP endpoint.
+	TraceOTLPURL string
+
+	// Bounds the whole deploy, 0 means no limit.
+	Timeout time.Duration
+	// Bounds each upload, 0 means no limit.
+	PutTimeout time.Duration
+
+	// Write the mapping of the fingerprinted files to their
+	// fingerprinted paths to this file as JSON.
+	FingerprintManifest string
+
+	// Check the headers and metadata of unchanged remote files
+	// against the current rules, and fix them if they disagree.
+	ReconcileMetadata bool
+
+	// Hold an advisory lock in the remote store while deploying.
+	Lock bool
+	// How long a lock is valid, in case it's not released.
+	LockTTL time.Duration
+	// How long to wait for a lock held by someone else.
+	LockTimeout time.Duration
+
+	// Print the planned changes and ask for confirmation before
+	// making any remote changes.
+	Confirm bool
+
+	// Write the planned changes to PlanFile instead of deploying,
+	// or deploy the changes planned in ApplyFile.
+	PlanFile  string
+	ApplyFile string
+
+	// Append a Markdown summary of the deploy to the file in
+	// $GITHUB_STEP_SUMMARY, if set.
+	GitHubSummary bool
+
+	// The order to upload the files in, one of "small-first" and
+	// "large-first". Defaults to the order the files are found in.
+	UploadOrder string
 
 	// One or more regular expressions of files to ignore when walking the local directory.
 	// If not set, defaults to ".DS_Store".
@@ -91,23 +391,117 @@ type Config struct {
 	// Note that the path given will have Unix separators, regardless of the OS.
 	SkipLocalDirs Strings
 
+	// A file with gitignore patterns of local files to not deploy,
+	// relative to the source directory. Defaults to ".s3deployignore".
+	IgnoreFile string
+
+	// How to handle symlinks when walking the local directory, one of
+	// "follow" (the default), "skip" and "error".
+	FollowSymlinks string
+
+	// The Unicode normalization form of the keys of the local files,
+	// one of "nfc" (the default), "nfd" and "none".
+	Normalize string
+
+	// How to handle local files with keys only differing by case,
+	// one of "warn" (the default), "error" and "ignore".
+	CaseConflicts string
+
+	// Local files larger than this (in bytes) are not deployed, see
+	// MaxFileSizeAction. Zero means no limit.
+	MaxFileSize int64
+
+	// What to do with files larger than MaxFileSize, one of
+	// "error" (fail the deploy, the default) and "skip".
+	MaxFileSizeAction string
+
+	// The maximum total size of the local files held in memory waiting
+	// to be uploaded, e.g. "256MB". Reading more files waits for the
+	// uploads to catch up. Empty means no limit.
+	MaxBuffer string
+
 	// CLI state
 	PrintVersion bool
 
+	// Print the deploy stats and the s3deploy diff-manifests result as JSON.
+	JSON bool
+
+	// The command line arguments left after the flags.
+	Args []string
+
 	// Print help
 	Help bool
 
+	// Keep going when files fail to upload, up to MaxErrors files or,
+	// with ContinueOnError, any number of files. The failed files are
+	// retried once at the end, and the deploy fails if any still fail.
+	MaxErrors       int
+	ContinueOnError bool
+
+	// Optional callbacks for per-file events, e.g. to show the progress in
+	// an application embedding s3deploy. The keys are the remote keys.
+	// They may be called concurrently from multiple goroutines.
+	// OnUpload is called after a file is uploaded (or copied from the
+	// reference bucket), OnSkip for unchanged files, OnDelete after a
+	// file is deleted and OnError when a file failed to upload.
+	OnUpload func(key, reason string)
+	OnSkip   func(key string)
+	OnDelete func(key string)
+	OnError  func(key string, err error)
+
+	// Progress, if set, receives typed events while deploying, e.g. to
+	// render the progress in a GUI. Sends block, so the channel must be
+	// read until Deploy returns. It's never closed.
+	Progress chan<- ProgressEvent
+
 	// Mostly useful for testing.
-	baseStore remoteStore
+	baseStore        remoteStore
+	referenceStore   remoteStore
+	stsClient        stsHandler
+	doctorS3         doctorS3Handler
+	doctorCloudFront cloudfrontHandler
+	awsCLI           awsCLIRunner
+	stdin            io.Reader
+	stdout           io.Writer
 
 	fs *flag.FlagSet
 
 	initOnce sync.Once
 
+	// The decrypted and expanded ConfigFile, with the files it
+	// extends merged in, set when it's read for the flags.
+	configData []byte
+
+	// Set when session credentials are minted.
+	sessionToken string
+
+	// Parsed from SessionTags.
+	sessionTags map[string]string
+
+	// Set when tracing is enabled.
+	tracer *tracer
+
+	// Set when any route has fingerprinting enabled.
+	fingerprinter *fingerprinter
+
 	// Compiled values.
 	skipLocalFiles predicate.P[string]
 	skipLocalDirs  predicate.P[string]
 	ignore         predicate.P[string]
+	include        predicate.P[string] // nil if Include is not set.
+	keep           predicate.P[string]
+	deployWindow   *deployWindow
+	maxBuffer      int64
+
+	// Set when ETagCache is enabled, for the current deploy.
+	etagCache *etagCache
+
+	// Parsed from Target.
+	target *url.URL
+}
+
+func (cfg *Config) hasReference() bool {
+	return cfg.ReferenceBucket != "" || cfg.ReferencePath != ""
 }
 
 func (cfg *Config) Usage() {
@@ -124,16 +518,26 @@ func (cfg *Config) Init() error {
 
 func (cfg *Config) loadFileConfig() error {
 	if cfg.ConfigFile != "" {
-		data, err := os.ReadFile(cfg.ConfigFile)
+		data := cfg.configData
+		var err error
+		if data == nil {
+			data, err = os.ReadFile(cfg.ConfigFile)
+			if err == nil {
+				data, err = cfg.readConfigFile(cfg.ConfigFile, data, nil)
+			}
+		}
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return err
 			}
+			if cfg.Environment != "" {
+				return fmt.Errorf("environment %q not found, the config file does not exist", cfg.Environment)
+			}
 		} else {
-			s := envhelpers.Expand(string(data), func(k string) string {
-				return os.Getenv(k)
-			})
-			data = []byte(s)
+			data, err = selectEnvironment(data, cfg.Environment)
+			if err != nil {
+				return err
+			}
 
 			err = yaml.Unmarshal(data, &cfg.fileConf)
 			if err != nil {
@@ -142,11 +546,56 @@ func (cfg *Config) loadFileConfig() error {
 		}
 	}
 
+	if cfg.RoutesFile != "" {
+		if err := cfg.loadRoutesFile(); err != nil {
+			return fmt.Errorf("routes file %s: %w", cfg.RoutesFile, err)
+		}
+	}
+
 	return cfg.fileConf.init()
 }
 
+// selectEnvironment returns the config file content data with the settings
+// of the environment name in the environments section merged over the top
+// level ones, e.g. the bucket and the routes. The environments section is
+// left out.
+func selectEnvironment(data []byte, name string) ([]byte, error) {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	envs, found := m["environments"]
+	if !found && name == "" {
+		return data, nil
+	}
+	delete(m, "environments")
+
+	if name != "" {
+		envsm, _ := envs.(map[interface{}]interface{})
+		env, found := envsm[name]
+		if !found {
+			return nil, fmt.Errorf("environment %q not found in the environments section", name)
+		}
+		envm, ok := env.(map[interface{}]interface{})
+		if !ok && env != nil {
+			return nil, fmt.Errorf("environment %q must be a map of settings", name)
+		}
+		for k, v := range envm {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+
+	return yaml.Marshal(m)
+}
+
 func (cfg *Config) shouldIgnoreLocal(key string) bool {
-	return cfg.ignore(key)
+	return cfg.ignore(key) || !cfg.isIncluded(key)
+}
+
+// isIncluded reports whether key (relative to the bucket path)
+// matches the -include patterns, if set.
+func (cfg *Config) isIncluded(key string) bool {
+	return cfg.include == nil || cfg.include(key)
 }
 
 func (cfg *Config) shouldIgnoreRemote(key string) bool {
@@ -154,12 +603,26 @@ func (cfg *Config) shouldIgnoreRemote(key string) bool {
 	sub = strings.TrimPrefix(sub, "/")
 
 	for _, r := range cfg.fileConf.Routes {
-		if r.Ignore && r.routerRE.MatchString(sub) {
+		// Content type and size is only known for local files.
+		if r.Ignore && !r.hasLocalSelectors() && r.routerRE.MatchString(sub) {
 			return true
 		}
 	}
 
-	return cfg.ignore(sub)
+	return cfg.ignore(sub) || !cfg.isIncluded(sub)
+}
+
+func (cfg *Config) shouldKeepRemote(key string) bool {
+	sub := key[len(cfg.BucketPath):]
+	sub = strings.TrimPrefix(sub, "/")
+
+	for _, r := range cfg.fileConf.Routes {
+		if r.Keep && !r.hasLocalSelectors() && r.routerRE.MatchString(sub) {
+			return true
+		}
+	}
+
+	return cfg.keep(sub)
 }
 
 const (
@@ -167,17 +630,40 @@ const (
 	defaultSkipLocalDirs  = `^\/?(?:\w+\/)*(\.\w+)`
 )
 
+// accountIDRe matches an AWS account ID.
+var accountIDRe = regexp.MustCompile(`^\d{12}$`)
+
 func (cfg *Config) init() error {
-	if cfg.BucketName == "" {
+	if cfg.Target != "" {
+		target, err := parseTarget(cfg.Target)
+		if err != nil {
+			return err
+		}
+		if len(cfg.CDNDistributionIDs) > 0 {
+			return errors.New("-target cannot be combined with -distribution-id")
+		}
+		cfg.target = target
+	} else if cfg.BucketName == "" {
 		return errors.New("AWS bucket is required")
 	}
 
 	// The region may be possible for the AWS SDK to figure out from the context.
 
-	if cfg.AccessKey == "" {
+	if cfg.SSOProfile != "" {
+		if cfg.AccessKey != "" || cfg.SecretKey != "" {
+			return errors.New("-sso-profile cannot be combined with an access key and a secret key")
+		}
+		if cfg.MintSession {
+			return errors.New("-sso-profile cannot be combined with -mint-session")
+		}
+	} else if cfg.SSOLogin {
+		return errors.New("-sso-login requires -sso-profile")
+	}
+
+	if cfg.AccessKey == "" && cfg.SSOProfile == "" {
 		cfg.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
 	}
-	if cfg.SecretKey == "" {
+	if cfg.SecretKey == "" && cfg.SSOProfile == "" {
 		cfg.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	}
 
@@ -187,6 +673,105 @@ func (cfg *Config) init() error {
 		return errors.New("both AWS access key and secret key must be provided")
 	}
 
+	keepPatterns := cfg.Keep
+
+	if cfg.CanaryPercent < 0 || cfg.CanaryPercent > 15 {
+		return errors.New("canary percent must be between 0 and 15")
+	}
+	if cfg.CanaryPercent > 0 && cfg.CanaryPromote {
+		return errors.New("canary percent and canary promote cannot be combined")
+	}
+	if (cfg.CanaryPercent > 0 || cfg.CanaryPromote) && cfg.CanaryPolicyID == "" {
+		return errors.New("canary deploys require a continuous deployment policy ID")
+	}
+	if cfg.CanaryPolicyID != "" {
+		if cfg.CanaryPrefix == "" {
+			cfg.CanaryPrefix = "canary"
+		}
+		if cfg.CanaryPercent > 0 {
+			cfg.BucketPath = pathJoin(cfg.BucketPath, cfg.CanaryPrefix)
+		} else {
+			// Never delete the canary files in a regular deploy.
+			keepPatterns = append(keepPatterns, "^"+regexp.QuoteMeta(strings.Trim(cfg.CanaryPrefix, "/"))+"/")
+		}
+	}
+
+	if cfg.GzipLevel == 0 {
+		// Not set.
+		cfg.GzipLevel = gzip.DefaultCompression
+	}
+	if err := validateGzipLevel(cfg.GzipLevel); err != nil {
+		return err
+	}
+
+	if cfg.Lock && cfg.LockTTL <= 0 {
+		cfg.LockTTL = 30 * time.Minute
+	}
+
+	if cfg.DeployWindow != "" {
+		var err error
+		cfg.deployWindow, err = parseDeployWindow(cfg.DeployWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DeleteScope == "" {
+		cfg.DeleteScope = cfg.BucketPath
+	}
+
+	if cfg.PlanFile != "" && cfg.ApplyFile != "" {
+		return errors.New("the flags plan and apply cannot be combined")
+	}
+
+	switch cfg.UploadOrder {
+	case "", uploadOrderSmallFirst, uploadOrderLargeFirst:
+	default:
+		return fmt.Errorf("invalid upload order %q, must be one of %q and %q", cfg.UploadOrder, uploadOrderSmallFirst, uploadOrderLargeFirst)
+	}
+
+	if cfg.Inventory != "" {
+		if _, _, err := parseS3URL(cfg.Inventory); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DeployID == "" {
+		cfg.DeployID = ulid.Make().String()
+	}
+
+	if len(cfg.SessionTags) > 0 || cfg.SourceIdentity != "" {
+		if cfg.RoleARN == "" {
+			return errors.New("session tags and source identity require a role to assume")
+		}
+		cfg.sessionTags = make(map[string]string)
+		for _, tag := range cfg.SessionTags {
+			k, v, found := strings.Cut(tag, "=")
+			if !found || k == "" {
+				return fmt.Errorf("invalid session tag %q, must be on the form key=value", tag)
+			}
+			cfg.sessionTags[k] = v
+		}
+	}
+
+	if cfg.MintSession {
+		if cfg.SessionDuration == 0 {
+			cfg.SessionDuration = time.Hour
+		}
+		if cfg.SessionDuration < 15*time.Minute || cfg.SessionDuration > 36*time.Hour {
+			return errors.New("session duration must be between 15m and 36h")
+		}
+	}
+
+	if cfg.hasReference() {
+		if cfg.ReferenceBucket == "" {
+			cfg.ReferenceBucket = cfg.BucketName
+		}
+		if cfg.ReferenceBucket == cfg.BucketName && strings.Trim(cfg.ReferencePath, "/") == strings.Trim(cfg.BucketPath, "/") {
+			return errors.New("the reference bucket and path must be different from the target")
+		}
+	}
+
 	cfg.SourcePath = filepath.Clean(cfg.SourcePath)
 
 	// Sanity check to prevent people from uploading their entire disk.
@@ -196,10 +781,34 @@ func (cfg *Config) init() error {
 		return errors.New("invalid source path: Cannot deploy from root")
 	}
 
+	// The modification times in e.g. an embed.FS are all zero.
+	if cfg.SourceFS != nil && cfg.ETagCache {
+		return errors.New("-etag-cache cannot be combined with a source file system")
+	}
+
 	if cfg.PublicReadACL {
 		log.Print("WARNING: the 'public-access' flag is deprecated. Please use -acl='public-read' instead.")
 	}
 
+	if cfg.NumberOfWorkers > 0 {
+		log.Print("WARNING: the 'workers' flag is deprecated. Please use -upload-workers instead.")
+		if cfg.UploadWorkers <= 0 {
+			cfg.UploadWorkers = cfg.NumberOfWorkers
+		}
+	}
+	if cfg.UploadWorkers <= 0 {
+		cfg.UploadWorkers = runtime.NumCPU()
+	}
+	if cfg.DeleteWorkers <= 0 {
+		cfg.DeleteWorkers = 4
+	}
+	if cfg.ListConcurrency <= 0 {
+		cfg.ListConcurrency = 1
+	}
+	if cfg.HashWorkers <= 0 {
+		cfg.HashWorkers = runtime.NumCPU()
+	}
+
 	if cfg.PublicReadACL && cfg.ACL != "" {
 		return errors.New("you passed a value for the flags public-access and acl, which is not supported. the public-access flag is deprecated. please use the acl flag moving forward")
 	}
@@ -221,6 +830,31 @@ func (cfg *Config) init() error {
 		})
 	}
 
+	for _, pattern := range cfg.Include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New("cannot compile 'include' flag pattern " + err.Error())
+		}
+		fn := func(s string) bool {
+			return re.MatchString(s)
+		}
+		cfg.include = cfg.include.Or(fn)
+	}
+
+	cfg.keep = predicate.P[string](func(s string) bool {
+		return false
+	})
+	for _, pattern := range keepPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New("cannot compile 'keep' flag pattern " + err.Error())
+		}
+		fn := func(s string) bool {
+			return re.MatchString(s)
+		}
+		cfg.keep = cfg.keep.Or(fn)
+	}
+
 	if cfg.SkipLocalFiles == nil {
 		cfg.SkipLocalFiles = Strings{defaultSkipLocalFiles}
 	}
@@ -239,6 +873,53 @@ func (cfg *Config) init() error {
 		cfg.skipLocalFiles = cfg.skipLocalFiles.Or(fn)
 	}
 
+	switch cfg.FollowSymlinks {
+	case "":
+		cfg.FollowSymlinks = symlinksFollow
+	case symlinksFollow, symlinksSkip, symlinksError:
+	default:
+		return fmt.Errorf("invalid -follow-symlinks %q, must be one of follow, skip and error", cfg.FollowSymlinks)
+	}
+
+	switch cfg.Normalize {
+	case "":
+		cfg.Normalize = normalizeNFC
+	case normalizeNFC, normalizeNFD, normalizeNone:
+	default:
+		return fmt.Errorf("invalid -normalize %q, must be one of nfc, nfd and none", cfg.Normalize)
+	}
+
+	if cfg.MaxDeletePercent < 0 || cfg.MaxDeletePercent > 100 {
+		return errors.New("-max-delete-percent must be between 0 and 100")
+	}
+
+	if cfg.MaxFileSize < 0 {
+		return errors.New("-max-file-size must be positive")
+	}
+	switch cfg.MaxFileSizeAction {
+	case "":
+		cfg.MaxFileSizeAction = maxFileSizeError
+	case maxFileSizeError, maxFileSizeSkip:
+	default:
+		return fmt.Errorf("invalid -max-file-size-action %q, must be one of error and skip", cfg.MaxFileSizeAction)
+	}
+
+	if cfg.MaxBuffer != "" {
+		n, err := parseBytes(cfg.MaxBuffer)
+		if err != nil {
+			return fmt.Errorf("-max-buffer: %w", err)
+		}
+		cfg.maxBuffer = n
+	}
+
+	switch cfg.CaseConflicts {
+	case "":
+		cfg.CaseConflicts = caseConflictsWarn
+	case caseConflictsWarn, caseConflictsError, caseConflictsIgnore:
+	default:
+		return fmt.Errorf("invalid -case-conflicts %q, must be one of warn, error and ignore", cfg.CaseConflicts)
+	}
+
 	for _, pattern := range cfg.SkipLocalDirs {
 		re, err := regexp.Compile(pattern)
 		if err != nil {
@@ -256,6 +937,97 @@ func (cfg *Config) init() error {
 		return fmt.Errorf("failed to load config from %s: %s", cfg.ConfigFile, err)
 	}
 
+	if len(cfg.CDNDistributionIDs) > 0 {
+		for _, r := range cfg.fileConf.Routes {
+			if r.contentEncoding() == encodingZstd {
+				log.Printf("WARNING: route %q uses zstd compression, which CloudFront does not support; clients not accepting zstd will get content they cannot decode.", r.Route)
+			}
+		}
+	}
+
+	if cfg.fileConf.Credentials != nil && cfg.SSOProfile != "" {
+		return fmt.Errorf("the credentials command in %s cannot be combined with -sso-profile", cfg.ConfigFile)
+	}
+
+	if len(cfg.fileConf.Grants) > 0 && (cfg.ACL != "" || cfg.PublicReadACL) {
+		return errors.New("a canned ACL cannot be combined with explicit grants, use one or the other")
+	}
+
+	if cfg.WebsiteIndexDocument != "" || cfg.WebsiteErrorDocument != "" {
+		if cfg.fileConf.Website == nil {
+			cfg.fileConf.Website = &websiteConfig{}
+		}
+		if cfg.WebsiteIndexDocument != "" {
+			cfg.fileConf.Website.IndexDocument = cfg.WebsiteIndexDocument
+		}
+		if cfg.WebsiteErrorDocument != "" {
+			cfg.fileConf.Website.ErrorDocument = cfg.WebsiteErrorDocument
+		}
+		if err := cfg.fileConf.Website.init(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.hasher, err = newContentHasher(cfg.Hash); err != nil {
+		return err
+	}
+	if cfg.hasher != nil {
+		if cfg.DetectMoves {
+			return errors.New("-detect-moves compares the remote ETags and requires -hash=md5")
+		}
+		for _, r := range cfg.fileConf.Routes {
+			if r.Delta {
+				return fmt.Errorf("route %q: delta uploads use MD5 checksums and require -hash=md5", r.Route)
+			}
+		}
+	}
+
+	if cfg.ExpectedBucketOwner != "" && !accountIDRe.MatchString(cfg.ExpectedBucketOwner) {
+		return fmt.Errorf("invalid -expected-bucket-owner %q, must be a 12 digit AWS account ID", cfg.ExpectedBucketOwner)
+	}
+
+	switch cfg.RequestPayer {
+	case "", "requester":
+	default:
+		return fmt.Errorf("invalid -request-payer %q, must be 'requester'", cfg.RequestPayer)
+	}
+
+	if cfg.Accelerate {
+		if isAccessPoint(cfg.BucketName) {
+			return errors.New("-accelerate cannot be used with access points")
+		}
+		if strings.Contains(cfg.BucketName, ".") {
+			return fmt.Errorf("-accelerate cannot be used with bucket %q, Transfer Acceleration does not support bucket names with dots", cfg.BucketName)
+		}
+	}
+
+	if isAccessPoint(cfg.BucketName) {
+		if err := cfg.initAccessPoint(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.CreateBucket {
+		if cfg.RegionName == "" {
+			return errors.New("-create-bucket requires -region")
+		}
+		if (cfg.ACL == "public-read" || cfg.PublicReadACL) && !cfg.CreateBucketPublic {
+			log.Printf("WARNING: public-read ACLs are blocked on a bucket created with -create-bucket, set -create-bucket-public to allow them.")
+		}
+	}
+
+	if len(cfg.fileConf.Redirects) > 0 && cfg.CloudFrontFunction == "" {
+		log.Printf("WARNING: the redirects in %s are skipped, set -cloudfront-function to deploy them.", cfg.ConfigFile)
+	}
+
+	if len(cfg.fileConf.Checks) > 0 && cfg.ChecksURL == "" {
+		log.Printf("WARNING: the checks in %s are skipped, set -checks-url to run them.", cfg.ConfigFile)
+	}
+
+	if cfg.ChecksRollback && cfg.CanaryPercent <= 0 {
+		return errors.New("-checks-rollback requires -canary-percent")
+	}
+
 	return nil
 }
 
@@ -265,57 +1037,56 @@ func (i *Strings) String() string {
 	return strings.Join(*i, ",")
 }
 
+// Set adds value, or, if it spans multiple lines, each non-empty line.
+// The latter allows setting multiple values in one environment variable.
 func (i *Strings) Set(value string) error {
-	*i = append(*i, value)
+	if !strings.Contains(value, "\n") {
+		*i = append(*i, value)
+		return nil
+	}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			*i = append(*i, line)
+		}
+	}
 	return nil
 }
 
 func flagsToConfig(f *flag.FlagSet) *Config {
 	cfg := &Config{}
 	cfg.fs = f
-	f.StringVar(&cfg.AccessKey, "key", "", "access key ID for AWS")
-	f.StringVar(&cfg.SecretKey, "secret", "", "secret access key for AWS")
-	f.StringVar(&cfg.RegionName, "region", "", "name of AWS region")
-	f.StringVar(&cfg.BucketName, "bucket", "", "destination bucket name on AWS")
-	f.StringVar(&cfg.BucketPath, "path", "", "optional bucket sub path")
-	f.StringVar(&cfg.SourcePath, "source", ".", "path of files to upload")
-	f.Var(&cfg.CDNDistributionIDs, "distribution-id", "optional CDN distribution ID for cache invalidation, repeat flag for multiple distributions")
-	f.StringVar(&cfg.EndpointURL, "endpoint-url", "", "optional endpoint URL")
-	f.StringVar(&cfg.ConfigFile, "config", ".s3deploy.yml", "optional config file")
-	f.IntVar(&cfg.MaxDelete, "max-delete", 256, "maximum number of files to delete per deploy")
-	f.BoolVar(&cfg.PublicReadACL, "public-access", false, "DEPRECATED: please set -acl='public-read'")
-	f.BoolVar(&cfg.StripIndexHTML, "strip-index-html", false, "strip index.html from all directories expect for the root entry")
-	f.StringVar(&cfg.ACL, "acl", "", "provide an ACL for uploaded objects. to make objects public, set to 'public-read'. all possible values are listed here: https://docs.aws.amazon.com/AmazonS3/latest/userguide/acl-overview.html#canned-acl (default \"private\")")
-	f.BoolVar(&cfg.Force, "force", false, "upload even if the etags match")
-	f.Var(&cfg.Ignore, "ignore", "regexp pattern for ignoring files, repeat flag for multiple patterns,")
-	f.Var(&cfg.SkipLocalFiles, "skip-local-files", fmt.Sprintf("regexp pattern of files to ignore when walking the local directory, repeat flag for multiple patterns, default %q", defaultSkipLocalFiles))
-	f.Var(&cfg.SkipLocalDirs, "skip-local-dirs", fmt.Sprintf("regexp pattern of files of directories to ignore when walking the local directory, repeat flag for multiple patterns, default %q", defaultSkipLocalDirs))
-	f.BoolVar(&cfg.Try, "try", false, "trial run, no remote updates")
-	f.BoolVar(&cfg.Verbose, "v", false, "enable verbose logging")
-	f.BoolVar(&cfg.Silent, "quiet", false, "enable silent mode")
-	f.BoolVar(&cfg.PrintVersion, "V", false, "print version and exit")
-	f.IntVar(&cfg.NumberOfWorkers, "workers", -1, "number of workers to upload files")
-	f.BoolVar(&cfg.Help, "h", false, "help")
+	for _, s := range settings {
+		s.define(f, cfg)
+	}
 
 	return cfg
 }
 
-// parserYAMLConfig is a parser for YAML file format. Flags and their values are read
-// from the key/value pairs defined in the config file.
+// parseYAMLConfig is a parser for YAML file format. Flags and their values are read
+// from the key/value pairs defined in the config file, decrypted first if needed.
 // YAML types that cannot easily be represented as a string gets skipped (e.g. maps).
 // This is based on https://github.com/peterbourgon/ff/blob/main/ffyaml/ffyaml.go
-func parserYAMLConfig(r io.Reader, set func(name, value string) error) error {
+func (cfg *Config) parseYAMLConfig(r io.Reader, set func(name, value string) error) error {
 	// We need to buffer the Reader so we can expand any environment variables.
 	var b bytes.Buffer
 	if _, err := io.Copy(&b, r); err != nil {
 		return err
 	}
 
-	s := envhelpers.Expand(b.String(), func(k string) string {
-		return os.Getenv(k)
-	})
+	// The flags are parsed before the config file, so
+	// ConfigIdentity and Environment are set.
+	data, err := cfg.readConfigFile(cfg.ConfigFile, b.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	cfg.configData = data
 
-	r = strings.NewReader(s)
+	data, err = selectEnvironment(data, cfg.Environment)
+	if err != nil {
+		return err
+	}
+
+	r = bytes.NewReader(data)
 
 	var m map[string]interface{}
 	d := yaml.NewDecoder(r)
@@ -323,6 +1094,15 @@ func parserYAMLConfig(r io.Reader, set func(name, value string) error) error {
 		return err
 	}
 	for key, val := range m {
+		if isFileConfigKey(key) {
+			// Handled in loadFileConfig.
+			continue
+		}
+		if _, isList := val.([]interface{}); isList {
+			if s, found := lookupSetting(key); found && !s.repeatable() {
+				return fmt.Errorf("%s takes a single value, not a list", key)
+			}
+		}
 		values, err := valsToStrs(val)
 		if err != nil {
 			if err == errUnsupportedFlagType {
@@ -339,6 +1119,27 @@ func parserYAMLConfig(r io.Reader, set func(name, value string) error) error {
 	return nil
 }
 
+var (
+	fileConfigKeys     map[string]bool
+	fileConfigKeysInit sync.Once
+)
+
+// isFileConfigKey reports whether key is a top level key in fileConfig
+// and not a flag.
+func isFileConfigKey(key string) bool {
+	fileConfigKeysInit.Do(func() {
+		fileConfigKeys = make(map[string]bool)
+		t := reflect.TypeOf(fileConfig{})
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fileConfigKeys[name] = true
+			}
+		}
+	})
+	return fileConfigKeys[key]
+}
+
 func valToStr(val interface{}) (string, error) {
 	switch v := val.(type) {
 	case byte:
@@ -8,6 +8,7 @@ package lib
 import (
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -70,6 +71,7 @@ ignore: foo
 skip-local-dirs: ["a", "b"]
 skip-local-files: c
 
+mergeRoutes: true
 routes:
     - route: "^.+\\.(a)$"
       headers:
@@ -96,6 +98,7 @@ routes:
 	c.Assert(cfg.Ignore, qt.DeepEquals, Strings{"foo"})
 	c.Assert(cfg.SkipLocalDirs, qt.DeepEquals, Strings{"a", "b"})
 	c.Assert(cfg.SkipLocalFiles, qt.DeepEquals, Strings{"c"})
+	c.Assert(cfg.fileConf.MergeRoutes, qt.IsTrue)
 	routes := cfg.fileConf.Routes
 	c.Assert(routes, qt.HasLen, 3)
 	c.Assert(routes[0].Route, qt.Equals, "^.+\\.(a)$")
@@ -104,6 +107,63 @@ routes:
 	c.Assert(routes[2].Gzip, qt.IsTrue)
 }
 
+func TestConfigEnvironments(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+	c.Assert(os.WriteFile(cfgFile, []byte(`
+bucket: staging.example.com
+max-delete: 42
+distribution-id: STAGING
+routes:
+    - route: ".*"
+      headers:
+         Cache-Control: "no-cache"
+environments:
+    production:
+        bucket: example.com
+        path: site
+        distribution-id: [PROD1, PROD2]
+        routes:
+            - route: ".*"
+              headers:
+                 Cache-Control: "max-age=3600"
+    preview:
+`), 0o644), qt.IsNil)
+
+	cfg, err := ConfigFromArgs([]string{"-config=" + cfgFile})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "staging.example.com")
+	c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"STAGING"})
+	c.Assert(cfg.fileConf.Routes[0].Headers["Cache-Control"], qt.Equals, "no-cache")
+
+	cfg, err = ConfigFromArgs([]string{"-config=" + cfgFile, "-env=production"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(cfg.BucketPath, qt.Equals, "site")
+	c.Assert(cfg.MaxDelete, qt.Equals, 42)
+	c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"PROD1", "PROD2"})
+	c.Assert(cfg.fileConf.Routes, qt.HasLen, 1)
+	c.Assert(cfg.fileConf.Routes[0].Headers["Cache-Control"], qt.Equals, "max-age=3600")
+
+	// Flags still take precedence.
+	cfg, err = ConfigFromArgs([]string{"-config=" + cfgFile, "-env=production", "-bucket=other.example.com"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "other.example.com")
+
+	cfg, err = ConfigFromArgs([]string{"-config=" + cfgFile, "-env=preview"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "staging.example.com")
+
+	_, err = ConfigFromArgs([]string{"-config=" + cfgFile, "-env=prod"})
+	c.Assert(err, qt.ErrorMatches, `environment "prod" not found in the environments section`)
+
+	cfg = &Config{BucketName: "example.com", ConfigFile: filepath.Join(dir, "missing.yml"), Environment: "production"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `failed to load config from .*: environment "production" not found, the config file does not exist`)
+}
+
 func TestConfigFromFileErrors(t *testing.T) {
 	c := qt.New(t)
 	dir := t.TempDir()
@@ -136,6 +196,30 @@ routes:
 	c.Assert(err, qt.IsNotNil)
 }
 
+func TestWorkersFlags(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.UploadWorkers, qt.Equals, runtime.NumCPU())
+	c.Assert(cfg.DeleteWorkers, qt.Equals, 4)
+	c.Assert(cfg.ListConcurrency, qt.Equals, 1)
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-upload-workers=32", "-delete-workers=2", "-list-concurrency=8"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.UploadWorkers, qt.Equals, 32)
+	c.Assert(cfg.DeleteWorkers, qt.Equals, 2)
+	c.Assert(cfg.ListConcurrency, qt.Equals, 8)
+
+	// The deprecated flag.
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-workers=3"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.UploadWorkers, qt.Equals, 3)
+}
+
 func TestSetAclAndPublicAccessFlag(t *testing.T) {
 	c := qt.New(t)
 	args := []string{
@@ -167,6 +251,60 @@ func TestIgnoreFlagError(t *testing.T) {
 	c.Assert(err.Error(), qt.Contains, "cannot compile 'ignore' flag pattern")
 }
 
+func TestDeployWindowFlag(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-deploy-window=Mon-Fri 09:00-17:00 UTC", "-wait-for-window"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.deployWindow, qt.IsNotNil)
+	c.Assert(cfg.WaitForWindow, qt.IsTrue)
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-deploy-window=Someday"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, "invalid deploy window.*")
+}
+
+func TestAccelerateFlag(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-accelerate", "-dualstack"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.Accelerate, qt.IsTrue)
+	c.Assert(cfg.DualStack, qt.IsTrue)
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=example.com", "-accelerate"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, `-accelerate cannot be used with bucket "example.com".*`)
+}
+
+func TestRequestPayerFlag(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-request-payer=requester"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.RequestPayer, qt.Equals, "requester")
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-request-payer=owner"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -request-payer "owner", must be 'requester'`)
+}
+
+func TestExpectedBucketOwnerFlag(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-expected-bucket-owner=123456789012"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.ExpectedBucketOwner, qt.Equals, "123456789012")
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-expected-bucket-owner=12345"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -expected-bucket-owner "12345", must be a 12 digit AWS account ID`)
+}
+
 func TestShouldIgnore(t *testing.T) {
 	c := qt.New(t)
 
@@ -201,6 +339,23 @@ func TestShouldIgnore(t *testing.T) {
 	c.Assert(cfgIgnore.shouldIgnoreRemote("my/path/ignored-prefix/file.txt"), qt.IsTrue)
 }
 
+func TestShouldKeep(t *testing.T) {
+	c := qt.New(t)
+
+	cfg, err := ConfigFromArgs([]string{
+		"-bucket=mybucket",
+		"-path=my/path",
+		"-keep=^uploads/",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+
+	c.Assert(cfg.shouldKeepRemote("my/path/uploads/a.jpg"), qt.IsTrue)
+	c.Assert(cfg.shouldKeepRemote("my/path/other/a.jpg"), qt.IsFalse)
+	c.Assert(cfg.shouldIgnoreRemote("my/path/uploads/a.jpg"), qt.IsFalse)
+	c.Assert(cfg.shouldIgnoreLocal("uploads/a.jpg"), qt.IsFalse)
+}
+
 func TestSkipLocalDefault(t *testing.T) {
 	c := qt.New(t)
 
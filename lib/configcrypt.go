@@ -0,0 +1,90 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The ways the config file can be encrypted.
+const (
+	configEncryptionAge  = "age"
+	configEncryptionSOPS = "sops"
+)
+
+// configEncryption returns how b, the content of the config
+// file, is encrypted, or an empty string if it's not.
+func configEncryption(b []byte) string {
+	if bytes.HasPrefix(b, []byte("age-encryption.org/v1\n")) ||
+		bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN AGE ENCRYPTED FILE-----")) {
+		return configEncryptionAge
+	}
+	// SOPS keeps the values encrypted in place, and adds its
+	// metadata, including a MAC of the content, in a sops section.
+	var m struct {
+		Sops struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(b, &m); err == nil && m.Sops.MAC != "" {
+		return configEncryptionSOPS
+	}
+	return ""
+}
+
+// decryptConfig decrypts b, the content of the config file, if it's
+// encrypted with age or SOPS, using the age or sops command with the
+// age identity in ConfigIdentity. SOPS may also decrypt with its other
+// key sources (e.g. AWS KMS) configured in the environment.
+func (cfg *Config) decryptConfig(b []byte) ([]byte, error) {
+	var (
+		cmd *exec.Cmd
+		enc = configEncryption(b)
+	)
+	switch enc {
+	case configEncryptionAge:
+		if cfg.ConfigIdentity == "" {
+			return nil, errors.New("the config file is encrypted with age, set -config-identity to the age identity file to decrypt it with")
+		}
+		cmd = exec.Command("age", "--decrypt", "--identity", cfg.ConfigIdentity)
+		cmd.Stdin = bytes.NewReader(b)
+	case configEncryptionSOPS:
+		// sops needs a file to decrypt.
+		f, err := os.CreateTemp("", "s3deploy-config-*.yml")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", f.Name())
+		if cfg.ConfigIdentity != "" {
+			cmd.Env = append(os.Environ(), "SOPS_AGE_KEY_FILE="+cfg.ConfigIdentity)
+		}
+	default:
+		return b, nil
+	}
+
+	if _, err := exec.LookPath(cmd.Args[0]); err != nil {
+		return nil, fmt.Errorf("the config file is encrypted with %s, which requires the %s command: %w", enc, cmd.Args[0], err)
+	}
+	decrypted, err := runCmd(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the config file with %s: %w", enc, err)
+	}
+	return decrypted, nil
+}
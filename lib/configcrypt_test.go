@@ -0,0 +1,59 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestConfigEncryption(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(configEncryption([]byte("age-encryption.org/v1\n-> X25519 abc\n")), qt.Equals, configEncryptionAge)
+	c.Assert(configEncryption([]byte("\n-----BEGIN AGE ENCRYPTED FILE-----\nYWdl\n-----END AGE ENCRYPTED FILE-----\n")), qt.Equals, configEncryptionAge)
+	c.Assert(configEncryption([]byte("bucket: ENC[AES256_GCM,data:abc,type:str]\nsops:\n  mac: ENC[AES256_GCM,data:def,type:str]\n  version: 3.8.1\n")), qt.Equals, configEncryptionSOPS)
+	c.Assert(configEncryption([]byte("bucket: example.com\nsops: foo\n")), qt.Equals, "")
+	c.Assert(configEncryption([]byte("routes:\n  - route: \"^.+\\\\.(js|css)$\"\n")), qt.Equals, "")
+
+	cfg := &Config{}
+	_, err := cfg.decryptConfig([]byte("age-encryption.org/v1\n"))
+	c.Assert(err, qt.ErrorMatches, "the config file is encrypted with age, set -config-identity to the age identity file to decrypt it with")
+	b, err := cfg.decryptConfig([]byte("bucket: example.com\n"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "bucket: example.com\n")
+}
+
+func TestConfigFromEncryptedFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the age command")
+	}
+	c := qt.New(t)
+	dir := t.TempDir()
+
+	// A fake age command printing the decrypted config if given the right identity.
+	age := "#!/bin/sh\n[ \"$3\" = key.txt ] || { echo 'no identity matched' >&2; exit 1; }\n" +
+		"printf 'bucket: example.com\\nmax-delete: 42\\nbudget:\\n  maxFiles: 100\\n'\n"
+	c.Assert(os.WriteFile(filepath.Join(dir, "age"), []byte(age), 0o755), qt.IsNil)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	configFile := filepath.Join(dir, "s3deploy.yml.age")
+	c.Assert(os.WriteFile(configFile, []byte("age-encryption.org/v1\n-> X25519 abc\n"), 0o644), qt.IsNil)
+
+	cfg, err := ConfigFromArgs([]string{"-config", configFile, "-config-identity", "key.txt"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(cfg.MaxDelete, qt.Equals, 42)
+	c.Assert(cfg.fileConf.Budget.MaxFiles, qt.Equals, 100)
+
+	_, err = ConfigFromArgs([]string{"-config", configFile, "-config-identity", "other.txt"})
+	c.Assert(err, qt.ErrorMatches, "failed to decrypt the config file with age: no identity matched")
+}
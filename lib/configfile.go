@@ -0,0 +1,189 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bep/helpers/envhelpers"
+	"gopkg.in/yaml.v2"
+)
+
+// readConfigFile decrypts data, the content of the config file filename,
+// expands the environment variables in it, and merges it over the config
+// files it extends, if any. Relative filenames in extends are relative to
+// the directory of filename. seen is the files extending filename.
+func (cfg *Config) readConfigFile(filename string, data []byte, seen []string) ([]byte, error) {
+	data, err := cfg.decryptConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(envhelpers.Expand(string(data), func(k string) string {
+		return os.Getenv(k)
+	}))
+
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	extends, found := m["extends"]
+	if !found {
+		return data, nil
+	}
+	delete(m, "extends")
+
+	var bases []string
+	switch v := extends.(type) {
+	case string:
+		bases = []string{v}
+	case []interface{}:
+		for _, vv := range v {
+			s, ok := vv.(string)
+			if !ok {
+				return nil, errors.New("extends must be a filename or a list of filenames")
+			}
+			bases = append(bases, s)
+		}
+	default:
+		return nil, errors.New("extends must be a filename or a list of filenames")
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	seen = append(seen, abs)
+
+	merged := make(map[string]interface{})
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(abs), base)
+		}
+		for _, s := range seen {
+			if s == base {
+				return nil, fmt.Errorf("extends: cycle through %s", base)
+			}
+		}
+		b, err := os.ReadFile(base)
+		if err != nil {
+			return nil, fmt.Errorf("extends: %w", err)
+		}
+		b, err = cfg.readConfigFile(base, b, seen)
+		if err != nil {
+			return nil, fmt.Errorf("extends %s: %w", base, err)
+		}
+		var bm map[string]interface{}
+		if err := yaml.Unmarshal(b, &bm); err != nil {
+			return nil, fmt.Errorf("extends %s: %w", base, err)
+		}
+		mergeConfigFiles(merged, bm)
+	}
+	mergeConfigFiles(merged, m)
+
+	return yaml.Marshal(merged)
+}
+
+// mergeConfigFiles merges the top level settings in over into base:
+//
+//   - Maps (e.g. website and grants) are merged key by key.
+//   - The routes in over with the same route pattern as a route in base are
+//     merged into it, keeping its position, with the headers merged by name.
+//     The other routes in over are added before the routes in base, so they
+//     are matched first.
+//   - Any other value (e.g. a list of distribution IDs) in over replaces the
+//     one in base.
+func mergeConfigFiles(base, over map[string]interface{}) {
+	for k, v := range over {
+		if k == "routes" {
+			base[k] = mergeConfigRoutes(base[k], v)
+			continue
+		}
+		base[k] = mergeConfigValues(base[k], v)
+	}
+}
+
+func mergeConfigValues(base, over interface{}) interface{} {
+	bm, ok1 := base.(map[interface{}]interface{})
+	om, ok2 := over.(map[interface{}]interface{})
+	if !ok1 || !ok2 {
+		return over
+	}
+	merged := make(map[interface{}]interface{}, len(bm)+len(om))
+	for k, v := range bm {
+		merged[k] = v
+	}
+	for k, v := range om {
+		merged[k] = mergeConfigValues(merged[k], v)
+	}
+	return merged
+}
+
+func mergeConfigRoutes(base, over interface{}) interface{} {
+	baseRoutes, ok1 := base.([]interface{})
+	overRoutes, ok2 := over.([]interface{})
+	if !ok1 || !ok2 {
+		return over
+	}
+
+	routePattern := func(r interface{}) string {
+		m, _ := r.(map[interface{}]interface{})
+		pattern, _ := m["route"].(string)
+		return pattern
+	}
+
+	merged := make([]interface{}, len(baseRoutes))
+	copy(merged, baseRoutes)
+	var added []interface{}
+	for _, r := range overRoutes {
+		found := false
+		if pattern := routePattern(r); pattern != "" {
+			for i, b := range merged {
+				if routePattern(b) == pattern {
+					merged[i] = mergeConfigValues(b, r)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			added = append(added, r)
+		}
+	}
+
+	return append(added, merged...)
+}
+
+// routesFileConfig is the content of the RoutesFile.
+type routesFileConfig struct {
+	Routes      routes `yaml:"routes"`
+	MergeRoutes *bool  `yaml:"mergeRoutes"`
+}
+
+// loadRoutesFile replaces the routes from the config file with those
+// in RoutesFile, which is read like the config file, e.g. with the
+// environment variables expanded.
+func (cfg *Config) loadRoutesFile() error {
+	data, err := os.ReadFile(cfg.RoutesFile)
+	if err != nil {
+		return err
+	}
+	data, err = cfg.readConfigFile(cfg.RoutesFile, data, nil)
+	if err != nil {
+		return err
+	}
+	var conf routesFileConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return err
+	}
+	cfg.fileConf.Routes = conf.Routes
+	if conf.MergeRoutes != nil {
+		cfg.fileConf.MergeRoutes = *conf.MergeRoutes
+	}
+	return nil
+}
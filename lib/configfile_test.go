@@ -0,0 +1,174 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestConfigExtends(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "shared"), 0o755), qt.IsNil)
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		return filename
+	}
+
+	write("shared/base.yml", `
+extends: headers.yml
+max-delete: 10
+distribution-id: [BASE1, BASE2]
+website:
+    indexDocument: index.html
+routes:
+    - route: "^.+\\.(js|css)$"
+      headers:
+         Cache-Control: "max-age=630720000"
+         X-Shared: "yes"
+      gzip: true
+    - route: ".*"
+      headers:
+         Cache-Control: "no-cache"
+`)
+	write("shared/headers.yml", `
+budget:
+    maxFiles: 100
+`)
+	cfgFile := write("site.yml", `
+extends: shared/base.yml
+bucket: example.com
+distribution-id: SITE
+website:
+    errorDocument: 404.html
+routes:
+    - route: "^.+\\.(js|css)$"
+      headers:
+         Cache-Control: "max-age=3600"
+    - route: "^images/"
+      headers:
+         Cache-Control: "max-age=86400"
+`)
+
+	cfg, err := ConfigFromArgs([]string{"-config=" + cfgFile})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(cfg.MaxDelete, qt.Equals, 10)
+	c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"SITE"})
+	c.Assert(cfg.fileConf.Budget.MaxFiles, qt.Equals, 100)
+	c.Assert(cfg.fileConf.Website.IndexDocument, qt.Equals, "index.html")
+	c.Assert(cfg.fileConf.Website.ErrorDocument, qt.Equals, "404.html")
+
+	routes := cfg.fileConf.Routes
+	c.Assert(routes, qt.HasLen, 3)
+	c.Assert(routes[0].Route, qt.Equals, "^images/")
+	c.Assert(routes[1].Route, qt.Equals, `^.+\.(js|css)$`)
+	c.Assert(routes[1].Headers, qt.DeepEquals, map[string]string{"Cache-Control": "max-age=3600", "X-Shared": "yes"})
+	c.Assert(routes[1].Gzip, qt.IsTrue)
+	c.Assert(routes[2].Route, qt.Equals, ".*")
+
+	write("a.yml", "extends: b.yml\n")
+	write("b.yml", "extends: [a.yml]\n")
+	cfg = &Config{BucketName: "example.com", ConfigFile: filepath.Join(dir, "a.yml")}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `failed to load config from .*: extends .*b.yml: extends: cycle through .*a.yml`)
+
+	write("c.yml", "extends: missing.yml\n")
+	cfg = &Config{BucketName: "example.com", ConfigFile: filepath.Join(dir, "c.yml")}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `failed to load config from .*: extends: open .*missing.yml: .*`)
+}
+
+func TestConfigRoutesFile(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+	c.Assert(os.WriteFile(cfgFile, []byte(`
+bucket: example.com
+routes:
+    - route: ".*"
+      headers:
+         Cache-Control: "no-cache"
+`), 0o644), qt.IsNil)
+	routesFile := filepath.Join(dir, "routes.yml")
+	c.Assert(os.WriteFile(routesFile, []byte(`
+mergeRoutes: true
+routes:
+    - route: "^.+\\.css$"
+      headers:
+         Cache-Control: "max-age=3600"
+      gzip: true
+`), 0o644), qt.IsNil)
+
+	cfg, err := ConfigFromArgs([]string{"-config=" + cfgFile, "-routes-file=" + routesFile})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	c.Assert(cfg.fileConf.MergeRoutes, qt.IsTrue)
+	c.Assert(cfg.fileConf.Routes, qt.HasLen, 1)
+	c.Assert(cfg.fileConf.Routes[0].Route, qt.Equals, `^.+\.css$`)
+	c.Assert(cfg.fileConf.Routes[0].Gzip, qt.IsTrue)
+
+	c.Assert(os.WriteFile(routesFile, []byte("bucket: other.example.com\n"), 0o644), qt.IsNil)
+	cfg = &Config{BucketName: "example.com", RoutesFile: routesFile}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `(?s)failed to load config from .*: routes file .*routes.yml: .*field bucket not found in type lib.routesFileConfig`)
+}
+
+func TestFlagsAndFileConfigKeys(t *testing.T) {
+	c := qt.New(t)
+
+	// All flags can be set in the config file, so they
+	// can't share a name with the other settings there.
+	names := make(map[string]bool)
+	for _, s := range settings {
+		c.Assert(names[s.name], qt.IsFalse, qt.Commentf("flag %q defined twice", s.name))
+		names[s.name] = true
+		c.Assert(isFileConfigKey(s.name), qt.IsFalse, qt.Commentf("flag %q", s.name))
+		c.Assert(s.name, qt.Not(qt.Equals), "extends")
+		c.Assert(s.name, qt.Not(qt.Equals), "environments")
+	}
+
+	// The flags are all generated from the settings.
+	fs := flag.NewFlagSet("s3deploy", flag.ContinueOnError)
+	flagsToConfig(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		c.Assert(names[f.Name], qt.IsTrue, qt.Commentf("flag %q", f.Name))
+		delete(names, f.Name)
+	})
+	c.Assert(names, qt.HasLen, 0)
+}
+
+func TestConfigFileSettings(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+
+	c.Assert(os.WriteFile(cfgFile, []byte(`
+bucket: example.com
+max-delete: 10
+lock-ttl: 5m
+distribution-id: [ABC, DEF]
+ignore: "^foo/"
+`), 0o644), qt.IsNil)
+	cfg, err := ConfigFromArgs([]string{"-config=" + cfgFile, "-max-delete=20"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.BucketName, qt.Equals, "example.com")
+	// The flags win.
+	c.Assert(cfg.MaxDelete, qt.Equals, 20)
+	c.Assert(cfg.LockTTL, qt.Equals, 5*time.Minute)
+	c.Assert(cfg.CDNDistributionIDs, qt.DeepEquals, Strings{"ABC", "DEF"})
+	c.Assert(cfg.Ignore, qt.DeepEquals, Strings{"^foo/"})
+
+	c.Assert(os.WriteFile(cfgFile, []byte("path: [a, b]\n"), 0o644), qt.IsNil)
+	_, err = ConfigFromArgs([]string{"-config=" + cfgFile})
+	c.Assert(err, qt.ErrorMatches, "path takes a single value, not a list")
+}
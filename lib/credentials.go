@@ -0,0 +1,202 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// credentialsExpiryWindow is how long before they expire
+// cached credentials are considered expired.
+const credentialsExpiryWindow = 5 * time.Minute
+
+// credentialsConfig configures an external command printing the AWS
+// credentials to use, in the JSON format of the AWS credential_process
+// setting, e.g. a script using the Vault or the 1Password CLI.
+type credentialsConfig struct {
+	// The command and its arguments, split on white space.
+	// It's not run in a shell.
+	Command string `yaml:"command"`
+	// How long to cache the credentials in the user cache directory,
+	// never past their expiration. 0 runs the command in every deploy.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+
+	args []string
+
+	// Mostly useful for testing.
+	run       func(ctx context.Context, name string, args ...string) ([]byte, error)
+	cacheFile string
+}
+
+func (c *credentialsConfig) init() error {
+	c.args = strings.Fields(c.Command)
+	if len(c.args) == 0 {
+		return errors.New("credentials: command is required")
+	}
+	if c.CacheTTL < 0 {
+		return errors.New("credentials: cacheTTL must be positive")
+	}
+	return nil
+}
+
+// processCredentials is the JSON printed by a credential_process command.
+type processCredentials struct {
+	Version         int
+	AccessKeyID     string     `json:"AccessKeyId"`
+	SecretAccessKey string     `json:",omitempty"`
+	SessionToken    string     `json:",omitempty"`
+	Expiration      *time.Time `json:",omitempty"`
+}
+
+func parseProcessCredentials(b []byte) (processCredentials, error) {
+	var creds processCredentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return creds, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, errors.New("no credentials returned")
+	}
+	return creds, nil
+}
+
+// cachedCredentials is what's stored in the credentials cache file.
+type cachedCredentials struct {
+	Expires     time.Time          `json:"expires"`
+	Credentials processCredentials `json:"credentials"`
+}
+
+// cacheFilename returns the file to cache the credentials in,
+// one per command.
+func (c *credentialsConfig) cacheFilename() (string, error) {
+	if c.cacheFile != "" {
+		return c.cacheFile, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(strings.Join(c.args, " ")))
+	return filepath.Join(cacheDir, "s3deploy", "credentials", hex.EncodeToString(h[:8])+".json"), nil
+}
+
+// cached returns the cached credentials, if not expired.
+func (c *credentialsConfig) cached() (processCredentials, bool) {
+	if c.CacheTTL == 0 {
+		return processCredentials{}, false
+	}
+	filename, err := c.cacheFilename()
+	if err != nil {
+		return processCredentials{}, false
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return processCredentials{}, false
+	}
+	var cached cachedCredentials
+	if err := json.Unmarshal(b, &cached); err != nil || !time.Now().Before(cached.Expires) {
+		return processCredentials{}, false
+	}
+	return cached.Credentials, true
+}
+
+// cache stores creds in the cache file for CacheTTL, or until
+// shortly before they expire, readable by the current user only.
+func (c *credentialsConfig) cache(creds processCredentials) error {
+	if c.CacheTTL == 0 {
+		return nil
+	}
+	expires := time.Now().Add(c.CacheTTL)
+	if creds.Expiration != nil {
+		if exp := creds.Expiration.Add(-credentialsExpiryWindow); exp.Before(expires) {
+			expires = exp
+		}
+	}
+	if !time.Now().Before(expires) {
+		return nil
+	}
+
+	filename, err := c.cacheFilename()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(cachedCredentials{Expires: expires, Credentials: creds})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0o600)
+}
+
+// initProcessCredentials gets the credentials from the command
+// in the credentials section of the config file, or from the cache.
+func (cfg *Config) initProcessCredentials(ctx context.Context) error {
+	c := cfg.fileConf.Credentials
+	creds, found := c.cached()
+	if !found {
+		run := c.run
+		if run == nil {
+			run = runCommand
+		}
+		b, err := run(ctx, c.args[0], c.args[1:]...)
+		if err != nil {
+			return fmt.Errorf("credentials command failed: %w", err)
+		}
+		if creds, err = parseProcessCredentials(b); err != nil {
+			return fmt.Errorf("credentials command failed: %w", err)
+		}
+		if err := c.cache(creds); err != nil {
+			log.Printf("WARNING: failed to cache the credentials: %s", err)
+		}
+	}
+	cfg.setProcessCredentials(creds)
+	return nil
+}
+
+// setProcessCredentials sets creds as the credentials
+// for all AWS clients created after this.
+func (cfg *Config) setProcessCredentials(creds processCredentials) {
+	cfg.AccessKey = creds.AccessKeyID
+	cfg.SecretKey = creds.SecretAccessKey
+	cfg.sessionToken = creds.SessionToken
+	if runningInGitHubActions() {
+		cfg.maskSecrets(os.Stderr)
+	}
+}
+
+// runCommand runs name with args and returns what it writes to
+// stdout, or, if it fails, what it writes to stderr as the error.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCmd(exec.CommandContext(ctx, name, args...))
+}
+
+// runCmd runs cmd and returns what it writes to stdout,
+// or, if it fails, what it writes to stderr as the error.
+func runCmd(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,85 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/yaml.v2"
+)
+
+func TestInitProcessCredentials(t *testing.T) {
+	c := qt.New(t)
+
+	var conf fileConfig
+	c.Assert(yaml.Unmarshal([]byte("credentials:\n  command: vault-creds  deploy --role site\n  cacheTTL: 15m\n"), &conf), qt.IsNil)
+	c.Assert(conf.init(), qt.IsNil)
+	c.Assert(conf.Credentials.CacheTTL, qt.Equals, 15*time.Minute)
+	c.Assert(conf.Credentials.args, qt.DeepEquals, []string{"vault-creds", "deploy", "--role", "site"})
+
+	var calls []string
+	output := `{"Version": 1, "AccessKeyId": "processkey", "SecretAccessKey": "processsecret", "SessionToken": "processtoken"}`
+	conf.Credentials.run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return []byte(output), nil
+	}
+	conf.Credentials.cacheFile = filepath.Join(t.TempDir(), "credentials.json")
+
+	newConfig := func() *Config {
+		cfg := &Config{BucketName: "example.com"}
+		c.Assert(cfg.Init(), qt.IsNil)
+		cfg.fileConf.Credentials = conf.Credentials
+		return cfg
+	}
+
+	cfg := newConfig()
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(calls, qt.DeepEquals, []string{"vault-creds deploy --role site"})
+	creds, err := createCredentials(cfg).Retrieve(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(creds.AccessKeyID, qt.Equals, "processkey")
+	c.Assert(creds.SecretAccessKey, qt.Equals, "processsecret")
+	c.Assert(creds.SessionToken, qt.Equals, "processtoken")
+	fi, err := os.Stat(conf.Credentials.cacheFile)
+	c.Assert(err, qt.IsNil)
+	if os.PathSeparator == '/' {
+		c.Assert(fi.Mode().Perm(), qt.Equals, os.FileMode(0o600))
+	}
+
+	// Cached.
+	cfg = newConfig()
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(cfg.AccessKey, qt.Equals, "processkey")
+	c.Assert(calls, qt.HasLen, 1)
+
+	// Not cached past the expiration.
+	c.Assert(os.Remove(conf.Credentials.cacheFile), qt.IsNil)
+	output = `{"Version": 1, "AccessKeyId": "processkey", "SecretAccessKey": "processsecret", "Expiration": "` + time.Now().Add(time.Minute).Format(time.RFC3339) + `"}`
+	c.Assert(newConfig().initSession(context.Background()), qt.IsNil)
+	c.Assert(newConfig().initSession(context.Background()), qt.IsNil)
+	c.Assert(calls, qt.HasLen, 3)
+
+	conf.Credentials.run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, errors.New("vault: permission denied")
+	}
+	c.Assert(newConfig().initSession(context.Background()), qt.ErrorMatches, "credentials command failed: vault: permission denied")
+
+	output = `{"Version": 1}`
+	conf.Credentials.run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return []byte(output), nil
+	}
+	c.Assert(newConfig().initSession(context.Background()), qt.ErrorMatches, "credentials command failed: no credentials returned")
+
+	conf = fileConfig{Credentials: &credentialsConfig{}}
+	c.Assert(conf.init(), qt.ErrorMatches, "credentials: command is required")
+}
@@ -0,0 +1,80 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// splitDuplicates returns the files in uploads to upload, holding back
+// the files with the same content as another file in uploads, to be
+// copied from it server side once uploaded (-dedupe).
+func (d *Deployer) splitDuplicates(uploads []*osFile) []*osFile {
+	originals := make(map[string]*osFile)
+	var keep []*osFile
+	for _, f := range uploads {
+		// Empty files, e.g. directory markers, are cheaper to upload.
+		// A copy of a file uploaded in blocks would get another ETag.
+		if f.copyFrom != "" || f.Size() == 0 || f.delta {
+			keep = append(keep, f)
+			continue
+		}
+		// The ETag is the MD5 of the content uploaded, after any compression.
+		original, found := originals[f.ETag()]
+		if !found {
+			originals[f.ETag()] = f
+			keep = append(keep, f)
+			continue
+		}
+		d.printf("%s has the same content as %s, will copy\n", f.keyPath, original.keyPath)
+		f.duplicateOf = original
+		d.duplicates = append(d.duplicates, f)
+	}
+	return keep
+}
+
+// copyDuplicates copies the files held back by splitDuplicates from the
+// uploaded files with the same content. The files with an original that
+// failed to upload are uploaded instead.
+func (d *Deployer) copyDuplicates(ctx context.Context) error {
+	if len(d.duplicates) == 0 {
+		return nil
+	}
+
+	c, ok := d.store.(remoteCopier)
+	if !ok {
+		return errCopyNotSupported
+	}
+
+	workers := d.cfg.UploadWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+
+	for _, f := range d.duplicates {
+		f := f
+		g.Go(func() error {
+			if !f.duplicateOf.uploaded {
+				return d.uploadFile(ctx, f)
+			}
+			if err := c.CopyFrom(ctx, d.cfg.BucketName, f.duplicateOf.Key(), f); err != nil {
+				return fmt.Errorf("failed to copy %q to %q: %w", f.duplicateOf.Key(), f.Key(), err)
+			}
+			atomic.AddUint64(&d.stats.Deduplicated, uint64(1))
+			d.recordChange(f.Key(), "copied")
+			d.recordVerify(f)
+			d.onUpload(f)
+			return nil
+		})
+	}
+	return g.Wait()
+}
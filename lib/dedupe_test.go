@@ -0,0 +1,61 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployDedupe(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	for filename, content := range map[string]string{
+		"de/index.html": "<h1>Hi</h1>",
+		"en/index.html": "<h1>Hi</h1>",
+		"fr/index.html": "<h1>Hi</h1>",
+		"about.html":    "<h1>About</h1>",
+	} {
+		filename = filepath.Join(source, filename)
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+	}
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: source,
+			Dedupe:     true,
+			baseStore:  store,
+		}
+	}
+
+	store := newTestStoreFrom(make(map[string]file), 0).(*testStore)
+	stats, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 2, skipped 0 (100% changed), copied 2 duplicates")
+	c.Assert(stats.Deduplicated, qt.Equals, uint64(2))
+	c.Assert(store.copied, qt.DeepEquals, []string{"example.com/de/index.html", "example.com/de/index.html"})
+	assertKeys(t, store.m, "about.html", "de/index.html", "en/index.html", "fr/index.html")
+
+	// The duplicates are uploaded if the original fails.
+	store = newTestStoreFrom(make(map[string]file), 0).(*testStore)
+	store.putFailures = map[string]int{"de/index.html": -1}
+	cfg := newConfig(store)
+	cfg.MaxErrors = 1
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `(?s).*de/index.html.*`)
+	c.Assert(stats.Deduplicated, qt.Equals, uint64(0))
+	c.Assert(store.copied, qt.HasLen, 0)
+	assertKeys(t, store.m, "about.html", "en/index.html", "fr/index.html")
+}
@@ -0,0 +1,253 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// The block size of delta uploads, the minimum size of
+	// an S3 multipart upload part.
+	deltaBlockSize = 5 << 20
+
+	// S3 limits the user metadata to 2 KB, which limits the
+	// number of block checksums stored with an object.
+	deltaMaxBlocks = 80
+
+	// The metadata with the block checksums of a delta upload.
+	deltaBlocksHeader = "Delta-Blocks"
+)
+
+// deltaBlocks are the MD5 checksums of the blocks of a file uploaded
+// in parts of deltaBlockSize, see route.Delta.
+type deltaBlocks [][md5.Size]byte
+
+// isDeltaSize reports whether a file of the given size is uploaded in
+// blocks if its route has delta set. Smaller files are uploaded in one
+// part, and the checksums of larger files don't fit in the metadata.
+func isDeltaSize(size int64) bool {
+	return size > deltaBlockSize && size <= deltaBlockSize*deltaMaxBlocks
+}
+
+func calculateDeltaBlocks(r io.Reader) (deltaBlocks, error) {
+	var blocks deltaBlocks
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, r, deltaBlockSize)
+		if n > 0 {
+			var sum [md5.Size]byte
+			copy(sum[:], h.Sum(nil))
+			blocks = append(blocks, sum)
+		}
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// etag returns the ETag S3 sets on an object uploaded with the blocks as
+// parts, the MD5 of the part checksums followed by the number of parts.
+func (b deltaBlocks) etag() string {
+	h := md5.New()
+	for _, sum := range b {
+		h.Write(sum[:])
+	}
+	return fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(h.Sum(nil)), len(b))
+}
+
+// String returns the block size and checksums, stored in deltaBlocksHeader.
+func (b deltaBlocks) String() string {
+	sums := make([]byte, 0, len(b)*md5.Size)
+	for _, sum := range b {
+		sums = append(sums, sum[:]...)
+	}
+	return strconv.Itoa(deltaBlockSize) + ":" + base64.RawURLEncoding.EncodeToString(sums)
+}
+
+// parseDeltaBlocks parses the blocks stored in deltaBlocksHeader,
+// returning nil if s is invalid or has another block size.
+func parseDeltaBlocks(s string) deltaBlocks {
+	size, encoded, found := strings.Cut(s, ":")
+	if !found || size != strconv.Itoa(deltaBlockSize) {
+		return nil
+	}
+	sums, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sums)%md5.Size != 0 {
+		return nil
+	}
+	blocks := make(deltaBlocks, len(sums)/md5.Size)
+	for i := range blocks {
+		copy(blocks[i][:], sums[i*md5.Size:])
+	}
+	return blocks
+}
+
+// deltaFile is implemented by local files uploaded in blocks.
+type deltaFile interface {
+	// deltaBlocks returns the blocks of the content, or nil
+	// if the file should be uploaded in one request.
+	deltaBlocks() deltaBlocks
+}
+
+type deltaHandler interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// putDelta uploads content with the metadata in put as a multipart upload,
+// one part per block. The blocks unchanged since the current version of
+// the object are copied from it server side, returning the number of bytes
+// copied.
+func putDelta(ctx context.Context, svc deltaHandler, put *s3.PutObjectInput, content io.Reader, blocks deltaBlocks) (int64, error) {
+	// The previous blocks, stored with the current version.
+	var (
+		prevBlocks deltaBlocks
+		prevETag   *string
+	)
+	head, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:              put.Bucket,
+		Key:                 put.Key,
+		RequestPayer:        put.RequestPayer,
+		ExpectedBucketOwner: put.ExpectedBucketOwner,
+	})
+	if err == nil {
+		for k, v := range head.Metadata {
+			if http.CanonicalHeaderKey(k) == deltaBlocksHeader {
+				prevBlocks = parseDeltaBlocks(v)
+			}
+		}
+		prevETag = head.ETag
+	} else {
+		var notFound *types.NotFound
+		if !errors.As(err, &notFound) {
+			return 0, err
+		}
+	}
+
+	mpu, err := svc.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:              put.Bucket,
+		Key:                 put.Key,
+		ACL:                 put.ACL,
+		ContentType:         put.ContentType,
+		CacheControl:        put.CacheControl,
+		ContentDisposition:  put.ContentDisposition,
+		ContentEncoding:     put.ContentEncoding,
+		ContentLanguage:     put.ContentLanguage,
+		Expires:             put.Expires,
+		Metadata:            put.Metadata,
+		GrantRead:           put.GrantRead,
+		GrantReadACP:        put.GrantReadACP,
+		GrantWriteACP:       put.GrantWriteACP,
+		GrantFullControl:    put.GrantFullControl,
+		RequestPayer:        put.RequestPayer,
+		ExpectedBucketOwner: put.ExpectedBucketOwner,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	copied, parts, err := uploadDeltaParts(ctx, svc, put, mpu.UploadId, content, blocks, prevBlocks, prevETag)
+	if err == nil {
+		_, err = svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:              put.Bucket,
+			Key:                 put.Key,
+			UploadId:            mpu.UploadId,
+			MultipartUpload:     &types.CompletedMultipartUpload{Parts: parts},
+			RequestPayer:        put.RequestPayer,
+			ExpectedBucketOwner: put.ExpectedBucketOwner,
+		})
+	}
+	if err != nil {
+		// Don't leave the parts uploaded behind, they are charged for.
+		svc.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:              put.Bucket,
+			Key:                 put.Key,
+			UploadId:            mpu.UploadId,
+			RequestPayer:        put.RequestPayer,
+			ExpectedBucketOwner: put.ExpectedBucketOwner,
+		})
+		return 0, err
+	}
+
+	return copied, nil
+}
+
+func uploadDeltaParts(ctx context.Context, svc deltaHandler, put *s3.PutObjectInput, uploadID *string, content io.Reader, blocks, prevBlocks deltaBlocks, prevETag *string) (int64, []types.CompletedPart, error) {
+	var (
+		copied int64
+		parts  []types.CompletedPart
+		buf    = make([]byte, deltaBlockSize)
+	)
+	for i, sum := range blocks {
+		n, err := io.ReadFull(content, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, nil, err
+		}
+		partNumber := int32(i + 1)
+		start := int64(i) * deltaBlockSize
+
+		if i < len(prevBlocks) && prevBlocks[i] == sum {
+			out, err := svc.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:     put.Bucket,
+				Key:        put.Key,
+				UploadId:   uploadID,
+				PartNumber: partNumber,
+				CopySource: aws.String(url.PathEscape(aws.ToString(put.Bucket) + "/" + aws.ToString(put.Key))),
+				// The blocks must be from the version we got the checksums of.
+				CopySourceIfMatch:         prevETag,
+				CopySourceRange:           aws.String(fmt.Sprintf("bytes=%d-%d", start, start+int64(n)-1)),
+				RequestPayer:              put.RequestPayer,
+				ExpectedBucketOwner:       put.ExpectedBucketOwner,
+				ExpectedSourceBucketOwner: put.ExpectedBucketOwner,
+			})
+			if err != nil {
+				return 0, nil, err
+			}
+			parts = append(parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: partNumber})
+			copied += int64(n)
+			continue
+		}
+
+		out, err := svc.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:              put.Bucket,
+			Key:                 put.Key,
+			UploadId:            uploadID,
+			PartNumber:          partNumber,
+			Body:                bytes.NewReader(buf[:n]),
+			ContentLength:       int64(n),
+			RequestPayer:        put.RequestPayer,
+			ExpectedBucketOwner: put.ExpectedBucketOwner,
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: partNumber})
+	}
+	return copied, parts, nil
+}
@@ -0,0 +1,176 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeltaBlocks(t *testing.T) {
+	c := qt.New(t)
+
+	content := bytes.Repeat([]byte("a"), deltaBlockSize*2+10)
+	blocks, err := calculateDeltaBlocks(bytes.NewReader(content))
+	c.Assert(err, qt.IsNil)
+	c.Assert(blocks, qt.HasLen, 3)
+	c.Assert(blocks[0], qt.Equals, blocks[1])
+	c.Assert(blocks[2], qt.Equals, md5.Sum(bytes.Repeat([]byte("a"), 10)))
+
+	var sums []byte
+	for _, sum := range blocks {
+		sums = append(sums, sum[:]...)
+	}
+	c.Assert(blocks.etag(), qt.Equals, fmt.Sprintf("\"%x-3\"", md5.Sum(sums)))
+
+	c.Assert(parseDeltaBlocks(blocks.String()), qt.DeepEquals, blocks)
+	c.Assert(strings.HasPrefix(blocks.String(), "5242880:"), qt.IsTrue)
+	c.Assert(parseDeltaBlocks("1024:"+strings.SplitN(blocks.String(), ":", 2)[1]), qt.IsNil)
+	c.Assert(parseDeltaBlocks("5242880:abc"), qt.IsNil)
+
+	// The checksums of the largest files must fit in the metadata.
+	c.Assert(len(make(deltaBlocks, deltaMaxBlocks).String()) < 2048-len(deltaBlocksHeader), qt.IsTrue)
+	c.Assert(isDeltaSize(deltaBlockSize), qt.IsFalse)
+	c.Assert(isDeltaSize(deltaBlockSize+1), qt.IsTrue)
+	c.Assert(isDeltaSize(deltaBlockSize*deltaMaxBlocks+1), qt.IsFalse)
+}
+
+func TestPutDelta(t *testing.T) {
+	c := qt.New(t)
+
+	prev := bytes.Repeat([]byte("a"), deltaBlockSize*2+10)
+	prevBlocks, err := calculateDeltaBlocks(bytes.NewReader(prev))
+	c.Assert(err, qt.IsNil)
+
+	// Change the second block.
+	content := append([]byte{}, prev...)
+	content[deltaBlockSize+1] = 'b'
+	blocks, err := calculateDeltaBlocks(bytes.NewReader(content))
+	c.Assert(err, qt.IsNil)
+
+	put := &s3.PutObjectInput{
+		Bucket:      aws.String("example.com"),
+		Key:         aws.String("data/index.json"),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{deltaBlocksHeader: blocks.String()},
+	}
+
+	h := &deltaTestHandler{metadata: map[string]string{"delta-blocks": prevBlocks.String()}}
+	copied, err := putDelta(context.Background(), h, put, bytes.NewReader(content), blocks)
+	c.Assert(err, qt.IsNil)
+	c.Assert(copied, qt.Equals, int64(deltaBlockSize+10))
+	c.Assert(h.ops, qt.DeepEquals, []string{
+		"create application/json",
+		"copy 1 bytes=0-5242879 if \"prev\"",
+		"upload 2 5242880",
+		"copy 3 bytes=10485760-10485769 if \"prev\"",
+		"complete 3",
+	})
+
+	// A new file.
+	h = &deltaTestHandler{}
+	copied, err = putDelta(context.Background(), h, put, bytes.NewReader(content), blocks)
+	c.Assert(err, qt.IsNil)
+	c.Assert(copied, qt.Equals, int64(0))
+	c.Assert(h.ops, qt.DeepEquals, []string{"create application/json", "upload 1 5242880", "upload 2 5242880", "upload 3 10", "complete 3"})
+
+	// The upload is aborted on errors.
+	h = &deltaTestHandler{failUpload: true}
+	_, err = putDelta(context.Background(), h, put, bytes.NewReader(content), blocks)
+	c.Assert(err, qt.ErrorMatches, "upload failed")
+	c.Assert(h.ops, qt.DeepEquals, []string{"create application/json", "abort"})
+}
+
+func TestOSFileDelta(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "index.json"), bytes.Repeat([]byte("a"), deltaBlockSize+10), 0o644), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(source, "small.json"), []byte("{}"), 0o644), qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com"}
+	cfg.fileConf.Routes = routes{{Route: `\.json$`, Delta: true}}
+	c.Assert(cfg.fileConf.init(), qt.IsNil)
+
+	newFile := func(name string) *osFile {
+		filename := filepath.Join(source, name)
+		fi, err := os.Stat(filename)
+		c.Assert(err, qt.IsNil)
+		of, err := newOSFile(cfg, name, filename, fi)
+		c.Assert(err, qt.IsNil)
+		return of
+	}
+
+	of := newFile("index.json")
+	c.Assert(of.delta, qt.IsTrue)
+	c.Assert(strings.HasSuffix(of.ETag(), "-2\""), qt.IsTrue)
+	c.Assert(of.Headers()[deltaBlocksHeader], qt.Equals, of.deltaBlocks().String())
+
+	of = newFile("small.json")
+	c.Assert(of.delta, qt.IsFalse)
+	c.Assert(of.deltaBlocks(), qt.IsNil)
+
+	cfg.fileConf.Routes = routes{{Route: `\.json$`, Delta: true, Gzip: true}}
+	c.Assert(cfg.fileConf.init(), qt.ErrorMatches, `route ".*": delta cannot be combined with compression`)
+}
+
+type deltaTestHandler struct {
+	metadata   map[string]string
+	failUpload bool
+	ops        []string
+}
+
+func (h *deltaTestHandler) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if h.metadata == nil {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(`"prev"`), Metadata: h.metadata}, nil
+}
+
+func (h *deltaTestHandler) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	h.ops = append(h.ops, "create "+aws.ToString(params.ContentType))
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+}
+
+func (h *deltaTestHandler) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if h.failUpload {
+		return nil, errors.New("upload failed")
+	}
+	b, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	h.ops = append(h.ops, fmt.Sprintf("upload %d %d", params.PartNumber, len(b)))
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"%x"`, md5.Sum(b)))}, nil
+}
+
+func (h *deltaTestHandler) UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	h.ops = append(h.ops, fmt.Sprintf("copy %d %s if %s", params.PartNumber, aws.ToString(params.CopySourceRange), aws.ToString(params.CopySourceIfMatch)))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String(`"copied"`)}}, nil
+}
+
+func (h *deltaTestHandler) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	h.ops = append(h.ops, fmt.Sprintf("complete %d", len(params.MultipartUpload.Parts)))
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (h *deltaTestHandler) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	h.ops = append(h.ops, "abort")
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
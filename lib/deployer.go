@@ -6,14 +6,17 @@
 package lib
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -23,6 +26,10 @@ import (
 
 const up = `↑`
 
+// freezeMarkerKey is the key, relative to BucketPath, of the object that
+// when present blocks all deploys.
+const freezeMarkerKey = ".s3deploy.freeze"
+
 // Deployer deploys.
 type Deployer struct {
 	cfg   *Config
@@ -31,60 +38,140 @@ type Deployer struct {
 	g *errgroup.Group
 
 	filesToUpload chan *osFile
+	// The remote keys to delete, in the order to delete them.
+	// Only accessed from plan, and after the uploads are done.
 	filesToDelete []string
 
 	// Verbose output.
 	outv io.Writer
 	// Regular output.
 	printer
+	// The line per file uploaded, discarded with -brief.
+	outf io.Writer
+	// Whether to colorize the output.
+	color bool
 
 	store remoteStore
+
+	// Set when resuming is enabled.
+	checkpoint *checkpoint
+
+	// The entries in stats.Routes by route pattern.
+	// Only accessed from plan.
+	routeStats map[string]*RouteStats
+
+	changesMu sync.Mutex
+	dirMu     sync.Mutex
+
+	// Failed uploads to retry (-max-errors, -continue-on-error).
+	failed   []*osFile
+	failedMu sync.Mutex
+
+	// Files to copy from uploaded files with the same content (-dedupe).
+	duplicates []*osFile
+
+	// Uploaded files to verify (-verify).
+	toVerify []*osFile
+	verifyMu sync.Mutex
+
+	// Set when only planning the deploy, see PlanDeploy.
+	deployPlan *DeployPlan
+
+	// Bounds the local files in memory (-max-buffer), nil if not set.
+	buffer *bufferBudget
 }
 
 // Deploy deploys to the remote based on the given config.
 func Deploy(cfg *Config) (DeployStats, error) {
+	return DeployWithContext(context.Background(), cfg)
+}
+
+// DeployWithContext deploys to the remote based on the given config.
+// The context is passed on to all remote operations, so canceling it
+// will cancel the deploy.
+func DeployWithContext(ctx context.Context, cfg *Config) (DeployStats, error) {
+	return runDeploy(ctx, cfg, nil)
+}
+
+// runDeploy deploys the changes in p, or, if p is nil, the changes found
+// comparing the local and the remote files.
+func runDeploy(ctx context.Context, cfg *Config, p *DeployPlan) (DeployStats, error) {
 	if err := cfg.Init(); err != nil {
 		return DeployStats{}, err
 	}
-	var outv, out io.Writer = io.Discard, os.Stdout
-	if cfg.Silent {
-		out = io.Discard
-	} else {
-		if cfg.Verbose {
-			outv = os.Stdout
+
+	start := time.Now()
+
+	if cfg.TraceOTLPURL != "" {
+		cfg.tracer = newTracer(cfg.TraceOTLPURL, "s3deploy", "s3deploy deploy")
+	}
+
+	var stats DeployStats
+	err := cfg.initSession(ctx)
+	if err == nil {
+		stats, err = deploy(ctx, cfg, p)
+	}
+	err = cfg.checkExpiredCredentials(err)
+
+	if cfg.tracer != nil {
+		tctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+		if terr := cfg.tracer.finish(tctx, err); terr != nil && !cfg.Silent {
+			fmt.Printf("WARNING: failed to send trace: %s\n", terr)
+		}
+		cancel()
+	}
+
+	if cfg.MetricsPushgatewayURL != "" || cfg.MetricsOTLPURL != "" {
+		if perr := pushMetrics(cfg, deployMetrics(stats, time.Since(start), err)); perr != nil && !cfg.Silent {
+			fmt.Printf("WARNING: failed to push metrics: %s\n", perr)
+		}
+	}
+
+	if cfg.GitHubSummary {
+		if serr := writeGitHubSummary(cfg, stats, time.Since(start), err); serr != nil && !cfg.Silent {
+			fmt.Printf("WARNING: failed to write GitHub step summary: %s\n", serr)
 		}
+	}
+
+	return stats, err
+}
+
+func deploy(ctx context.Context, cfg *Config, p *DeployPlan) (DeployStats, error) {
+	if err := cfg.fileConf.resolveHeaders(os.LookupEnv); err != nil {
+		return DeployStats{}, err
+	}
+	if !cfg.Silent {
 		start := time.Now()
 		defer func() {
 			fmt.Printf("\nTotal in %.2f seconds\n", time.Since(start).Seconds())
 		}()
 	}
 
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	parentCtx := ctx
 	var g *errgroup.Group
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	g, ctx = errgroup.WithContext(ctx)
 	defer cancel()
 
-	d := &Deployer{
-		g:             g,
-		outv:          outv,
-		printer:       newPrinter(out),
-		filesToUpload: make(chan *osFile),
-		cfg:           cfg,
-		stats:         &DeployStats{},
+	d := newDeployer(cfg, g)
+
+	if err := d.waitForDeployWindow(ctx); err != nil {
+		return *d.stats, err
 	}
 
-	numberOfWorkers := cfg.NumberOfWorkers
-	if numberOfWorkers <= 0 {
-		numberOfWorkers = runtime.NumCPU()
+	if err := d.initFingerprinter(); err != nil {
+		return *d.stats, err
 	}
 
-	baseStore := d.cfg.baseStore
-	if baseStore == nil {
-		var err error
-		baseStore, err = newRemoteStore(d.cfg, d)
-		if err != nil {
-			return *d.stats, err
-		}
+	baseStore, err := d.newBaseStore()
+	if err != nil {
+		return *d.stats, err
 	}
 	if d.cfg.Try {
 		baseStore = newNoUpdateStore(baseStore)
@@ -92,40 +179,337 @@ func Deploy(cfg *Config) (DeployStats, error) {
 	}
 	d.store = newStore(d.cfg, baseStore)
 
-	for i := 0; i < numberOfWorkers; i++ {
+	if d.cfg.CreateBucket {
+		if err := d.createBucket(ctx, baseStore); err != nil {
+			return *d.stats, err
+		}
+	}
+
+	if err := d.checkACLs(ctx, baseStore); err != nil {
+		return *d.stats, err
+	}
+
+	if d.cfg.Lock && !d.cfg.Try {
+		lock, err := newDeployLock(d.cfg, baseStore, d)
+		if err != nil {
+			return *d.stats, err
+		}
+		if err := lock.Acquire(ctx); err != nil {
+			return *d.stats, err
+		}
+		defer func() {
+			if err := lock.Release(context.Background()); err != nil {
+				d.Printf("WARNING: failed to release deploy lock: %s\n", err)
+			}
+		}()
+	}
+
+	// Checked on the remote, as the remote files may be listed
+	// from a checkpoint or an S3 Inventory report.
+	if err := d.checkFreezeMarker(ctx, baseStore); err != nil {
+		return *d.stats, err
+	}
+
+	if d.cfg.Resume && !d.cfg.Try {
+		cp, err := newCheckpoint(d.cfg)
+		if err != nil {
+			return *d.stats, err
+		}
+		d.checkpoint = cp
+	}
+
+	uploadStart := time.Now()
+	for i := 0; i < cfg.UploadWorkers; i++ {
 		g.Go(func() error {
 			return d.upload(ctx)
 		})
 	}
 
-	err := d.plan(ctx)
+	if p != nil {
+		err = d.applyPlan(ctx, p)
+	} else {
+		err = d.plan(ctx)
+	}
 	if err != nil {
 		cancel()
 	}
 
 	errg := g.Wait()
+	d.stats.UploadDuration = time.Since(uploadStart)
+
+	if err == nil && errg != nil && errg != context.Canceled {
+		err = errg
+	}
+
+	if err == nil {
+		// Canceled by the caller.
+		err = parentCtx.Err()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) && cfg.Timeout > 0 && parentCtx.Err() != nil {
+		err = fmt.Errorf("deploy timed out after %s: %w", cfg.Timeout, err)
+	}
 
 	if err != nil {
+		if d.checkpoint != nil {
+			d.checkpoint.close(false)
+		}
+		return *d.stats, err
+	}
+
+	// Deletes and CDN invalidations are done even if some files still
+	// fail, so the files deployed are served.
+	failedErr := d.retryFailed(parentCtx)
+
+	if err := d.copyDuplicates(parentCtx); err != nil {
+		if d.checkpoint != nil {
+			d.checkpoint.close(false)
+		}
 		return *d.stats, err
 	}
 
-	if errg != nil && errg != context.Canceled {
-		return *d.stats, errg
+	if err := d.verifyUploads(parentCtx); err != nil {
+		if d.checkpoint != nil {
+			d.checkpoint.close(false)
+		}
+		return *d.stats, err
 	}
 
+	deleteStart := time.Now()
 	err = d.store.DeleteObjects(
-		context.Background(),
+		parentCtx,
 		d.filesToDelete,
 		withDeleteStats(d.stats),
-		withMaxDelete(d.cfg.MaxDelete))
+		withMaxDelete(d.maxDelete()),
+		withDeleteScope(d.cfg.DeleteScope),
+		withDeleteBatches(func(keys []string) {
+			d.progress(ProgressEvent{Type: ProgressDeleteBatch, Keys: keys})
+		}))
+	d.stats.DeleteDuration = time.Since(deleteStart)
+
+	if err == nil {
+		// The files are deleted in order, stopping at MaxDelete.
+		if d.stats.Deleted > 0 {
+			d.stats.DeletedKeys = append([]string(nil), d.filesToDelete[:d.stats.Deleted]...)
+			sort.Strings(d.stats.DeletedKeys)
+			d.printDeleted(d.stats.DeletedKeys)
+		}
+		for _, key := range d.filesToDelete[:d.stats.Deleted] {
+			d.recordChange(key, "deleted")
+			d.countDirectory(key, func(s *DirectoryStats) { s.Deleted++ })
+			if cfg.OnDelete != nil {
+				cfg.OnDelete(key)
+			}
+		}
+		if d.stats.Stale > 0 {
+			if cfg.MaxDeletePercent > 0 {
+				d.Printf("WARNING: %d remote file(s) not found in source were left, as deleting them would exceed -max-delete-percent=%g of the %d remote files\n", d.stats.Stale, cfg.MaxDeletePercent, d.stats.RemoteFiles)
+			} else {
+				d.Printf("WARNING: %d remote file(s) not found in source were left, as deleting them would exceed -max-delete=%d\n", d.stats.Stale, cfg.MaxDelete)
+			}
+		}
+
+		invalidateStart := time.Now()
+		err = d.store.Finalize(parentCtx)
+		d.stats.InvalidateDuration = time.Since(invalidateStart)
+
+		// Also set if some of the distributions failed.
+		if cdn, ok := baseStore.(remoteCDNPaths); ok {
+			d.stats.InvalidationPaths = cdn.InvalidatedPaths()
+			d.stats.Invalidations = cdn.InvalidationIDs()
+			d.progressInvalidations(d.stats.Invalidations)
+		}
+	}
+
+	if err == nil {
+		if err = d.runChecks(parentCtx); err != nil && cfg.ChecksRollback {
+			if rerr := d.rollback(parentCtx, baseStore); rerr != nil {
+				err = fmt.Errorf("%w; rollback failed: %s", err, rerr)
+			}
+		}
+	}
 
 	if err == nil {
-		err = d.store.Finalize(context.Background())
+		err = failedErr
+	}
+
+	if err == nil && cfg.FailOnStale && d.stats.Stale > 0 {
+		limit := "-max-delete"
+		if cfg.MaxDeletePercent > 0 {
+			limit = "-max-delete-percent"
+		}
+		err = fmt.Errorf("%d remote file(s) not found in source were left because of %s (-fail-on-stale)", d.stats.Stale, limit)
+	}
+
+	if d.checkpoint != nil {
+		if cerr := d.checkpoint.close(err == nil); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
 
 	return *d.stats, err
 }
 
+// New creates a Deployer for cfg, to plan and apply a deploy in separate
+// steps, e.g. to inspect or filter the planned changes before applying them.
+func New(cfg *Config) (*Deployer, error) {
+	if err := cfg.Init(); err != nil {
+		return nil, err
+	}
+	return newDeployer(cfg, nil), nil
+}
+
+// Plan compares the local and the remote files and returns the changes
+// to make, without making any remote changes. The plan returned may be
+// modified (e.g. to leave out some of the files) before calling Apply.
+func (d *Deployer) Plan(ctx context.Context) (*DeployPlan, error) {
+	if err := d.cfg.initSession(ctx); err != nil {
+		return nil, d.cfg.checkExpiredCredentials(err)
+	}
+	if err := d.cfg.fileConf.resolveHeaders(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g, ctx := errgroup.WithContext(ctx)
+	d.g = g
+	d.stats = &DeployStats{}
+	d.routeStats = make(map[string]*RouteStats)
+	d.filesToUpload = make(chan *osFile)
+	d.filesToDelete = nil
+	d.deployPlan = &DeployPlan{
+		Version: deployPlanVersion,
+		Bucket:  d.cfg.BucketName,
+		Path:    d.cfg.BucketPath,
+		Created: time.Now().UTC(),
+	}
+
+	if err := d.initFingerprinter(); err != nil {
+		return nil, err
+	}
+
+	baseStore, err := d.newBaseStore()
+	if err != nil {
+		return nil, err
+	}
+	d.store = newStore(d.cfg, newNoUpdateStore(baseStore))
+
+	if err := d.checkFreezeMarker(ctx, baseStore); err != nil {
+		return nil, d.cfg.checkExpiredCredentials(err)
+	}
+
+	err = d.plan(ctx)
+	if err != nil {
+		// Stop the walk, which may be waiting to send the next file.
+		cancel()
+	}
+	if gerr := g.Wait(); err == nil {
+		err = gerr
+	}
+	if err != nil {
+		return nil, d.cfg.checkExpiredCredentials(err)
+	}
+
+	return d.deployPlan, nil
+}
+
+// Apply deploys the changes in the plan returned by the last call to Plan,
+// planning first if needed. It fails if any of the local files to upload
+// have changed since.
+func (d *Deployer) Apply(ctx context.Context) (DeployStats, error) {
+	if d.deployPlan == nil {
+		if _, err := d.Plan(ctx); err != nil {
+			return *d.stats, err
+		}
+	}
+	stats, err := ApplyPlan(ctx, d.cfg, d.deployPlan)
+	d.stats = &stats
+	return stats, err
+}
+
+// Stats returns the stats of the last call to Plan or Apply.
+func (d *Deployer) Stats() DeployStats {
+	return *d.stats
+}
+
+func newDeployer(cfg *Config, g *errgroup.Group) *Deployer {
+	var outv, out, outf io.Writer = io.Discard, os.Stdout, os.Stdout
+	if cfg.Silent {
+		out, outf = io.Discard, io.Discard
+	} else if cfg.Verbose {
+		outv = os.Stdout
+	} else if cfg.Brief {
+		outf = io.Discard
+	}
+
+	return &Deployer{
+		g:             g,
+		outv:          outv,
+		outf:          outf,
+		printer:       newPrinter(out),
+		color:         useColor(cfg),
+		filesToUpload: make(chan *osFile),
+		cfg:           cfg,
+		stats:         &DeployStats{},
+		routeStats:    make(map[string]*RouteStats),
+	}
+}
+
+// initFingerprinter fingerprints the files with fingerprinting enabled,
+// if any, and writes the fingerprint manifest if configured.
+func (d *Deployer) initFingerprinter() error {
+	fp, err := newFingerprinter(d.cfg, d.cfg.SourcePath)
+	if err != nil {
+		return err
+	}
+	d.cfg.fingerprinter = fp
+	if fp != nil && d.cfg.FingerprintManifest != "" {
+		return fp.writeManifest(d.cfg.FingerprintManifest)
+	}
+	return nil
+}
+
+// newBaseStore returns the configured remote store.
+func (d *Deployer) newBaseStore() (remoteStore, error) {
+	if d.cfg.baseStore != nil {
+		return d.cfg.baseStore, nil
+	}
+	return newTargetStore(d.cfg, d)
+}
+
+// waitForDeployWindow returns an error if outside of the configured deploy
+// window, or waits for it to open if WaitForWindow is set.
+func (d *Deployer) waitForDeployWindow(ctx context.Context) error {
+	w := d.cfg.deployWindow
+	if w == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if w.contains(now) {
+		return nil
+	}
+
+	next := w.next(now)
+	if next.IsZero() {
+		return fmt.Errorf("deploy window %q never opens", d.cfg.DeployWindow)
+	}
+
+	if !d.cfg.WaitForWindow {
+		return fmt.Errorf("outside of deploy window %q, next window opens at %s", d.cfg.DeployWindow, next.Format(time.RFC1123))
+	}
+
+	d.Printf("Outside of deploy window %q, waiting until %s …\n", d.cfg.DeployWindow, next.Format(time.RFC1123))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(next)):
+		return nil
+	}
+}
+
 type printer interface {
 	Println(a ...interface{}) (n int, err error)
 	Printf(format string, a ...interface{}) (n int, err error)
@@ -152,7 +536,7 @@ func (d *Deployer) printf(format string, a ...interface{}) {
 }
 
 func (d *Deployer) enqueueUpload(ctx context.Context, f *osFile) {
-	d.Printf("%s (%s) %s ", f.keyPath, f.reason, up)
+	fmt.Fprint(d.outf, d.formatAction(actionUpload, f.keyPath, string(f.reason)))
 	select {
 	case <-ctx.Done():
 	case d.filesToUpload <- f:
@@ -160,126 +544,529 @@ func (d *Deployer) enqueueUpload(ctx context.Context, f *osFile) {
 }
 
 func (d *Deployer) skipFile(f *osFile) {
-	d.printf("%s skipping …\n", f.relPath)
+	d.printf("%s", d.formatAction(actionSkip, f.relPath, "skipping …"))
 	atomic.AddUint64(&d.stats.Skipped, uint64(1))
+	d.countDirectory(f.Key(), func(s *DirectoryStats) { s.Skipped++ })
+	atomic.AddUint64(&f.stats.Skipped, uint64(1))
+	if d.cfg.OnSkip != nil {
+		d.cfg.OnSkip(f.Key())
+	}
+	d.progress(ProgressEvent{Type: ProgressFileSkipped, Key: f.Key()})
+}
+
+func (d *Deployer) onUpload(f *osFile) {
+	if d.cfg.OnUpload != nil {
+		d.cfg.OnUpload(f.Key(), string(f.reason))
+	}
+	d.countDirectory(f.Key(), func(s *DirectoryStats) { s.Uploaded++ })
+	d.progress(ProgressEvent{Type: ProgressFileUploaded, Key: f.Key(), Reason: string(f.reason)})
+}
+
+// onError reports the error uploading the file key, unless it was
+// canceled because of an error elsewhere.
+func (d *Deployer) onError(key string, err error) {
+	if d.cfg.OnError != nil && !errors.Is(err, context.Canceled) {
+		d.cfg.OnError(key, err)
+	}
+}
+
+// routeStatsFor returns the route stats to count f in.
+func (d *Deployer) routeStatsFor(f *osFile) *RouteStats {
+	var pattern string
+	if f.route != nil {
+		pattern = f.route.Route
+	}
+	rs, found := d.routeStats[pattern]
+	if !found {
+		rs = &RouteStats{Route: pattern}
+		d.routeStats[pattern] = rs
+		d.stats.Routes = append(d.stats.Routes, rs)
+	}
+	return rs
 }
 
 func (d *Deployer) enqueueDelete(key string) {
-	d.printf("%s not found in source, deleting.\n", key)
+	d.printf("%s", d.formatAction(actionDelete, key, "not found in source, deleting."))
 	d.filesToDelete = append(d.filesToDelete, key)
 }
 
+// describeFileDiff returns a human readable description of
+// the differences between the remote file and f.
+func describeFileDiff(remote, f file) string {
+	var diffs []string
+	if remote.Size() != f.Size() {
+		diffs = append(diffs, fmt.Sprintf("size %d => %d", remote.Size(), f.Size()))
+	}
+	if remote.ETag() != f.ETag() {
+		diffs = append(diffs, fmt.Sprintf("ETag %s => %s", remote.ETag(), f.ETag()))
+	}
+	return strings.Join(diffs, ", ")
+}
+
 type uploadReason string
 
 const (
-	reasonNotFound uploadReason = "not found"
-	reasonForce    uploadReason = "force"
-	reasonSize     uploadReason = "size"
-	reasonETag     uploadReason = "ETag"
+	reasonNotFound  uploadReason = "not found"
+	reasonForce     uploadReason = "force"
+	reasonSize      uploadReason = "size"
+	reasonETag      uploadReason = "ETag"
+	reasonHash      uploadReason = "hash"
+	reasonReference uploadReason = "reference"
 )
 
-// plan figures out which files need to be uploaded.
+// plan figures out which files need to be uploaded. The uploads are
+// closed when it returns, also on errors, so the upload workers exit.
 func (d *Deployer) plan(ctx context.Context) error {
-	remoteFiles, err := d.store.FileMap(ctx)
+	defer close(d.filesToUpload)
+
+	listStart := time.Now()
+	remoteFiles, err := d.remoteFileMap(ctx)
 	if err != nil {
 		return err
 	}
+	d.stats.RemoteFiles = uint64(len(remoteFiles))
 	d.printf("Found %d remote files\n", len(remoteFiles))
 
-	// All local files at sourcePath
+	referenceFiles, err := d.referenceFileMap(ctx)
+	if err != nil {
+		return err
+	}
+	d.stats.ListDuration = time.Since(listStart)
+
+	planStart := time.Now()
+	defer func() {
+		d.stats.PlanDuration = time.Since(planStart)
+	}()
+
+	// Never delete the freeze marker or the deploy lock.
+	delete(remoteFiles, pathJoin(d.cfg.BucketPath, freezeMarkerKey))
+	delete(remoteFiles, pathJoin(d.cfg.BucketPath, lockKey))
+
+	var uploads, reconciles []*osFile
+	// The local files by their lower-cased key.
+	keys := make(map[string]*osFile)
+	// The number and total size of the local files, for the budget,
+	// and the number of files to upload.
+	var (
+		localCount  int
+		localBytes  int64
+		uploadCount int
+	)
+	budget := d.cfg.fileConf.Budget
+
+	d.buffer = nil
+	if d.cfg.maxBuffer > 0 {
+		if d.holdUploads() {
+			// The held back uploads would never make room.
+			d.Printf("WARNING: -max-buffer has no effect when the uploads wait for the planning, e.g. with -confirm or -upload-order\n")
+		} else {
+			d.buffer = newBufferBudget(d.cfg.maxBuffer)
+		}
+	}
+
+	d.cfg.etagCache = nil
+	if d.cfg.ETagCache {
+		if d.cfg.fingerprinter != nil {
+			// The content depends on the other files.
+			d.Printf("WARNING: -etag-cache is not used with fingerprinting\n")
+		} else {
+			c, err := loadETagCache(d.cfg)
+			if err != nil {
+				return err
+			}
+			d.cfg.etagCache = c
+		}
+	}
+
+	// All local files at sourcePath, hashed in parallel. If returning
+	// before all of them are planned, the walk is stopped and the files
+	// drained, so it never blocks on sending the next file.
+	walkCtx, stopWalk := context.WithCancel(ctx)
+	walked := make(chan *osFile)
 	localFiles := make(chan *osFile)
 	d.g.Go(func() error {
-		return d.walk(ctx, d.cfg.SourcePath, localFiles)
+		return d.walk(walkCtx, d.cfg.SourcePath, walked)
+	})
+	d.g.Go(func() error {
+		return d.hashFiles(walkCtx, walked, localFiles)
 	})
+	defer func() {
+		stopWalk()
+		for range localFiles {
+		}
+	}()
 
 	for f := range localFiles {
 		// default: upload because local file not found on remote.
 		up := true
 		reason := reasonNotFound
 
+		if err := d.checkKeyConflict(keys, f); err != nil {
+			return err
+		}
+		localCount++
+		localBytes += f.rawSize
+		d.cfg.etagCache.put(f)
+
 		bucketPath := f.keyPath
 		if d.cfg.BucketPath != "" {
 			bucketPath = pathJoin(d.cfg.BucketPath, bucketPath)
 		}
 
 		if remoteFile, ok := remoteFiles[bucketPath]; ok {
+			f.remote = remoteFile
 			if d.cfg.Force {
 				up = true
 				reason = reasonForce
 			} else {
 				up, reason = f.shouldThisReplace(remoteFile)
+				if up {
+					same, err := d.sameContent(ctx, f)
+					if err != nil {
+						return err
+					}
+					up = !same
+				}
+				if up && f.hasher == nil {
+					d.printf("%s differs from remote: %s\n", f.keyPath, describeFileDiff(remoteFile, f))
+				}
 			}
 			// remove from map, whatever is leftover should be deleted:
 			delete(remoteFiles, bucketPath)
 		}
 
+		if up && !d.cfg.Force && referenceFiles != nil {
+			referenceKey := pathJoin(d.cfg.ReferencePath, f.keyPath)
+			if referenceFile, ok := referenceFiles[referenceKey]; ok {
+				if replace, _ := f.shouldThisReplace(referenceFile); !replace {
+					f.copyFrom = referenceKey
+					reason = reasonReference
+				}
+			}
+		}
+
 		f.reason = reason
+		f.stats = d.routeStatsFor(f)
+
+		if !up {
+			d.releaseBuffer(f)
+		}
+
+		if !up && d.cfg.ReconcileMetadata {
+			f.reconcile = true
+			reconciles = append(reconciles, f)
+			continue
+		}
 
 		if up {
-			d.enqueueUpload(ctx, f)
+			uploadCount++
+			if d.holdUploads() {
+				uploads = append(uploads, f)
+			} else {
+				d.enqueueUpload(ctx, f)
+			}
 		} else {
 			d.skipFile(f)
 		}
 	}
-	close(d.filesToUpload)
+
+	if err := d.cfg.etagCache.save(); err != nil {
+		d.Printf("WARNING: failed to save the ETag cache: %s\n", err)
+	}
 
 	// any remote files not found locally should be removed:
-	// except for ignored files
+	// except for ignored files. In key order, so the same files
+	// are deleted on every run when limited by -max-delete.
+	remoteKeys := make([]string, 0, len(remoteFiles))
 	for key := range remoteFiles {
+		remoteKeys = append(remoteKeys, key)
+	}
+	sort.Strings(remoteKeys)
+	for _, key := range remoteKeys {
+		f := remoteFiles[key]
 		if d.cfg.shouldIgnoreRemote(key) {
 			d.printf("%s ignored …\n", key)
 			continue
 		}
+		if d.cfg.shouldKeepRemote(key) || (d.cfg.fileConf.DirectoryMarkers == directoryMarkersKeep && isDirectoryMarker(f)) {
+			d.printf("%s kept …\n", key)
+			continue
+		}
 		d.enqueueDelete(key)
 	}
 
-	return nil
-}
+	// If canceled, the local files may not all have been walked.
+	if ctx.Err() == nil {
+		if err := d.checkDeleteAll(uploadCount); err != nil {
+			return err
+		}
+	}
 
-// walk a local directory
-func (d *Deployer) walk(ctx context.Context, basePath string, files chan<- *osFile) error {
-	err := filepath.Walk(basePath, func(fpath string, info os.FileInfo, err error) error {
-		if err != nil {
+	if d.cfg.DetectMoves {
+		d.detectMoves(uploads, remoteFiles)
+	}
+
+	if budget != nil {
+		if err := budget.check(localCount, localBytes, len(d.filesToDelete)); err != nil {
 			return err
 		}
+	}
 
-		pathUnix := path.Clean(filepath.ToSlash(strings.TrimPrefix(fpath, basePath)))
+	return d.enqueuePlanned(ctx, uploads, reconciles)
+}
 
-		if info.IsDir() {
-			if d.cfg.skipLocalDirs(pathUnix) {
-				return filepath.SkipDir
-			}
-			return nil
-		} else {
-			if d.cfg.skipLocalFiles(pathUnix) {
-				return nil
-			}
+// A deploy deleting more than deleteAllPercent of at least deleteAllMinRemote
+// remote files while uploading at most deleteAllMaxUploads files is refused,
+// unless ForceDeleteAll is set.
+const (
+	deleteAllPercent    = 80
+	deleteAllMinRemote  = 10
+	deleteAllMaxUploads = 3
+)
+
+// checkDeleteAll returns an error if the deploy, uploading uploadCount
+// files, would delete (almost) all of the remote files, which is most likely
+// an empty source directory or the wrong path.
+func (d *Deployer) checkDeleteAll(uploadCount int) error {
+	deletes := len(d.filesToDelete)
+	if d.cfg.ForceDeleteAll || d.stats.RemoteFiles < deleteAllMinRemote || uploadCount > deleteAllMaxUploads {
+		return nil
+	}
+	if float64(deletes) <= float64(d.stats.RemoteFiles)*deleteAllPercent/100 {
+		return nil
+	}
+	return fmt.Errorf("refusing to delete %d of %d remote files while uploading %d: the source looks empty or the path doesn't match, set -force-delete-all to deploy anyway", deletes, d.stats.RemoteFiles, uploadCount)
+}
+
+// maxDelete returns the maximum number of remote files to delete: MaxDelete,
+// or, with MaxDeletePercent set, all of the files to delete if they're within
+// that share of the remote files, else none, to block wiping the bucket.
+func (d *Deployer) maxDelete() int {
+	if d.cfg.MaxDeletePercent <= 0 {
+		return d.cfg.MaxDelete
+	}
+	limit := int(float64(d.stats.RemoteFiles) * d.cfg.MaxDeletePercent / 100)
+	if len(d.filesToDelete) > limit {
+		return 0
+	}
+	return len(d.filesToDelete)
+}
+
+// holdUploads reports whether to hold back the uploads until the local
+// files are planned, to be confirmed, sorted, planned, checked against
+// the budget, deduplicated or matched with moved files.
+func (d *Deployer) holdUploads() bool {
+	return d.cfg.Confirm || d.cfg.UploadOrder != "" || d.deployPlan != nil ||
+		d.cfg.fileConf.Budget != nil || d.cfg.Dedupe || d.cfg.DetectMoves
+}
+
+// enqueuePlanned enqueues the uploads held back while planning and the
+// files to fix the metadata of, or adds them to the plan if only planning.
+func (d *Deployer) enqueuePlanned(ctx context.Context, uploads, reconciles []*osFile) error {
+	if d.deployPlan != nil {
+		d.deployPlan.add(d.cfg, uploads, reconciles, d.filesToDelete)
+		d.deployPlan.RemoteFiles = d.stats.RemoteFiles
+		return nil
+	}
+
+	if d.cfg.Confirm {
+		if err := d.confirm(uploads); err != nil {
+			return err
 		}
+	}
+
+	if d.cfg.Dedupe {
+		uploads = d.splitDuplicates(uploads)
+	}
+
+	sortUploads(uploads, d.cfg.UploadOrder)
+	for _, f := range uploads {
+		d.enqueueUpload(ctx, f)
+	}
 
-		if runtime.GOOS == "darwin" {
-			// When a file system is HFS+, its filepath is in NFD form.
-			fpath = norm.NFC.String(fpath)
+	for _, f := range reconciles {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d.filesToUpload <- f:
 		}
+	}
 
-		abs, err := filepath.Abs(fpath)
+	return nil
+}
+
+// Policies for keys only differing by case, see -case-conflicts.
+const (
+	caseConflictsWarn   = "warn"
+	caseConflictsError  = "error"
+	caseConflictsIgnore = "ignore"
+)
+
+// checkKeyConflict returns an error if f is uploaded to the same key as
+// another local file, e.g. after stripping index.html or fingerprinting.
+// Keys only differing by case overwrite each other on some S3 compatible
+// stores and case-insensitive CDNs, these are handled as set in -case-conflicts.
+func (d *Deployer) checkKeyConflict(keys map[string]*osFile, f *osFile) error {
+	lower := strings.ToLower(f.keyPath)
+	other, found := keys[lower]
+	if !found {
+		keys[lower] = f
+		return nil
+	}
+	if other.keyPath == f.keyPath {
+		return fmt.Errorf("%q and %q are both uploaded to %q", other.relPath, f.relPath, f.keyPath)
+	}
+	msg := fmt.Sprintf("%q (from %q) and %q (from %q) only differ by case", other.keyPath, other.relPath, f.keyPath, f.relPath)
+	switch d.cfg.CaseConflicts {
+	case caseConflictsError:
+		return fmt.Errorf("%s, set -case-conflicts to warn or ignore to deploy anyway", msg)
+	case caseConflictsWarn:
+		d.Printf("WARNING: %s\n", msg)
+	}
+	return nil
+}
+
+const (
+	uploadOrderSmallFirst = "small-first"
+	uploadOrderLargeFirst = "large-first"
+)
+
+// sortUploads sorts files by size in the given order, so e.g. many
+// small pages don't have to wait for a few big videos to upload.
+// Files of the same size keep their order.
+func sortUploads(files []*osFile, order string) {
+	switch order {
+	case uploadOrderSmallFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size() < files[j].Size() })
+	case uploadOrderLargeFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size() > files[j].Size() })
+	}
+}
+
+// frozen returns an error unless told to override the
+// remote freeze marker freezeKey found.
+func (d *Deployer) frozen(freezeKey string) error {
+	if !d.cfg.OverrideFreeze {
+		return fmt.Errorf("deploys are frozen: found remote freeze marker %q, remove it or use -override-freeze to deploy anyway", freezeKey)
+	}
+	d.Printf("WARNING: overriding deploy freeze marker %q\n", freezeKey)
+	return nil
+}
+
+// remoteFileMap lists the remote files, or, if resuming,
+// loads them from the checkpoint.
+func (d *Deployer) remoteFileMap(ctx context.Context) (map[string]file, error) {
+	if d.checkpoint == nil {
+		return d.listRemote(ctx)
+	}
+
+	remoteFiles, err := d.checkpoint.load()
+	if err != nil {
+		return nil, err
+	}
+	if remoteFiles != nil {
+		d.Printf("Resuming from checkpoint %s\n", d.checkpoint.filename)
+	} else {
+		remoteFiles, err = d.listRemote(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		rel, err := filepath.Rel(basePath, fpath)
-		if err != nil {
-			return err
+	}
+
+	if err := d.checkpoint.start(remoteFiles); err != nil {
+		return nil, err
+	}
+
+	return remoteFiles, nil
+}
+
+// listRemote lists the remote files, from the S3 Inventory if set.
+func (d *Deployer) listRemote(ctx context.Context) (map[string]file, error) {
+	if d.cfg.Inventory != "" {
+		return d.inventoryFileMap(ctx)
+	}
+	return d.store.FileMap(ctx)
+}
+
+// confirm prints the planned changes and asks the user for confirmation.
+func (d *Deployer) confirm(uploads []*osFile) error {
+	if d.cfg.Try || (len(uploads) == 0 && len(d.filesToDelete) == 0) {
+		return nil
+	}
+
+	in := d.cfg.stdin
+	if in == nil {
+		fi, err := os.Stdin.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return errors.New("-confirm requires an interactive terminal")
+		}
+		in = os.Stdin
+	}
+
+	out := d.cfg.stdout
+	if out == nil {
+		out = os.Stdout
+	}
+
+	if d.cfg.Verbose {
+		for _, f := range uploads {
+			fmt.Fprintf(out, "%s (%s) %s\n", f.keyPath, f.reason, up)
 		}
+	}
+	for _, key := range d.filesToDelete {
+		fmt.Fprintf(out, "%s will be deleted\n", key)
+	}
+	fmt.Fprintf(out, "\n%d file(s) will be uploaded and %d file(s) deleted", len(uploads), len(d.filesToDelete))
+	if max := d.maxDelete(); len(d.filesToDelete) > max {
+		fmt.Fprintf(out, " (max %d per deploy)", max)
+	}
+	fmt.Fprint(out, ". Continue? [y/N] ")
 
-		if d.cfg.shouldIgnoreLocal(rel) {
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return errors.New("deploy aborted")
+	}
+}
+
+// walk a local directory
+func (d *Deployer) walk(ctx context.Context, basePath string, files chan<- *osFile) error {
+	err := d.cfg.walkLocal(basePath, d, func(rel, abs string, info os.FileInfo) error {
+		if info.IsDir() {
+			// An empty directory.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case files <- newDirectoryMarker(d.cfg, rel, abs):
+			}
 			return nil
 		}
 
+		if d.cfg.MaxFileSize > 0 && info.Size() > d.cfg.MaxFileSize {
+			msg := fmt.Sprintf("%s (%s) is larger than -max-file-size (%s)", rel, formatBytes(uint64(info.Size())), formatBytes(uint64(d.cfg.MaxFileSize)))
+			if d.cfg.MaxFileSizeAction == maxFileSizeSkip {
+				d.Printf("WARNING: skipping %s\n", msg)
+				return nil
+			}
+			return fmt.Errorf("%s, set -max-file-size-action=skip to skip such files", msg)
+		}
+
+		buffered, err := d.buffer.acquire(ctx, info.Size())
+		if err != nil {
+			return err
+		}
+
 		f, err := newOSFile(d.cfg, rel, abs, info)
 		if err != nil {
+			d.buffer.release(buffered)
 			return err
 		}
+		f.buffered = buffered
 
 		if f.route != nil && f.route.Ignore {
+			d.releaseBuffer(f)
 			return nil
 		}
 
@@ -289,6 +1076,16 @@ func (d *Deployer) walk(ctx context.Context, basePath string, files chan<- *osFi
 		case files <- f:
 		}
 
+		if d.cfg.IndexCopies {
+			if c := f.indexCopy(); c != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case files <- c:
+				}
+			}
+		}
+
 		return nil
 	})
 
@@ -297,6 +1094,396 @@ func (d *Deployer) walk(ctx context.Context, basePath string, files chan<- *osFi
 	return err
 }
 
+// hashFiles calculates the ETags of the files from in with HashWorkers
+// workers, so the hashing doesn't hold up the walk or the planning,
+// and sends them to out in the order received.
+func (d *Deployer) hashFiles(ctx context.Context, in <-chan *osFile, out chan<- *osFile) error {
+	defer close(out)
+
+	type hashed struct {
+		f    *osFile
+		done chan struct{}
+	}
+
+	workers := d.cfg.HashWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	// The files being hashed, in order, and the free workers.
+	queue := make(chan hashed, workers)
+	sem := make(chan struct{}, workers)
+
+	go func() {
+		defer close(queue)
+		for f := range in {
+			h := hashed{f: f, done: make(chan struct{})}
+			select {
+			case <-ctx.Done():
+				return
+			case sem <- struct{}{}:
+			}
+			go func() {
+				defer func() { <-sem }()
+				defer close(h.done)
+				h.f.ETag()
+			}()
+			select {
+			case <-ctx.Done():
+				return
+			case queue <- h:
+			}
+		}
+	}()
+
+	for h := range queue {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.done:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- h.f:
+		}
+	}
+
+	return nil
+}
+
+// Symlink policies, see -follow-symlinks.
+const (
+	symlinksFollow = "follow"
+	symlinksSkip   = "skip"
+	symlinksError  = "error"
+)
+
+// What to do with local files larger than -max-file-size, see -max-file-size-action.
+const (
+	maxFileSizeError = "error"
+	maxFileSizeSkip  = "skip"
+)
+
+// Unicode normalization forms of the local paths, see -normalize.
+const (
+	normalizeNFC  = "nfc"
+	normalizeNFD  = "nfd"
+	normalizeNone = "none"
+)
+
+// normalizePath applies the Unicode normalization set in -normalize to p.
+func (cfg *Config) normalizePath(p string) string {
+	switch cfg.Normalize {
+	case normalizeNFC:
+		return norm.NFC.String(p)
+	case normalizeNFD:
+		return norm.NFD.String(p)
+	default:
+		return p
+	}
+}
+
+// walkLocal walks the local files below basePath not skipped or ignored,
+// calling fn with the path relative to basePath and the absolute path of each.
+// With directoryMarkers set to create, fn is also called for empty directories.
+// With SourceFS set, that is walked instead of basePath. Warnings are printed
+// to logger.
+func (cfg *Config) walkLocal(basePath string, logger printer, fn func(rel, abs string, info os.FileInfo) error) error {
+	var (
+		realBase string
+		rules    ignoreRules
+		err      error
+	)
+	if cfg.SourceFS != nil {
+		if cfg.IgnoreFile != "" {
+			if rules, err = loadIgnoreFileFS(cfg.SourceFS, cfg.IgnoreFile); err != nil {
+				return err
+			}
+		}
+	} else {
+		// Deep trees on Windows are walked past MAX_PATH.
+		if basePath, err = longPath(basePath); err != nil {
+			return err
+		}
+		if realBase, err = realPath(basePath); err != nil {
+			return err
+		}
+		if cfg.IgnoreFile != "" {
+			if rules, err = loadIgnoreFile(filepath.Join(basePath, cfg.IgnoreFile)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Paths that only differ in their Unicode normalization would be
+	// uploaded to the same key, or look the same with -normalize=none.
+	seen := make(map[string]string)
+	walkFn := func(rel, abs string, info os.FileInfo) error {
+		key := norm.NFC.String(rel)
+		if other, found := seen[key]; found {
+			if cfg.Normalize != normalizeNone {
+				return fmt.Errorf("%q and %q have the same key %q after Unicode normalization", trimLongPathPrefix(other), trimLongPathPrefix(abs), rel)
+			}
+			logger.Printf("WARNING: %q and %q only differ in their Unicode normalization and are uploaded as different keys\n", trimLongPathPrefix(other), trimLongPathPrefix(abs))
+		}
+		seen[key] = abs
+		return fn(rel, abs, info)
+	}
+
+	if cfg.SourceFS != nil {
+		return cfg.walkSourceFS(rules, walkFn)
+	}
+	return cfg.walkLocalDir(basePath, basePath, basePath, []string{realBase}, rules, walkFn)
+}
+
+// walkLocalDir walks dir, reporting the files found as if below dirPath,
+// which differs from dir when dir is the target of a followed symlink.
+// The chain holds the real paths of the directories walked into via
+// symlinks, to detect cycles.
+func (cfg *Config) walkLocalDir(basePath, dirPath, dir string, chain []string, rules ignoreRules, fn func(rel, abs string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		realFpath := fpath
+		if dir != dirPath {
+			fpath = filepath.Join(dirPath, strings.TrimPrefix(fpath, dir))
+		}
+
+		pathUnix := path.Clean(filepath.ToSlash(strings.TrimPrefix(fpath, basePath)))
+		// The path relative to the ignore file.
+		ignorePath := strings.TrimPrefix(pathUnix, "/")
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch cfg.FollowSymlinks {
+			case symlinksSkip:
+				return nil
+			case symlinksError:
+				return fmt.Errorf("%q is a symlink, set -follow-symlinks to follow or skip symlinks", trimLongPathPrefix(fpath))
+			}
+			target, err := realPath(realFpath)
+			if err != nil {
+				return fmt.Errorf("failed to follow symlink %q: %s", trimLongPathPrefix(fpath), err)
+			}
+			if info, err = os.Stat(target); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if cfg.skipLocalDirs(pathUnix) || rules.match(ignorePath, true) {
+					return nil
+				}
+				parent, err := realPath(filepath.Dir(realFpath))
+				if err != nil {
+					return err
+				}
+				if isSymlinkCycle(chain, parent, target) {
+					return fmt.Errorf("symlink cycle: %q points to %q", trimLongPathPrefix(fpath), trimLongPathPrefix(target))
+				}
+				return cfg.walkLocalDir(basePath, fpath, target, append(chain[:len(chain):len(chain)], target), rules, fn)
+			}
+		}
+
+		if info.IsDir() {
+			if cfg.skipLocalDirs(pathUnix) || (ignorePath != "." && rules.match(ignorePath, true)) {
+				return filepath.SkipDir
+			}
+			if ignorePath == "." || cfg.fileConf.DirectoryMarkers != directoryMarkersCreate || !isEmptyDir(realFpath) {
+				return nil
+			}
+		} else {
+			if cfg.skipLocalFiles(pathUnix) || ignorePath == cfg.IgnoreFile || rules.match(ignorePath, false) {
+				return nil
+			}
+		}
+
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(basePath, fpath)
+		if err != nil {
+			return err
+		}
+		// File names on macOS (HFS+) are in NFD form, while most
+		// other systems keep them as they were created.
+		rel = cfg.normalizePath(rel)
+
+		if cfg.shouldIgnoreLocal(rel) {
+			return nil
+		}
+
+		return fn(rel, abs, info)
+	})
+}
+
+func isEmptyDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 0
+}
+
+// realPath returns the absolute path of p with all symlinks resolved,
+// as an extended-length path on Windows, see longPath.
+func realPath(p string) (string, error) {
+	p, err := filepath.EvalSymlinks(trimLongPathPrefix(p))
+	if err != nil {
+		return "", err
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return "", err
+	}
+	return longPath(p)
+}
+
+// isSymlinkCycle reports whether following a symlink in the real directory
+// parent to the real directory target would walk into a directory already
+// being walked.
+func isSymlinkCycle(chain []string, parent, target string) bool {
+	if parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)) {
+		return true
+	}
+	for _, dir := range chain {
+		if dir == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Deployer) put(ctx context.Context, f *osFile) error {
+	if d.cfg.PutTimeout <= 0 {
+		return d.store.Put(ctx, f, withUploadStats(d.stats))
+	}
+
+	putCtx, cancel := context.WithTimeout(ctx, d.cfg.PutTimeout)
+	defer cancel()
+
+	err := d.store.Put(putCtx, f, withUploadStats(d.stats))
+	if err != nil && putCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("upload of %q timed out after %s: %w", f.Key(), d.cfg.PutTimeout, err)
+	}
+	return err
+}
+
+func (d *Deployer) countUploaded(f *osFile) {
+	atomic.AddUint64(&d.stats.BytesUploadedRaw, uint64(f.rawSize))
+	atomic.AddUint64(&d.stats.BytesUploadedCompressed, uint64(f.size))
+	atomic.AddUint64(&f.stats.Uploaded, uint64(1))
+	atomic.AddUint64(&f.stats.BytesUploadedRaw, uint64(f.rawSize))
+	atomic.AddUint64(&f.stats.BytesUploadedCompressed, uint64(f.size))
+}
+
+// recordChange adds a changed file to the stats if needed for the GitHub summary.
+func (d *Deployer) recordChange(key, action string) {
+	if !d.cfg.GitHubSummary {
+		return
+	}
+	d.changesMu.Lock()
+	defer d.changesMu.Unlock()
+	d.stats.Changes = append(d.stats.Changes, FileChange{Key: key, Action: action})
+}
+
+// uploadFile uploads f, copies it from the reference bucket,
+// or fixes its remote metadata.
+func (d *Deployer) uploadFile(ctx context.Context, f *osFile) error {
+	if f.reconcile {
+		return d.reconcileMetadata(ctx, f)
+	}
+	if f.copyFrom != "" {
+		if err := d.copyFromReference(ctx, f); err != nil {
+			return err
+		}
+		d.recordVerify(f)
+		d.onUpload(f)
+		return nil
+	}
+	if f.moveFrom != "" {
+		if err := d.copyMoved(ctx, f); err != nil {
+			return err
+		}
+		f.uploaded = true
+		d.recordVerify(f)
+		d.onUpload(f)
+		return nil
+	}
+	if err := d.put(ctx, f); err != nil {
+		return err
+	}
+	f.uploaded = true
+	d.countUploaded(f)
+	d.recordChange(f.Key(), "uploaded")
+	d.recordVerify(f)
+	d.onUpload(f)
+	if d.checkpoint != nil {
+		if err := d.checkpoint.uploaded(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tolerateError returns nil if the failed upload of f should not stop the
+// deploy (-max-errors or -continue-on-error), to be retried at the end.
+func (d *Deployer) tolerateError(f *osFile, err error) error {
+	if (d.cfg.MaxErrors <= 0 && !d.cfg.ContinueOnError) || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	d.failedMu.Lock()
+	defer d.failedMu.Unlock()
+	d.failed = append(d.failed, f)
+	if !d.cfg.ContinueOnError && len(d.failed) > d.cfg.MaxErrors {
+		return fmt.Errorf("too many upload errors (more than %d), last: %w", d.cfg.MaxErrors, err)
+	}
+	d.Printf("WARNING: failed to upload %s, will retry: %s\n", f.Key(), err)
+	return nil
+}
+
+// retryFailed retries the failed uploads once, returning
+// the ones still failing as a FileErrors.
+func (d *Deployer) retryFailed(ctx context.Context) error {
+	if len(d.failed) == 0 {
+		return nil
+	}
+
+	d.Printf("Retrying %d failed file(s) …\n", len(d.failed))
+
+	var errs FileErrors
+	for _, f := range d.failed {
+		if err := d.uploadFile(ctx, f); err != nil {
+			d.onError(f.Key(), err)
+			errs = append(errs, FileError{Key: f.Key(), Err: err})
+		}
+	}
+	d.failed = nil
+
+	if len(errs) == 0 {
+		return nil
+	}
+	atomic.AddUint64(&d.stats.Failed, uint64(len(errs)))
+	return errs
+}
+
+// FileError is a file that failed to upload.
+type FileError struct {
+	Key string
+	Err error
+}
+
+// FileErrors is returned when files failed to upload with
+// -max-errors or -continue-on-error set, after the rest of the
+// deploy has finished.
+type FileErrors []FileError
+
+func (e FileErrors) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d file(s) failed to upload:", len(e))
+	for _, fe := range e {
+		fmt.Fprintf(&sb, "\n  %s: %s", fe.Key, fe.Err)
+	}
+	return sb.String()
+}
+
 func (d *Deployer) upload(ctx context.Context) error {
 	for {
 		select {
@@ -304,9 +1491,13 @@ func (d *Deployer) upload(ctx context.Context) error {
 			if !ok {
 				return nil
 			}
-			err := d.store.Put(ctx, f, withUploadStats(d.stats))
+			err := d.uploadFile(ctx, f)
+			d.releaseBuffer(f)
 			if err != nil {
-				return err
+				d.onError(f.Key(), err)
+				if err := d.tolerateError(f, err); err != nil {
+					return err
+				}
 			}
 		case <-ctx.Done():
 			return ctx.Err()
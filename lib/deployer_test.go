@@ -6,20 +6,36 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"golang.org/x/sync/errgroup"
 )
 
-var _ remoteStore = (*testStore)(nil)
+var (
+	_ remoteStore              = (*testStore)(nil)
+	_ remoteObjectGetter       = (*testStore)(nil)
+	_ remoteMetadataReconciler = (*testStore)(nil)
+	_ remoteLister             = (*testStore)(nil)
+	_ remoteCopier             = (*testStore)(nil)
+	_ remoteInventoryReader    = (*testStore)(nil)
+	_ remoteCDN                = (*testStore)(nil)
+	_ remoteCDNPaths           = (*testStore)(nil)
+)
 
 func TestDeploy(t *testing.T) {
 	c := qt.New(t)
@@ -40,14 +56,33 @@ func TestDeploy(t *testing.T) {
 
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
 	assertKeys(t, m, ".s3deploy.yml", "main.css", "index.html", "ab.txt")
 
 	mainCss := m["main.css"]
 	c.Assert(mainCss.(*osFile).ContentType(), qt.Equals, "text/css; charset=utf-8")
 	headers := mainCss.(*osFile).Headers()
-	c.Assert(headers["Content-Encoding"], qt.Equals, "gzip")
+	// Too small to get smaller when gzipped.
+	c.Assert(headers["Content-Encoding"], qt.Equals, "")
 	c.Assert(headers["Cache-Control"], qt.Equals, "max-age=630720000, no-transform, public")
+
+	c.Assert(stats.RemoteFiles, qt.Equals, uint64(3))
+	c.Assert(stats.BytesUploadedRaw > 0, qt.IsTrue)
+	c.Assert(stats.BytesUploadedCompressed <= stats.BytesUploadedRaw, qt.IsTrue)
+	c.Assert(stats.Summary(), qt.Matches, `(?s).*\nUploaded \d+ B \(\d+ B compressed\), 3 remote files; list .*`)
+
+	routeStats := make(map[string]RouteStats)
+	for _, r := range stats.Routes {
+		routeStats[r.Route] = *r
+	}
+	c.Assert(routeStats, qt.HasLen, 3)
+	c.Assert(routeStats["^.+\\.(js|css|svg|ttf)$"].Uploaded, qt.Equals, uint64(1))
+	c.Assert(routeStats["^.+\\.(html|xml|json)$"].Uploaded, qt.Equals, uint64(1))
+	c.Assert(routeStats["^.+\\.(html|xml|json)$"].BytesUploadedCompressed > 0, qt.IsTrue)
+	c.Assert(routeStats[""].Uploaded, qt.Equals, uint64(1))
+	c.Assert(routeStats[""].Skipped, qt.Equals, uint64(1))
+	c.Assert(stats.RouteSummary(), qt.Contains, `Route "^.+\\.(js|css|svg|ttf)$": uploaded 1 (`)
+	c.Assert(stats.RouteSummary(), qt.Contains, "No route: uploaded 1 (")
 }
 
 func TestDeployWithBucketPath(t *testing.T) {
@@ -70,12 +105,12 @@ func TestDeployWithBucketPath(t *testing.T) {
 
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
 	assertKeys(t, m, "my/path/.s3deploy.yml", "my/path/main.css", "my/path/index.html", "my/path/ab.txt")
 	mainCss := m["my/path/main.css"]
 	c.Assert(mainCss.(*osFile).Key(), qt.Equals, "my/path/main.css")
 	headers := mainCss.(*osFile).Headers()
-	c.Assert(headers["Content-Encoding"], qt.Equals, "gzip")
+	c.Assert(headers["Content-Encoding"], qt.Equals, "")
 }
 
 func TestDeployForce(t *testing.T) {
@@ -95,7 +130,7 @@ func TestDeployForce(t *testing.T) {
 
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 1 of 1, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 4, skipped 0 (100% changed)")
 }
 
 func TestDeployWitIgnorePattern(t *testing.T) {
@@ -124,7 +159,7 @@ func TestDeployWitIgnorePattern(t *testing.T) {
 
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 0 of 0, uploaded 2, skipped 1 (67% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 2, skipped 1 (67% changed)")
 	assertKeys(t, m,
 		"my/path/.s3deploy.yml",
 		"my/path/index.html",
@@ -162,7 +197,7 @@ func TestDeployWitRoutesIgnore(t *testing.T) {
 
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 0 of 0, uploaded 2, skipped 1 (67% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 2, skipped 1 (67% changed)")
 	assertKeys(t, m,
 		"my/path/.s3deploy.yml",
 		"my/path/index.html",
@@ -278,83 +313,1561 @@ func TestDeployMaxDelete(t *testing.T) {
 	stats, err := Deploy(cfg)
 	c.Assert(err, qt.IsNil)
 	c.Assert(len(m), qt.Equals, 158+4)
-	c.Assert(stats.Summary(), qt.Equals, "Deleted 42 of 200, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 42 of 200, uploaded 4, skipped 0 (100% changed)")
+
+	// Nothing is uploaded in the deploys below.
+	cfg.ForceDeleteAll = true
+	cfg.FailOnStale = true
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `116 remote file\(s\) not found in source were left because of -max-delete \(-fail-on-stale\)`)
+	c.Assert(stats.Deleted, qt.Equals, uint64(42))
+	c.Assert(len(m), qt.Equals, 116+4)
+
+	cfg.MaxDelete = 0
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `116 remote file\(s\) .*`)
+	c.Assert(stats.Stale, qt.Equals, uint64(116))
 }
 
-func testSourcePath() string {
-	wd, _ := os.Getwd()
-	return filepath.Join(wd, "testdata") + "/"
+// Run with -race.
+func TestDeployManyFiles(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	m := make(map[string]file)
+	for i := 0; i < 3000; i++ {
+		dir := filepath.Join(source, fmt.Sprintf("dir%d", i%10))
+		c.Assert(os.MkdirAll(dir, 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0o644), qt.IsNil)
+		if i%3 == 0 {
+			// Changed.
+			key := fmt.Sprintf("dir%d/file%d.txt", i%10, i)
+			m[key] = &testFile{key: key, etag: `"changed"`, size: 1}
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("old%d/file%04d.txt", i%10, i)
+		m[key] = &testFile{key: key, etag: `"old"`, size: 3}
+	}
+	store := newTestStoreFrom(m, 0)
+
+	progress := make(chan ProgressEvent)
+	var progressCount int
+	done := make(chan struct{})
+	go func() {
+		for range progress {
+			progressCount++
+		}
+		close(done)
+	}()
+
+	var (
+		mu       sync.Mutex
+		uploaded int
+		deleted  []string
+	)
+	cfg := &Config{
+		BucketName:    "example.com",
+		RegionName:    "eu-west-1",
+		Silent:        true,
+		SourcePath:    source,
+		MaxDelete:     100,
+		UploadWorkers: 32,
+		baseStore:     store,
+		Progress:      progress,
+		OnUpload: func(key, reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			uploaded++
+		},
+		OnDelete: func(key string) {
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = append(deleted, key)
+		},
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	close(progress)
+	<-done
+
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 100 of 1000, uploaded 3000, skipped 0 (100% changed)")
+	c.Assert(uploaded, qt.Equals, 3000)
+	c.Assert(progressCount, qt.Equals, 3000+1)
+	c.Assert(stats.Directories["dir0/"].Uploaded, qt.Equals, uint64(300))
+
+	// The first files in key order are deleted.
+	c.Assert(deleted, qt.HasLen, 100)
+	for i, key := range deleted {
+		c.Assert(key, qt.Equals, fmt.Sprintf("old0/file%04d.txt", i*10))
+	}
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, deleted)
 }
 
-func newTestStore(failAt int, root string) (remoteStore, map[string]file) {
-	m := map[string]file{
-		path.Join(root, "ab.txt"):       &testFile{key: path.Join(root, "ab.txt"), etag: `"b86fc6b051f63d73de262d4c34e3a0a9"`, size: int64(2)},
-		path.Join(root, "main.css"):     &testFile{key: path.Join(root, "main.css"), etag: `"changed"`, size: int64(27)},
-		path.Join(root, "deleteme.txt"): &testFile{},
+func TestDeployMaxDeletePercent(t *testing.T) {
+	c := qt.New(t)
+
+	m := make(map[string]file)
+	for i := 0; i < 200; i++ {
+		m[fmt.Sprintf("file%d.css", i)] = &testFile{}
 	}
+	store := newTestStoreFrom(m, 0)
 
-	return newTestStoreFrom(m, failAt), m
+	cfg := &Config{
+		BucketName:       "example.com",
+		RegionName:       "eu-west-1",
+		Silent:           true,
+		SourcePath:       testSourcePath(),
+		MaxDeletePercent: 20,
+		baseStore:        store,
+	}
+
+	// A full wipe is blocked.
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 200, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(len(m), qt.Equals, 200+4)
+
+	// 3 of 15 remote files.
+	store, m = newTestStore(0, "")
+	for i := 0; i < 2; i++ {
+		m[fmt.Sprintf("file%d.css", i)] = &testFile{}
+	}
+	for i := 0; i < 10; i++ {
+		m[fmt.Sprintf("keep/file%d.css", i)] = &testFile{}
+	}
+	cfg = &Config{
+		BucketName:       "example.com",
+		RegionName:       "eu-west-1",
+		Silent:           true,
+		SourcePath:       testSourcePath(),
+		MaxDeletePercent: 20,
+		Keep:             Strings{"^keep/"},
+		baseStore:        store,
+	}
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.RemoteFiles, qt.Equals, uint64(15))
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 3 of 3, uploaded 3, skipped 1 (86% changed)")
+
+	cfg = &Config{BucketName: "example.com", MaxDeletePercent: 120}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "-max-delete-percent must be between 0 and 100")
 }
 
-func newTestStoreFrom(m map[string]file, failAt int) remoteStore {
-	return &testStore{m: m, failAt: failAt}
+func TestDeployDeleteAll(t *testing.T) {
+	c := qt.New(t)
+
+	m := make(map[string]file)
+	for i := 0; i < 20; i++ {
+		m[fmt.Sprintf("file%d.css", i)] = &testFile{}
+	}
+	store := newTestStoreFrom(m, 0)
+
+	newConfig := func() *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			Silent:     true,
+			MaxDelete:  300,
+			SourcePath: t.TempDir(),
+			baseStore:  store,
+		}
+	}
+
+	_, err := Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `refusing to delete 20 of 20 remote files while uploading 0: the source looks empty or the path doesn't match, set -force-delete-all to deploy anyway`)
+	c.Assert(m, qt.HasLen, 20)
+
+	cfg := newConfig()
+	cfg.ForceDeleteAll = true
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(20))
+	c.Assert(m, qt.HasLen, 0)
 }
 
-type testStore struct {
-	failAt int
-	m      map[string]file
+func TestDeployKeep(t *testing.T) {
+	c := qt.New(t)
+	root := "my/path"
+	store, m := newTestStore(0, root)
+	m["my/path/uploads/a.jpg"] = &testFile{key: "my/path/uploads/a.jpg"}
 
-	sync.Mutex
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		BucketPath: root,
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		Keep:       Strings{"^uploads/", "^deleteme"},
+		baseStore:  store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 3, skipped 1 (75% changed)")
+	c.Assert(m["my/path/uploads/a.jpg"], qt.IsNotNil)
+	c.Assert(m["my/path/deleteme.txt"], qt.IsNotNil)
 }
 
-func assertKeys(t *testing.T, m map[string]file, keys ...string) {
-	for _, k := range keys {
-		if _, found := m[k]; !found {
-			t.Fatal("key not found:", k)
+func TestDeployInclude(t *testing.T) {
+	c := qt.New(t)
+	root := "my/path"
+	store, m := newTestStore(0, root)
+
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		BucketPath: root,
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		Include:    Strings{`\.css$`},
+		baseStore:  store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 1, skipped 0 (100% changed)")
+	c.Assert(m["my/path/main.css"].ETag(), qt.Not(qt.Equals), `"changed"`)
+	// Not included, so not deleted.
+	c.Assert(m["my/path/deleteme.txt"], qt.IsNotNil)
+	c.Assert(m["my/path/index.html"], qt.IsNil)
+}
+
+func TestDeployCaseConflicts(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("needs a case-sensitive file system")
+	}
+	c := qt.New(t)
+
+	source := t.TempDir()
+	for _, filename := range []string{"index.html", "about.html", "About.html"} {
+		c.Assert(os.WriteFile(filepath.Join(source, filename), []byte(filename), 0o644), qt.IsNil)
+	}
+
+	deploy := func(policy string) (map[string]file, error) {
+		store, m := newTestStore(0, "")
+		cfg := &Config{
+			BucketName:    "example.com",
+			RegionName:    "eu-west-1",
+			MaxDelete:     300,
+			Silent:        true,
+			SourcePath:    source,
+			CaseConflicts: policy,
+			baseStore:     store,
 		}
+		_, err := Deploy(cfg)
+		return m, err
 	}
 
-	if len(keys) != len(m) {
-		t.Log(m)
-		t.Fatalf("map length mismatch: %d vs %d", len(keys), len(m))
+	m, err := deploy("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m["about.html"], qt.IsNotNil)
+	c.Assert(m["About.html"], qt.IsNotNil)
+	_, err = deploy("ignore")
+	c.Assert(err, qt.IsNil)
+	_, err = deploy("error")
+	c.Assert(err, qt.ErrorMatches, `"About.html" \(from "About.html"\) and "about.html" \(from "about.html"\) only differ by case, set -case-conflicts to warn or ignore to deploy anyway`)
+
+	cfg := &Config{BucketName: "example.com", CaseConflicts: "fail"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -case-conflicts "fail", must be one of warn, error and ignore`)
+
+	// Files uploaded to the same key always fail.
+	d := &Deployer{cfg: &Config{CaseConflicts: caseConflictsIgnore}}
+	keys := make(map[string]*osFile)
+	c.Assert(d.checkKeyConflict(keys, &osFile{relPath: "blog/index.html", keyPath: "blog/"}), qt.IsNil)
+	c.Assert(d.checkKeyConflict(keys, &osFile{relPath: "Blog/index.html", keyPath: "Blog/"}), qt.IsNil)
+	c.Assert(d.checkKeyConflict(keys, &osFile{relPath: "blog/", keyPath: "blog/"}), qt.ErrorMatches, `"blog/index.html" and "blog/" are both uploaded to "blog/"`)
+}
+
+func TestDeployMaxFileSize(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "index.html"), []byte("<h1>Hi</h1>"), 0o644), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(source, "site.tar.gz"), make([]byte, 2048), 0o644), qt.IsNil)
+
+	deploy := func(action string) (map[string]file, error) {
+		store, m := newTestStore(0, "")
+		cfg := &Config{
+			BucketName:        "example.com",
+			RegionName:        "eu-west-1",
+			MaxDelete:         300,
+			Silent:            true,
+			SourcePath:        source,
+			MaxFileSize:       1024,
+			MaxFileSizeAction: action,
+			baseStore:         store,
+		}
+		_, err := Deploy(cfg)
+		return m, err
 	}
+
+	_, err := deploy("")
+	c.Assert(err, qt.ErrorMatches, `site.tar.gz \(2.0 KiB\) is larger than -max-file-size \(1.0 KiB\), set -max-file-size-action=skip to skip such files`)
+
+	m, err := deploy("skip")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m["index.html"], qt.IsNotNil)
+	c.Assert(m["site.tar.gz"], qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com", MaxFileSizeAction: "warn"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -max-file-size-action "warn", must be one of error and skip`)
 }
 
-func (s *testStore) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
-	s.Lock()
-	defer s.Unlock()
+func TestDeployDirectoryMarkers(t *testing.T) {
+	c := qt.New(t)
 
-	if s.failAt == 1 {
-		return nil, errors.New("fail")
+	source := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "index.html"), []byte("<h1>Hi</h1>"), 0o644), qt.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(source, "uploads", "empty"), 0o755), qt.IsNil)
+
+	deploy := func(markers string, m map[string]file) (DeployStats, error) {
+		cfg := &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: source,
+			baseStore:  newTestStoreFrom(m, 0),
+		}
+		cfg.fileConf.DirectoryMarkers = markers
+		c.Assert(cfg.fileConf.init(), qt.IsNil)
+		return Deploy(cfg)
 	}
-	c := make(map[string]file)
-	for k, v := range s.m {
-		c[k] = v
+
+	m := map[string]file{
+		"old/": &testFile{key: "old/"},
 	}
-	return c, nil
+	stats, err := deploy("create", m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 2, skipped 0 (100% changed)")
+	assertKeys(t, m, "index.html", "uploads/empty/")
+	c.Assert(m["uploads/empty/"].Size(), qt.Equals, int64(0))
+
+	// Unchanged.
+	stats, err = deploy("create", m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 2 (0% changed)")
+
+	m["old/"] = &testFile{key: "old/"}
+	stats, err = deploy("keep", m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 1 (0% changed)")
+	assertKeys(t, m, "index.html", "uploads/empty/", "old/")
+
+	stats, err = deploy("", m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 2 of 2, uploaded 0, skipped 1 (67% changed)")
+	assertKeys(t, m, "index.html")
+
+	var fc fileConfig
+	fc.DirectoryMarkers = "always"
+	c.Assert(fc.init(), qt.ErrorMatches, `invalid directoryMarkers "always", must be one of create, keep and delete`)
 }
 
-func (s *testStore) Put(ctx context.Context, f localFile, opts ...opOption) error {
-	s.Lock()
-	defer s.Unlock()
+func TestDeployConfirm(t *testing.T) {
+	c := qt.New(t)
 
-	if s.failAt == 2 {
-		return errors.New("fail")
+	for _, test := range []struct {
+		answer    string
+		confirmed bool
+		expect    string
+	}{
+		{"y\n", true, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)"},
+		{"yes\n", true, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)"},
+		{"n\n", false, "Deleted 0 of 0, uploaded 0, skipped 1 (0% changed)"},
+		{"", false, "Deleted 0 of 0, uploaded 0, skipped 1 (0% changed)"},
+	} {
+		store, m := newTestStore(0, "")
+		var out bytes.Buffer
+
+		cfg := &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			Confirm:    true,
+			baseStore:  store,
+			stdin:      strings.NewReader(test.answer),
+			stdout:     &out,
+		}
+
+		stats, err := Deploy(cfg)
+		if test.confirmed {
+			c.Assert(err, qt.IsNil)
+			c.Assert(m["deleteme.txt"], qt.IsNil)
+		} else {
+			c.Assert(err, qt.ErrorMatches, "deploy aborted")
+			c.Assert(m["deleteme.txt"], qt.IsNotNil)
+		}
+		c.Assert(firstLine(stats.Summary()), qt.Equals, test.expect)
+		c.Assert(out.String(), qt.Contains, "deleteme.txt will be deleted")
+		c.Assert(out.String(), qt.Contains, "3 file(s) will be uploaded and 1 file(s) deleted. Continue? [y/N]")
 	}
-	s.m[f.Key()] = f
-	return nil
 }
 
-func (s *testStore) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
-	s.Lock()
-	defer s.Unlock()
+func TestDeployUploadOrder(t *testing.T) {
+	c := qt.New(t)
 
-	if s.failAt == 3 {
-		return errors.New("fail")
+	for _, order := range []string{uploadOrderSmallFirst, uploadOrderLargeFirst} {
+		store, m := newTestStore(0, "")
+
+		cfg := &Config{
+			BucketName:    "example.com",
+			RegionName:    "eu-west-1",
+			MaxDelete:     300,
+			Silent:        true,
+			SourcePath:    testSourcePath(),
+			UploadOrder:   order,
+			UploadWorkers: 1,
+			baseStore:     store,
+		}
+
+		stats, err := Deploy(cfg)
+		c.Assert(err, qt.IsNil)
+		c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+
+		keys := store.(*testStore).putKeys
+		c.Assert(keys, qt.HasLen, 3)
+		for i := 1; i < len(keys); i++ {
+			prev, cur := m[keys[i-1]].Size(), m[keys[i]].Size()
+			if order == uploadOrderSmallFirst {
+				c.Assert(prev <= cur, qt.IsTrue, qt.Commentf("%v", keys))
+			} else {
+				c.Assert(prev >= cur, qt.IsTrue, qt.Commentf("%v", keys))
+			}
+		}
 	}
-	for _, k := range keys {
-		delete(s.m, k)
+
+	cfg := &Config{BucketName: "example.com", UploadOrder: "random"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid upload order "random".*`)
+}
+
+func TestDeployerHashFiles(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	var files []*osFile
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		filename := filepath.Join(source, name)
+		c.Assert(os.WriteFile(filename, bytes.Repeat([]byte("a"), i*1000), 0o644), qt.IsNil)
+		fi, err := os.Stat(filename)
+		c.Assert(err, qt.IsNil)
+		of, err := newOSFile(&Config{}, name, filename, fi)
+		c.Assert(err, qt.IsNil)
+		files = append(files, of)
+	}
+
+	d := &Deployer{cfg: &Config{HashWorkers: 4}}
+	in, out := make(chan *osFile), make(chan *osFile)
+	go func() {
+		defer close(in)
+		for _, f := range files {
+			in <- f
+		}
+	}()
+
+	errc := make(chan error, 1)
+	go func() { errc <- d.hashFiles(context.Background(), in, out) }()
+
+	var i int
+	for f := range out {
+		// The files come out in order, hashed.
+		c.Assert(f, qt.Equals, files[i])
+		c.Assert(f.etag, qt.Not(qt.Equals), "")
+		i++
+	}
+	c.Assert(i, qt.Equals, len(files))
+	c.Assert(<-errc, qt.IsNil)
+}
+
+func TestDeployerPlanStopsOnError(t *testing.T) {
+	c := qt.New(t)
+
+	source := c.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("file%02d.txt", i)] = strings.Repeat("content", 100)
+	}
+	writeTestFiles(c, source, files)
+
+	// Comparing the content of the first file fails.
+	store := newTestStoreFrom(map[string]file{
+		"file00.txt": failingMetadataFile{&testFile{key: "file00.txt", etag: `"changed"`}},
+	}, 0)
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: source,
+		baseStore:  store,
 	}
+	cfg.fileConf.Routes = routes{{Route: "^.+\\.txt$", Gzip: true}}
+
+	d, err := New(cfg)
+	c.Assert(err, qt.IsNil)
+	// Not canceled on the first error, so plan must stop the walk itself.
+	g := &errgroup.Group{}
+	d.g = g
+	d.store = newStore(cfg, store)
+	g.Go(func() error {
+		// An upload worker, waiting for the uploads to be closed.
+		for range d.filesToUpload {
+		}
+		return nil
+	})
+
+	err = d.plan(context.Background())
+	c.Assert(err, qt.ErrorMatches, `failed to get metadata for "file00.txt": fail`)
+
+	done := make(chan struct{})
+	go func() {
+		g.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("the walk or the upload worker is still blocked")
+	}
+}
+
+func TestNewDeployerOutput(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name                string
+		cfg                 *Config
+		out, outv, outFiles io.Writer
+	}{
+		{"default", &Config{}, os.Stdout, io.Discard, os.Stdout},
+		{"quiet", &Config{Silent: true}, io.Discard, io.Discard, io.Discard},
+		{"brief", &Config{Brief: true}, os.Stdout, io.Discard, io.Discard},
+		{"verbose", &Config{Verbose: true, Brief: true}, os.Stdout, os.Stdout, os.Stdout},
+	} {
+		d := newDeployer(test.cfg, nil)
+		c.Assert(d.printer.(print).out, qt.Equals, test.out, qt.Commentf(test.name))
+		c.Assert(d.outv, qt.Equals, test.outv, qt.Commentf(test.name))
+		c.Assert(d.outf, qt.Equals, test.outFiles, qt.Commentf(test.name))
+	}
+}
+
+func TestDeployCallbacks(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		mu       sync.Mutex
+		uploaded = make(map[string]string)
+		skipped  []string
+		deleted  []string
+		failed   = make(map[string]error)
+	)
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			baseStore:  store,
+			OnUpload: func(key, reason string) {
+				mu.Lock()
+				defer mu.Unlock()
+				uploaded[key] = reason
+			},
+			OnSkip: func(key string) {
+				mu.Lock()
+				defer mu.Unlock()
+				skipped = append(skipped, key)
+			},
+			OnDelete: func(key string) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted = append(deleted, key)
+			},
+			OnError: func(key string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed[key] = err
+			},
+		}
+	}
+
+	store, _ := newTestStore(0, "")
+	_, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(uploaded, qt.DeepEquals, map[string]string{".s3deploy.yml": "not found", "index.html": "not found", "main.css": "size"})
+	c.Assert(skipped, qt.DeepEquals, []string{"ab.txt"})
+	c.Assert(deleted, qt.DeepEquals, []string{"deleteme.txt"})
+	c.Assert(failed, qt.HasLen, 0)
+
+	store, _ = newTestStore(2, "")
+	_, err = Deploy(newConfig(store))
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(failed, qt.Not(qt.HasLen), 0)
+	for _, err := range failed {
+		c.Assert(err, qt.ErrorMatches, "fail")
+	}
+}
+
+func TestDeployProgress(t *testing.T) {
+	c := qt.New(t)
+
+	progress := make(chan ProgressEvent, 100)
+	store, _ := newTestStore(0, "")
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		baseStore:  store,
+		Progress:   progress,
+	}
+
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	close(progress)
+
+	events := make(map[ProgressEventType][]ProgressEvent)
+	var last ProgressEvent
+	for ev := range progress {
+		events[ev.Type] = append(events[ev.Type], ev)
+		last = ev
+	}
+	c.Assert(events[ProgressFileUploaded], qt.HasLen, 3)
+	c.Assert(events[ProgressFileSkipped], qt.DeepEquals, []ProgressEvent{{Type: ProgressFileSkipped, Key: "ab.txt", Uploaded: events[ProgressFileSkipped][0].Uploaded, Skipped: 1}})
+	c.Assert(events[ProgressDeleteBatch], qt.HasLen, 1)
+	c.Assert(events[ProgressDeleteBatch][0].Keys, qt.DeepEquals, []string{"deleteme.txt"})
+	c.Assert(last.Type, qt.Equals, ProgressDeleteBatch)
+	c.Assert(last.Uploaded, qt.Equals, uint64(3))
+	c.Assert(last.Deleted, qt.Equals, uint64(1))
+
+	for _, ev := range events[ProgressFileUploaded] {
+		if ev.Key == "main.css" {
+			c.Assert(ev.Reason, qt.Equals, "size")
+		}
+	}
+
+	progress = make(chan ProgressEvent, 2)
+	d := &Deployer{cfg: &Config{Progress: progress}, stats: &DeployStats{}}
+	d.progressInvalidations(map[string]string{"E2": "I2", "E1": "I1"})
+	c.Assert(<-progress, qt.DeepEquals, ProgressEvent{Type: ProgressInvalidationCreated, DistributionID: "E1", InvalidationID: "I1"})
+	c.Assert(<-progress, qt.DeepEquals, ProgressEvent{Type: ProgressInvalidationCreated, DistributionID: "E2", InvalidationID: "I2"})
+}
+
+func TestDeployMaxErrors(t *testing.T) {
+	c := qt.New(t)
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			MaxErrors:  1,
+			baseStore:  store,
+		}
+	}
+
+	// Fails once, succeeds on retry.
+	store, m := newTestStore(0, "")
+	store.(*testStore).putFailures = map[string]int{"index.html": 1}
+	stats, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(3))
+	c.Assert(stats.Failed, qt.Equals, uint64(0))
+	c.Assert(m["index.html"], qt.IsNotNil)
+
+	// Always fails, the rest of the deploy is done.
+	store, m = newTestStore(0, "")
+	store.(*testStore).putFailures = map[string]int{"index.html": -1}
+	stats, err = Deploy(newConfig(store))
+	var errs FileErrors
+	c.Assert(errors.As(err, &errs), qt.IsTrue)
+	c.Assert(errs, qt.HasLen, 1)
+	c.Assert(errs[0].Key, qt.Equals, "index.html")
+	c.Assert(err, qt.ErrorMatches, "1 file\\(s\\) failed to upload:\n  index.html: fail index.html")
+	c.Assert(stats.Uploaded, qt.Equals, uint64(2))
+	c.Assert(stats.Failed, qt.Equals, uint64(1))
+	c.Assert(stats.Deleted, qt.Equals, uint64(1))
+	c.Assert(m["index.html"], qt.IsNil)
+	c.Assert(m["main.css"], qt.IsNotNil)
+
+	// Too many errors.
+	store, _ = newTestStore(0, "")
+	store.(*testStore).putFailures = map[string]int{"index.html": -1, "main.css": -1}
+	_, err = Deploy(newConfig(store))
+	c.Assert(err, qt.ErrorMatches, "too many upload errors.*")
+
+	// No limit.
+	store, _ = newTestStore(0, "")
+	store.(*testStore).putFailures = map[string]int{"index.html": -1, "main.css": -1}
+	cfg := newConfig(store)
+	cfg.MaxErrors = 0
+	cfg.ContinueOnError = true
+	stats, err = Deploy(cfg)
+	c.Assert(errors.As(err, &errs), qt.IsTrue)
+	c.Assert(errs, qt.HasLen, 2)
+	c.Assert(stats.Failed, qt.Equals, uint64(2))
+}
+
+func TestDeployVerify(t *testing.T) {
+	c := qt.New(t)
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			Verify:     true,
+			baseStore:  store,
+		}
+	}
+
+	store, _ := newTestStore(0, "")
+	stats, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(3))
+
+	store, m := newTestStore(0, "")
+	store.(*testStore).corrupt = map[string]bool{"main.css": true}
+	stats, err = Deploy(newConfig(store))
+	c.Assert(err, qt.ErrorMatches, `(?s)verification failed for 1 file\(s\):\n  main.css: size 1, expected \d+, Content-Type "binary/octet-stream", expected "text/css.*"`)
+	// Nothing is deleted after a failed verification.
+	c.Assert(stats.Deleted, qt.Equals, uint64(0))
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+}
+
+func TestDeployIndexCopies(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "about.html", "blog/index.html", "blog/post/index.html"} {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte("<h1>"+name+"</h1>"), 0o644), qt.IsNil)
+	}
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName:  "example.com",
+			RegionName:  "eu-west-1",
+			MaxDelete:   300,
+			Silent:      true,
+			SourcePath:  dir + "/",
+			IndexCopies: true,
+			baseStore:   store,
+		}
+	}
+
+	store, m := newTestStore(0, "")
+	_, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	assertKeys(t, m, "index.html", "about.html", "blog/index.html", "blog", "blog/post/index.html", "blog/post")
+	c.Assert(m["blog"].(localFile).ContentType(), qt.Equals, "text/html; charset=utf-8")
+
+	// Unchanged.
+	stats, err := Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(0))
+	c.Assert(stats.Skipped, qt.Equals, uint64(6))
+
+	// Both the index.html and its copy are deleted with the directory.
+	c.Assert(os.RemoveAll(filepath.Join(dir, "blog", "post")), qt.IsNil)
+	stats, err = Deploy(newConfig(store))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(2))
+	assertKeys(t, m, "index.html", "about.html", "blog/index.html", "blog")
+
+	// With -strip-index-html.
+	store, m = newTestStore(0, "")
+	cfg := newConfig(store)
+	cfg.StripIndexHTML = true
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	assertKeys(t, m, "index.html", "about.html", "blog/", "blog")
+}
+
+func TestDeployLock(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+
+	newConfig := func() *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			Lock:       true,
+			baseStore:  store,
+		}
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	// Released.
+	c.Assert(m[lockKey], qt.IsNil)
+
+	// Held by someone else.
+	m[lockKey] = newMemoryFile(lockKey, "application/json", []byte(fmt.Sprintf(`{"id":"other","owner":"someone","expires":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))))
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `deploy lock ".s3deploy.lock" is held by someone.*`)
+	c.Assert(m[lockKey], qt.IsNotNil)
+
+	// Expired.
+	m[lockKey] = newMemoryFile(lockKey, "application/json", []byte(fmt.Sprintf(`{"id":"other","owner":"someone","expires":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339))))
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(m[lockKey], qt.IsNil)
+}
+
+func TestDeployResume(t *testing.T) {
+	c := qt.New(t)
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+
+	// Fail in the delete step.
+	store, m := newTestStore(3, "")
+	newConfig := func() *Config {
+		return &Config{
+			BucketName:     "example.com",
+			RegionName:     "eu-west-1",
+			MaxDelete:      300,
+			Silent:         true,
+			SourcePath:     testSourcePath(),
+			Resume:         true,
+			CheckpointFile: checkpointFile,
+			baseStore:      store,
+		}
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 3, skipped 1 (75% changed)")
+	_, err = os.Stat(checkpointFile)
+	c.Assert(err, qt.IsNil)
+
+	// Listing the remote now fails, so this must use the checkpoint.
+	store.(*testStore).failAt = 1
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 0, skipped 4 (20% changed)")
+	c.Assert(m["deleteme.txt"], qt.IsNil)
+	_, err = os.Stat(checkpointFile)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestDeployWithContextCanceled(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		baseStore:  store,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := DeployWithContext(ctx, cfg)
+	c.Assert(err, qt.Equals, context.Canceled)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+}
+
+func TestDeployFreeze(t *testing.T) {
+	c := qt.New(t)
+	root := "my/path"
+	store, m := newTestStore(0, root)
+	m["my/path/.s3deploy.freeze"] = &testFile{key: "my/path/.s3deploy.freeze"}
+
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		BucketPath: root,
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		baseStore:  store,
+	}
+
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(err.Error(), qt.Contains, "deploys are frozen")
+
+	cfg = &Config{
+		BucketName:     "example.com",
+		RegionName:     "eu-west-1",
+		BucketPath:     root,
+		MaxDelete:      300,
+		Silent:         true,
+		SourcePath:     testSourcePath(),
+		OverrideFreeze: true,
+		baseStore:      store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	c.Assert(m["my/path/.s3deploy.freeze"], qt.IsNotNil)
+}
+
+func TestDeployFreezeResume(t *testing.T) {
+	c := qt.New(t)
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+
+	// Fail in the delete step, leaving a checkpoint.
+	store, m := newTestStore(3, "")
+	newConfig := func() *Config {
+		return &Config{
+			BucketName:     "example.com",
+			RegionName:     "eu-west-1",
+			MaxDelete:      300,
+			Silent:         true,
+			SourcePath:     testSourcePath(),
+			Resume:         true,
+			CheckpointFile: checkpointFile,
+			baseStore:      store,
+		}
+	}
+	_, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNotNil)
+
+	// Frozen after the checkpoint. Listing the remote now
+	// fails, so the remote files are read from the checkpoint.
+	store.(*testStore).failAt = 1
+	m[".s3deploy.freeze"] = &testFile{key: ".s3deploy.freeze"}
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `deploys are frozen: .*`)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+}
+
+func TestDeployReconcileMetadata(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+	source := testSourcePath()
+
+	cfg := &Config{
+		BucketName:        "example.com",
+		RegionName:        "eu-west-1",
+		ConfigFile:        filepath.Join(source, ".s3deploy.yml"),
+		MaxDelete:         300,
+		Silent:            true,
+		SourcePath:        source,
+		ReconcileMetadata: true,
+		baseStore:         store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed), fixed metadata of 1")
+	c.Assert(m["ab.txt"].(localFile).ContentType(), qt.Equals, "text/plain; charset=utf-8")
+
+	// All in sync.
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Reconciled, qt.Equals, uint64(0))
+}
+
+func TestDeployReconcileHeaders(t *testing.T) {
+	c := qt.New(t)
+	m := make(map[string]file)
+	source := c.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "main.css"), []byte("body { color: red; }"), 0o644), qt.IsNil)
+
+	newConfig := func(cacheControl string) *Config {
+		cfg := &Config{
+			BucketName:        "example.com",
+			RegionName:        "eu-west-1",
+			Silent:            true,
+			SourcePath:        source,
+			ReconcileMetadata: true,
+			baseStore:         newTestStoreFrom(m, 0),
+		}
+		cfg.fileConf.Routes = routes{{Route: `\.css$`, Headers: map[string]string{"Cache-Control": cacheControl}}}
+		return cfg
+	}
+
+	stats, err := Deploy(newConfig("max-age=60"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(1))
+
+	stats, err = Deploy(newConfig("max-age=60"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Reconciled, qt.Equals, uint64(0))
+
+	// Only the headers changed.
+	stats, err = Deploy(newConfig("max-age=3600"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(0))
+	c.Assert(stats.Reconciled, qt.Equals, uint64(1))
+	c.Assert(m["main.css"].(localFile).Headers()["Cache-Control"], qt.Equals, "max-age=3600")
+}
+
+func TestDeployReconcileMetadataFromRemoteFile(t *testing.T) {
+	c := qt.New(t)
+	m := make(map[string]file)
+	source := c.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "main.css"), []byte("body { color: red; }"), 0o644), qt.IsNil)
+
+	cfg := &Config{
+		BucketName:        "example.com",
+		RegionName:        "eu-west-1",
+		Silent:            true,
+		SourcePath:        source,
+		ReconcileMetadata: true,
+		baseStore:         newTestStoreFrom(m, 0),
+	}
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+
+	remote := &metadataTestFile{file: m["main.css"], meta: objectMetadata{ContentType: "text/plain"}}
+	m["main.css"] = remote
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Reconciled, qt.Equals, uint64(1))
+	c.Assert(remote.calls, qt.Equals, 1)
+}
+
+// metadataTestFile is a remote file carrying its own metadata.
+type metadataTestFile struct {
+	file
+	meta  objectMetadata
+	calls int
+}
+
+func (f *metadataTestFile) Metadata(ctx context.Context) (objectMetadata, error) {
+	f.calls++
+	return f.meta, nil
+}
+
+func TestObjectMetadataDiff(t *testing.T) {
+	c := qt.New(t)
+
+	remote := objectMetadata{
+		ContentType: "text/html; charset=UTF-8",
+		Headers:     map[string]string{"Cache-Control": "max-age=60", "Expires": "Mon, 01 Dec 2098 16:00:00 GMT", "X-Old": "a"},
+	}
+	wanted := objectMetadata{
+		ContentType: "text/html; charset=utf-8",
+		Headers:     map[string]string{"Cache-Control": "max-age=60", "Expires": normalizeExpires("Mon, 01 Dec 2098 16:00:00 GMT")},
+	}
+	c.Assert(remote.diff(wanted), qt.Equals, `X-Old "a" => ""`)
+	wanted.Headers["Cache-Control"] = "no-cache"
+	c.Assert(remote.diff(wanted), qt.Equals, `Cache-Control "max-age=60" => "no-cache", X-Old "a" => ""`)
+}
+
+func TestDeployReconcileMetadataTry(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+	source := testSourcePath()
+
+	cfg := &Config{
+		BucketName:        "example.com",
+		RegionName:        "eu-west-1",
+		ConfigFile:        filepath.Join(source, ".s3deploy.yml"),
+		MaxDelete:         300,
+		Silent:            true,
+		SourcePath:        source,
+		ReconcileMetadata: true,
+		Try:               true,
+		baseStore:         store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Reconciled, qt.Equals, uint64(1))
+	_, isTestFile := m["ab.txt"].(*testFile)
+	c.Assert(isTestFile, qt.IsTrue)
+}
+
+func TestDeploySameContentRecompressed(t *testing.T) {
+	c := qt.New(t)
+	m := make(map[string]file)
+	store := newTestStoreFrom(m, 0)
+	source := c.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(source, "index.html"), []byte(strings.Repeat("<p>Hello</p>", 100)), 0o644), qt.IsNil)
+
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: source,
+		baseStore:  store,
+	}
+	cfg.fileConf.Routes = routes{{Route: "^.+\\.html$", Gzip: true}}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(1))
+	c.Assert(m["index.html"].(localFile).Headers()[contentMD5Header], qt.Not(qt.Equals), "")
+
+	// Compressed by another version, same content.
+	m["index.html"] = recompressedFile{m["index.html"].(localFile)}
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(0))
+	c.Assert(stats.Skipped, qt.Equals, uint64(1))
+
+	// Changed content.
+	c.Assert(os.WriteFile(filepath.Join(source, "index.html"), []byte(strings.Repeat("<p>Hi</p>", 100)), 0o644), qt.IsNil)
+	stats, err = Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(1))
+}
+
+// recompressedFile is a file with the same content as its localFile,
+// but compressed differently.
+type recompressedFile struct {
+	localFile
+}
+
+func (f recompressedFile) ETag() string {
+	return `"recompressed"`
+}
+
+func TestDeployTimeout(t *testing.T) {
+	c := qt.New(t)
+	source := testSourcePath()
+
+	newConfig := func() *Config {
+		store, _ := newTestStore(0, "")
+		store.(*testStore).putDelay = time.Minute
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: source,
+			baseStore:  store,
+		}
+	}
+
+	cfg := newConfig()
+	cfg.Timeout = 50 * time.Millisecond
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, "deploy timed out after 50ms.*")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+
+	cfg = newConfig()
+	cfg.PutTimeout = 50 * time.Millisecond
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `upload of ".*" timed out after 50ms.*`)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+}
+
+func TestDeployReference(t *testing.T) {
+	c := qt.New(t)
+	store := newTestStoreFrom(make(map[string]file), 0)
+	reference := newTestStoreFrom(map[string]file{
+		"blue/ab.txt":    &testFile{key: "blue/ab.txt", etag: `"b86fc6b051f63d73de262d4c34e3a0a9"`, size: int64(2)},
+		"blue/main.css":  &testFile{key: "blue/main.css", etag: `"changed"`, size: int64(27)},
+		"blue/other.txt": &testFile{key: "blue/other.txt"},
+	}, 0)
+	source := testSourcePath()
+
+	cfg := &Config{
+		BucketName:     "example.com",
+		RegionName:     "eu-west-1",
+		ConfigFile:     filepath.Join(source, ".s3deploy.yml"),
+		BucketPath:     "green",
+		ReferencePath:  "blue",
+		MaxDelete:      300,
+		Silent:         true,
+		SourcePath:     source,
+		baseStore:      store,
+		referenceStore: reference,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 3, skipped 0 (100% changed), copied 1 from reference")
+	c.Assert(store.(*testStore).copied, qt.DeepEquals, []string{"example.com/blue/ab.txt"})
+	assertKeys(t, store.(*testStore).m, "green/.s3deploy.yml", "green/main.css", "green/index.html", "green/ab.txt")
+
+	// Same as target.
+	cfg = &Config{
+		BucketName:    "example.com",
+		BucketPath:    "green",
+		ReferencePath: "/green/",
+	}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "the reference bucket and path must be different from the target")
+}
+
+func TestWalkLocalSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need special privileges on Windows")
+	}
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "public")
+	shared := filepath.Join(dir, "shared")
+	for _, f := range []string{"public/index.html", "shared/css/main.css", "shared/logo.svg"} {
+		filename := filepath.Join(dir, f)
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte(f), 0o644), qt.IsNil)
+	}
+	c.Assert(os.Symlink(shared, filepath.Join(source, "assets")), qt.IsNil)
+	c.Assert(os.Symlink(filepath.Join(shared, "logo.svg"), filepath.Join(source, "logo.svg")), qt.IsNil)
+
+	walk := func(policy string) (map[string]int64, error) {
+		cfg := &Config{BucketName: "example.com", FollowSymlinks: policy}
+		c.Assert(cfg.Init(), qt.IsNil)
+		files := make(map[string]int64)
+		err := cfg.walkLocal(source, newPrinter(io.Discard), func(rel, abs string, info os.FileInfo) error {
+			files[filepath.ToSlash(rel)] = info.Size()
+			return nil
+		})
+		return files, err
+	}
+
+	files, err := walk("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(files, qt.DeepEquals, map[string]int64{
+		"index.html":          17,
+		"assets/css/main.css": 19,
+		"assets/logo.svg":     15,
+		"logo.svg":            15,
+	})
+
+	files, err = walk("skip")
+	c.Assert(err, qt.IsNil)
+	c.Assert(files, qt.DeepEquals, map[string]int64{"index.html": 17})
+
+	_, err = walk("error")
+	c.Assert(err, qt.ErrorMatches, `".*/assets" is a symlink, set -follow-symlinks to follow or skip symlinks`)
+
+	// A symlink to a parent directory.
+	c.Assert(os.Symlink(shared, filepath.Join(shared, "css", "loop")), qt.IsNil)
+	_, err = walk("follow")
+	c.Assert(err, qt.ErrorMatches, `symlink cycle: ".*/assets/css/loop" points to ".*/shared"`)
+
+	cfg := &Config{BucketName: "example.com", FollowSymlinks: "always"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -follow-symlinks "always", must be one of follow, skip and error`)
+}
+
+func TestWalkLocalNormalize(t *testing.T) {
+	c := qt.New(t)
+
+	const (
+		nfc = "caf\u00e9.html"
+		nfd = "cafe\u0301.html"
+	)
+
+	dir := t.TempDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, nfd), []byte("nfd"), 0o644), qt.IsNil)
+
+	var warnings bytes.Buffer
+	walk := func(normalize string) ([]string, error) {
+		cfg := &Config{BucketName: "example.com", Normalize: normalize}
+		c.Assert(cfg.Init(), qt.IsNil)
+		var keys []string
+		err := cfg.walkLocal(dir, newPrinter(&warnings), func(rel, abs string, info os.FileInfo) error {
+			keys = append(keys, rel)
+			return nil
+		})
+		sort.Strings(keys)
+		return keys, err
+	}
+
+	keys, err := walk("")
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.DeepEquals, []string{nfc})
+	keys, err = walk("nfd")
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.DeepEquals, []string{nfd})
+
+	if runtime.GOOS == "darwin" {
+		// APFS and HFS+ don't allow both forms side by side.
+		return
+	}
+	c.Assert(os.WriteFile(filepath.Join(dir, nfc), []byte("nfc"), 0o644), qt.IsNil)
+	_, err = walk("nfc")
+	c.Assert(err, qt.ErrorMatches, `".*" and ".*" have the same key "caf\x{00e9}.html" after Unicode normalization`)
+	c.Assert(warnings.String(), qt.Equals, "")
+	keys, err = walk("none")
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.DeepEquals, []string{nfd, nfc})
+	c.Assert(warnings.String(), qt.Matches, `WARNING: ".*" and ".*" only differ in their Unicode normalization and are uploaded as different keys\n`)
+
+	cfg := &Config{BucketName: "example.com", Normalize: "nfkc"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid -normalize "nfkc", must be one of nfc, nfd and none`)
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+func testSourcePath() string {
+	wd, _ := os.Getwd()
+	return filepath.Join(wd, "testdata") + "/"
+}
+
+func newTestStore(failAt int, root string) (remoteStore, map[string]file) {
+	m := map[string]file{
+		path.Join(root, "ab.txt"):       &testFile{key: path.Join(root, "ab.txt"), etag: `"b86fc6b051f63d73de262d4c34e3a0a9"`, size: int64(2)},
+		path.Join(root, "main.css"):     &testFile{key: path.Join(root, "main.css"), etag: `"changed"`, size: int64(27)},
+		path.Join(root, "deleteme.txt"): &testFile{},
+	}
+
+	return newTestStoreFrom(m, failAt), m
+}
+
+func newTestStoreFrom(m map[string]file, failAt int) remoteStore {
+	return &testStore{m: m, failAt: failAt}
+}
+
+type testStore struct {
+	failAt int
+	m      map[string]file
+
+	// Simulates slow uploads.
+	putDelay time.Duration
+
+	// Page size and page to fail at (once) in ListPage.
+	pageSize   int
+	listFailAt int
+
+	// Source keys passed to CopyFrom.
+	copied []string
+
+	// Keys passed to Put, in order.
+	putKeys []string
+
+	// Number of times Put should fail for a key, -1 for always.
+	putFailures map[string]int
+
+	// Keys to store with the wrong content in Put.
+	corrupt map[string]bool
+
+	// Paths passed to InvalidateCDNCache.
+	invalidated []string
+
+	// Objects in other buckets, keyed by bucket/key.
+	bucketObjects map[string][]byte
+
+	sync.Mutex
+}
+
+func assertKeys(t *testing.T, m map[string]file, keys ...string) {
+	for _, k := range keys {
+		if _, found := m[k]; !found {
+			t.Fatal("key not found:", k)
+		}
+	}
+
+	if len(keys) != len(m) {
+		t.Log(m)
+		t.Fatalf("map length mismatch: %d vs %d", len(keys), len(m))
+	}
+}
+
+func (s *testStore) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.failAt == 1 {
+		return nil, errors.New("fail")
+	}
+	c := make(map[string]file)
+	for k, v := range s.m {
+		c[k] = v
+	}
+	return c, nil
+}
+
+func (s *testStore) ListPage(ctx context.Context, token string) ([]file, string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pageSize := s.pageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+
+	var start int
+	if token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	if s.listFailAt > 0 && start/pageSize+1 == s.listFailAt {
+		s.listFailAt = 0
+		return nil, "", errors.New("fail")
+	}
+
+	end := start + pageSize
+	var next string
+	if end < len(keys) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+
+	files := make([]file, 0, end-start)
+	for _, k := range keys[start:end] {
+		files = append(files, s.m[k])
+	}
+
+	return files, next, nil
+}
+
+func (s *testStore) Put(ctx context.Context, f localFile, opts ...opOption) error {
+	if s.putDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.putDelay):
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.failAt == 2 {
+		return errors.New("fail")
+	}
+	if n := s.putFailures[f.Key()]; n != 0 {
+		if n > 0 {
+			s.putFailures[f.Key()] = n - 1
+		}
+		return fmt.Errorf("fail %s", f.Key())
+	}
+	if s.corrupt[f.Key()] {
+		s.m[f.Key()] = &testFile{key: f.Key(), size: 1}
+		return nil
+	}
+	s.m[f.Key()] = f
+	s.putKeys = append(s.putKeys, f.Key())
+	return nil
+}
+
+func (s *testStore) CopyFrom(ctx context.Context, srcBucket, srcKey string, f localFile) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.copied = append(s.copied, srcBucket+"/"+srcKey)
+	s.m[f.Key()] = f
+	return nil
+}
+
+func (s *testStore) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.failAt == 3 {
+		return errors.New("fail")
+	}
+	for _, k := range keys {
+		delete(s.m, k)
+	}
+	return nil
+}
+
+func (s *testStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, found := s.m[key]
+	if !found {
+		return nil, errObjectNotFound
+	}
+	lf, ok := f.(localFile)
+	if !ok {
+		return nil, nil
+	}
+	return io.ReadAll(lf.Content())
+}
+
+func (s *testStore) HeadObject(ctx context.Context, key string) (objectMetadata, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, found := s.m[key]
+	if !found {
+		return objectMetadata{}, errObjectNotFound
+	}
+	lf, ok := f.(localFile)
+	if !ok {
+		// Uploaded by some older tool without a content type.
+		return objectMetadata{ContentType: "binary/octet-stream", Size: f.Size(), ETag: f.ETag()}, nil
+	}
+	return localFileMetadata(lf), nil
+}
+
+func (s *testStore) InvalidateCDNCache(ctx context.Context, paths ...string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, p := range paths {
+		s.invalidated = append(s.invalidated, "/"+p)
+	}
+	return nil
+}
+
+func (s *testStore) InvalidatedPaths() []string {
+	return s.invalidated
+}
+
+func (s *testStore) InvalidationIDs() map[string]string {
+	return nil
+}
+
+func (s *testStore) GetBucketObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	b, found := s.bucketObjects[bucket+"/"+key]
+	if !found {
+		return nil, errObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *testStore) ListBucketPrefixes(ctx context.Context, bucket, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for k := range s.bucketObjects {
+		if !strings.HasPrefix(k, bucket+"/"+prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, bucket+"/"+prefix)
+		if i := strings.Index(rest, "/"); i != -1 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+func (s *testStore) UpdateMetadata(ctx context.Context, f localFile) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.m[f.Key()] = f
 	return nil
 }
 
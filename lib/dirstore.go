@@ -0,0 +1,186 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	_ remoteStore              = (*dirStore)(nil)
+	_ remoteObjectGetter       = (*dirStore)(nil)
+	_ remoteMetadataReconciler = (*dirStore)(nil)
+)
+
+// dirStore is a remoteStore deploying to a local directory, e.g. on
+// an NFS share or for previews, see -target.
+type dirStore struct {
+	dir        string
+	bucketPath string
+
+	// The index, loaded in FileMap, with the metadata
+	// that would otherwise be stored with the objects.
+	index *targetIndex
+}
+
+func newDirStore(cfg *Config, dir string) *dirStore {
+	return &dirStore{
+		dir:        dir,
+		bucketPath: cfg.BucketPath,
+		index:      newTargetIndex(),
+	}
+}
+
+type dirFile struct {
+	key  string
+	etag string
+	size int64
+}
+
+func (f *dirFile) Key() string {
+	return f.key
+}
+
+func (f *dirFile) ETag() string {
+	return f.etag
+}
+
+func (f *dirFile) Size() int64 {
+	return f.size
+}
+
+func (s *dirStore) filename(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *dirStore) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
+	if err := s.index.load(func() ([]byte, error) { return s.GetObject(ctx, targetIndexKey) }); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]file)
+	err := filepath.WalkDir(s.filename(s.bucketPath), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Not created yet.
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if key == targetIndexKey {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		m[key] = &dirFile{key: key, etag: s.index.etag(key, info.Size()), size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (s *dirStore) Put(ctx context.Context, f localFile, opts ...opOption) error {
+	filename := s.filename(f.Key())
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filename, f.Content()); err != nil {
+		return err
+	}
+
+	s.index.put(f)
+
+	return nil
+}
+
+func (s *dirStore) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
+	for _, key := range keys {
+		if err := os.Remove(s.filename(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeEmptyDirs(key, func(dir string) error {
+			return os.Remove(s.filename(dir))
+		})
+		s.index.delete(key)
+	}
+	return nil
+}
+
+func (s *dirStore) HeadObject(ctx context.Context, key string) (objectMetadata, error) {
+	fi, err := os.Stat(s.filename(key))
+	if err != nil {
+		return objectMetadata{}, err
+	}
+
+	m, found := s.index.get(key)
+	if !found || m.Size != fi.Size() {
+		// Not uploaded by us.
+		return objectMetadata{Size: fi.Size()}, nil
+	}
+	return m, nil
+}
+
+func (s *dirStore) UpdateMetadata(ctx context.Context, f localFile) error {
+	s.index.put(f)
+	return nil
+}
+
+func (s *dirStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	b, err := os.ReadFile(s.filename(key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return b, err
+}
+
+// Finalize writes the index if any files were changed.
+func (s *dirStore) Finalize(ctx context.Context) error {
+	return s.index.save(func(b []byte) error {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return err
+		}
+		return writeFileAtomic(s.filename(targetIndexKey), bytes.NewReader(b))
+	})
+}
+
+// writeFileAtomic writes the content of r to filename via a temporary
+// file, so readers never see a partially written file.
+func writeFileAtomic(filename string, r io.Reader) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
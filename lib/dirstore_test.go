@@ -0,0 +1,93 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployDir(t *testing.T) {
+	c := qt.New(t)
+	source := testSourcePath()
+	dir := t.TempDir()
+	target := filepath.ToSlash(dir)
+	if !strings.HasPrefix(target, "/") {
+		// file:///C:/...
+		target = "/" + target
+	}
+
+	newConfig := func() *Config {
+		return &Config{
+			Target:     "file://" + target,
+			BucketPath: "blog",
+			ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+			SourcePath: source,
+			MaxDelete:  300,
+			Silent:     true,
+		}
+	}
+
+	files := func() []string {
+		var files []string
+		c.Assert(filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+			return err
+		}), qt.IsNil)
+		sort.Strings(files)
+		return files
+	}
+
+	cfg := newConfig()
+	cfg.Try = true
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(files(), qt.HasLen, 0)
+
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(files(), qt.DeepEquals, []string{".s3deploy-index.json", "blog/.s3deploy.yml", "blog/ab.txt", "blog/index.html", "blog/main.css"})
+	b, err := os.ReadFile(filepath.Join(dir, "blog", "ab.txt"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "AB")
+
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 4 (0% changed)")
+
+	// Replaced by someone else, and a stale file.
+	c.Assert(os.WriteFile(filepath.Join(dir, "blog", "ab.txt"), []byte("ABC"), 0o644), qt.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "blog", "old"), 0o755), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "blog", "old", "deleteme.txt"), []byte("stale"), 0o644), qt.IsNil)
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 1, skipped 3 (40% changed)")
+	c.Assert(files(), qt.DeepEquals, []string{".s3deploy-index.json", "blog/.s3deploy.yml", "blog/ab.txt", "blog/index.html", "blog/main.css"})
+	_, err = os.Stat(filepath.Join(dir, "blog", "old"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	// The metadata is kept in the index.
+	s := newDirStore(newConfig(), dir)
+	_, err = s.FileMap(context.Background())
+	c.Assert(err, qt.IsNil)
+	m, err := s.HeadObject(context.Background(), "blog/main.css")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.ContentType, qt.Equals, "text/css; charset=utf-8")
+	c.Assert(m.Headers["Cache-Control"], qt.Equals, "max-age=630720000, no-transform, public")
+}
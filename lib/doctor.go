@@ -0,0 +1,443 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// The status of a DoctorCheck.
+const (
+	DoctorOK      = "ok"
+	DoctorWarning = "warning"
+	DoctorFailed  = "failed"
+	DoctorSkipped = "skipped"
+)
+
+// DoctorCheck is the result of one of the checks run by Doctor.
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// DoctorReport is the result of the checks run by Doctor, in order.
+type DoctorReport struct {
+	Bucket string        `json:"bucket"`
+	Path   string        `json:"path,omitempty"`
+	Checks []DoctorCheck `json:"checks"`
+}
+
+func (r *DoctorReport) add(name, status, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, DoctorCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, a...)})
+}
+
+// Failures returns the number of failed checks.
+func (r *DoctorReport) Failures() int {
+	var n int
+	for _, c := range r.Checks {
+		if c.Status == DoctorFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// String returns the report formatted as one line per check,
+// with the status, name and detail aligned in columns.
+func (r *DoctorReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Checked s3://%s\n\n", pathJoin(r.Bucket, r.Path))
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Status, c.Name, c.Detail)
+	}
+	w.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// doctorS3Handler is the subset of the S3 API used by Doctor.
+type doctorS3Handler interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// doctorProbeKey is the key, relative to the bucket path, used to check
+// the upload and delete permissions. It's never stored, see Doctor.
+const doctorProbeKey = ".s3deploy-doctor"
+
+// Doctor checks the configuration and the access to AWS needed to deploy,
+// without changing anything: the flags and the config file, the routes,
+// the credentials, the bucket and its region, the permissions to list,
+// upload and delete files and the access to the CloudFront distributions.
+// The upload permission is checked with a request that S3 rejects after
+// the authorization (the Content-MD5 doesn't match the content), and the
+// delete permission by deleting a file that doesn't exist.
+//
+// The returned error is only set if the checks could not be run,
+// see DoctorReport.Failures for the result.
+func Doctor(ctx context.Context, cfg *Config) (*DoctorReport, error) {
+	r := &DoctorReport{Bucket: cfg.BucketName, Path: cfg.BucketPath}
+
+	if err := cfg.Init(); err != nil {
+		r.add("config", DoctorFailed, "%s", err)
+		return r, nil
+	}
+	r.Path = cfg.BucketPath
+	if _, err := os.Stat(cfg.ConfigFile); err == nil {
+		r.add("config", DoctorOK, "%s with %d route(s)", cfg.ConfigFile, len(cfg.fileConf.Routes))
+	} else {
+		r.add("config", DoctorOK, "no config file")
+	}
+
+	r.checkRoutes(cfg)
+
+	const noAccess = "not checked without access to AWS"
+	skip := func(names ...string) (*DoctorReport, error) {
+		for _, name := range names {
+			r.add(name, DoctorSkipped, noAccess)
+		}
+		return r, nil
+	}
+
+	if !r.checkCredentials(ctx, cfg) {
+		return skip("bucket", "region", "list", "upload", "delete", "cloudfront")
+	}
+
+	awsConfig, err := newAWSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := cfg.doctorS3
+	if svc == nil {
+		svc = newS3Client(cfg, awsConfig)
+	}
+	if r.checkBucket(ctx, cfg, svc) {
+		r.checkRegion(ctx, cfg, svc)
+		r.checkS3Permissions(ctx, cfg, svc)
+	} else {
+		for _, name := range []string{"region", "list", "upload", "delete"} {
+			r.add(name, DoctorSkipped, "not checked without access to the bucket")
+		}
+	}
+
+	cf := cfg.doctorCloudFront
+	if cf == nil {
+		cf = cloudfront.NewFromConfig(awsConfig)
+	}
+	r.checkCloudFront(ctx, cfg, cf)
+
+	return r, nil
+}
+
+// checkRoutes warns about the routes not matching any of the local files,
+// most likely because of a mistake in the regular expression.
+func (r *DoctorReport) checkRoutes(cfg *Config) {
+	routes := cfg.fileConf.Routes
+	if len(routes) == 0 {
+		r.add("routes", DoctorSkipped, "no routes in the config file")
+		return
+	}
+
+	var paths []string
+	err := fs.WalkDir(cfg.sourceFS(), ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel != "." && cfg.skipLocalDirs("/"+rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !cfg.skipLocalFiles("/"+rel) && !cfg.shouldIgnoreLocal(rel) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		r.add("routes", DoctorSkipped, "failed to read the source: %s", err)
+		return
+	}
+
+	var unmatched []string
+	for _, route := range routes {
+		found := false
+		for _, p := range paths {
+			if route.routerRE.MatchString(p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, fmt.Sprintf("%q", route.Route))
+		}
+	}
+	if len(unmatched) > 0 {
+		r.add("routes", DoctorWarning, "route(s) %s match none of the %d files in %s", strings.Join(unmatched, ", "), len(paths), cfg.SourcePath)
+		return
+	}
+	r.add("routes", DoctorOK, "all %d route(s) match files in %s", len(routes), cfg.SourcePath)
+}
+
+// checkCredentials reports where the credentials are from and
+// who they belong to, and whether there are any.
+func (r *DoctorReport) checkCredentials(ctx context.Context, cfg *Config) bool {
+	var source string
+	switch {
+	case cfg.SSOProfile != "":
+		source = fmt.Sprintf("AWS SSO profile %q", cfg.SSOProfile)
+	case cfg.AccessKey != "":
+		source = "access key " + maskAccessKey(cfg.AccessKey)
+	case cfg.fileConf.Credentials != nil:
+		source = "the credentials command in the config file"
+	default:
+		r.add("credentials", DoctorFailed, "none found, set -key and -secret, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or -sso-profile")
+		return false
+	}
+	if cfg.MintSession {
+		source += ", with minted session credentials"
+	}
+	if cfg.RoleARN != "" {
+		source += ", assuming " + cfg.RoleARN
+	}
+
+	if err := cfg.initSession(ctx); err != nil {
+		r.add("credentials", DoctorFailed, "%s: %s", source, cfg.checkExpiredCredentials(err))
+		return false
+	}
+
+	client := cfg.stsClient
+	if client == nil {
+		var err error
+		if client, err = newSTSClient(cfg); err != nil {
+			r.add("credentials", DoctorFailed, "%s: %s", source, err)
+			return false
+		}
+	}
+	out, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		status := DoctorFailed
+		if cfg.EndpointURL != "" {
+			// S3 compatible services may not support STS.
+			status = DoctorWarning
+		}
+		r.add("credentials", status, "%s: %s", source, cfg.checkExpiredCredentials(err))
+		return status != DoctorFailed
+	}
+	identity := aws.ToString(out.Arn)
+	if identity == "" {
+		identity = "account " + aws.ToString(out.Account)
+	}
+	r.add("credentials", DoctorOK, "%s, authenticated as %s", source, identity)
+	return true
+}
+
+// maskAccessKey returns the access key ID with all but the first
+// and the last four characters masked, e.g. "AKIA…MPLE".
+func maskAccessKey(key string) string {
+	if len(key) <= 8 {
+		return "…"
+	}
+	return key[:4] + "…" + key[len(key)-4:]
+}
+
+// checkBucket checks that the bucket exists and can be accessed.
+func (r *DoctorReport) checkBucket(ctx context.Context, cfg *Config, svc doctorS3Handler) bool {
+	_, err := svc.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket:              aws.String(cfg.BucketName),
+		ExpectedBucketOwner: aws.String(cfg.ExpectedBucketOwner),
+	})
+	if err == nil {
+		r.add("bucket", DoctorOK, "%s exists", cfg.BucketName)
+		return true
+	}
+	switch doctorErrorCode(err) {
+	case "NotFound", "NoSuchBucket":
+		r.add("bucket", DoctorFailed, "%s does not exist, create it or set -create-bucket", cfg.BucketName)
+	case "Forbidden", "AccessDenied":
+		r.add("bucket", DoctorFailed, "access to %s denied, s3:ListBucket is needed, or the bucket is owned by another account", cfg.BucketName)
+	case "MovedPermanently", "PermanentRedirect":
+		r.add("bucket", DoctorFailed, "%s is not in %s, set -region to the bucket's region", cfg.BucketName, displayRegion(cfg.RegionName))
+	default:
+		r.add("bucket", DoctorFailed, "%s", cfg.checkExpiredCredentials(err))
+	}
+	return false
+}
+
+// checkRegion checks that -region is the region of the bucket.
+func (r *DoctorReport) checkRegion(ctx context.Context, cfg *Config, svc doctorS3Handler) {
+	out, err := svc.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket:              aws.String(cfg.BucketName),
+		ExpectedBucketOwner: aws.String(cfg.ExpectedBucketOwner),
+	})
+	if err != nil {
+		// Not needed to deploy.
+		r.add("region", DoctorWarning, "failed to get the bucket's region: %s", err)
+		return
+	}
+	region := bucketLocationRegion(out.LocationConstraint)
+	switch cfg.RegionName {
+	case region:
+		r.add("region", DoctorOK, "%s", region)
+	case "":
+		r.add("region", DoctorWarning, "the bucket is in %s, set -region to it", region)
+	default:
+		r.add("region", DoctorFailed, "-region is %s, but the bucket is in %s", cfg.RegionName, region)
+	}
+}
+
+// bucketLocationRegion returns the region of a bucket location constraint,
+// which is empty for us-east-1, and EU for the oldest buckets in eu-west-1.
+func bucketLocationRegion(c types.BucketLocationConstraint) string {
+	switch c {
+	case "":
+		return "us-east-1"
+	case types.BucketLocationConstraintEu:
+		return "eu-west-1"
+	}
+	return string(c)
+}
+
+func displayRegion(region string) string {
+	if region == "" {
+		return "the default region"
+	}
+	return region
+}
+
+// checkS3Permissions checks the permissions to list, upload and delete
+// files below the bucket path, without changing anything.
+func (r *DoctorReport) checkS3Permissions(ctx context.Context, cfg *Config, svc doctorS3Handler) {
+	bucket := aws.String(cfg.BucketName)
+	owner := aws.String(cfg.ExpectedBucketOwner)
+	key := strings.TrimPrefix(pathJoin(cfg.BucketPath, doctorProbeKey), "/")
+
+	_, err := svc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:              bucket,
+		Prefix:              aws.String(cfg.BucketPath),
+		MaxKeys:             1,
+		ExpectedBucketOwner: owner,
+	})
+	r.addPermission("list", "s3:ListBucket", err)
+
+	// S3 checks the Content-MD5 after the authorization,
+	// so this fails with BadDigest if the upload is allowed.
+	content := []byte("s3deploy doctor")
+	sum := md5.Sum(nil)
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:              bucket,
+		Key:                 aws.String(key),
+		Body:                bytes.NewReader(content),
+		ContentLength:       int64(len(content)),
+		ContentMD5:          aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		ExpectedBucketOwner: owner,
+	})
+	// If stored anyway, e.g. by an S3 compatible service not
+	// checking the digest, it's deleted below.
+	if code := doctorErrorCode(err); code == "BadDigest" || code == "InvalidDigest" {
+		err = nil
+	}
+	r.addPermission("upload", "s3:PutObject", err)
+
+	out, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: bucket,
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{{Key: aws.String(key)}},
+			Quiet:   true,
+		},
+		ExpectedBucketOwner: owner,
+	})
+	if err == nil && len(out.Errors) > 0 {
+		e := out.Errors[0]
+		err = &smithy.GenericAPIError{Code: aws.ToString(e.Code), Message: aws.ToString(e.Message)}
+	}
+	r.addPermission("delete", "s3:DeleteObject", err)
+}
+
+func (r *DoctorReport) addPermission(name, action string, err error) {
+	switch {
+	case err == nil:
+		r.add(name, DoctorOK, "%s allowed", action)
+	case doctorErrorCode(err) == "AccessDenied" || doctorErrorCode(err) == "Forbidden":
+		r.add(name, DoctorFailed, "%s denied", action)
+	default:
+		r.add(name, DoctorFailed, "%s: %s", action, err)
+	}
+}
+
+// checkCloudFront checks the access to the CloudFront distributions
+// and that they serve the bucket.
+func (r *DoctorReport) checkCloudFront(ctx context.Context, cfg *Config, cf cloudfrontHandler) {
+	if len(cfg.CDNDistributionIDs) == 0 {
+		r.add("cloudfront", DoctorSkipped, "no -distribution-id set")
+		return
+	}
+	for _, s := range cfg.CDNDistributionIDs {
+		id, _, _ := strings.Cut(s, ":")
+		name := "cloudfront " + id
+		out, err := cf.GetDistribution(ctx, &cloudfront.GetDistributionInput{Id: aws.String(id)})
+		if err != nil {
+			switch doctorErrorCode(err) {
+			case "AccessDenied":
+				r.add(name, DoctorFailed, "cloudfront:GetDistribution denied, it's needed for the invalidations")
+			case "NoSuchDistribution":
+				r.add(name, DoctorFailed, "the distribution does not exist")
+			default:
+				r.add(name, DoctorFailed, "%s", err)
+			}
+			continue
+		}
+		d := out.Distribution
+		if !distributionServesBucket(d, cfg.BucketName) {
+			r.add(name, DoctorWarning, "%s has no origin in %s", aws.ToString(d.DomainName), cfg.BucketName)
+			continue
+		}
+		r.add(name, DoctorOK, "%s", aws.ToString(d.DomainName))
+	}
+}
+
+func distributionServesBucket(d *cftypes.Distribution, bucket string) bool {
+	if d == nil || d.DistributionConfig == nil || d.DistributionConfig.Origins == nil {
+		return false
+	}
+	for _, o := range d.DistributionConfig.Origins.Items {
+		if isBucketOrigin(aws.ToString(o.DomainName), bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// doctorErrorCode returns the error code of an AWS API error, else "".
+func doctorErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+var _ remoteEdgeFunction = (*edgeFunctionClient)(nil)
+
+// maxEdgeFunctionSize is the maximum size of a CloudFront Function.
+const maxEdgeFunctionSize = 10 << 10
+
+// redirect is a redirect configured in the redirects
+// section of the config file.
+type redirect struct {
+	// The request path, e.g. "/old/".
+	From string `yaml:"from"`
+	// The path or URL to redirect to.
+	To string `yaml:"to"`
+	// One of 301 (the default), 302, 307 and 308.
+	Status int `yaml:"status"`
+}
+
+var redirectStatusTexts = map[int]string{
+	301: "Moved Permanently",
+	302: "Found",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+}
+
+func (r *redirect) init() error {
+	if !strings.HasPrefix(r.From, "/") {
+		return fmt.Errorf("redirect: from %q must start with a slash", r.From)
+	}
+	if r.To == "" {
+		return fmt.Errorf("redirect %q: to must be set", r.From)
+	}
+	if r.Status == 0 {
+		r.Status = 301
+	}
+	if _, ok := redirectStatusTexts[r.Status]; !ok {
+		return fmt.Errorf("redirect %q: invalid status %d", r.From, r.Status)
+	}
+	return nil
+}
+
+// remoteEdgeFunction is implemented by stores that can
+// update the CloudFront Function in front of the site.
+type remoteEdgeFunction interface {
+	UpdateEdgeFunction(ctx context.Context, code []byte) error
+}
+
+type functionHandler interface {
+	DescribeFunction(ctx context.Context, params *cloudfront.DescribeFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.DescribeFunctionOutput, error)
+	GetFunction(ctx context.Context, params *cloudfront.GetFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetFunctionOutput, error)
+	UpdateFunction(ctx context.Context, params *cloudfront.UpdateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateFunctionOutput, error)
+	PublishFunction(ctx context.Context, params *cloudfront.PublishFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.PublishFunctionOutput, error)
+}
+
+// edgeFunctionClient updates and publishes an existing CloudFront Function.
+type edgeFunctionClient struct {
+	name string
+
+	logger printer
+	cf     functionHandler
+}
+
+func newEdgeFunctionClient(handler functionHandler, logger printer, cfg *Config) (*edgeFunctionClient, error) {
+	if cfg.CloudFrontFunction == "" {
+		return nil, errors.New("must provide a CloudFront Function name")
+	}
+	return &edgeFunctionClient{
+		name:   cfg.CloudFrontFunction,
+		logger: logger,
+		cf:     handler,
+	}, nil
+}
+
+func (c *edgeFunctionClient) UpdateEdgeFunction(ctx context.Context, code []byte) error {
+	live, err := c.cf.GetFunction(ctx, &cloudfront.GetFunctionInput{
+		Name:  aws.String(c.name),
+		Stage: types.FunctionStageLive,
+	})
+	if err == nil && bytes.Equal(live.FunctionCode, code) {
+		// Nothing to do.
+		return nil
+	}
+
+	desc, err := c.cf.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+		Name:  aws.String(c.name),
+		Stage: types.FunctionStageDevelopment,
+	})
+	if err != nil {
+		return err
+	}
+	if desc.FunctionSummary == nil || desc.FunctionSummary.FunctionConfig == nil {
+		return fmt.Errorf("CloudFront Function %q has no config", c.name)
+	}
+
+	c.logger.Printf("Update and publish CloudFront Function %s\n", c.name)
+
+	updated, err := c.cf.UpdateFunction(ctx, &cloudfront.UpdateFunctionInput{
+		Name:           aws.String(c.name),
+		IfMatch:        desc.ETag,
+		FunctionConfig: desc.FunctionSummary.FunctionConfig,
+		FunctionCode:   code,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.cf.PublishFunction(ctx, &cloudfront.PublishFunctionInput{
+		Name:    aws.String(c.name),
+		IfMatch: updated.ETag,
+	})
+	return err
+}
+
+// edgeFunctionCode returns the code of a CloudFront Function (cloudfront-js-1.0)
+// that serves the redirects and, with cleanURLs, rewrites directory
+// requests (e.g. "/blog" and "/blog/") to their index.html.
+func edgeFunctionCode(redirects []*redirect, cleanURLs bool) ([]byte, error) {
+	type target struct {
+		To     string `json:"to"`
+		Status int    `json:"status"`
+		Text   string `json:"text"`
+	}
+	m := make(map[string]target)
+	for _, r := range redirects {
+		m[r.From] = target{To: r.To, Status: r.Status, Text: redirectStatusTexts[r.Status]}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Generated by s3deploy, do not edit.\n")
+	fmt.Fprintf(&buf, "var redirects = %s;\n", b)
+	fmt.Fprintf(&buf, "var cleanURLs = %t;\n", cleanURLs)
+	buf.WriteString(`
+function handler(event) {
+  var request = event.request;
+  var r = redirects[request.uri];
+  if (r) {
+    return {
+      statusCode: r.status,
+      statusDescription: r.text,
+      headers: { location: { value: r.to } }
+    };
+  }
+  if (cleanURLs) {
+    var uri = request.uri;
+    if (uri.charAt(uri.length - 1) === "/") {
+      request.uri = uri + "index.html";
+    } else if (uri.substring(uri.lastIndexOf("/")).indexOf(".") === -1) {
+      request.uri = uri + "/index.html";
+    }
+  }
+  return request;
+}
+`)
+
+	if buf.Len() > maxEdgeFunctionSize {
+		return nil, fmt.Errorf("the CloudFront Function for %d redirects is %d bytes, the maximum is %d", len(redirects), buf.Len(), maxEdgeFunctionSize)
+	}
+
+	return buf.Bytes(), nil
+}
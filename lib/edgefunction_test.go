@@ -0,0 +1,110 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRedirectInit(t *testing.T) {
+	c := qt.New(t)
+
+	r := &redirect{From: "/old/", To: "/new/"}
+	c.Assert(r.init(), qt.IsNil)
+	c.Assert(r.Status, qt.Equals, 301)
+
+	c.Assert((&redirect{From: "old/", To: "/new/"}).init(), qt.ErrorMatches, `redirect: from "old/" must start with a slash`)
+	c.Assert((&redirect{From: "/old/"}).init(), qt.ErrorMatches, `redirect "/old/": to must be set`)
+	c.Assert((&redirect{From: "/old/", To: "/new/", Status: 200}).init(), qt.ErrorMatches, `redirect "/old/": invalid status 200`)
+}
+
+func TestEdgeFunctionCode(t *testing.T) {
+	c := qt.New(t)
+
+	code, err := edgeFunctionCode([]*redirect{
+		{From: "/old/", To: "/new/", Status: 301},
+		{From: "/tmp", To: "https://example.org/?a=b&c=d", Status: 302},
+	}, true)
+	c.Assert(err, qt.IsNil)
+	s := string(code)
+	c.Assert(s, qt.Contains, `"/old/":{"to":"/new/","status":301,"text":"Moved Permanently"}`)
+	c.Assert(s, qt.Contains, `"/tmp":{"to":"https://example.org/?a=b\u0026c=d","status":302,"text":"Found"}`)
+	c.Assert(s, qt.Contains, "var cleanURLs = true;")
+	c.Assert(s, qt.Contains, "function handler(event)")
+
+	code, err = edgeFunctionCode(nil, false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(code), qt.Contains, "var redirects = {};\nvar cleanURLs = false;")
+
+	var many []*redirect
+	for i := 0; i < 500; i++ {
+		many = append(many, &redirect{From: fmt.Sprintf("/some/old/page-%d/", i), To: "/", Status: 301})
+	}
+	_, err = edgeFunctionCode(many, false)
+	c.Assert(err, qt.ErrorMatches, `the CloudFront Function for 500 redirects is \d+ bytes, the maximum is 10240`)
+}
+
+type mockFunctionHandler struct {
+	live    []byte
+	updated []byte
+	calls   []string
+}
+
+func (h *mockFunctionHandler) DescribeFunction(ctx context.Context, params *cloudfront.DescribeFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.DescribeFunctionOutput, error) {
+	h.calls = append(h.calls, "describe")
+	return &cloudfront.DescribeFunctionOutput{
+		ETag: aws.String("E1"),
+		FunctionSummary: &types.FunctionSummary{
+			FunctionConfig: &types.FunctionConfig{Comment: aws.String("redirects"), Runtime: types.FunctionRuntimeCloudfrontJs10},
+		},
+	}, nil
+}
+
+func (h *mockFunctionHandler) GetFunction(ctx context.Context, params *cloudfront.GetFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetFunctionOutput, error) {
+	h.calls = append(h.calls, "get")
+	return &cloudfront.GetFunctionOutput{FunctionCode: h.live}, nil
+}
+
+func (h *mockFunctionHandler) UpdateFunction(ctx context.Context, params *cloudfront.UpdateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateFunctionOutput, error) {
+	h.calls = append(h.calls, "update "+*params.IfMatch)
+	h.updated = params.FunctionCode
+	return &cloudfront.UpdateFunctionOutput{ETag: aws.String("E2")}, nil
+}
+
+func (h *mockFunctionHandler) PublishFunction(ctx context.Context, params *cloudfront.PublishFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.PublishFunctionOutput, error) {
+	h.calls = append(h.calls, "publish "+*params.IfMatch)
+	h.live = h.updated
+	return &cloudfront.PublishFunctionOutput{}, nil
+}
+
+func TestEdgeFunctionClient(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := newEdgeFunctionClient(&mockFunctionHandler{}, newPrinter(io.Discard), &Config{})
+	c.Assert(err, qt.IsNotNil)
+
+	handler := &mockFunctionHandler{live: []byte("old")}
+	client, err := newEdgeFunctionClient(handler, newPrinter(io.Discard), &Config{CloudFrontFunction: "my-site"})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(client.UpdateEdgeFunction(context.Background(), []byte("new")), qt.IsNil)
+	c.Assert(strings.Join(handler.calls, ","), qt.Equals, "get,describe,update E1,publish E2")
+	c.Assert(string(handler.live), qt.Equals, "new")
+
+	// Unchanged.
+	handler.calls = nil
+	c.Assert(client.UpdateEdgeFunction(context.Background(), []byte("new")), qt.IsNil)
+	c.Assert(handler.calls, qt.DeepEquals, []string{"get"})
+}
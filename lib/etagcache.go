@@ -0,0 +1,252 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dsnet/golib/memfile"
+)
+
+// etagCacheVersion is stored in the cache and must be
+// bumped when the processing of the local files changes.
+const etagCacheVersion = 1
+
+// etagCacheEntry is what's stored about a local file in the ETag cache.
+type etagCacheEntry struct {
+	// The size and modification time (in nanoseconds) of the file on disk.
+	Size  int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+	// A hash of the settings used to process the file, see etagCacheConfig.
+	Config string `json:"config"`
+
+	// The content type detected before any route overrides,
+	// used to select the route.
+	ContentType     string `json:"contentType"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	ContentMD5      string `json:"contentMD5,omitempty"`
+	// The size after any processing, and after any compression.
+	RawSize    int64  `json:"rawSize"`
+	UploadSize int64  `json:"uploadSize"`
+	ETag       string `json:"etag"`
+	// Set for files uploaded in blocks (route.Delta).
+	Blocks string `json:"blocks,omitempty"`
+}
+
+type etagCacheData struct {
+	Version int                       `json:"version"`
+	Source  string                    `json:"source"`
+	Files   map[string]etagCacheEntry `json:"files"`
+}
+
+// etagCache is a local file with the ETags of the local files calculated
+// in the previous deploy from the same directory (-etag-cache), so the files
+// not modified since aren't read, processed and compressed again unless they
+// need to be uploaded.
+type etagCache struct {
+	filename string
+	source   string
+
+	mu sync.Mutex
+	// The files as of the previous deploy.
+	prev map[string]etagCacheEntry
+	// The files seen in this deploy.
+	files map[string]etagCacheEntry
+}
+
+// etagCacheFilename returns the ETag cache filename to use for cfg.
+func etagCacheFilename(cfg *Config) (string, error) {
+	if cfg.ETagCacheFile != "" {
+		return cfg.ETagCacheFile, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	source, err := filepath.Abs(cfg.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(source))
+	return filepath.Join(cacheDir, "s3deploy", "etags", hex.EncodeToString(h[:8])+".json"), nil
+}
+
+// loadETagCache loads the ETag cache for cfg, starting
+// a new one if none or an outdated one exists.
+func loadETagCache(cfg *Config) (*etagCache, error) {
+	filename, err := etagCacheFilename(cfg)
+	if err != nil {
+		return nil, err
+	}
+	source, err := filepath.Abs(cfg.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	c := &etagCache{
+		filename: filename,
+		source:   source,
+		files:    make(map[string]etagCacheEntry),
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	var data etagCacheData
+	if err := json.Unmarshal(b, &data); err != nil || data.Version != etagCacheVersion || data.Source != source {
+		// Start over.
+		return c, nil
+	}
+	c.prev = data.Files
+
+	return c, nil
+}
+
+// etagCacheConfig returns a hash of the settings that
+// change the processed content of a file on route r.
+func etagCacheConfig(cfg *Config, r *route) string {
+	b, _ := json.Marshal(struct {
+		Hash             string
+		GzipLevel        int
+		PreferSystemMIME bool
+		Route            *route
+	}{cfg.Hash, cfg.GzipLevel, cfg.PreferSystemMIME, r})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newETagCacheEntry returns the entry for a file read from disk,
+// to be completed by put once its ETag is calculated.
+func newETagCacheEntry(cfg *Config, r *route, detectedContentType string, fi os.FileInfo) *etagCacheEntry {
+	return &etagCacheEntry{
+		Size:        fi.Size(),
+		Mtime:       fi.ModTime().UnixNano(),
+		Config:      etagCacheConfig(cfg, r),
+		ContentType: detectedContentType,
+	}
+}
+
+// get returns the file relPath from the cache, with its content to
+// be read when needed, or nil if it's not cached or modified since.
+func (c *etagCache) get(cfg *Config, relPath, absPath string, fi os.FileInfo) *osFile {
+	if c == nil {
+		return nil
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	c.mu.Lock()
+	e, found := c.prev[relPath]
+	c.mu.Unlock()
+	if !found || e.Size != fi.Size() || e.Mtime != fi.ModTime().UnixNano() {
+		return nil
+	}
+
+	route := cfg.fileConf.getRoute(relPath, e.ContentType, fi.Size())
+	if e.Config != etagCacheConfig(cfg, route) {
+		return nil
+	}
+
+	keyPath := relPath
+	if cfg.StripIndexHTML {
+		keyPath = trimIndexHTML(keyPath)
+	}
+
+	of := &osFile{
+		route:           route,
+		targetRoot:      cfg.BucketPath,
+		absPath:         absPath,
+		relPath:         relPath,
+		keyPath:         keyPath,
+		size:            e.UploadSize,
+		rawSize:         e.RawSize,
+		contentType:     e.ContentType,
+		contentEncoding: e.ContentEncoding,
+		contentMD5:      e.ContentMD5,
+		hasher:          cfg.hasher,
+		etag:            e.ETag,
+		cacheEntry:      &e,
+		load: func() (*memfile.File, error) {
+			f, err := readOSFile(cfg, relPath, absPath, fi)
+			if err != nil {
+				return nil, err
+			}
+			return f.f, nil
+		},
+	}
+
+	if cfg.PreserveMtime {
+		of.mtime = formatMtime(fi.ModTime())
+	}
+
+	of.delta = route != nil && route.Delta && of.contentEncoding == "" && isDeltaSize(of.size)
+	if of.delta {
+		if of.blocks = parseDeltaBlocks(e.Blocks); of.blocks == nil {
+			return nil
+		}
+	}
+	// The ETag is already known.
+	of.etagInit.Do(func() {})
+
+	if err := of.initContentType(); err != nil {
+		return nil
+	}
+
+	return of
+}
+
+// put records f, with its ETag calculated, to be stored in the cache.
+func (c *etagCache) put(f *osFile) {
+	if c == nil || f.cacheEntry == nil {
+		return
+	}
+	e := *f.cacheEntry
+	e.ETag = f.ETag()
+	e.Blocks = ""
+	if f.delta {
+		e.Blocks = f.deltaBlocks().String()
+	}
+	e.RawSize = f.rawSize
+	e.UploadSize = f.size
+	e.ContentEncoding = f.contentEncoding
+	e.ContentMD5 = f.contentMD5
+
+	c.mu.Lock()
+	c.files[f.relPath] = e
+	c.mu.Unlock()
+}
+
+// save writes the files put in this deploy to the cache file,
+// leaving out any files removed since the previous deploy.
+func (c *etagCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	b, err := json.Marshal(etagCacheData{Version: etagCacheVersion, Source: c.source, Files: c.files})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a failed write
+	// doesn't leave a partial cache behind.
+	tmp := c.filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
+}
@@ -0,0 +1,84 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployETagCache(t *testing.T) {
+	c := qt.New(t)
+
+	source := testSourcePath()
+	cacheFile := filepath.Join(t.TempDir(), "etags.json")
+	store, m := newTestStore(0, "")
+	newConfig := func() *Config {
+		return &Config{
+			BucketName:    "example.com",
+			RegionName:    "eu-west-1",
+			ConfigFile:    filepath.Join(source, ".s3deploy.yml"),
+			MaxDelete:     300,
+			Silent:        true,
+			SourcePath:    source,
+			ETagCache:     true,
+			ETagCacheFile: cacheFile,
+			baseStore:     store,
+		}
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+
+	cfg := newConfig()
+	c.Assert(cfg.Init(), qt.IsNil)
+	cache, err := loadETagCache(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cache.prev, qt.HasLen, 4)
+
+	filename := filepath.Join(source, "main.css")
+	fi, err := os.Stat(filename)
+	c.Assert(err, qt.IsNil)
+
+	// The cached file isn't read until its content is needed.
+	cached := cache.get(cfg, "main.css", filename, fi)
+	c.Assert(cached, qt.IsNotNil)
+	c.Assert(cached.f, qt.IsNil)
+	read, err := readOSFile(cfg, "main.css", filename, fi)
+	c.Assert(err, qt.IsNil)
+	c.Assert(cached.ETag(), qt.Equals, read.ETag())
+	c.Assert(cached.Size(), qt.Equals, read.Size())
+	c.Assert(cached.ContentType(), qt.Equals, read.ContentType())
+	c.Assert(cached.Headers(), qt.DeepEquals, read.Headers())
+	b, err := io.ReadAll(cached.Content())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "ABC")
+
+	// Modified files are read again.
+	c.Assert(cache.get(cfg, "main.css", filename, modTimeFileInfo{fi, fi.ModTime().Add(time.Second)}), qt.IsNil)
+	cfg.GzipLevel = 1
+	c.Assert(cache.get(cfg, "main.css", filename, fi), qt.IsNil)
+
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 4 (0% changed)")
+	assertKeys(t, m, ".s3deploy.yml", "main.css", "index.html", "ab.txt")
+}
+
+type modTimeFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (fi modTimeFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
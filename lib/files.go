@@ -15,8 +15,11 @@ import (
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/dsnet/golib/memfile"
@@ -26,6 +29,7 @@ var (
 	_ file      = (*osFile)(nil)
 	_ localFile = (*osFile)(nil)
 	_ reasoner  = (*osFile)(nil)
+	_ localFile = (*memoryFile)(nil)
 )
 
 type file interface {
@@ -61,16 +65,63 @@ type osFile struct {
 	targetRoot string
 
 	reason uploadReason
+	// The route stats this file is counted in.
+	stats *RouteStats
+	// The remote file with the same key, if any.
+	remote file
+
+	// Set when the file is unchanged, but its remote metadata
+	// should be checked (-reconcile-metadata).
+	reconcile bool
+
+	// Set to the reference key when the file should be copied
+	// from the reference bucket instead of uploaded.
+	copyFrom string
+
+	// Set to the key of a remote file to be deleted with the same content,
+	// to copy the file from server side instead of uploading it (-detect-moves).
+	moveFrom string
+
+	// Set when the file has the same content as another file uploaded
+	// in this deploy, to copy it from server side (-dedupe).
+	duplicateOf *osFile
+	// Set when the file is uploaded.
+	uploaded bool
 
 	absPath string
 	size    int64
+	// The size before any compression.
+	rawSize int64
 
 	etag     string
 	etagInit sync.Once
 
 	contentType string
+	// Set when the content is compressed.
+	contentEncoding string
+	// The MD5 of the uncompressed content, set when the content is compressed.
+	contentMD5 string
+	// The local modification time, set with -preserve-mtime.
+	mtime string
+
+	// Set when the file is uploaded in blocks (route.Delta),
+	// with blocks set together with the ETag.
+	delta  bool
+	blocks deltaBlocks
+
+	// The hasher of the ETag (-hash), nil for MD5.
+	hasher contentHasher
 
 	f *memfile.File
+	// Set when the content is read when needed, see etagCache.get.
+	load     func() (*memfile.File, error)
+	loadInit sync.Once
+	loadErr  error
+	// The entry to store in the ETag cache (-etag-cache), nil if not used.
+	cacheEntry *etagCacheEntry
+
+	// The room taken in the buffer budget (-max-buffer).
+	buffered int64
 
 	route *route
 }
@@ -89,7 +140,14 @@ func (f *osFile) UploadReason() uploadReason {
 func (f *osFile) ETag() string {
 	f.etagInit.Do(func() {
 		var err error
-		f.etag, err = calculateETag(f.Content())
+		if f.delta {
+			f.blocks, err = calculateDeltaBlocks(f.Content())
+			f.etag = f.blocks.etag()
+		} else if f.hasher != nil {
+			f.etag, err = calculateHash(f.hasher, f.Content())
+		} else {
+			f.etag, err = calculateETag(f.Content())
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -97,6 +155,23 @@ func (f *osFile) ETag() string {
 	return f.etag
 }
 
+// remoteETag returns the ETag of the remote object to compare with f's, or,
+// with a hasher set (-hash), the hash in its metadata, looked up with meta.
+func (f *osFile) remoteETag(etag string, meta func(key string) string) string {
+	if f.hasher == nil {
+		return etag
+	}
+	return "\"" + meta(hashHeader(f.hasher)) + "\""
+}
+
+func (f *osFile) deltaBlocks() deltaBlocks {
+	if !f.delta {
+		return nil
+	}
+	f.ETag()
+	return f.blocks
+}
+
 func (f *osFile) Size() int64 {
 	return f.size
 }
@@ -106,20 +181,63 @@ func (f *osFile) ContentType() string {
 }
 
 func (f *osFile) Content() io.ReadSeeker {
+	if err := f.loadContent(); err != nil {
+		return errReadSeeker{err: err}
+	}
 	f.f.Seek(0, 0)
 	return f.f
 }
 
+// loadContent reads the content of a file from the ETag cache.
+func (f *osFile) loadContent() error {
+	f.loadInit.Do(func() {
+		if f.f == nil && f.load != nil {
+			f.f, f.loadErr = f.load()
+		}
+	})
+	return f.loadErr
+}
+
+// errReadSeeker is the content of a file that failed to be read.
+type errReadSeeker struct {
+	err error
+}
+
+func (r errReadSeeker) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, r.err
+}
+
 func (f *osFile) Headers() map[string]string {
 	headers := map[string]string{}
 
+	if f.contentEncoding != "" {
+		headers["Content-Encoding"] = f.contentEncoding
+	}
+
+	if f.contentMD5 != "" {
+		headers[contentMD5Header] = f.contentMD5
+	}
+
+	if f.mtime != "" {
+		headers[mtimeHeader] = f.mtime
+	}
+
+	if f.delta {
+		headers[deltaBlocksHeader] = f.deltaBlocks().String()
+	}
+
+	if f.hasher != nil {
+		headers[hashHeader(f.hasher)] = strings.Trim(f.ETag(), `"`)
+	}
+
 	if f.route != nil {
-		if f.route.Gzip {
-			headers["Content-Encoding"] = "gzip"
-		}
 
-		if f.route.Headers != nil {
-			for k, v := range f.route.Headers {
+		if h := f.route.headers(); h != nil {
+			for k, v := range h {
 				headers[k] = v
 			}
 		}
@@ -128,27 +246,13 @@ func (f *osFile) Headers() map[string]string {
 	return headers
 }
 
-func (f *osFile) initContentType(peek []byte) error {
+func (f *osFile) initContentType() error {
 	if f.route != nil {
-		if contentType, found := f.route.Headers["Content-Type"]; found {
+		if contentType, found := f.route.headers()["Content-Type"]; found {
 			f.contentType = contentType
-			return nil
 		}
 	}
 
-	contentType := mime.TypeByExtension(filepath.Ext(f.relPath))
-	if contentType != "" {
-		f.contentType = contentType
-		return nil
-	}
-
-	// Have to look inside the file itself.
-	if peek != nil {
-		f.contentType = detectContentTypeFromContent(peek)
-	} else {
-		f.contentType = detectContentTypeFromContent(f.f.Bytes())
-	}
-
 	return nil
 }
 
@@ -170,6 +274,11 @@ func (f *osFile) shouldThisReplace(other file) (bool, uploadReason) {
 		return true, reasonSize
 	}
 
+	if f.hasher != nil {
+		// The hash in the remote metadata is checked in sameContent.
+		return true, reasonHash
+	}
+
 	if f.ETag() != other.ETag() {
 		return true, reasonETag
 	}
@@ -178,61 +287,245 @@ func (f *osFile) shouldThisReplace(other file) (bool, uploadReason) {
 }
 
 func newOSFile(cfg *Config, relPath, absPath string, fi os.FileInfo) (*osFile, error) {
+	if of := cfg.etagCache.get(cfg, relPath, absPath, fi); of != nil {
+		return of, nil
+	}
+	return readOSFile(cfg, relPath, absPath, fi)
+}
+
+// readOSFile reads and processes the local file at absPath.
+func readOSFile(cfg *Config, relPath, absPath string, fi os.FileInfo) (*osFile, error) {
 	targetRoot := cfg.BucketPath
-	routes := cfg.fileConf.Routes
 
 	relPath = filepath.ToSlash(relPath)
 
-	file, err := os.Open(absPath)
+	file, err := cfg.openSource(absPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open %q: %s", absPath, err)
 	}
 	defer file.Close()
 
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
 	var (
 		mFile *memfile.File
 		size  = fi.Size()
-		peek  []byte
 	)
 
-	route := routes.get(relPath)
-
-	if route != nil && route.Gzip {
-		var b bytes.Buffer
-		gz := gzip.NewWriter(&b)
-		io.Copy(gz, file)
-		gz.Close()
-		mFile = memfile.New(b.Bytes())
-		size = int64(b.Len())
-		peek = make([]byte, 512)
-		file.Read(peek)
-	} else {
-		b, err := io.ReadAll(file)
+	// The detected content type is used to select the route,
+	// the route may in turn override it.
+	detectedContentType := typeByExtension(filepath.Ext(relPath), cfg.PreferSystemMIME)
+	if detectedContentType == "" {
+		detectedContentType = detectContentTypeFromContent(b)
+	}
+
+	route := cfg.fileConf.getRoute(relPath, detectedContentType, size)
+
+	keyPath := relPath
+	if cfg.fingerprinter != nil {
+		if b, err = cfg.fingerprinter.rewrite(relPath, detectedContentType, b); err != nil {
+			return nil, err
+		}
+		keyPath = cfg.fingerprinter.keyPath(relPath)
+		size = int64(len(b))
+	}
+
+	if route != nil && (route.Minify || len(route.processors) > 0) {
+		processors := route.processors
+		if route.Minify {
+			processors = append([]processor{processorFunc(minifyContent)}, processors...)
+		}
+		mediaType := strings.TrimSpace(strings.Split(detectedContentType, ";")[0])
+		if b, err = processContent(processors, mediaType, b); err != nil {
+			return nil, fmt.Errorf("failed to process %q: %s", relPath, err)
+		}
+		size = int64(len(b))
+	}
+	rawSize := size
+
+	var contentEncoding, contentMD5 string
+	encoding := route.contentEncoding()
+	if encoding != "" && !route.GzipIncompressible && isIncompressible(detectedContentType, filepath.Ext(relPath)) {
+		// E.g. images and fonts; compressing them again is wasted effort.
+		encoding = ""
+	}
+	if encoding != "" && size >= route.GzipMinSize {
+		level := cfg.GzipLevel
+		if route.GzipLevel != 0 {
+			level = route.GzipLevel
+		}
+		compressed, err := compress(encoding, level, b)
 		if err != nil {
 			return nil, err
 		}
+		// Small files may get bigger when compressed.
+		if len(compressed) < len(b) {
+			mFile = memfile.New(compressed)
+			size = int64(len(compressed))
+			contentEncoding = encoding
+			if cfg.hasher == nil {
+				contentMD5 = md5Hex(b)
+			}
+		}
+	}
+	if mFile == nil {
 		mFile = memfile.New(b)
 	}
 
-	keyPath := relPath
 	if cfg.StripIndexHTML {
 		keyPath = trimIndexHTML(keyPath)
 	}
 
-	of := &osFile{route: route, f: mFile, targetRoot: targetRoot, absPath: absPath, relPath: relPath, keyPath: keyPath, size: size}
+	of := &osFile{route: route, f: mFile, targetRoot: targetRoot, absPath: absPath, relPath: relPath, keyPath: keyPath, size: size, rawSize: rawSize, contentType: detectedContentType, contentEncoding: contentEncoding, contentMD5: contentMD5, hasher: cfg.hasher}
 
-	if err := of.initContentType(peek); err != nil {
+	if cfg.PreserveMtime {
+		of.mtime = formatMtime(fi.ModTime())
+	}
+
+	// Compressed content changes all over on small changes.
+	of.delta = route != nil && route.Delta && contentEncoding == "" && isDeltaSize(size)
+
+	if err := of.initContentType(); err != nil {
 		return nil, err
 	}
 
+	if cfg.etagCache != nil {
+		of.cacheEntry = newETagCacheEntry(cfg, route, detectedContentType, fi)
+	}
+
 	return of, nil
 }
 
+// indexCopy returns a copy of f stored at the key of its directory without
+// the trailing slash, e.g. "blog" for "blog/index.html", or nil if f is
+// not the index.html of a sub directory (-index-copies).
+func (f *osFile) indexCopy() *osFile {
+	var keyPath string
+	switch {
+	case strings.HasSuffix(f.keyPath, "/index.html"):
+		keyPath = strings.TrimSuffix(f.keyPath, "/index.html")
+	case strings.HasSuffix(f.keyPath, "/") && filepath.Base(f.relPath) == "index.html":
+		// -strip-index-html
+		keyPath = strings.TrimSuffix(f.keyPath, "/")
+	default:
+		return nil
+	}
+
+	c := &osFile{
+		route:           f.route,
+		load:            f.load,
+		targetRoot:      f.targetRoot,
+		absPath:         f.absPath,
+		relPath:         f.relPath,
+		keyPath:         keyPath,
+		size:            f.size,
+		rawSize:         f.rawSize,
+		contentType:     f.contentType,
+		contentEncoding: f.contentEncoding,
+		contentMD5:      f.contentMD5,
+		mtime:           f.mtime,
+		delta:           f.delta,
+		hasher:          f.hasher,
+	}
+	if f.f != nil {
+		c.f = memfile.New(f.f.Bytes())
+	} else {
+		// From the ETag cache, with the content read when needed.
+		c.etag, c.blocks = f.etag, f.blocks
+		c.etagInit.Do(func() {})
+	}
+	return c
+}
+
+// Directory marker policies, see fileConfig.DirectoryMarkers.
+const (
+	// Create markers for empty local directories, and delete
+	// the markers of directories no longer empty or present.
+	directoryMarkersCreate = "create"
+	// Never create or delete any markers.
+	directoryMarkersKeep = "keep"
+	// Delete all remote markers, as any other remote object
+	// without a local file.
+	directoryMarkersDelete = "delete"
+
+	directoryMarkerContentType = "application/x-directory"
+)
+
+// newDirectoryMarker returns a zero-byte directory marker object
+// for the empty local directory relPath, e.g. "assets/empty/".
+func newDirectoryMarker(cfg *Config, relPath, absPath string) *osFile {
+	keyPath := filepath.ToSlash(relPath) + "/"
+	return &osFile{
+		f:           memfile.New(nil),
+		targetRoot:  cfg.BucketPath,
+		absPath:     absPath,
+		relPath:     keyPath,
+		keyPath:     keyPath,
+		contentType: directoryMarkerContentType,
+	}
+}
+
+// isDirectoryMarker reports whether the remote file f is a directory marker.
+func isDirectoryMarker(f file) bool {
+	return strings.HasSuffix(f.Key(), "/") && f.Size() == 0
+}
+
+// memoryFile is a localFile with in-memory content, e.g. for
+// objects created by s3deploy itself.
+type memoryFile struct {
+	key         string
+	contentType string
+	b           []byte
+	etag        string
+}
+
+func newMemoryFile(key, contentType string, b []byte) *memoryFile {
+	etag, _ := calculateETag(bytes.NewReader(b))
+	return &memoryFile{key: key, contentType: contentType, b: b, etag: etag}
+}
+
+func (f *memoryFile) Key() string {
+	return f.key
+}
+
+func (f *memoryFile) ETag() string {
+	return f.etag
+}
+
+func (f *memoryFile) Size() int64 {
+	return int64(len(f.b))
+}
+
+func (f *memoryFile) shouldThisReplace(other file) (bool, uploadReason) {
+	if f.Size() != other.Size() {
+		return true, reasonSize
+	}
+	if f.ETag() != other.ETag() {
+		return true, reasonETag
+	}
+	return false, ""
+}
+
+func (f *memoryFile) Content() io.ReadSeeker {
+	return bytes.NewReader(f.b)
+}
+
+func (f *memoryFile) ContentType() string {
+	return f.contentType
+}
+
+func (f *memoryFile) Headers() map[string]string {
+	return nil
+}
+
 type routes []*route
 
-func (r routes) get(path string) *route {
+func (r routes) get(path, contentType string, size int64) *route {
 	for _, route := range r {
-		if route.routerRE.MatchString(path) {
+		if route.match(path, contentType, size) {
 			return route
 		}
 	}
@@ -241,18 +534,243 @@ func (r routes) get(path string) *route {
 	return nil
 }
 
+// getAll returns all routes matching the given file.
+func (r routes) getAll(path, contentType string, size int64) routes {
+	var matches routes
+	for _, route := range r {
+		if route.match(path, contentType, size) {
+			matches = append(matches, route)
+		}
+	}
+	return matches
+}
+
+// merge merges the routes in order, so for headers, the last route wins.
+// Gzip and Ignore will be set if set in any of the routes.
+func (r routes) merge() *route {
+	switch len(r) {
+	case 0:
+		return nil
+	case 1:
+		return r[0]
+	}
+
+	merged := &route{
+		routerRE: r[0].routerRE,
+	}
+	var patterns []string
+	for _, rr := range r {
+		patterns = append(patterns, rr.Route)
+		merged.Gzip = merged.Gzip || rr.Gzip
+		if rr.GzipLevel != 0 {
+			merged.GzipLevel = rr.GzipLevel
+		}
+		if rr.Compression != "" {
+			merged.Compression = rr.Compression
+		}
+		if rr.GzipMinSize != 0 {
+			merged.GzipMinSize = rr.GzipMinSize
+		}
+		merged.GzipIncompressible = merged.GzipIncompressible || rr.GzipIncompressible
+		merged.Minify = merged.Minify || rr.Minify
+		merged.Fingerprint = merged.Fingerprint || rr.Fingerprint
+		merged.Delta = merged.Delta || rr.Delta
+		if len(rr.Process) > 0 {
+			merged.Process, merged.processors = rr.Process, rr.processors
+		}
+		merged.Ignore = merged.Ignore || rr.Ignore
+		h := rr.headers()
+		if len(h) > 0 && merged.Headers == nil {
+			merged.Headers = make(map[string]string)
+		}
+		for k, v := range h {
+			merged.Headers[k] = v
+		}
+	}
+	merged.Route = strings.Join(patterns, " + ")
+
+	return merged
+}
+
 // read config from .s3deploy.yml if found.
 type fileConfig struct {
 	Routes routes `yaml:"routes"`
+
+	// When set, all matching routes are merged in order instead of
+	// using only the first match.
+	MergeRoutes bool `yaml:"mergeRoutes"`
+
+	// Explicit ACL grants for uploaded objects, grantee => permission,
+	// e.g. `id=79a59df900b949e5: READ`.
+	Grants map[string]string `yaml:"grants"`
+
+	// Compiled from Grants, permission => Grant header value.
+	grantHeaders map[string]string
+
+	// Smoke tests run against the deployed site (-checks-url).
+	Checks []*check `yaml:"checks"`
+
+	// Redirects served by the CloudFront Function (-cloudfront-function).
+	Redirects []*redirect `yaml:"redirects"`
+
+	// The S3 static website configuration to set in the deploy.
+	Website *websiteConfig `yaml:"website"`
+
+	// How to handle zero-byte directory marker objects, e.g. "assets/",
+	// one of "create", "keep" and "delete" (the default).
+	DirectoryMarkers string `yaml:"directoryMarkers"`
+
+	// Limits on the size of the deploy.
+	Budget *budgetConfig `yaml:"budget"`
+
+	// An external command to get the AWS credentials from.
+	Credentials *credentialsConfig `yaml:"credentials"`
+}
+
+// getRoute returns the route to use for the given file, or nil if none found.
+func (c *fileConfig) getRoute(path, contentType string, size int64) *route {
+	if c.MergeRoutes {
+		return c.Routes.getAll(path, contentType, size).merge()
+	}
+	return c.Routes.get(path, contentType, size)
+}
+
+func (c *fileConfig) hasFingerprints() bool {
+	for _, r := range c.Routes {
+		if r.Fingerprint {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *fileConfig) init() error {
+	if err := c.initGrants(); err != nil {
+		return err
+	}
+
+	for _, ch := range c.Checks {
+		if err := ch.init(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range c.Redirects {
+		if err := r.init(); err != nil {
+			return err
+		}
+	}
+
+	if c.Website != nil {
+		if err := c.Website.init(); err != nil {
+			return err
+		}
+	}
+
+	if c.Budget != nil {
+		if err := c.Budget.init(); err != nil {
+			return err
+		}
+	}
+
+	if c.Credentials != nil {
+		if err := c.Credentials.init(); err != nil {
+			return err
+		}
+	}
+
+	switch c.DirectoryMarkers {
+	case "", directoryMarkersCreate, directoryMarkersKeep, directoryMarkersDelete:
+	default:
+		return fmt.Errorf("invalid directoryMarkers %q, must be one of create, keep and delete", c.DirectoryMarkers)
+	}
+
 	for _, r := range c.Routes {
 		var err error
 		r.routerRE, err = regexp.Compile(r.Route)
 		if err != nil {
 			return err
 		}
+		if r.ContentType != "" {
+			if _, err := path.Match(r.ContentType, ""); err != nil {
+				return fmt.Errorf("invalid contentType pattern %q: %s", r.ContentType, err)
+			}
+		}
+		if r.MaxSize > 0 && r.MinSize > r.MaxSize {
+			return fmt.Errorf("route %q: minSize (%d) is larger than maxSize (%d)", r.Route, r.MinSize, r.MaxSize)
+		}
+		if err := validateGzipLevel(r.GzipLevel); err != nil {
+			return fmt.Errorf("route %q: %s", r.Route, err)
+		}
+		if r.GzipMinSize < 0 {
+			return fmt.Errorf("route %q: gzipMinSize must be positive", r.Route)
+		}
+		if err := validateCompression(r.Compression); err != nil {
+			return fmt.Errorf("route %q: %s", r.Route, err)
+		}
+		if r.Gzip && r.Compression != "" && r.Compression != encodingGzip {
+			return fmt.Errorf("route %q: gzip cannot be combined with compression %q", r.Route, r.Compression)
+		}
+		if r.Delta && r.contentEncoding() != "" {
+			return fmt.Errorf("route %q: delta cannot be combined with compression", r.Route)
+		}
+		if err := r.initHeaders(); err != nil {
+			return fmt.Errorf("route %q: %s", r.Route, err)
+		}
+		r.processors = nil
+		for _, name := range r.Process {
+			p, err := newProcessor(name)
+			if err != nil {
+				return fmt.Errorf("route %q: %s", r.Route, err)
+			}
+			r.processors = append(r.processors, p)
+		}
+	}
+
+	return nil
+}
+
+func validateGzipLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip level %d, must be between %d and %d", level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+var grantPermissions = map[string]bool{
+	"READ":         true,
+	"READ_ACP":     true,
+	"WRITE_ACP":    true,
+	"FULL_CONTROL": true,
+}
+
+func (c *fileConfig) initGrants() error {
+	if len(c.Grants) == 0 {
+		return nil
+	}
+
+	grantees := make(map[string][]string)
+	for grantee, permission := range c.Grants {
+		permission = strings.ToUpper(permission)
+		if !grantPermissions[permission] {
+			return fmt.Errorf("invalid grant permission %q for grantee %q", permission, grantee)
+		}
+		typ, value, found := strings.Cut(grantee, "=")
+		if !found || value == "" {
+			return fmt.Errorf("invalid grantee %q, must be on the form type=value", grantee)
+		}
+		switch typ {
+		case "id", "emailAddress", "uri":
+		default:
+			return fmt.Errorf("invalid grantee type %q, must be one of id, emailAddress or uri", typ)
+		}
+		grantees[permission] = append(grantees[permission], fmt.Sprintf("%s=%q", typ, strings.Trim(value, `"`)))
+	}
+
+	c.grantHeaders = make(map[string]string)
+	for permission, values := range grantees {
+		sort.Strings(values)
+		c.grantHeaders[permission] = strings.Join(values, ", ")
 	}
 
 	return nil
@@ -262,9 +780,178 @@ type route struct {
 	Route   string            `yaml:"route"`
 	Headers map[string]string `yaml:"headers"`
 	Gzip    bool              `yaml:"gzip"`
-	Ignore  bool              `yaml:"ignore"`
+	// The gzip compression level (1-9, -1 for default, -2 for Huffman only).
+	// Zero means use the global default.
+	GzipLevel int `yaml:"gzipLevel"`
+	// The compression to use, "gzip" or "zstd".
+	// Setting Gzip to true is the same as setting this to "gzip".
+	Compression string `yaml:"compression"`
+	// Files smaller than this (in bytes) are not compressed.
+	GzipMinSize int64 `yaml:"gzipMinSize"`
+	// Compress files even if their content type is already compressed,
+	// e.g. images, fonts and archives. These are skipped by default.
+	GzipIncompressible bool `yaml:"gzipIncompressible"`
+	// Processors to run on the content before it's compressed and uploaded,
+	// e.g. "optimize-png".
+	Process []string `yaml:"process"`
+	// Minify HTML, CSS, JavaScript, JSON, SVG and XML before any processors.
+	Minify bool `yaml:"minify"`
+	// Add a hash of the content to the key, e.g. "main.1a2b3c4d5e6f.css",
+	// and rewrite the references to it in the HTML and CSS files deployed.
+	Fingerprint bool `yaml:"fingerprint"`
+	Ignore      bool `yaml:"ignore"`
+	Keep        bool `yaml:"keep"`
+
+	// Upload large files in blocks, and copy the blocks not changed since
+	// the previous deploy server side instead of uploading them again.
+	Delta bool `yaml:"delta"`
+
+	// Optional selectors in addition to the Route regexp.
+	// ContentType is a glob pattern matched against the detected media type
+	// (without parameters), e.g. "image/*".
+	ContentType string `yaml:"contentType"`
+	// The file size range (in bytes) to match. Zero means no limit.
+	MinSize int64 `yaml:"minSize"`
+	MaxSize int64 `yaml:"maxSize"`
+
+	routerRE   *regexp.Regexp // compiled version of Route
+	processors []processor    // compiled version of Process
+
+	// Headers with any ${env:VAR} expressions resolved.
+	resolvedHeaders map[string]string
+}
+
+// headers returns the headers to apply to files matching this route.
+func (r *route) headers() map[string]string {
+	if r.resolvedHeaders != nil {
+		return r.resolvedHeaders
+	}
+	return r.Headers
+}
+
+var envHeaderRe = regexp.MustCompile(`\$\{env:(\w+)\}`)
+
+// resolveHeaders resolves any ${env:VAR} expressions in the route header values
+// using lookup. Unlike ${VAR} expressions, which are expanded when the config
+// file is loaded, these are resolved for every deploy and it's an error if
+// the variable is not set.
+func (c *fileConfig) resolveHeaders(lookup func(string) (string, bool)) error {
+	for _, r := range c.Routes {
+		r.resolvedHeaders = nil
+		if len(r.Headers) == 0 {
+			continue
+		}
+		resolved := make(map[string]string, len(r.Headers))
+		for k, v := range r.Headers {
+			var err error
+			resolved[k] = envHeaderRe.ReplaceAllStringFunc(v, func(s string) string {
+				name := envHeaderRe.FindStringSubmatch(s)[1]
+				val, found := lookup(name)
+				if !found && err == nil {
+					err = fmt.Errorf("route %q: header %q: environment variable %q is not set", r.Route, k, name)
+				}
+				return val
+			})
+			if err != nil {
+				return err
+			}
+		}
+		r.resolvedHeaders = resolved
+	}
+	return nil
+}
+
+// initHeaders canonicalizes the header keys and validates
+// and normalizes any Content-Type header.
+func (r *route) initHeaders() error {
+	if len(r.Headers) == 0 {
+		return nil
+	}
+
+	headers := make(map[string]string, len(r.Headers))
+	for k, v := range r.Headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	if v, found := headers["Content-Type"]; found && !envHeaderRe.MatchString(v) {
+		mediaType, charset, err := splitContentType(v)
+		if err != nil {
+			return err
+		}
+		headers["Content-Type"] = joinContentType(mediaType, charset)
+	}
+
+	r.Headers = headers
+
+	return nil
+}
+
+// splitContentType splits a Content-Type value into its media type and charset.
+func splitContentType(s string) (mediaType, charset string, err error) {
+	mediaType, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Content-Type %q: %s", s, err)
+	}
+	return mediaType, strings.ToLower(params["charset"]), nil
+}
+
+func joinContentType(mediaType, charset string) string {
+	if charset == "" {
+		return mediaType
+	}
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": charset})
+}
+
+// contentEncoding returns the content encoding to compress the
+// content with, or empty if none.
+func (r *route) contentEncoding() string {
+	if r == nil {
+		return ""
+	}
+	if r.Compression != "" {
+		return r.Compression
+	}
+	if r.Gzip {
+		return encodingGzip
+	}
+	return ""
+}
+
+// hasLocalSelectors reports whether this route can only be
+// fully matched against local files, e.g. by content type or size.
+func (r *route) hasLocalSelectors() bool {
+	return r.ContentType != "" || r.MinSize > 0 || r.MaxSize > 0
+}
+
+func (r *route) match(p, contentType string, size int64) bool {
+	if !r.routerRE.MatchString(p) {
+		return false
+	}
+
+	if r.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return false
+		}
+		if ok, _ := path.Match(r.ContentType, mediaType); !ok {
+			return false
+		}
+	}
+
+	if r.MinSize > 0 && size < r.MinSize {
+		return false
+	}
+
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return false
+	}
+
+	return true
+}
 
-	routerRE *regexp.Regexp // compiled version of Route
+func md5Hex(b []byte) string {
+	h := md5.Sum(b)
+	return hex.EncodeToString(h[:])
 }
 
 func calculateETag(r io.Reader) (string, error) {
@@ -6,13 +6,16 @@
 package lib
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestOSFile(t *testing.T) {
@@ -53,6 +56,173 @@ func TestShouldThisReplace(t *testing.T) {
 	}
 }
 
+func TestOSFileGzipLevel(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data.txt")
+	var content strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&content, "line %d: %d\n", i, i*i%997)
+	}
+	c.Assert(os.WriteFile(filename, []byte(content.String()), 0o644), qt.IsNil)
+	fi, err := os.Stat(filename)
+	c.Assert(err, qt.IsNil)
+
+	sizeWith := func(globalLevel, routeLevel int) int64 {
+		cfg := &Config{BucketName: "example.com", GzipLevel: globalLevel}
+		cfg.fileConf.Routes = routes{{Route: ".*", Gzip: true, GzipLevel: routeLevel}}
+		c.Assert(cfg.Init(), qt.IsNil)
+		of, err := newOSFile(cfg, "data.txt", filename, fi)
+		c.Assert(err, qt.IsNil)
+		return of.Size()
+	}
+
+	c.Assert(sizeWith(1, 0) > sizeWith(9, 0), qt.IsTrue)
+	c.Assert(sizeWith(9, 1), qt.Equals, sizeWith(1, 0))
+	c.Assert(sizeWith(0, 0), qt.Equals, sizeWith(-1, 0))
+
+	cfg := &Config{BucketName: "example.com", GzipLevel: 10}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "invalid gzip level.*")
+}
+
+func TestOSFileGzipMinSize(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	newFile := func(name, content string, minSize int64) *osFile {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+		fi, err := os.Stat(filename)
+		c.Assert(err, qt.IsNil)
+		cfg := &Config{BucketName: "example.com"}
+		cfg.fileConf.Routes = routes{{Route: ".*", Gzip: true, GzipMinSize: minSize}}
+		c.Assert(cfg.Init(), qt.IsNil)
+		of, err := newOSFile(cfg, name, filename, fi)
+		c.Assert(err, qt.IsNil)
+		return of
+	}
+
+	large := strings.Repeat("body { color: red; }\n", 100)
+
+	of := newFile("large.css", large, 0)
+	c.Assert(of.Headers()["Content-Encoding"], qt.Equals, "gzip")
+	c.Assert(of.Size() < int64(len(large)), qt.IsTrue)
+
+	// Below gzipMinSize.
+	of = newFile("large.css", large, int64(len(large)+1))
+	c.Assert(of.Headers()["Content-Encoding"], qt.Equals, "")
+	c.Assert(of.Size(), qt.Equals, int64(len(large)))
+
+	// Gzip would make it bigger.
+	of = newFile("small.css", "a{}", 0)
+	c.Assert(of.Headers()["Content-Encoding"], qt.Equals, "")
+	c.Assert(of.Size(), qt.Equals, int64(3))
+}
+
+func TestOSFilePreserveMtime(t *testing.T) {
+	c := qt.New(t)
+
+	filename := filepath.Join(t.TempDir(), "main.css")
+	c.Assert(os.WriteFile(filename, []byte("a{}"), 0o644), qt.IsNil)
+	mtime := time.Unix(1700000000, 250000000)
+	c.Assert(os.Chtimes(filename, mtime, mtime), qt.IsNil)
+	fi, err := os.Stat(filename)
+	c.Assert(err, qt.IsNil)
+
+	newFile := func(preserve bool) *osFile {
+		cfg := &Config{BucketName: "example.com", PreserveMtime: preserve}
+		c.Assert(cfg.Init(), qt.IsNil)
+		of, err := newOSFile(cfg, "main.css", filename, fi)
+		c.Assert(err, qt.IsNil)
+		return of
+	}
+
+	of := newFile(true)
+	c.Assert(of.Headers()[mtimeHeader], qt.Equals, "1700000000.25")
+	c.Assert(formatMtime(time.Unix(1700000000, 0)), qt.Equals, "1700000000")
+
+	// The mtime of unchanged content is not reconciled.
+	remote := localFileMetadata(of)
+	remote.Headers[mtimeHeader] = "1600000000"
+	c.Assert(remote.diff(localFileMetadata(of)), qt.Equals, "")
+	c.Assert(verifyDiff(of, of.Size(), of.ETag(), of.ContentType(), "1600000000"), qt.Equals, "mtime 1600000000, expected 1700000000.25")
+
+	of = newFile(false)
+	_, found := of.Headers()[mtimeHeader]
+	c.Assert(found, qt.IsFalse)
+}
+
+func TestOSFileGzipIncompressible(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	newFile := func(name string, force bool) *osFile {
+		filename := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(filename, []byte(strings.Repeat("compressible ", 100)), 0o644), qt.IsNil)
+		fi, err := os.Stat(filename)
+		c.Assert(err, qt.IsNil)
+		cfg := &Config{BucketName: "example.com"}
+		cfg.fileConf.Routes = routes{{Route: ".*", Gzip: true, GzipIncompressible: force}}
+		c.Assert(cfg.Init(), qt.IsNil)
+		of, err := newOSFile(cfg, name, filename, fi)
+		c.Assert(err, qt.IsNil)
+		return of
+	}
+
+	c.Assert(newFile("logo.png", false).Headers()["Content-Encoding"], qt.Equals, "")
+	c.Assert(newFile("font.woff2", false).Headers()["Content-Encoding"], qt.Equals, "")
+	c.Assert(newFile("archive.zip", false).Headers()["Content-Encoding"], qt.Equals, "")
+	c.Assert(newFile("logo.svg", false).Headers()["Content-Encoding"], qt.Equals, "gzip")
+	c.Assert(newFile("main.css", false).Headers()["Content-Encoding"], qt.Equals, "gzip")
+	c.Assert(newFile("logo.png", true).Headers()["Content-Encoding"], qt.Equals, "gzip")
+}
+
+func TestIsIncompressible(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(isIncompressible("image/jpeg", ".jpg"), qt.IsTrue)
+	c.Assert(isIncompressible("image/webp", ""), qt.IsTrue)
+	c.Assert(isIncompressible("video/mp4", ""), qt.IsTrue)
+	c.Assert(isIncompressible("application/zip", ""), qt.IsTrue)
+	c.Assert(isIncompressible("application/octet-stream", ".GZ"), qt.IsTrue)
+	c.Assert(isIncompressible("image/svg+xml", ".svg"), qt.IsFalse)
+	c.Assert(isIncompressible("text/html; charset=utf-8", ".html"), qt.IsFalse)
+	c.Assert(isIncompressible("application/json", ".json"), qt.IsFalse)
+}
+
+func TestOSFileZstd(t *testing.T) {
+	c := qt.New(t)
+
+	absPath := filepath.Join(t.TempDir(), "index.html")
+	c.Assert(os.WriteFile(absPath, []byte("<html>"+strings.Repeat("<p>zstd</p>", 100)+"</html>"), 0o644), qt.IsNil)
+	fi, err := os.Stat(absPath)
+	c.Assert(err, qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com"}
+	cfg.fileConf.Routes = routes{{Route: ".*", Compression: "zstd"}}
+	c.Assert(cfg.Init(), qt.IsNil)
+
+	of, err := newOSFile(cfg, "index.html", absPath, fi)
+	c.Assert(err, qt.IsNil)
+	c.Assert(of.Headers()["Content-Encoding"], qt.Equals, "zstd")
+	c.Assert(of.ContentType(), qt.Equals, "text/html; charset=utf-8")
+
+	zr, err := zstd.NewReader(of.Content())
+	c.Assert(err, qt.IsNil)
+	defer zr.Close()
+	b, err := io.ReadAll(zr)
+	c.Assert(err, qt.IsNil)
+	expected, err := os.ReadFile(absPath)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, string(expected))
+
+	fc := fileConfig{Routes: routes{{Route: ".*", Compression: "br"}}}
+	c.Assert(fc.init(), qt.ErrorMatches, ".*invalid compression.*")
+	fc = fileConfig{Routes: routes{{Route: ".*", Gzip: true, Compression: "zstd"}}}
+	c.Assert(fc.init(), qt.ErrorMatches, ".*gzip cannot be combined.*")
+}
+
 func TestDetectContentTypeFromContent(t *testing.T) {
 	c := qt.New(t)
 
@@ -60,6 +230,109 @@ func TestDetectContentTypeFromContent(t *testing.T) {
 	c.Assert(detectContentTypeFromContent([]byte("<html>"+strings.Repeat("abc", 300)+"</html>")), qt.Equals, "text/html; charset=utf-8")
 }
 
+func TestRoutesGet(t *testing.T) {
+	c := qt.New(t)
+
+	fc := fileConfig{
+		Routes: routes{
+			{Route: "^.+\\.txt$", ContentType: "image/*"},
+			{Route: "", ContentType: "image/*", Gzip: false},
+			{Route: "", ContentType: "text/*", MaxSize: 100, Gzip: true},
+			{Route: "^.+\\.html$", MinSize: 100},
+		},
+	}
+	c.Assert(fc.init(), qt.IsNil)
+	r := fc.Routes
+
+	c.Assert(r.get("a.png", "image/png", 1000), qt.Equals, r[1])
+	c.Assert(r.get("a.txt", "text/plain; charset=utf-8", 10), qt.Equals, r[2])
+	c.Assert(r.get("a.html", "text/html; charset=utf-8", 10), qt.Equals, r[2])
+	c.Assert(r.get("a.html", "text/html; charset=utf-8", 1000), qt.Equals, r[3])
+	c.Assert(r.get("a.json", "application/json", 10), qt.IsNil)
+
+	fc = fileConfig{Routes: routes{{ContentType: "image/[", Gzip: true}}}
+	c.Assert(fc.init(), qt.IsNotNil)
+	fc = fileConfig{Routes: routes{{MinSize: 10, MaxSize: 5}}}
+	c.Assert(fc.init(), qt.IsNotNil)
+}
+
+func TestMergeRoutes(t *testing.T) {
+	c := qt.New(t)
+
+	fc := fileConfig{
+		MergeRoutes: true,
+		Routes: routes{
+			{Route: ".*", Headers: map[string]string{"Cache-Control": "max-age=60", "Content-Language": "nn"}},
+			{Route: "\\.css$", Headers: map[string]string{"Cache-Control": "max-age=31536000"}},
+			{Route: "\\.(css|js)$", Gzip: true},
+		},
+	}
+	c.Assert(fc.init(), qt.IsNil)
+
+	r := fc.getRoute("main.css", "text/css", 10)
+	c.Assert(r.Gzip, qt.IsTrue)
+	c.Assert(r.Headers, qt.DeepEquals, map[string]string{"Cache-Control": "max-age=31536000", "Content-Language": "nn"})
+	c.Assert(fc.getRoute("index.html", "text/html", 10), qt.Equals, fc.Routes[0])
+
+	fc.MergeRoutes = false
+	c.Assert(fc.getRoute("main.css", "text/css", 10), qt.Equals, fc.Routes[0])
+}
+
+func TestResolveHeaders(t *testing.T) {
+	c := qt.New(t)
+
+	fc := fileConfig{
+		Routes: routes{
+			{Route: "a", Headers: map[string]string{"X-Build": "${env:S3DEPLOY_TEST_SHA}", "X-Build-Ref": "ref-${env:S3DEPLOY_TEST_REF}"}},
+			{Route: "b", Headers: map[string]string{"Cache-Control": "max-age=60"}},
+		},
+	}
+	c.Assert(fc.init(), qt.IsNil)
+
+	env := map[string]string{"S3DEPLOY_TEST_SHA": "abc123", "S3DEPLOY_TEST_REF": "main"}
+	lookup := func(k string) (string, bool) {
+		v, found := env[k]
+		return v, found
+	}
+
+	c.Assert(fc.resolveHeaders(lookup), qt.IsNil)
+	c.Assert(fc.Routes[0].headers(), qt.DeepEquals, map[string]string{"X-Build": "abc123", "X-Build-Ref": "ref-main"})
+	c.Assert(fc.Routes[0].Headers["X-Build"], qt.Equals, "${env:S3DEPLOY_TEST_SHA}")
+	c.Assert(fc.Routes[1].headers(), qt.DeepEquals, map[string]string{"Cache-Control": "max-age=60"})
+
+	// Resolved per deploy.
+	env["S3DEPLOY_TEST_SHA"] = "def456"
+	c.Assert(fc.resolveHeaders(lookup), qt.IsNil)
+	c.Assert(fc.Routes[0].headers()["X-Build"], qt.Equals, "def456")
+
+	delete(env, "S3DEPLOY_TEST_REF")
+	c.Assert(fc.resolveHeaders(lookup), qt.ErrorMatches, `route "a": header "X-Build-Ref": environment variable "S3DEPLOY_TEST_REF" is not set`)
+}
+
+func TestRouteContentTypeHeader(t *testing.T) {
+	c := qt.New(t)
+
+	fc := fileConfig{
+		Routes: routes{
+			{Route: "a", Headers: map[string]string{"content-type": "Text/HTML;Charset=UTF-8", "cache-control": "max-age=60"}},
+			{Route: "b", Headers: map[string]string{"Content-Type": "application/json"}},
+		},
+	}
+	c.Assert(fc.init(), qt.IsNil)
+	c.Assert(fc.Routes[0].Headers, qt.DeepEquals, map[string]string{"Content-Type": "text/html; charset=utf-8", "Cache-Control": "max-age=60"})
+	c.Assert(fc.Routes[1].Headers["Content-Type"], qt.Equals, "application/json")
+
+	mediaType, charset, err := splitContentType("text/css; charset=UTF-8")
+	c.Assert(err, qt.IsNil)
+	c.Assert(mediaType, qt.Equals, "text/css")
+	c.Assert(charset, qt.Equals, "utf-8")
+
+	fc = fileConfig{Routes: routes{{Route: "c", Headers: map[string]string{"Content-Type": "text/html; charset"}}}}
+	err = fc.init()
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(err.Error(), qt.Contains, "invalid Content-Type")
+}
+
 type testFile struct {
 	key  string
 	size int64
@@ -0,0 +1,235 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The number of hex characters of the content hash added to the key.
+const fingerprintLength = 12
+
+var (
+	// Attributes in HTML that may hold references to other files.
+	htmlRefRe = regexp.MustCompile(`(?i)(\s(src|href|poster|srcset)\s*=\s*)("[^"]*"|'[^']*')`)
+	// url(...) in CSS, also in HTML style elements and attributes.
+	cssURLRe = regexp.MustCompile(`(url\(\s*)("[^"]*"|'[^']*'|[^"')\s]+)`)
+	// @import "..." in CSS.
+	cssImportRe = regexp.MustCompile(`(@import\s+)("[^"]*"|'[^']*')`)
+)
+
+// fingerprinter adds a hash of the content to the key of the files with
+// fingerprinting enabled, and rewrites the references to them in the
+// HTML and CSS files deployed.
+type fingerprinter struct {
+	cfg *Config
+
+	// The relative paths of the files to fingerprint, mapped to the
+	// absolute paths before fingerprinting and to the fingerprinted
+	// relative paths after.
+	files  map[string]string
+	hashed map[string]string
+
+	// Used to detect reference cycles.
+	resolving map[string]bool
+}
+
+// newFingerprinter finds and fingerprints the files below basePath with
+// fingerprinting enabled in their route, or returns nil if there are none.
+func newFingerprinter(cfg *Config, basePath string) (*fingerprinter, error) {
+	if !cfg.fileConf.hasFingerprints() {
+		return nil, nil
+	}
+
+	fp := &fingerprinter{
+		cfg:       cfg,
+		files:     make(map[string]string),
+		hashed:    make(map[string]string),
+		resolving: make(map[string]bool),
+	}
+
+	// Any warnings are printed by the deploy walk.
+	err := cfg.walkLocal(basePath, newPrinter(io.Discard), func(rel, abs string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		contentType := typeByExtension(filepath.Ext(rel), cfg.PreferSystemMIME)
+		if contentType == "" {
+			b, err := cfg.readSource(abs)
+			if err != nil {
+				return err
+			}
+			contentType = detectContentTypeFromContent(b)
+		}
+		if r := cfg.fileConf.getRoute(rel, contentType, info.Size()); r != nil && r.Fingerprint && !r.Ignore {
+			fp.files[rel] = abs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for rel := range fp.files {
+		if _, err := fp.resolve(rel); err != nil {
+			return nil, err
+		}
+	}
+
+	return fp, nil
+}
+
+// resolve returns the fingerprinted path of the file rel, which must be
+// one of the files to fingerprint.
+func (fp *fingerprinter) resolve(rel string) (string, error) {
+	if hashed, found := fp.hashed[rel]; found {
+		return hashed, nil
+	}
+	if fp.resolving[rel] {
+		return "", fmt.Errorf("fingerprint: reference cycle involving %q", rel)
+	}
+	fp.resolving[rel] = true
+	defer delete(fp.resolving, rel)
+
+	b, err := fp.cfg.readSource(fp.files[rel])
+	if err != nil {
+		return "", err
+	}
+
+	// Any references in the content are rewritten before hashing, so
+	// a changed image also changes the hash of the CSS referencing it.
+	b, err = fp.rewrite(rel, typeByExtension(path.Ext(rel), fp.cfg.PreferSystemMIME), b)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	hash := hex.EncodeToString(h[:])[:fingerprintLength]
+	ext := path.Ext(rel)
+	hashed := strings.TrimSuffix(rel, ext) + "." + hash + ext
+	fp.hashed[rel] = hashed
+
+	return hashed, nil
+}
+
+// keyPath returns the fingerprinted path of rel,
+// or rel if it's not fingerprinted.
+func (fp *fingerprinter) keyPath(rel string) string {
+	if hashed, found := fp.hashed[rel]; found {
+		return hashed
+	}
+	return rel
+}
+
+// rewrite rewrites the references to fingerprinted files in b,
+// the content of the HTML or CSS file rel.
+func (fp *fingerprinter) rewrite(rel, contentType string, b []byte) ([]byte, error) {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	var res []*regexp.Regexp
+	switch mediaType {
+	case "text/html":
+		res = []*regexp.Regexp{htmlRefRe, cssURLRe}
+	case "text/css":
+		res = []*regexp.Regexp{cssURLRe, cssImportRe}
+	default:
+		return b, nil
+	}
+
+	var err error
+	for _, re := range res {
+		b = re.ReplaceAllFunc(b, func(m []byte) []byte {
+			if err != nil {
+				return m
+			}
+			// The first group is kept as is, the last is the reference.
+			sm := re.FindSubmatch(m)
+			prefix, value := string(sm[1]), string(sm[len(sm)-1])
+			quote := ""
+			if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, `'`) {
+				quote, value = value[:1], value[1:len(value)-1]
+			}
+			var rewritten string
+			if re == htmlRefRe && strings.EqualFold(string(sm[2]), "srcset") {
+				rewritten, err = fp.rewriteSrcset(rel, value)
+			} else {
+				rewritten, err = fp.rewriteURL(rel, value)
+			}
+			return []byte(prefix + quote + rewritten + quote)
+		})
+	}
+
+	return b, err
+}
+
+func (fp *fingerprinter) rewriteSrcset(rel, srcset string) (string, error) {
+	candidates := strings.Split(srcset, ",")
+	for i, c := range candidates {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+		u, err := fp.rewriteURL(rel, fields[0])
+		if err != nil {
+			return "", err
+		}
+		candidates[i] = strings.Replace(c, fields[0], u, 1)
+	}
+	return strings.Join(candidates, ","), nil
+}
+
+// rewriteURL returns u, found in the file rel, pointing to the
+// fingerprinted file if it's a local reference to one.
+func (fp *fingerprinter) rewriteURL(rel, u string) (string, error) {
+	if u == "" || strings.HasPrefix(u, "#") || strings.HasPrefix(u, "//") || strings.Contains(u, ":") {
+		// Not a local file.
+		return u, nil
+	}
+
+	p, suffix := u, ""
+	if i := strings.IndexAny(u, "?#"); i != -1 {
+		p, suffix = u[:i], u[i:]
+	}
+
+	var target string
+	if strings.HasPrefix(p, "/") {
+		target = strings.TrimPrefix(path.Clean(p), "/")
+	} else {
+		target = path.Join(path.Dir(rel), p)
+	}
+
+	if _, found := fp.files[target]; !found {
+		return u, nil
+	}
+
+	hashed, err := fp.resolve(target)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(path.Dir(p), path.Base(hashed)) + suffix, nil
+}
+
+// writeManifest writes a JSON object mapping the paths of the
+// fingerprinted files to their fingerprinted paths to filename.
+func (fp *fingerprinter) writeManifest(filename string) error {
+	// The keys are sorted by encoding/json.
+	b, err := json.MarshalIndent(fp.hashed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0o644)
+}
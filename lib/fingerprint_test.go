@@ -0,0 +1,111 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func writeTestFiles(c *qt.C, dir string, files map[string]string) {
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+	}
+}
+
+func TestDeployFingerprint(t *testing.T) {
+	c := qt.New(t)
+
+	source := c.TempDir()
+	writeTestFiles(c, source, map[string]string{
+		"index.html":       `<link rel="stylesheet" href="/css/main.css"><img src="img/logo.png" srcset="img/logo.png 1x, img/logo@2x.png 2x"><a href="https://example.org/img/logo.png">`,
+		"css/main.css":     `body { background: url("../img/logo.png?v=1"); } @import 'other.css';`,
+		"css/other.css":    `p { color: red; }`,
+		"img/logo.png":     "logo",
+		"img/logo@2x.png":  "logo@2x",
+		"img/unhashed.txt": "text",
+	})
+
+	manifestFilename := filepath.Join(c.TempDir(), "manifest.json")
+
+	m := make(map[string]file)
+	cfg := &Config{
+		BucketName:          "example.com",
+		RegionName:          "eu-west-1",
+		Silent:              true,
+		SourcePath:          source,
+		FingerprintManifest: manifestFilename,
+		baseStore:           newTestStoreFrom(m, 0),
+	}
+	cfg.fileConf.Routes = routes{{Route: `\.(css|png)$`, Fingerprint: true}}
+
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+
+	b, err := os.ReadFile(manifestFilename)
+	c.Assert(err, qt.IsNil)
+	var manifest map[string]string
+	c.Assert(json.Unmarshal(b, &manifest), qt.IsNil)
+	c.Assert(manifest, qt.HasLen, 4)
+	for k, v := range manifest {
+		c.Assert(v, qt.Matches, regexp.QuoteMeta(k[:len(k)-len(filepath.Ext(k))])+`\.[0-9a-f]{12}`+regexp.QuoteMeta(filepath.Ext(k)))
+		c.Assert(m[v], qt.IsNotNil)
+		c.Assert(m[k], qt.IsNil)
+	}
+	c.Assert(m["index.html"], qt.IsNotNil)
+	c.Assert(m["img/unhashed.txt"], qt.IsNotNil)
+
+	content := func(key string) string {
+		b, err := io.ReadAll(m[key].(localFile).Content())
+		c.Assert(err, qt.IsNil)
+		return string(b)
+	}
+
+	c.Assert(content("index.html"), qt.Equals, `<link rel="stylesheet" href="/`+manifest["css/main.css"]+`"><img src="`+manifest["img/logo.png"]+`" srcset="`+manifest["img/logo.png"]+` 1x, `+manifest["img/logo@2x.png"]+` 2x"><a href="https://example.org/img/logo.png">`)
+	c.Assert(content(manifest["css/main.css"]), qt.Equals, `body { background: url("../img/`+filepath.Base(manifest["img/logo.png"])+`?v=1"); } @import '`+filepath.Base(manifest["css/other.css"])+`';`)
+
+	// A changed image changes the hash of the CSS referencing it.
+	writeTestFiles(c, source, map[string]string{"img/logo.png": "new logo"})
+	cfg = &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		Silent:     true,
+		SourcePath: source,
+		baseStore:  newTestStoreFrom(make(map[string]file), 0),
+	}
+	cfg.fileConf.Routes = routes{{Route: `\.(css|png)$`, Fingerprint: true}}
+	c.Assert(cfg.Init(), qt.IsNil)
+	fp, err := newFingerprinter(cfg, source)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fp.keyPath("img/logo.png"), qt.Not(qt.Equals), manifest["img/logo.png"])
+	c.Assert(fp.keyPath("css/main.css"), qt.Not(qt.Equals), manifest["css/main.css"])
+	c.Assert(fp.keyPath("css/other.css"), qt.Equals, manifest["css/other.css"])
+	c.Assert(fp.keyPath("index.html"), qt.Equals, "index.html")
+}
+
+func TestFingerprintCycle(t *testing.T) {
+	c := qt.New(t)
+
+	source := c.TempDir()
+	writeTestFiles(c, source, map[string]string{
+		"a.css": `@import "b.css";`,
+		"b.css": `@import "a.css";`,
+	})
+
+	cfg := &Config{BucketName: "example.com", SourcePath: source}
+	cfg.fileConf.Routes = routes{{Route: `\.css$`, Fingerprint: true}}
+	c.Assert(cfg.Init(), qt.IsNil)
+	_, err := newFingerprinter(cfg, source)
+	c.Assert(err, qt.ErrorMatches, `fingerprint: reference cycle involving ".*"`)
+}
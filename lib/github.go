@@ -0,0 +1,123 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// githubStepSummaryEnv is set by GitHub Actions to the file to write
+// the Markdown summary of a job step to.
+const githubStepSummaryEnv = "GITHUB_STEP_SUMMARY"
+
+// The summary is limited to 1 MiB by GitHub, so don't list all files
+// of very big deploys.
+const maxGitHubSummaryChanges = 1000
+
+// writeGitHubSummary appends a Markdown summary of the deploy to the
+// GitHub Actions step summary, if running in GitHub Actions.
+func writeGitHubSummary(cfg *Config, stats DeployStats, duration time.Duration, deployErr error) error {
+	filename := os.Getenv(githubStepSummaryEnv)
+	if filename == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(githubSummary(cfg, stats, duration, deployErr)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func githubSummary(cfg *Config, stats DeployStats, duration time.Duration, deployErr error) string {
+	var b strings.Builder
+
+	target := cfg.BucketName
+	if cfg.BucketPath != "" {
+		target = pathJoin(target, cfg.BucketPath)
+	}
+	fmt.Fprintf(&b, "### s3deploy to `%s`\n\n", target)
+
+	if deployErr != nil {
+		fmt.Fprintf(&b, "**Deploy failed:** %s\n\n", markdownEscape(deployErr.Error()))
+	}
+	if cfg.Try {
+		b.WriteString("_This was a trial run, with no remote updates._\n\n")
+	}
+
+	b.WriteString("| | |\n| --- | --- |\n")
+	fmt.Fprintf(&b, "| Uploaded | %d (%s, %s compressed) |\n", stats.Uploaded, formatBytes(stats.BytesUploadedRaw), formatBytes(stats.BytesUploadedCompressed))
+	if stats.Copied > 0 {
+		fmt.Fprintf(&b, "| Copied from reference | %d |\n", stats.Copied)
+	}
+	if stats.Deduplicated > 0 {
+		fmt.Fprintf(&b, "| Copied duplicates | %d |\n", stats.Deduplicated)
+	}
+	if stats.Moved > 0 {
+		fmt.Fprintf(&b, "| Moved | %d |\n", stats.Moved)
+	}
+	fmt.Fprintf(&b, "| Deleted | %d of %d |\n", stats.Deleted, stats.Deleted+stats.Stale)
+	fmt.Fprintf(&b, "| Skipped | %d |\n", stats.Skipped)
+	if stats.Reconciled > 0 {
+		fmt.Fprintf(&b, "| Fixed metadata | %d |\n", stats.Reconciled)
+	}
+	if stats.Failed > 0 {
+		fmt.Fprintf(&b, "| Failed | %d |\n", stats.Failed)
+	}
+	fmt.Fprintf(&b, "| Duration | %s |\n", formatDuration(duration))
+
+	if len(stats.InvalidationPaths) > 0 {
+		paths := make([]string, len(stats.InvalidationPaths))
+		for i, p := range stats.InvalidationPaths {
+			paths[i] = "`" + markdownEscape(p) + "`"
+		}
+		fmt.Fprintf(&b, "\nCDN invalidation paths: %s\n", strings.Join(paths, ", "))
+	}
+	if len(stats.Invalidations) > 0 {
+		ids := make([]string, 0, len(stats.Invalidations))
+		for distributionID, invalidationID := range stats.Invalidations {
+			ids = append(ids, fmt.Sprintf("`%s` (%s)", invalidationID, distributionID))
+		}
+		sort.Strings(ids)
+		fmt.Fprintf(&b, "\nCloudFront invalidations: %s\n", strings.Join(ids, ", "))
+	}
+
+	if len(stats.Changes) > 0 {
+		changes := make([]FileChange, len(stats.Changes))
+		copy(changes, stats.Changes)
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+
+		fmt.Fprintf(&b, "\n<details><summary>Changed files (%d)</summary>\n\n", len(changes))
+		b.WriteString("| File | Change |\n| --- | --- |\n")
+		for i, c := range changes {
+			if i == maxGitHubSummaryChanges {
+				fmt.Fprintf(&b, "| … and %d more | |\n", len(changes)-i)
+				break
+			}
+			fmt.Fprintf(&b, "| `%s` | %s |\n", markdownEscape(c.Key), c.Action)
+		}
+		b.WriteString("\n</details>\n")
+	}
+
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// markdownEscape escapes s for use in a Markdown table cell.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
@@ -0,0 +1,72 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployGitHubSummary(t *testing.T) {
+	c := qt.New(t)
+
+	summaryFile := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv(githubStepSummaryEnv, summaryFile)
+
+	store, _ := newTestStore(0, "")
+	cfg := &Config{
+		BucketName:    "example.com",
+		RegionName:    "eu-west-1",
+		MaxDelete:     300,
+		Silent:        true,
+		SourcePath:    testSourcePath(),
+		GitHubSummary: true,
+		baseStore:     store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Changes, qt.HasLen, 4)
+	c.Assert(stats.InvalidationPaths, qt.HasLen, 4)
+
+	b, err := os.ReadFile(summaryFile)
+	c.Assert(err, qt.IsNil)
+	summary := string(b)
+	c.Assert(summary, qt.Contains, "### s3deploy to `example.com`")
+	c.Assert(summary, qt.Contains, "| Deleted | 1 of 1 |")
+	c.Assert(summary, qt.Contains, "| Skipped | 1 |")
+	c.Assert(summary, qt.Contains, "<summary>Changed files (4)</summary>")
+	c.Assert(summary, qt.Contains, "| `deleteme.txt` | deleted |")
+	c.Assert(summary, qt.Contains, "| `index.html` | uploaded |")
+	c.Assert(summary, qt.Contains, "CDN invalidation paths: ")
+
+	// Appended to.
+	c.Assert(writeGitHubSummary(cfg, stats, time.Second, nil), qt.IsNil)
+	b, err = os.ReadFile(summaryFile)
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.Count(string(b), "### s3deploy"), qt.Equals, 2)
+}
+
+func TestGitHubSummary(t *testing.T) {
+	c := qt.New(t)
+
+	cfg := &Config{BucketName: "example.com", BucketPath: "blog", Try: true}
+	stats := DeployStats{Uploaded: 1, Changes: []FileChange{{Key: "blog/a|b.txt", Action: "uploaded"}}}
+
+	summary := githubSummary(cfg, stats, 1500*time.Millisecond, errors.New("boom"))
+	c.Assert(summary, qt.Contains, "### s3deploy to `example.com/blog`")
+	c.Assert(summary, qt.Contains, "**Deploy failed:** boom")
+	c.Assert(summary, qt.Contains, "trial run")
+	c.Assert(summary, qt.Contains, "| Duration | 1.50s |")
+	c.Assert(summary, qt.Contains, "| `blog/a\\|b.txt` | uploaded |")
+	c.Assert(summary, qt.Not(qt.Contains), "CDN invalidation")
+}
@@ -0,0 +1,77 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Content hash algorithms, see -hash.
+const (
+	hashMD5    = "md5"
+	hashSHA256 = "sha256"
+	hashXXHash = "xxhash"
+)
+
+// contentHasher calculates the hash used to detect changed files when MD5,
+// and with that the ETag of the remote objects, can't be used, e.g. in FIPS
+// constrained environments. The hash of the uploaded content is stored in
+// the object metadata and compared with that instead.
+type contentHasher interface {
+	// Name returns the name of the algorithm, as set in -hash.
+	Name() string
+	New() hash.Hash
+}
+
+type hasherFunc struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h hasherFunc) Name() string {
+	return h.name
+}
+
+func (h hasherFunc) New() hash.Hash {
+	return h.new()
+}
+
+// newContentHasher returns the hasher for the algorithm name,
+// or nil for MD5, which is compared with the remote ETags.
+func newContentHasher(name string) (contentHasher, error) {
+	switch name {
+	case "", hashMD5:
+		return nil, nil
+	case hashSHA256:
+		return hasherFunc{name: name, new: sha256.New}, nil
+	case hashXXHash:
+		return hasherFunc{name: name, new: func() hash.Hash { return xxhash.New() }}, nil
+	default:
+		return nil, fmt.Errorf("invalid -hash %q, must be one of md5, sha256 and xxhash", name)
+	}
+}
+
+// hashHeader returns the metadata key of the hash calculated by h,
+// e.g. S3deploy-Sha256 (x-amz-meta-s3deploy-sha256).
+func hashHeader(h contentHasher) string {
+	return http.CanonicalHeaderKey("s3deploy-" + h.Name())
+}
+
+// calculateHash returns the hash of r calculated by h, quoted as an ETag.
+func calculateHash(h contentHasher, r io.Reader) (string, error) {
+	hh := h.New()
+	if _, err := io.Copy(hh, r); err != nil {
+		return "", err
+	}
+	return "\"" + hex.EncodeToString(hh.Sum(nil)) + "\"", nil
+}
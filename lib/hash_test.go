@@ -0,0 +1,80 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestContentHasher(t *testing.T) {
+	c := qt.New(t)
+
+	h, err := newContentHasher("md5")
+	c.Assert(err, qt.IsNil)
+	c.Assert(h, qt.IsNil)
+
+	h, err = newContentHasher("sha256")
+	c.Assert(err, qt.IsNil)
+	c.Assert(hashHeader(h), qt.Equals, "S3deploy-Sha256")
+	sum, err := calculateHash(h, strings.NewReader("abc"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(sum, qt.Equals, `"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"`)
+
+	h, err = newContentHasher("xxhash")
+	c.Assert(err, qt.IsNil)
+	c.Assert(hashHeader(h), qt.Equals, "S3deploy-Xxhash")
+	sum, err = calculateHash(h, strings.NewReader("abc"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(sum, qt.Equals, `"44bc2cf5ad770999"`)
+
+	_, err = newContentHasher("sha1")
+	c.Assert(err, qt.ErrorMatches, `invalid -hash "sha1", must be one of md5, sha256 and xxhash`)
+
+	cfg := &Config{BucketName: "example.com", Hash: "sha256", DetectMoves: true}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `-detect-moves compares the remote ETags and requires -hash=md5`)
+}
+
+func TestDeployHash(t *testing.T) {
+	c := qt.New(t)
+
+	source := testSourcePath()
+	store := newTestStoreFrom(make(map[string]file), 0)
+	newConfig := func() *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: source,
+			Hash:       "sha256",
+			baseStore:  store,
+		}
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(4))
+
+	m := store.(*testStore).m
+	headers := m["main.css"].(localFile).Headers()
+	c.Assert(headers["S3deploy-Sha256"], qt.HasLen, 64)
+
+	// Unchanged files are detected by the hash in the metadata.
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 4 (0% changed)")
+
+	// Objects without the hash are uploaded again.
+	m["main.css"] = &testFile{key: "main.css", etag: m["main.css"].ETag(), size: m["main.css"].Size()}
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 1, skipped 3 (25% changed)")
+}
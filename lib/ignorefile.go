@@ -0,0 +1,173 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is a pattern in an ignore file (-ignore-file), with gitignore semantics.
+type ignoreRule struct {
+	re *regexp.Regexp
+	// Re-include paths matched by earlier rules, "!pattern".
+	negate bool
+	// Only match directories, "pattern/".
+	dirOnly bool
+}
+
+type ignoreRules []ignoreRule
+
+// loadIgnoreFile loads the ignore rules in filename, if it exists.
+func loadIgnoreFile(filename string) (ignoreRules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Base(filename), err)
+	}
+	return rules, nil
+}
+
+// loadIgnoreFileFS loads the ignore rules in the file name in fsys, if it exists.
+func loadIgnoreFileFS(fsys fs.FS, name string) (ignoreRules, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path.Base(name), err)
+	}
+	return rules, nil
+}
+
+func parseIgnoreRules(r io.Reader) (ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A pattern with a slash is relative to the directory of
+		// the ignore file, otherwise it matches at any level.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		expr := globToRegexp(line)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %s", lineNum, scanner.Text(), err)
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// globToRegexp converts a gitignore glob to a regular expression.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") && (i == 0 || glob[i-1] == '/') {
+				rest := glob[i+2:]
+				switch {
+				case rest == "":
+					// "foo/**" matches everything inside foo.
+					sb.WriteString(".*")
+					i++
+					continue
+				case strings.HasPrefix(rest, "/"):
+					// "**/foo" and "a/**/b" match zero or more directories.
+					sb.WriteString("(.*/)?")
+					i += 2
+					continue
+				}
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// match reports whether the slash separated path p, relative to the
+// directory of the ignore file, is ignored. The last matching rule wins.
+func (r ignoreRules) match(p string, isDir bool) bool {
+	var ignored bool
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
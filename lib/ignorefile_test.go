@@ -0,0 +1,102 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	c := qt.New(t)
+
+	rules, err := parseIgnoreRules(strings.NewReader(`
+# Comment
+*.log
+!keep.log
+/drafts
+build/
+docs/**/*.tmp
+**/secret.txt
+vendor/**
+img/?.png
+[Tt]humbs.db
+\#notes.md
+`))
+	c.Assert(err, qt.IsNil)
+	c.Assert(rules, qt.HasLen, 10)
+
+	for _, test := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"debug.log", false, true},
+		{"a/b/debug.log", false, true},
+		{"keep.log", false, false},
+		{"a/keep.log", false, false},
+		{"drafts", true, true},
+		{"drafts", false, true},
+		{"a/drafts", true, false},
+		{"build", true, true},
+		{"a/build", true, true},
+		{"build", false, false},
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"a/docs/a.tmp", false, false},
+		{"secret.txt", false, true},
+		{"a/b/secret.txt", false, true},
+		{"vendor/a/b.js", false, true},
+		{"vendor", true, false},
+		{"img/a.png", false, true},
+		{"img/ab.png", false, false},
+		{"Thumbs.db", false, true},
+		{"thumbs.db", false, true},
+		{"#notes.md", false, true},
+		{"index.html", false, false},
+	} {
+		c.Assert(rules.match(test.path, test.isDir), qt.Equals, test.ignored, qt.Commentf("%s", test.path))
+	}
+}
+
+func TestWalkLocalIgnoreFile(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	for filename, content := range map[string]string{
+		".s3deployignore":  "*.map\ndrafts/\n",
+		"index.html":       "<h1>Hi</h1>",
+		"main.js":          "var a;",
+		"main.js.map":      "{}",
+		"drafts/post.html": "draft",
+		"blog/post.html":   "post",
+	} {
+		filename = filepath.Join(dir, filename)
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+	}
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=example.com", "-config="})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+
+	var files []string
+	c.Assert(cfg.walkLocal(dir, newPrinter(io.Discard), func(rel, abs string, info os.FileInfo) error {
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}), qt.IsNil)
+	sort.Strings(files)
+	c.Assert(files, qt.DeepEquals, []string{"blog/post.html", "index.html", "main.js"})
+
+	_, err = parseIgnoreRules(strings.NewReader("a\n[z-a]\n"))
+	c.Assert(err, qt.ErrorMatches, `line 2: invalid pattern "\[z-a\]": .*`)
+}
@@ -0,0 +1,65 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Invalidate invalidates paths, relative to the bucket path (e.g. "/blog/*"),
+// in the CDN distributions in cfg, without deploying anything. With no paths,
+// everything below the bucket path is invalidated. It returns the
+// invalidation ID per distribution ID.
+func Invalidate(ctx context.Context, cfg *Config, paths ...string) (map[string]string, error) {
+	if err := cfg.Init(); err != nil {
+		return nil, err
+	}
+	if len(cfg.CDNDistributionIDs) == 0 {
+		return nil, errors.New("must provide one or more distribution ID")
+	}
+	if err := cfg.initSession(ctx); err != nil {
+		return nil, cfg.checkExpiredCredentials(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.Silent {
+		out = io.Discard
+	}
+
+	s := cfg.baseStore
+	if s == nil {
+		var err error
+		s, err = newRemoteStore(cfg, newPrinter(out))
+		if err != nil {
+			return nil, err
+		}
+	}
+	cdn, ok := s.(remoteCDN)
+	if !ok {
+		return nil, errors.New("the remote store does not support CDN invalidations")
+	}
+
+	if len(paths) == 0 {
+		paths = []string{"/*"}
+	}
+	keys := make([]string, len(paths))
+	for i, p := range paths {
+		keys[i] = strings.TrimPrefix(pathJoin(cfg.BucketPath, p), "/")
+	}
+	if err := cdn.InvalidateCDNCache(ctx, keys...); err != nil {
+		return nil, cfg.checkExpiredCredentials(err)
+	}
+
+	var ids map[string]string
+	if c, ok := s.(remoteCDNPaths); ok {
+		ids = c.InvalidationIDs()
+	}
+	return ids, nil
+}
@@ -0,0 +1,38 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInvalidate(t *testing.T) {
+	c := qt.New(t)
+
+	store, _ := newTestStore(0, "")
+	cfg := &Config{
+		BucketName:         "example.com",
+		BucketPath:         "site",
+		CDNDistributionIDs: Strings{"EABC123"},
+		Silent:             true,
+		baseStore:          store,
+	}
+	_, err := Invalidate(context.Background(), cfg, "/blog/*", "index.html")
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.(*testStore).invalidated, qt.DeepEquals, []string{"/site/blog/*", "/site/index.html"})
+
+	store, _ = newTestStore(0, "")
+	cfg = &Config{BucketName: "example.com", CDNDistributionIDs: Strings{"EABC123"}, Silent: true, baseStore: store}
+	_, err = Invalidate(context.Background(), cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(store.(*testStore).invalidated, qt.DeepEquals, []string{"/*"})
+
+	_, err = Invalidate(context.Background(), &Config{BucketName: "example.com"})
+	c.Assert(err, qt.ErrorMatches, "must provide one or more distribution ID")
+}
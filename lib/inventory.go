@@ -0,0 +1,294 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+var errInventoryNotSupported = errors.New("the remote store does not support S3 Inventory listings")
+
+// remoteInventoryReader is implemented by stores that can read the
+// S3 Inventory reports stored in a (possibly different) bucket.
+type remoteInventoryReader interface {
+	// GetBucketObject opens the object key in bucket for reading.
+	GetBucketObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// ListBucketPrefixes lists the common prefixes ("directories")
+	// directly below prefix in bucket.
+	ListBucketPrefixes(ctx context.Context, bucket, prefix string) ([]string, error)
+}
+
+// inventoryManifest is the manifest.json of an S3 Inventory report.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// The folders of the daily or weekly reports, e.g. "2022-10-01T01-00Z/".
+var inventoryReportRe = regexp.MustCompile(`/\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z/$`)
+
+// parseS3URL splits s3://bucket/key into bucket and key.
+func parseS3URL(s string) (bucket, key string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, must be on the form s3://bucket/key", s)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// inventoryFileMap reads the remote file map from the S3 Inventory report
+// at cfg.Inventory, which is either the URL of a manifest.json or of
+// an inventory configuration's folder, in which case the latest report is used.
+func (d *Deployer) inventoryFileMap(ctx context.Context) (map[string]file, error) {
+	r, ok := d.store.(remoteInventoryReader)
+	if !ok {
+		return nil, errInventoryNotSupported
+	}
+
+	bucket, key, err := parseS3URL(d.cfg.Inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(key, "manifest.json") {
+		key, err = latestInventoryManifest(ctx, r, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := readInventoryManifest(ctx, r, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.SourceBucket != d.cfg.BucketName {
+		return nil, fmt.Errorf("the inventory at %q is of bucket %q, not %q", d.cfg.Inventory, manifest.SourceBucket, d.cfg.BucketName)
+	}
+	if ms, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64); err == nil {
+		d.Printf("Using S3 Inventory report %s from %s\n", key, time.UnixMilli(ms).UTC().Format(time.RFC3339))
+	}
+
+	// The reports are stored in the destination bucket.
+	dataBucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+
+	var readFile func(key string, m map[string]file) error
+	switch manifest.FileFormat {
+	case "CSV":
+		columns := make(map[string]int)
+		for i, name := range strings.Split(manifest.FileSchema, ",") {
+			columns[strings.TrimSpace(name)] = i
+		}
+		for _, name := range []string{"Key", "Size", "ETag"} {
+			if _, found := columns[name]; !found {
+				return nil, fmt.Errorf("the inventory must include the %s field", name)
+			}
+		}
+		readFile = func(key string, m map[string]file) error {
+			return readInventoryCSV(ctx, r, dataBucket, key, columns, d.cfg.BucketPath, m)
+		}
+	case "Parquet":
+		readFile = func(key string, m map[string]file) error {
+			return readInventoryParquet(ctx, r, dataBucket, key, d.cfg.BucketPath, m)
+		}
+	default:
+		return nil, fmt.Errorf("the inventory at %q is in %s format, which is not supported: set the output format of the S3 Inventory configuration to CSV or Parquet", d.cfg.Inventory, manifest.FileFormat)
+	}
+
+	m := make(map[string]file)
+	for _, f := range manifest.Files {
+		if err := readFile(f.Key, m); err != nil {
+			return nil, fmt.Errorf("failed to read inventory file %q: %w", f.Key, err)
+		}
+	}
+
+	return m, nil
+}
+
+func latestInventoryManifest(ctx context.Context, r remoteInventoryReader, bucket, prefix string) (string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	prefixes, err := r.ListBucketPrefixes(ctx, bucket, prefix)
+	if err != nil {
+		return "", err
+	}
+	var reports []string
+	for _, p := range prefixes {
+		if inventoryReportRe.MatchString("/" + p) {
+			reports = append(reports, p)
+		}
+	}
+	if len(reports) == 0 {
+		return "", fmt.Errorf("no inventory reports found in s3://%s/%s", bucket, prefix)
+	}
+	sort.Strings(reports)
+	return reports[len(reports)-1] + "manifest.json", nil
+}
+
+func readInventoryManifest(ctx context.Context, r remoteInventoryReader, bucket, key string) (*inventoryManifest, error) {
+	rc, err := r.GetBucketObject(ctx, bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory manifest s3://%s/%s: %w", bucket, key, err)
+	}
+	defer rc.Close()
+
+	var manifest inventoryManifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid inventory manifest s3://%s/%s: %w", bucket, key, err)
+	}
+	return &manifest, nil
+}
+
+// readInventoryCSV reads the gzipped CSV inventory file and adds
+// the current objects below prefix to m.
+func readInventoryCSV(ctx context.Context, r remoteInventoryReader, bucket, key string, columns map[string]int, prefix string, m map[string]file) error {
+	rc, err := r.GetBucketObject(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	isLatest, hasIsLatest := columns["IsLatest"]
+	isDeleteMarker, hasIsDeleteMarker := columns["IsDeleteMarker"]
+
+	cr := csv.NewReader(gz)
+	cr.FieldsPerRecord = len(columns)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip old versions in versioned buckets.
+		if hasIsLatest && record[isLatest] != "true" {
+			continue
+		}
+		if hasIsDeleteMarker && record[isDeleteMarker] == "true" {
+			continue
+		}
+
+		// The keys are URL encoded.
+		k, err := url.QueryUnescape(record[columns["Key"]])
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		size, err := strconv.ParseInt(record[columns["Size"]], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		m[k] = &remoteFileInfo{K: k, S: size, E: `"` + record[columns["ETag"]] + `"`}
+	}
+}
+
+// inventoryParquetRow holds the fields read from a Parquet inventory file.
+// Unlike in the CSV files, the keys are not URL encoded.
+type inventoryParquetRow struct {
+	Key            string  `parquet:"key"`
+	Size           *int64  `parquet:"size,optional"`
+	ETag           *string `parquet:"e_tag,optional"`
+	IsLatest       *bool   `parquet:"is_latest,optional"`
+	IsDeleteMarker *bool   `parquet:"is_delete_marker,optional"`
+}
+
+// readInventoryParquet reads the Parquet inventory file and adds
+// the current objects below prefix to m.
+func readInventoryParquet(ctx context.Context, r remoteInventoryReader, bucket, key, prefix string, m map[string]file) error {
+	rc, err := r.GetBucketObject(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Parquet files are read from the end, so spool it to disk
+	// rather than holding the (possibly large) file in memory.
+	tmp, err := os.CreateTemp("", "s3deploy-inventory-*.parquet")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, rc)
+	if err != nil {
+		return err
+	}
+	pf, err := parquet.OpenFile(tmp, size)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"key", "size", "e_tag"} {
+		if _, found := pf.Schema().Lookup(name); !found {
+			return fmt.Errorf("the inventory must include the %s field", name)
+		}
+	}
+
+	pr := parquet.NewGenericReader[inventoryParquetRow](pf)
+	defer pr.Close()
+
+	rows := make([]inventoryParquetRow, 1000)
+	for {
+		n, err := pr.Read(rows)
+		for _, row := range rows[:n] {
+			// Skip old versions in versioned buckets.
+			if row.IsLatest != nil && !*row.IsLatest {
+				continue
+			}
+			if row.IsDeleteMarker != nil && *row.IsDeleteMarker {
+				continue
+			}
+			if !strings.HasPrefix(row.Key, prefix) || row.Size == nil || row.ETag == nil {
+				continue
+			}
+			m[row.Key] = &remoteFileInfo{K: row.Key, S: *row.Size, E: `"` + *row.ETag + `"`}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/parquet-go/parquet-go"
+)
+
+func gzipString(c *qt.C, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(s))
+	c.Assert(err, qt.IsNil)
+	c.Assert(gz.Close(), qt.IsNil)
+	return buf.Bytes()
+}
+
+func TestDeployInventory(t *testing.T) {
+	c := qt.New(t)
+
+	const manifest = `{
+  "sourceBucket": "example.com",
+  "destinationBucket": "arn:aws:s3:::inventories",
+  "creationTimestamp": "1664586000000",
+  "fileFormat": "CSV",
+  "fileSchema": "Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size, ETag",
+  "files": [{"key": "example.com/all/data/1.csv.gz"}, {"key": "example.com/all/data/2.csv.gz"}]
+}`
+
+	store := newTestStoreFrom(make(map[string]file), 0).(*testStore)
+	store.bucketObjects = map[string][]byte{
+		"inventories/example.com/all/2022-09-30T01-00Z/manifest.json": []byte(`{"sourceBucket": "example.com", "fileFormat": "CSV"}`),
+		"inventories/example.com/all/2022-10-01T01-00Z/manifest.json": []byte(manifest),
+		"inventories/example.com/all/data/1.csv.gz": gzipString(c, `"example.com","ab.txt","v2","true","false","2","b86fc6b051f63d73de262d4c34e3a0a9"
+"example.com","ab.txt","v1","false","false","3","abc"
+"example.com","delete+me.txt","v1","true","false","3","abc"
+`),
+		"inventories/example.com/all/data/2.csv.gz": gzipString(c, `"example.com","deleted.txt","v2","true","true","0",""
+"example.com","main.css","v1","true","false","3","changed"
+`),
+	}
+
+	source := testSourcePath()
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: source,
+		Inventory:  "s3://inventories/example.com/all",
+		baseStore:  store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.RemoteFiles, qt.Equals, uint64(3))
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+
+	// The manifest given directly.
+	cfg = &Config{
+		BucketName: "example.org",
+		RegionName: "eu-west-1",
+		Silent:     true,
+		SourcePath: source,
+		Inventory:  "s3://inventories/example.com/all/2022-10-01T01-00Z/manifest.json",
+		baseStore:  store,
+	}
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `the inventory at .* is of bucket "example.com", not "example.org"`)
+
+	// Apache ORC reports can't be read.
+	store.bucketObjects["inventories/example.com/orc/2022-10-01T01-00Z/manifest.json"] = []byte(`{"sourceBucket": "example.com", "fileFormat": "ORC"}`)
+	cfg = &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		Silent:     true,
+		SourcePath: source,
+		Inventory:  "s3://inventories/example.com/orc",
+		baseStore:  store,
+	}
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `the inventory at "s3://inventories/example.com/orc" is in ORC format, which is not supported: set the output format of the S3 Inventory configuration to CSV or Parquet`)
+	c.Assert(store.putKeys, qt.HasLen, 3)
+
+	cfg = &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		Silent:     true,
+		SourcePath: source,
+		Inventory:  "inventories/example.com/all",
+	}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid S3 URL .*`)
+}
+
+// s3InventoryParquetRow is a row in the schema of S3 Inventory Parquet files.
+type s3InventoryParquetRow struct {
+	Bucket           string  `parquet:"bucket"`
+	Key              string  `parquet:"key"`
+	VersionID        *string `parquet:"version_id,optional"`
+	IsLatest         *bool   `parquet:"is_latest,optional"`
+	IsDeleteMarker   *bool   `parquet:"is_delete_marker,optional"`
+	Size             *int64  `parquet:"size,optional"`
+	LastModifiedDate *int64  `parquet:"last_modified_date,optional"`
+	ETag             *string `parquet:"e_tag,optional"`
+}
+
+func parquetRows(c *qt.C, rows ...s3InventoryParquetRow) []byte {
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[s3InventoryParquetRow](&buf, parquet.Compression(&parquet.Snappy))
+	_, err := w.Write(rows)
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+	return buf.Bytes()
+}
+
+func TestDeployInventoryParquet(t *testing.T) {
+	c := qt.New(t)
+
+	const manifest = `{
+  "sourceBucket": "example.com",
+  "destinationBucket": "arn:aws:s3:::inventories",
+  "creationTimestamp": "1664586000000",
+  "fileFormat": "Parquet",
+  "fileSchema": "message s3.inventory { required binary bucket (STRING); required binary key (STRING); optional binary version_id (STRING); optional boolean is_latest; optional boolean is_delete_marker; optional int64 size; optional int64 last_modified_date (TIMESTAMP(MILLIS,true)); optional binary e_tag (STRING);}",
+  "files": [{"key": "example.com/all/data/1.parquet"}, {"key": "example.com/all/data/2.parquet"}]
+}`
+
+	row := func(key, version string, isLatest, isDeleteMarker bool, size int64, etag string) s3InventoryParquetRow {
+		return s3InventoryParquetRow{
+			Bucket: "example.com", Key: key, VersionID: &version, IsLatest: &isLatest,
+			IsDeleteMarker: &isDeleteMarker, Size: &size, ETag: &etag,
+		}
+	}
+
+	store := newTestStoreFrom(make(map[string]file), 0).(*testStore)
+	store.bucketObjects = map[string][]byte{
+		"inventories/example.com/all/2022-10-01T01-00Z/manifest.json": []byte(manifest),
+		"inventories/example.com/all/data/1.parquet": parquetRows(c,
+			row("ab.txt", "v2", true, false, 2, "b86fc6b051f63d73de262d4c34e3a0a9"),
+			row("ab.txt", "v1", false, false, 3, "abc"),
+			// Not URL encoded, unlike in the CSV files.
+			row("delete+me.txt", "v1", true, false, 3, "abc"),
+		),
+		"inventories/example.com/all/data/2.parquet": parquetRows(c,
+			row("deleted.txt", "v2", true, true, 0, ""),
+			row("main.css", "v1", true, false, 3, "changed"),
+		),
+	}
+
+	source := testSourcePath()
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: source,
+		Inventory:  "s3://inventories/example.com/all",
+		baseStore:  store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.RemoteFiles, qt.Equals, uint64(3))
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 1 (80% changed)")
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, []string{"delete+me.txt"})
+
+	// The ETag is required.
+	store.bucketObjects["inventories/example.com/all/data/2.parquet"] = func() []byte {
+		type noETag struct {
+			Key  string `parquet:"key"`
+			Size int64  `parquet:"size"`
+		}
+		var buf bytes.Buffer
+		w := parquet.NewGenericWriter[noETag](&buf)
+		_, err := w.Write([]noETag{{Key: "main.css", Size: 3}})
+		c.Assert(err, qt.IsNil)
+		c.Assert(w.Close(), qt.IsNil)
+		return buf.Bytes()
+	}()
+	_, err = Deploy(cfg)
+	c.Assert(err, qt.ErrorMatches, `failed to read inventory file "example.com/all/data/2.parquet": the inventory must include the e_tag field`)
+}
@@ -0,0 +1,154 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// List prints the remote files below the bucket path to out, sorted by key,
+// with their last modified time, size and ETag. If a prefix, relative to the
+// bucket path, is given in cfg.Args, only the files below it are printed.
+// With ListMetadata, the Content-Type, Cache-Control and the other headers are
+// also printed (one HEAD request per file). With JSON, the files are printed
+// as a JSON array, in the format of the entries in a snapshot.
+func List(ctx context.Context, cfg *Config, out io.Writer) error {
+	if err := cfg.Init(); err != nil {
+		return err
+	}
+	if len(cfg.Args) > 1 {
+		return fmt.Errorf("expected at most one prefix, got %d", len(cfg.Args))
+	}
+	if err := cfg.initSession(ctx); err != nil {
+		return cfg.checkExpiredCredentials(err)
+	}
+
+	s := cfg.baseStore
+	if s == nil {
+		var err error
+		s, err = newTargetStore(cfg, newPrinter(io.Discard))
+		if err != nil {
+			return err
+		}
+	}
+
+	var metadata remoteMetadataReconciler
+	if cfg.ListMetadata {
+		var ok bool
+		if metadata, ok = s.(remoteMetadataReconciler); !ok {
+			return errMetadataNotSupported
+		}
+	}
+
+	files, err := s.FileMap(ctx)
+	if err != nil {
+		return cfg.checkExpiredCredentials(err)
+	}
+
+	prefix := strings.TrimPrefix(cfg.BucketPath, "/")
+	if len(cfg.Args) > 0 {
+		prefix = strings.TrimPrefix(path.Join(cfg.BucketPath, cfg.Args[0]), "/")
+		if strings.HasSuffix(cfg.Args[0], "/") && prefix != "" {
+			prefix += "/"
+		}
+	}
+
+	var keys []string
+	for key := range files {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]snapshotEntry, len(keys))
+	var total int64
+	for i, key := range keys {
+		rf := files[key]
+		e := snapshotEntry{remoteFileInfo: remoteFileInfo{K: rf.Key(), S: rf.Size(), E: rf.ETag()}}
+		if sf, ok := rf.(*s3File); ok {
+			e.LastModified = sf.o.LastModified
+			e.StorageClass = string(sf.o.StorageClass)
+		}
+		if metadata != nil {
+			var m objectMetadata
+			var err error
+			if mf, ok := rf.(metadataFile); ok {
+				m, err = mf.Metadata(ctx)
+			} else {
+				m, err = metadata.HeadObject(ctx, key)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get metadata for %q: %w", key, cfg.checkExpiredCredentials(err))
+			}
+			e.ContentType, e.ContentEncoding, e.Headers = m.ContentType, m.ContentEncoding, m.Headers
+		}
+		entries[i] = e
+		total += e.S
+	}
+
+	if cfg.JSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		lastModified := "-"
+		if e.LastModified != nil {
+			lastModified = e.LastModified.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s", lastModified, e.S, e.E, e.K)
+		if metadata != nil {
+			fmt.Fprintf(w, "\t%s\t%s", e.ContentType, formatListHeaders(e))
+		}
+		fmt.Fprintln(w)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%d files, %s\n", len(entries), formatBytes(uint64(total)))
+	return err
+}
+
+// formatListHeaders formats the headers of e other than the
+// Content-Type, with Cache-Control first, e.g.
+// "Cache-Control: max-age=3600; Content-Encoding: gzip".
+func formatListHeaders(e snapshotEntry) string {
+	headers := make(map[string]string, len(e.Headers)+1)
+	for k, v := range e.Headers {
+		headers[k] = v
+	}
+	if e.ContentEncoding != "" {
+		headers["Content-Encoding"] = e.ContentEncoding
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "Cache-Control") != (names[j] == "Cache-Control") {
+			return names[i] == "Cache-Control"
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, len(names))
+	for i, k := range names {
+		parts[i] = k + ": " + headers[k]
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,67 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestList(t *testing.T) {
+	c := qt.New(t)
+	source := testSourcePath()
+
+	store, _ := newTestStore(0, "")
+	cfg := &Config{
+		BucketName: "example.com",
+		ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+		SourcePath: source,
+		MaxDelete:  300,
+		Silent:     true,
+		baseStore:  store,
+	}
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	cfg = &Config{BucketName: "example.com", baseStore: store}
+	c.Assert(List(context.Background(), cfg, &buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Matches, `(?s).*\.s3deploy.yml\n-  +2  +"b86fc6b051f63d73de262d4c34e3a0a9"  +ab.txt\n.*index.html\n.*main.css\n4 files, \d+ B\n`)
+
+	buf.Reset()
+	cfg = &Config{BucketName: "example.com", ListMetadata: true, baseStore: store, Args: []string{"main"}}
+	c.Assert(List(context.Background(), cfg, &buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Matches, `-  +\d+  +"\w+"  +main.css  +text/css; charset=utf-8  +Cache-Control: max-age=630720000, no-transform, public\n1 files, \d+ B\n`)
+
+	buf.Reset()
+	cfg = &Config{BucketName: "example.com", ListMetadata: true, JSON: true, baseStore: store, Args: []string{"index.html"}}
+	c.Assert(List(context.Background(), cfg, &buf), qt.IsNil)
+	var entries []snapshotEntry
+	c.Assert(json.Unmarshal(buf.Bytes(), &entries), qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].K, qt.Equals, "index.html")
+	c.Assert(entries[0].ContentType, qt.Equals, "text/html; charset=utf-8")
+
+	cfg = &Config{BucketName: "example.com", baseStore: store, Args: []string{"a", "b"}}
+	c.Assert(List(context.Background(), cfg, &buf), qt.ErrorMatches, "expected at most one prefix, got 2")
+}
+
+func TestFormatListHeaders(t *testing.T) {
+	c := qt.New(t)
+
+	e := snapshotEntry{
+		ContentType:     "text/css",
+		ContentEncoding: "gzip",
+		Headers:         map[string]string{"X-Frame-Options": "DENY", "Cache-Control": "no-cache"},
+	}
+	c.Assert(formatListHeaders(e), qt.Equals, "Cache-Control: no-cache; Content-Encoding: gzip; X-Frame-Options: DENY")
+	c.Assert(formatListHeaders(snapshotEntry{}), qt.Equals, "")
+}
@@ -0,0 +1,173 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// lockKey is the key, relative to BucketPath, of the advisory deploy lock.
+const lockKey = ".s3deploy.lock"
+
+// errObjectNotFound is returned by remoteObjectGetter when the object does not exist.
+var errObjectNotFound = errors.New("object not found")
+
+// remoteObjectGetter is implemented by stores that can read object content.
+type remoteObjectGetter interface {
+	GetObject(ctx context.Context, key string) ([]byte, error)
+}
+
+// deployLockInfo is stored as JSON in the lock object.
+type deployLockInfo struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l deployLockInfo) String() string {
+	return fmt.Sprintf("%s (created %s, expires %s)", l.Owner, l.Created.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// deployLock is an advisory lock stored as an object in the remote store.
+// Note that this is best effort; two deploys starting at the exact same time
+// may both think they hold the lock.
+type deployLock struct {
+	key     string
+	ttl     time.Duration
+	timeout time.Duration
+
+	// How often to check the lock while waiting.
+	pollInterval time.Duration
+
+	info deployLockInfo
+
+	store  remoteStore
+	getter remoteObjectGetter
+	logger printer
+}
+
+func newDeployLock(cfg *Config, store remoteStore, logger printer) (*deployLock, error) {
+	getter, ok := store.(remoteObjectGetter)
+	if !ok {
+		return nil, errors.New("the remote store does not support deploy locks")
+	}
+
+	owner := "unknown"
+	if hostname, err := os.Hostname(); err == nil {
+		owner = hostname
+	}
+	if user := os.Getenv("USER"); user != "" {
+		owner = user + "@" + owner
+	}
+	owner += " pid " + strconv.Itoa(os.Getpid())
+
+	return &deployLock{
+		key:          pathJoin(cfg.BucketPath, lockKey),
+		ttl:          cfg.LockTTL,
+		timeout:      cfg.LockTimeout,
+		pollInterval: 5 * time.Second,
+		info: deployLockInfo{
+			ID:    strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(os.Getpid()),
+			Owner: owner,
+		},
+		store:  store,
+		getter: getter,
+		logger: logger,
+	}, nil
+}
+
+// current returns the current lock, if any and not expired.
+func (l *deployLock) current(ctx context.Context) (*deployLockInfo, error) {
+	b, err := l.getter.GetObject(ctx, l.key)
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var info deployLockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		// Not a valid lock, treat it as stale.
+		return nil, nil
+	}
+
+	if time.Now().After(info.Expires) {
+		return nil, nil
+	}
+
+	return &info, nil
+}
+
+// Acquire acquires the lock, waiting up to the configured timeout
+// if held by someone else.
+func (l *deployLock) Acquire(ctx context.Context) error {
+	deadline := time.Now().Add(l.timeout)
+
+	for {
+		holder, err := l.current(ctx)
+		if err != nil {
+			return err
+		}
+		if holder == nil || holder.ID == l.info.ID {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("deploy lock %q is held by %s", l.key, holder)
+		}
+
+		l.logger.Printf("Deploy lock %q is held by %s, waiting …\n", l.key, holder)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.pollInterval):
+		}
+	}
+
+	l.info.Created = time.Now().UTC()
+	l.info.Expires = l.info.Created.Add(l.ttl)
+
+	b, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+
+	if err := l.store.Put(ctx, newMemoryFile(l.key, "application/json", b)); err != nil {
+		return err
+	}
+
+	// Check that we won any race.
+	holder, err := l.current(ctx)
+	if err != nil {
+		return err
+	}
+	if holder == nil || holder.ID != l.info.ID {
+		return fmt.Errorf("failed to acquire deploy lock %q", l.key)
+	}
+
+	return nil
+}
+
+// Release releases the lock if held by us.
+func (l *deployLock) Release(ctx context.Context) error {
+	holder, err := l.current(ctx)
+	if err != nil {
+		return err
+	}
+	if holder == nil || holder.ID != l.info.ID {
+		return nil
+	}
+	return l.store.DeleteObjects(ctx, []string{l.key})
+}
@@ -0,0 +1,66 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The prefixes of Windows extended-length paths, which aren't limited
+// to MAX_PATH (260) characters, see
+// https://learn.microsoft.com/en-us/windows/win32/fileio/naming-a-file
+const (
+	longPathPrefix    = `\\?\`
+	longPathUNCPrefix = `\\?\UNC\`
+)
+
+// longPath returns p as an absolute extended-length path on Windows, so
+// deep source trees can be walked past MAX_PATH, also on UNC shares.
+// Go only does this itself for long absolute paths, and the paths walked
+// must all be in the same form for the keys to be relative to the base.
+// On other systems, p is returned as is.
+func longPath(p string) (string, error) {
+	if runtime.GOOS != "windows" {
+		return p, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return windowsLongPath(abs), nil
+}
+
+// windowsLongPath returns the absolute and clean Windows path p with the
+// extended-length prefix, e.g. \\?\C:\site for C:\site and
+// \\?\UNC\server\share\site for \\server\share\site.
+// Paths already prefixed, device paths (\\.\) and relative paths are
+// returned as is.
+func windowsLongPath(p string) string {
+	p = strings.ReplaceAll(p, "/", `\`)
+	switch {
+	case strings.HasPrefix(p, longPathPrefix), strings.HasPrefix(p, `\\.\`):
+		return p
+	case strings.HasPrefix(p, `\\`):
+		return longPathUNCPrefix + p[2:]
+	case len(p) >= 3 && p[1] == ':' && p[2] == '\\':
+		return longPathPrefix + p
+	}
+	return p
+}
+
+// trimLongPathPrefix returns p without the extended-length prefix
+// added by windowsLongPath, e.g. for error messages.
+func trimLongPathPrefix(p string) string {
+	switch {
+	case strings.HasPrefix(p, longPathUNCPrefix):
+		return `\\` + p[len(longPathUNCPrefix):]
+	case strings.HasPrefix(p, longPathPrefix):
+		return p[len(longPathPrefix):]
+	}
+	return p
+}
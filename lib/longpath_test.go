@@ -0,0 +1,72 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWindowsLongPath(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		path string
+		long string
+	}{
+		{`C:\Users\runner\site\public`, `\\?\C:\Users\runner\site\public`},
+		{`C:/Users/runner/site`, `\\?\C:\Users\runner\site`},
+		{`\\server\share\site\public`, `\\?\UNC\server\share\site\public`},
+		{`\\?\C:\site`, `\\?\C:\site`},
+		{`\\?\UNC\server\share\site`, `\\?\UNC\server\share\site`},
+		{`\\.\PhysicalDrive0`, `\\.\PhysicalDrive0`},
+		{`public\site`, `public\site`},
+	} {
+		c.Assert(windowsLongPath(test.path), qt.Equals, test.long, qt.Commentf(test.path))
+	}
+
+	c.Assert(trimLongPathPrefix(`\\?\C:\site`), qt.Equals, `C:\site`)
+	c.Assert(trimLongPathPrefix(`\\?\UNC\server\share\site`), qt.Equals, `\\server\share\site`)
+	c.Assert(trimLongPathPrefix("/home/runner/site"), qt.Equals, "/home/runner/site")
+}
+
+func TestWalkLocalLongPath(t *testing.T) {
+	c := qt.New(t)
+
+	// Deeper than MAX_PATH (260) on Windows.
+	dir := t.TempDir()
+	var elems []string
+	for i := 0; i < 12; i++ {
+		elems = append(elems, strings.Repeat("d", 30))
+	}
+	deep := filepath.Join(append([]string{dir}, elems...)...)
+	c.Assert(os.MkdirAll(deep, 0o755), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(deep, "index.html"), []byte("deep"), 0o644), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "main.css"), []byte("css"), 0o644), qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com"}
+	c.Assert(cfg.Init(), qt.IsNil)
+	files := make(map[string]string)
+	c.Assert(cfg.walkLocal(dir, newPrinter(io.Discard), func(rel, abs string, info os.FileInfo) error {
+		b, err := os.ReadFile(abs)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	}), qt.IsNil)
+
+	c.Assert(files, qt.DeepEquals, map[string]string{
+		"main.css": "css",
+		path.Join(append(elems, "index.html")...): "deep",
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// manifest is a list of remote files read from a snapshot
+// or a checkpoint file.
+type manifest struct {
+	Filename string          `json:"filename"`
+	Header   *snapshotHeader `json:"header,omitempty"`
+
+	files map[string]*snapshotEntry
+}
+
+// manifestChange is a file that exists in both manifests,
+// but with different content.
+type manifestChange struct {
+	Key string         `json:"key"`
+	Old *snapshotEntry `json:"old"`
+	New *snapshotEntry `json:"new"`
+}
+
+// manifestDiff is the difference between two manifests.
+type manifestDiff struct {
+	Old       *manifest         `json:"old"`
+	New       *manifest         `json:"new"`
+	Added     []*snapshotEntry  `json:"added"`
+	Removed   []*snapshotEntry  `json:"removed"`
+	Changed   []*manifestChange `json:"changed"`
+	Unchanged int               `json:"unchanged"`
+}
+
+// DiffManifests compares the two manifests given in cfg.Args and
+// prints the added, removed and changed keys to out.
+// A manifest is a file written by 's3deploy snapshot' or a checkpoint file,
+// gzipped or not. No AWS requests are made.
+func DiffManifests(cfg *Config, out io.Writer) error {
+	if len(cfg.Args) != 2 {
+		return errors.New("usage: s3deploy diff-manifests [-json] old new")
+	}
+
+	diff, err := diffManifestFiles(cfg.Args[0], cfg.Args[1])
+	if err != nil {
+		return err
+	}
+
+	if cfg.JSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+
+	diff.writeText(out)
+
+	return nil
+}
+
+func diffManifestFiles(oldFilename, newFilename string) (*manifestDiff, error) {
+	oldm, err := readManifest(oldFilename)
+	if err != nil {
+		return nil, err
+	}
+	newm, err := readManifest(newFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &manifestDiff{
+		Old:     oldm,
+		New:     newm,
+		Added:   []*snapshotEntry{},
+		Removed: []*snapshotEntry{},
+		Changed: []*manifestChange{},
+	}
+
+	for _, k := range sortedManifestKeys(newm.files) {
+		nf := newm.files[k]
+		of, found := oldm.files[k]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, nf)
+		case of.S != nf.S || of.E != nf.E:
+			diff.Changed = append(diff.Changed, &manifestChange{Key: k, Old: of, New: nf})
+		default:
+			diff.Unchanged++
+		}
+	}
+
+	for _, k := range sortedManifestKeys(oldm.files) {
+		if _, found := newm.files[k]; !found {
+			diff.Removed = append(diff.Removed, oldm.files[k])
+		}
+	}
+
+	return diff, nil
+}
+
+func (d *manifestDiff) writeText(out io.Writer) {
+	for _, f := range d.Added {
+		fmt.Fprintf(out, "+ %s (%s)\n", f.K, formatBytes(uint64(f.S)))
+	}
+	for _, f := range d.Removed {
+		fmt.Fprintf(out, "- %s (%s)\n", f.K, formatBytes(uint64(f.S)))
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(out, "~ %s (%s => %s)\n", c.Key, formatBytes(uint64(c.Old.S)), formatBytes(uint64(c.New.S)))
+	}
+	fmt.Fprintf(out, "Added %d, removed %d, changed %d, unchanged %d\n", len(d.Added), len(d.Removed), len(d.Changed), d.Unchanged)
+}
+
+// readManifest reads a JSON lines file with an optional header followed
+// by one entry per remote file, where a later entry for the same key
+// replaces an earlier one.
+func readManifest(filename string) (*manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest %q: %w", filename, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	m := &manifest{Filename: filename, files: make(map[string]*snapshotEntry)}
+
+	dec := json.NewDecoder(r)
+	for i := 0; ; i++ {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("invalid manifest %q: %w", filename, err)
+		}
+
+		var e snapshotEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("invalid manifest %q: %w", filename, err)
+		}
+		if e.K == "" {
+			if i > 0 {
+				return nil, fmt.Errorf("invalid manifest %q: entry %d has no key", filename, i)
+			}
+			var h snapshotHeader
+			if err := json.Unmarshal(line, &h); err != nil {
+				return nil, fmt.Errorf("invalid manifest %q: %w", filename, err)
+			}
+			m.Header = &h
+			continue
+		}
+		m.files[e.K] = &e
+	}
+
+	return m, nil
+}
+
+func sortedManifestKeys(m map[string]*snapshotEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,90 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiffManifests(t *testing.T) {
+	c := qt.New(t)
+
+	dir := c.TempDir()
+
+	// The old one is a snapshot.
+	m := make(map[string]file)
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("file%d.txt", i)
+		m[key] = &testFile{key: key, etag: fmt.Sprintf(`"etag%d"`, i), size: int64(i)}
+	}
+	oldFilename := filepath.Join(dir, "old.jsonl.gz")
+	cfg := &Config{
+		BucketName:   "example.com",
+		RegionName:   "eu-west-1",
+		Silent:       true,
+		SnapshotFile: oldFilename,
+		baseStore:    newTestStoreFrom(m, 0),
+	}
+	c.Assert(Snapshot(context.Background(), cfg), qt.IsNil)
+
+	// The new one is plain JSON lines without a header,
+	// with file1.txt listed twice.
+	newFilename := filepath.Join(dir, "new.jsonl")
+	c.Assert(os.WriteFile(newFilename, []byte(`{"key":"file0.txt","size":0,"etag":"\"etag0\""}
+{"key":"file1.txt","size":1,"etag":"\"etag1\""}
+{"key":"file2.txt","size":20,"etag":"\"etag20\""}
+{"key":"file4.txt","size":4,"etag":"\"etag4\""}
+{"key":"file1.txt","size":10,"etag":"\"etag10\""}
+`), 0o644), qt.IsNil)
+
+	var buf bytes.Buffer
+	cfg = &Config{Args: []string{oldFilename, newFilename}}
+	c.Assert(DiffManifests(cfg, &buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Equals, `+ file4.txt (4 B)
+- file3.txt (3 B)
+~ file1.txt (1 B => 10 B)
+~ file2.txt (2 B => 20 B)
+Added 1, removed 1, changed 2, unchanged 1
+`)
+
+	buf.Reset()
+	cfg.JSON = true
+	c.Assert(DiffManifests(cfg, &buf), qt.IsNil)
+	var diff manifestDiff
+	c.Assert(json.Unmarshal(buf.Bytes(), &diff), qt.IsNil)
+	c.Assert(diff.Old.Header.Bucket, qt.Equals, "example.com")
+	c.Assert(diff.New.Header, qt.IsNil)
+	c.Assert(diff.Added, qt.HasLen, 1)
+	c.Assert(diff.Added[0].K, qt.Equals, "file4.txt")
+	c.Assert(diff.Removed, qt.HasLen, 1)
+	c.Assert(diff.Changed, qt.HasLen, 2)
+	c.Assert(diff.Changed[0].Old.E, qt.Equals, `"etag1"`)
+	c.Assert(diff.Changed[0].New.E, qt.Equals, `"etag10"`)
+	c.Assert(diff.Unchanged, qt.Equals, 1)
+
+	cfg.Args = cfg.Args[:1]
+	c.Assert(DiffManifests(cfg, &buf), qt.ErrorMatches, "usage: .*")
+
+	// A header after the first line.
+	badFilename := filepath.Join(dir, "bad.jsonl.gz")
+	var gzbuf bytes.Buffer
+	gz := gzip.NewWriter(&gzbuf)
+	fmt.Fprintln(gz, `{"key":"file0.txt","size":0,"etag":"\"etag0\""}`)
+	fmt.Fprintln(gz, `{"bucket":"example.com"}`)
+	c.Assert(gz.Close(), qt.IsNil)
+	c.Assert(os.WriteFile(badFilename, gzbuf.Bytes(), 0o644), qt.IsNil)
+	cfg.Args = []string{oldFilename, badFilename}
+	c.Assert(DiffManifests(cfg, &buf), qt.ErrorMatches, `invalid manifest .*: entry 1 has no key`)
+}
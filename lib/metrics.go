@@ -0,0 +1,185 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const telemetryTimeout = 10 * time.Second
+
+type metric struct {
+	name  string
+	help  string
+	unit  string
+	value float64
+}
+
+// deployMetrics returns the metrics for a deploy.
+func deployMetrics(stats DeployStats, duration time.Duration, err error) []metric {
+	success := 1.0
+	if err != nil {
+		success = 0
+	}
+	return []metric{
+		{"s3deploy_success", "Whether the last deploy succeeded (1) or failed (0).", "", success},
+		{"s3deploy_files_uploaded", "Number of files uploaded.", "", float64(stats.Uploaded)},
+		{"s3deploy_files_deleted", "Number of files deleted.", "", float64(stats.Deleted)},
+		{"s3deploy_files_skipped", "Number of unchanged files.", "", float64(stats.Skipped)},
+		{"s3deploy_files_stale", "Number of remote files not deleted because of -max-delete.", "", float64(stats.Stale)},
+		{"s3deploy_remote_files", "Number of remote files considered.", "", float64(stats.RemoteFiles)},
+		{"s3deploy_uploaded_bytes", "Number of bytes uploaded, after compression.", "By", float64(stats.BytesUploadedCompressed)},
+		{"s3deploy_uploaded_raw_bytes", "Number of bytes uploaded, before compression.", "By", float64(stats.BytesUploadedRaw)},
+		{"s3deploy_duration_seconds", "Duration of the deploy.", "s", duration.Seconds()},
+		{"s3deploy_list_duration_seconds", "Duration of the remote listing.", "s", stats.ListDuration.Seconds()},
+		{"s3deploy_upload_duration_seconds", "Duration of the uploads.", "s", stats.UploadDuration.Seconds()},
+		{"s3deploy_delete_duration_seconds", "Duration of the deletes.", "s", stats.DeleteDuration.Seconds()},
+		{"s3deploy_invalidate_duration_seconds", "Duration of the CDN invalidation.", "s", stats.InvalidateDuration.Seconds()},
+		{"s3deploy_last_run_timestamp_seconds", "Time of the last deploy as a Unix timestamp.", "s", float64(time.Now().Unix())},
+	}
+}
+
+// pushMetrics pushes metrics to the configured exporters.
+func pushMetrics(cfg *Config, metrics []metric) error {
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+	defer cancel()
+
+	labels := [][2]string{{"bucket", cfg.BucketName}, {"path", cfg.BucketPath}}
+
+	var errs []string
+	if cfg.MetricsPushgatewayURL != "" {
+		if err := pushPrometheus(ctx, cfg.MetricsPushgatewayURL, cfg.MetricsJob, labels, metrics); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if cfg.MetricsOTLPURL != "" {
+		if err := pushOTLP(ctx, cfg.MetricsOTLPURL, cfg.MetricsJob, labels, metrics); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pushPrometheus pushes metrics to a Prometheus Pushgateway using the text exposition format.
+func pushPrometheus(ctx context.Context, gatewayURL, job string, labels [][2]string, metrics []metric) error {
+	var buf bytes.Buffer
+	var ls []string
+	for _, l := range labels {
+		ls = append(ls, fmt.Sprintf("%s=%s", l[0], strconv.Quote(l[1])))
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", m.name)
+		fmt.Fprintf(&buf, "%s{%s} %s\n", m.name, strings.Join(ls, ","), strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
+
+	u := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+
+	return doTelemetryRequest(ctx, http.MethodPut, u, "text/plain; version=0.0.4", &buf)
+}
+
+// pushOTLP sends metrics as gauges to an OTLP/HTTP endpoint using the JSON encoding.
+func pushOTLP(ctx context.Context, endpoint, job string, labels [][2]string, metrics []metric) error {
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	type dataPoint struct {
+		AsDouble     float64     `json:"asDouble"`
+		TimeUnixNano string      `json:"timeUnixNano"`
+		Attributes   []attribute `json:"attributes"`
+	}
+	type gauge struct {
+		DataPoints []dataPoint `json:"dataPoints"`
+	}
+	type otlpMetric struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Unit        string `json:"unit,omitempty"`
+		Gauge       gauge  `json:"gauge"`
+	}
+
+	var attrs []attribute
+	for _, l := range labels {
+		attrs = append(attrs, attribute{Key: l[0], Value: value{l[1]}})
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	var ms []otlpMetric
+	for _, m := range metrics {
+		ms = append(ms, otlpMetric{
+			Name:        m.name,
+			Description: m.help,
+			Unit:        m.unit,
+			Gauge:       gauge{DataPoints: []dataPoint{{AsDouble: m.value, TimeUnixNano: now, Attributes: attrs}}},
+		})
+	}
+
+	payload := map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []attribute{{Key: "service.name", Value: value{job}}},
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "s3deploy"},
+						"metrics": ms,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/metrics") {
+		u += "/v1/metrics"
+	}
+
+	return doTelemetryRequest(ctx, http.MethodPost, u, "application/json", bytes.NewReader(b))
+}
+
+func doTelemetryRequest(ctx context.Context, method, u, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployPushMetrics(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]string)
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path] = string(b)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	store, _ := newTestStore(0, "")
+	source := testSourcePath()
+
+	cfg := &Config{
+		BucketName:            "example.com",
+		RegionName:            "eu-west-1",
+		ConfigFile:            filepath.Join(source, ".s3deploy.yml"),
+		MaxDelete:             300,
+		Silent:                true,
+		SourcePath:            source,
+		MetricsPushgatewayURL: srv.URL,
+		MetricsOTLPURL:        srv.URL,
+		MetricsJob:            "mysite",
+		baseStore:             store,
+	}
+
+	_, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+
+	prom := requests["PUT /metrics/job/mysite"]
+	c.Assert(prom, qt.Contains, "# TYPE s3deploy_files_uploaded gauge\n")
+	c.Assert(prom, qt.Contains, `s3deploy_files_uploaded{bucket="example.com",path=""} 3`)
+	c.Assert(prom, qt.Contains, `s3deploy_success{bucket="example.com",path=""} 1`)
+
+	var otlp map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(requests["POST /v1/metrics"]), &otlp), qt.IsNil)
+	c.Assert(requests["POST /v1/metrics"], qt.Contains, `"name":"s3deploy_files_uploaded"`)
+}
+
+func TestPushMetricsError(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	err := pushMetrics(&Config{MetricsPushgatewayURL: srv.URL, MetricsJob: "s3deploy"}, deployMetrics(DeployStats{}, 0, nil))
+	c.Assert(err, qt.ErrorMatches, `PUT .*/metrics/job/s3deploy: 400 Bad Request: nope`)
+}
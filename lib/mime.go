@@ -0,0 +1,84 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	_ "embed"
+	"mime"
+	"strings"
+	"sync"
+)
+
+//go:embed mime.types
+var embeddedMimeTypes string
+
+// builtinMimeTypes are the types Go's mime package always knows about.
+// These win over the embedded table so the common web types are the same
+// as when the system MIME database was used.
+var builtinMimeTypes = map[string]string{
+	".avif": "image/avif",
+	".css":  "text/css; charset=utf-8",
+	".gif":  "image/gif",
+	".htm":  "text/html; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".mjs":  "text/javascript; charset=utf-8",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".wasm": "application/wasm",
+	".webp": "image/webp",
+	".xml":  "text/xml; charset=utf-8",
+}
+
+var (
+	mimeTypesInit sync.Once
+	mimeTypes     map[string]string
+)
+
+func initMimeTypes() {
+	mimeTypes = make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(embeddedMimeTypes))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= 1 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		typ := fields[0]
+		if strings.HasPrefix(typ, "text/") {
+			// Same as Go's mime package.
+			typ += "; charset=utf-8"
+		}
+		for _, ext := range fields[1:] {
+			ext = "." + strings.ToLower(ext)
+			if _, found := mimeTypes[ext]; !found {
+				mimeTypes[ext] = typ
+			}
+		}
+	}
+	for ext, typ := range builtinMimeTypes {
+		mimeTypes[ext] = typ
+	}
+}
+
+// typeByExtension returns the MIME type for the file extension ext
+// (e.g. ".html"), or an empty string if not known.
+// Only the embedded table is used unless preferSystem is set, in which
+// case the system's MIME database is consulted first. That database
+// differs between hosts, so it's never used as a fallback.
+func typeByExtension(ext string, preferSystem bool) string {
+	if preferSystem {
+		if typ := mime.TypeByExtension(ext); typ != "" {
+			return typ
+		}
+	}
+	mimeTypesInit.Do(initMimeTypes)
+	return mimeTypes[strings.ToLower(ext)]
+}
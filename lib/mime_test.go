@@ -0,0 +1,32 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"mime"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTypeByExtension(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(typeByExtension(".html", false), qt.Equals, "text/html; charset=utf-8")
+	c.Assert(typeByExtension(".HTML", false), qt.Equals, "text/html; charset=utf-8")
+	c.Assert(typeByExtension(".js", false), qt.Equals, "text/javascript; charset=utf-8")
+	c.Assert(typeByExtension(".woff2", false), qt.Equals, "font/woff2")
+	c.Assert(typeByExtension(".md", false), qt.Equals, "text/markdown; charset=utf-8")
+	c.Assert(typeByExtension(".ico", false), qt.Equals, "image/vnd.microsoft.icon")
+	c.Assert(typeByExtension(".nosuchext", false), qt.Equals, "")
+	c.Assert(typeByExtension(".nosuchext", true), qt.Equals, "")
+	c.Assert(typeByExtension(".css", true), qt.Equals, "text/css; charset=utf-8")
+
+	// Only in the system MIME database, which may differ between hosts.
+	c.Assert(mime.AddExtensionType(".s3deploytest", "application/x-s3deploy-test"), qt.IsNil)
+	c.Assert(typeByExtension(".s3deploytest", false), qt.Equals, "")
+	c.Assert(typeByExtension(".s3deploytest", true), qt.Equals, "application/x-s3deploy-test")
+}
@@ -0,0 +1,50 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+	"github.com/tdewolff/minify/v2/xml"
+)
+
+var (
+	minifierInit sync.Once
+	minifier     *minify.M
+)
+
+func initMinifier() {
+	minifier = minify.New()
+	// Keep the document structure intact, the same defaults as Hugo.
+	minifier.Add("text/html", &html.Minifier{
+		KeepConditionalComments: true,
+		KeepDefaultAttrVals:     true,
+		KeepDocumentTags:        true,
+		KeepEndTags:             true,
+	})
+	minifier.AddFunc("text/css", css.Minify)
+	minifier.AddFuncRegexp(regexp.MustCompile(`^(application|text)/(x-)?(java|ecma)script$`), js.Minify)
+	minifier.AddFuncRegexp(regexp.MustCompile(`^(application|text)/(x-)?json$|\+json$`), json.Minify)
+	minifier.AddFunc("image/svg+xml", svg.Minify)
+	minifier.AddFuncRegexp(regexp.MustCompile(`^(application|text)/xml$|\+xml$`), xml.Minify)
+}
+
+// minifyContent minifies HTML, CSS, JavaScript, JSON, SVG and XML.
+// Other media types are returned unchanged.
+func minifyContent(mediaType string, b []byte) ([]byte, error) {
+	minifierInit.Do(initMinifier)
+	if _, _, fn := minifier.Match(mediaType); fn == nil {
+		return b, nil
+	}
+	return minifier.Bytes(mediaType, b)
+}
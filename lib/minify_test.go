@@ -0,0 +1,49 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMinifyContent(t *testing.T) {
+	c := qt.New(t)
+
+	minify := func(mediaType, s string) string {
+		b, err := minifyContent(mediaType, []byte(s))
+		c.Assert(err, qt.IsNil)
+		return string(b)
+	}
+
+	c.Assert(minify("text/css", "body {\n  color: red;\n}\n"), qt.Equals, "body{color:red}")
+	c.Assert(minify("text/javascript", "var a = 1 ;\n\nvar b = 2;\n"), qt.Equals, "var a=1,b=2")
+	c.Assert(minify("application/json", `{ "a": [1, 2] }`), qt.Equals, `{"a":[1,2]}`)
+	c.Assert(minify("text/html", "<html>\n  <body>\n    <p>Hello</p>\n  </body>\n</html>\n"), qt.Equals, "<html><body><p>Hello</p></body></html>")
+	c.Assert(minify("text/plain", "  keep  me  "), qt.Equals, "  keep  me  ")
+}
+
+func TestOSFileMinify(t *testing.T) {
+	c := qt.New(t)
+
+	content := "body {\n  color: red;\n}\n"
+	filename := filepath.Join(t.TempDir(), "main.css")
+	c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+	fi, err := os.Stat(filename)
+	c.Assert(err, qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com"}
+	cfg.fileConf.Routes = routes{{Route: `\.css$`, Minify: true}}
+	c.Assert(cfg.Init(), qt.IsNil)
+
+	of, err := newOSFile(cfg, "main.css", filename, fi)
+	c.Assert(err, qt.IsNil)
+	c.Assert(of.Size(), qt.Equals, int64(len("body{color:red}")))
+	c.Assert(of.ContentType(), qt.Equals, "text/css; charset=utf-8")
+}
@@ -0,0 +1,59 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// detectMoves finds the files in uploads with the same content as a remote
+// file about to be deleted, e.g. after restructuring the site, and sets
+// them to be copied from it server side instead of uploaded (-detect-moves).
+// The remote files are deleted after the uploads, as usual.
+func (d *Deployer) detectMoves(uploads []*osFile, remoteFiles map[string]file) {
+	deleted := make(map[string]string)
+	for _, key := range d.filesToDelete {
+		rf, found := remoteFiles[key]
+		if !found || rf.Size() == 0 {
+			continue
+		}
+		if _, found := deleted[rf.ETag()]; !found {
+			deleted[rf.ETag()] = key
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	for _, f := range uploads {
+		// A copy of a file uploaded in blocks would get another ETag.
+		if f.copyFrom != "" || f.Size() == 0 || f.delta {
+			continue
+		}
+		key, found := deleted[f.ETag()]
+		if !found || remoteFiles[key].Size() != f.Size() {
+			continue
+		}
+		d.printf("%s moved from %s, will copy\n", f.keyPath, key)
+		f.moveFrom = key
+	}
+}
+
+// copyMoved copies f from the remote file it was moved from.
+func (d *Deployer) copyMoved(ctx context.Context, f *osFile) error {
+	c, ok := d.store.(remoteCopier)
+	if !ok {
+		return errCopyNotSupported
+	}
+	if err := c.CopyFrom(ctx, d.cfg.BucketName, f.moveFrom, f); err != nil {
+		return fmt.Errorf("failed to copy %q to %q: %w", f.moveFrom, f.Key(), err)
+	}
+	atomic.AddUint64(&d.stats.Moved, uint64(1))
+	d.recordChange(f.Key(), "moved")
+	return nil
+}
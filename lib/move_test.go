@@ -0,0 +1,59 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployDetectMoves(t *testing.T) {
+	c := qt.New(t)
+
+	source := t.TempDir()
+	for filename, content := range map[string]string{
+		"index.html":             "<h1>Hi</h1>",
+		"blog/post/index.html":   "<h1>Post</h1>",
+		"blog/post/video.mp4":    "video",
+		"blog/post/empty.txt":    "",
+		"blog/other/notes.txt":   "notes",
+		"blog/other/changed.txt": "before",
+	} {
+		filename = filepath.Join(source, filename)
+		c.Assert(os.MkdirAll(filepath.Dir(filename), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filename, []byte(content), 0o644), qt.IsNil)
+	}
+
+	store := newTestStoreFrom(make(map[string]file), 0).(*testStore)
+	newConfig := func() *Config {
+		return &Config{
+			BucketName:  "example.com",
+			RegionName:  "eu-west-1",
+			MaxDelete:   300,
+			Silent:      true,
+			SourcePath:  source,
+			DetectMoves: true,
+			baseStore:   store,
+		}
+	}
+	_, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+
+	// Restructure.
+	c.Assert(os.MkdirAll(filepath.Join(source, "posts"), 0o755), qt.IsNil)
+	c.Assert(os.Rename(filepath.Join(source, "blog", "post"), filepath.Join(source, "posts", "post")), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(source, "blog", "other", "changed.txt"), []byte("after"), 0o644), qt.IsNil)
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 3 of 3, uploaded 2, skipped 2 (78% changed), moved 2")
+	c.Assert(stats.Moved, qt.Equals, uint64(2))
+	c.Assert(store.copied, qt.ContentEquals, []string{"example.com/blog/post/index.html", "example.com/blog/post/video.mp4"})
+	assertKeys(t, store.m, "index.html", "posts/post/index.html", "posts/post/video.mp4", "posts/post/empty.txt", "blog/other/notes.txt", "blog/other/changed.txt")
+}
@@ -0,0 +1,125 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ANSI escape codes for the colors in the terminal output.
+const (
+	colorReset = "\x1b[0m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorGrey  = "\x1b[90m"
+)
+
+// The width of the key column in the file actions printed.
+// Longer keys push the rest of the line to the right.
+const keyColumnWidth = 40
+
+// fileAction is the symbol and color of an action printed for a file.
+type fileAction struct {
+	symbol string
+	color  string
+}
+
+var (
+	actionUpload = fileAction{symbol: up, color: colorGreen}
+	actionDelete = fileAction{symbol: "✗", color: colorRed}
+	actionSkip   = fileAction{symbol: "=", color: colorGrey}
+)
+
+// useColor reports whether to colorize the output written to stdout,
+// which is when it's a terminal, unless disabled with -no-color or
+// the NO_COLOR environment variable (https://no-color.org).
+func useColor(cfg *Config) bool {
+	if cfg.NoColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// formatAction formats the action a on key as a line, with the keys
+// and details of consecutive lines aligned in columns, e.g.
+//
+//	↑ blog/index.html                          not found
+func (d *Deployer) formatAction(a fileAction, key, detail string) string {
+	s := a.symbol + " " + key
+	if pad := keyColumnWidth - len([]rune(key)); pad > 0 {
+		s += strings.Repeat(" ", pad)
+	}
+	if d.color {
+		s = a.color + s + colorReset
+	}
+	return s + " " + detail + "\n"
+}
+
+// maxDeletedPrinted is the number of deleted keys printed
+// at the default verbosity, all are printed with -v.
+const maxDeletedPrinted = 50
+
+// printDeleted prints the keys deleted, up to maxDeletedPrinted.
+func (d *Deployer) printDeleted(keys []string) {
+	for i, key := range keys {
+		if i == maxDeletedPrinted && !d.cfg.Verbose {
+			d.Printf("… and %d more\n", len(keys)-i)
+			return
+		}
+		d.Printf("%s", d.formatAction(actionDelete, key, "deleted"))
+	}
+}
+
+// topDirectory returns the top level directory of key below the bucket
+// path, e.g. "blog/" for "blog/2023/post.html", or "/" for the files
+// at the root.
+func topDirectory(bucketPath, key string) string {
+	key = strings.TrimPrefix(key, strings.Trim(bucketPath, "/")+"/")
+	if i := strings.Index(key, "/"); i > 0 {
+		return key[:i+1]
+	}
+	return "/"
+}
+
+// countDirectory applies fn to the stats of the top level directory of key.
+func (d *Deployer) countDirectory(key string, fn func(s *DirectoryStats)) {
+	dir := topDirectory(d.cfg.BucketPath, key)
+	d.dirMu.Lock()
+	defer d.dirMu.Unlock()
+	if d.stats.Directories == nil {
+		d.stats.Directories = make(map[string]*DirectoryStats)
+	}
+	s, found := d.stats.Directories[dir]
+	if !found {
+		s = &DirectoryStats{}
+		d.stats.Directories[dir] = s
+	}
+	fn(s)
+}
+
+// DirectorySummary returns a formatted summary of the stats per top level
+// directory, one line per directory, aligned in columns.
+func (d DeployStats) DirectorySummary() string {
+	dirs := make([]string, 0, len(d.Directories))
+	for dir := range d.Directories {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, dir := range dirs {
+		s := d.Directories[dir]
+		fmt.Fprintf(w, "%s\tuploaded %d,\tskipped %d,\tdeleted %d\n", dir, s.Uploaded, s.Skipped, s.Deleted)
+	}
+	w.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
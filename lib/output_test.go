@@ -0,0 +1,85 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFormatAction(t *testing.T) {
+	c := qt.New(t)
+
+	d := &Deployer{cfg: &Config{}}
+	c.Assert(d.formatAction(actionUpload, "blog/index.html", "not found"), qt.Equals, "↑ blog/index.html                          not found\n")
+	c.Assert(d.formatAction(actionUpload, "a/very/long/key/that/is/longer/than/the/column.html", "size"), qt.Equals, "↑ a/very/long/key/that/is/longer/than/the/column.html size\n")
+
+	d.color = true
+	c.Assert(d.formatAction(actionDelete, "old.html", "not found in source, deleting."), qt.Equals, "\x1b[31m✗ old.html"+
+		"                                \x1b[0m not found in source, deleting.\n")
+
+	c.Assert(useColor(&Config{NoColor: true}), qt.IsFalse)
+	t.Setenv("NO_COLOR", "1")
+	c.Assert(useColor(&Config{}), qt.IsFalse)
+}
+
+func TestPrintDeleted(t *testing.T) {
+	c := qt.New(t)
+
+	var keys []string
+	for i := 0; i < maxDeletedPrinted+2; i++ {
+		keys = append(keys, fmt.Sprintf("file%02d.html", i))
+	}
+
+	var buf bytes.Buffer
+	d := &Deployer{cfg: &Config{}, printer: newPrinter(&buf)}
+	d.printDeleted(keys)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, qt.HasLen, maxDeletedPrinted+1)
+	c.Assert(lines[0], qt.Equals, "✗ file00.html                              deleted")
+	c.Assert(lines[maxDeletedPrinted], qt.Equals, "… and 2 more")
+
+	buf.Reset()
+	d.cfg.Verbose = true
+	d.printDeleted(keys)
+	c.Assert(strings.Count(buf.String(), "\n"), qt.Equals, len(keys))
+}
+
+func TestTopDirectory(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(topDirectory("", "index.html"), qt.Equals, "/")
+	c.Assert(topDirectory("", "blog/2023/post.html"), qt.Equals, "blog/")
+	c.Assert(topDirectory("", "blog/"), qt.Equals, "blog/")
+	c.Assert(topDirectory("site", "site/blog/post.html"), qt.Equals, "blog/")
+	c.Assert(topDirectory("/site/", "site/index.html"), qt.Equals, "/")
+}
+
+func TestDeployDirectoryStats(t *testing.T) {
+	c := qt.New(t)
+
+	store, _ := newTestStore(0, "")
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		baseStore:  store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, []string{"deleteme.txt"})
+	c.Assert(stats.Directories, qt.DeepEquals, map[string]*DirectoryStats{"/": {Uploaded: 3, Skipped: 1, Deleted: 1}})
+
+	stats.Directories["blog/"] = &DirectoryStats{Uploaded: 12, Deleted: 2}
+	c.Assert(stats.DirectorySummary(), qt.Equals, "/      uploaded 3,   skipped 1,  deleted 1\nblog/  uploaded 12,  skipped 0,  deleted 2")
+}
@@ -0,0 +1,112 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// remoteACLChecker is implemented by stores that upload with ACLs, which
+// fail on buckets with Object Ownership set to "Bucket owner enforced".
+type remoteACLChecker interface {
+	// ACLsDisabled reports whether the uploads are configured with an
+	// ACL that the bucket will reject.
+	ACLsDisabled(ctx context.Context) (bool, error)
+
+	// DisableACLs makes the uploads skip the ACL.
+	DisableACLs()
+}
+
+type ownershipHandler interface {
+	GetBucketOwnershipControls(ctx context.Context, params *s3.GetBucketOwnershipControlsInput, optFns ...func(*s3.Options)) (*s3.GetBucketOwnershipControlsOutput, error)
+}
+
+func (s *s3Store) ACLsDisabled(ctx context.Context) (bool, error) {
+	if (s.acl == "" || s.acl == "private") && len(s.grants) == 0 {
+		// The default ACL is accepted by all buckets.
+		return false, nil
+	}
+	if isAccessPoint(s.bucket) {
+		// The ownership controls can only be read from the bucket.
+		return false, nil
+	}
+	return bucketOwnerEnforced(ctx, s.svc, s.bucket, s.expectedBucketOwner)
+}
+
+func (s *s3Store) DisableACLs() {
+	s.acl = ""
+	s.grants = nil
+}
+
+func (s *noUpdateStore) ACLsDisabled(ctx context.Context) (bool, error) {
+	if c, ok := s.readOps.(remoteACLChecker); ok {
+		return c.ACLsDisabled(ctx)
+	}
+	return false, nil
+}
+
+func (s *noUpdateStore) DisableACLs() {
+	if c, ok := s.readOps.(remoteACLChecker); ok {
+		c.DisableACLs()
+	}
+}
+
+// bucketOwnerEnforced reports whether bucket has Object Ownership
+// set to "Bucket owner enforced", i.e. ACLs disabled.
+func bucketOwnerEnforced(ctx context.Context, svc ownershipHandler, bucket string, expectedOwner *string) (bool, error) {
+	out, err := svc.GetBucketOwnershipControls(ctx, &s3.GetBucketOwnershipControlsInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: expectedOwner,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "OwnershipControlsNotFoundError" {
+			// Buckets created before ownership controls have ACLs enabled.
+			return false, nil
+		}
+		return false, err
+	}
+	if out.OwnershipControls == nil {
+		return false, nil
+	}
+	for _, rule := range out.OwnershipControls.Rules {
+		if rule.ObjectOwnership == types.ObjectOwnershipBucketOwnerEnforced {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkACLs fails fast if the uploads are configured with an ACL, but ACLs
+// are disabled on the bucket, or skips the ACL if -acl-fallback is set.
+func (d *Deployer) checkACLs(ctx context.Context, s remoteStore) error {
+	c, ok := s.(remoteACLChecker)
+	if !ok {
+		return nil
+	}
+	disabled, err := c.ACLsDisabled(ctx)
+	if err != nil {
+		// E.g. missing s3:GetBucketOwnershipControls permission.
+		d.Printf("WARNING: failed to check whether ACLs are enabled on bucket %q: %s\n", d.cfg.BucketName, err)
+		return nil
+	}
+	if !disabled {
+		return nil
+	}
+	if d.cfg.ACLFallback {
+		d.Printf("WARNING: ACLs are disabled on bucket %q (Object Ownership \"Bucket owner enforced\"), uploading without ACL.\n", d.cfg.BucketName)
+		c.DisableACLs()
+		return nil
+	}
+	return fmt.Errorf("ACLs are disabled on bucket %q (Object Ownership \"Bucket owner enforced\"), so uploads with an ACL or grants fail; use a bucket policy for public access and remove -acl and any grants, enable ACLs on the bucket, or set -acl-fallback to upload without ACL", d.cfg.BucketName)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBucketOwnerEnforced(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	enforced, err := bucketOwnerEnforced(ctx, ownershipTestHandler{ownership: types.ObjectOwnershipBucketOwnerEnforced}, "example.com", nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(enforced, qt.IsTrue)
+
+	enforced, err = bucketOwnerEnforced(ctx, ownershipTestHandler{ownership: types.ObjectOwnershipBucketOwnerPreferred}, "example.com", nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(enforced, qt.IsFalse)
+
+	// No ownership controls.
+	enforced, err = bucketOwnerEnforced(ctx, ownershipTestHandler{err: &smithy.GenericAPIError{Code: "OwnershipControlsNotFoundError"}}, "example.com", nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(enforced, qt.IsFalse)
+
+	_, err = bucketOwnerEnforced(ctx, ownershipTestHandler{err: errors.New("access denied")}, "example.com", nil)
+	c.Assert(err, qt.ErrorMatches, "access denied")
+}
+
+func TestDeployACLsDisabled(t *testing.T) {
+	c := qt.New(t)
+
+	newConfig := func(store remoteStore) *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			baseStore:  store,
+		}
+	}
+
+	store, m := newTestStore(0, "")
+	s := &aclTestStore{testStore: store.(*testStore)}
+	_, err := Deploy(newConfig(s))
+	c.Assert(err, qt.ErrorMatches, `ACLs are disabled on bucket "example.com".*set -acl-fallback to upload without ACL`)
+	c.Assert(s.disabled, qt.IsFalse)
+	// Nothing uploaded or deleted.
+	c.Assert(m["main.css"].ETag(), qt.Equals, `"changed"`)
+	c.Assert(m, qt.HasLen, 3)
+
+	store, _ = newTestStore(0, "")
+	s = &aclTestStore{testStore: store.(*testStore)}
+	cfg := newConfig(s)
+	cfg.ACLFallback = true
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.disabled, qt.IsTrue)
+	c.Assert(stats.Uploaded, qt.Not(qt.Equals), uint64(0))
+}
+
+// aclTestStore is a store where the uploads are configured
+// with an ACL, but ACLs are disabled on the bucket.
+type aclTestStore struct {
+	*testStore
+	disabled bool
+}
+
+func (s *aclTestStore) ACLsDisabled(ctx context.Context) (bool, error) {
+	return !s.disabled, nil
+}
+
+func (s *aclTestStore) DisableACLs() {
+	s.disabled = true
+}
+
+type ownershipTestHandler struct {
+	ownership types.ObjectOwnership
+	err       error
+}
+
+func (h ownershipTestHandler) GetBucketOwnershipControls(ctx context.Context, params *s3.GetBucketOwnershipControlsInput, optFns ...func(*s3.Options)) (*s3.GetBucketOwnershipControlsOutput, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	return &s3.GetBucketOwnershipControlsOutput{
+		OwnershipControls: &types.OwnershipControls{
+			Rules: []types.OwnershipControlsRule{{ObjectOwnership: h.ownership}},
+		},
+	}, nil
+}
@@ -0,0 +1,244 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The version of the plan file format.
+const deployPlanVersion = 1
+
+// DeployPlan is a saved plan of the changes a deploy will make,
+// created by PlanDeploy and executed by ApplyPlan.
+type DeployPlan struct {
+	Version int       `json:"version"`
+	Bucket  string    `json:"bucket"`
+	Path    string    `json:"path,omitempty"`
+	Created time.Time `json:"created"`
+
+	Uploads []PlannedUpload `json:"uploads"`
+	// The remote keys to delete, limited by MaxDelete when applied.
+	Deletes []string `json:"deletes"`
+	// The keys to invalidate in the CDN, before any path normalization.
+	Invalidations []string `json:"invalidations,omitempty"`
+	// The number of remote files when planned, for -max-delete-percent.
+	RemoteFiles uint64 `json:"remoteFiles,omitempty"`
+}
+
+// PlannedUpload is a local file to upload in a DeployPlan.
+type PlannedUpload struct {
+	Key string `json:"key"`
+	// The local path, relative to the source directory.
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// The ETag and size of the content to upload, used to verify that
+	// the local file hasn't changed when the plan is applied.
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+	// Set when the file should be copied from the reference bucket.
+	CopyFrom string `json:"copyFrom,omitempty"`
+	// Set to the remote key to be deleted to copy the file from (-detect-moves).
+	MoveFrom string `json:"moveFrom,omitempty"`
+	// Set when the file is unchanged, but its remote metadata
+	// should be checked (-reconcile-metadata).
+	MetadataOnly bool `json:"metadataOnly,omitempty"`
+}
+
+func (p *DeployPlan) add(cfg *Config, uploads, reconciles []*osFile, deletes []string) {
+	for _, f := range uploads {
+		p.Uploads = append(p.Uploads, newPlannedUpload(f))
+		if len(cfg.CDNDistributionIDs) > 0 {
+			p.Invalidations = append(p.Invalidations, f.Key())
+		}
+	}
+	for _, f := range reconciles {
+		u := newPlannedUpload(f)
+		u.Reason = "metadata"
+		u.MetadataOnly = true
+		p.Uploads = append(p.Uploads, u)
+	}
+	p.Deletes = append(p.Deletes, deletes...)
+	if len(cfg.CDNDistributionIDs) > 0 {
+		p.Invalidations = append(p.Invalidations, deletes...)
+	}
+}
+
+func newPlannedUpload(f *osFile) PlannedUpload {
+	return PlannedUpload{
+		Key:      f.Key(),
+		Path:     f.relPath,
+		Reason:   string(f.reason),
+		ETag:     f.ETag(),
+		Size:     f.Size(),
+		CopyFrom: f.copyFrom,
+		MoveFrom: f.moveFrom,
+	}
+}
+
+// Summary returns a formatted summary of the planned changes.
+func (p *DeployPlan) Summary() string {
+	var uploads, copies, moves, metadata int
+	for _, u := range p.Uploads {
+		switch {
+		case u.MetadataOnly:
+			metadata++
+		case u.CopyFrom != "":
+			copies++
+		case u.MoveFrom != "":
+			moves++
+		default:
+			uploads++
+		}
+	}
+	s := fmt.Sprintf("Plan: upload %d, delete %d", uploads, len(p.Deletes))
+	if copies > 0 {
+		s += fmt.Sprintf(", copy %d from reference", copies)
+	}
+	if moves > 0 {
+		s += fmt.Sprintf(", move %d", moves)
+	}
+	if metadata > 0 {
+		s += fmt.Sprintf(", check metadata of %d", metadata)
+	}
+	return s
+}
+
+// WriteFile writes the plan as JSON to filename.
+func (p *DeployPlan) WriteFile(filename string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0o644)
+}
+
+// ReadPlanFile reads a plan written by DeployPlan.WriteFile.
+func ReadPlanFile(filename string) (*DeployPlan, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p DeployPlan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid plan file %q: %w", filename, err)
+	}
+	return &p, nil
+}
+
+// PlanDeploy compares the local and the remote files and returns the
+// changes a deploy would make, without making any remote changes.
+// Use ApplyPlan to execute it, e.g. after it's been reviewed.
+func PlanDeploy(ctx context.Context, cfg *Config) (*DeployPlan, error) {
+	d, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return d.Plan(ctx)
+}
+
+// ApplyPlan deploys the changes in p, created by PlanDeploy with the same
+// configuration. It fails if any of the local files to upload have
+// changed since the plan was created.
+func ApplyPlan(ctx context.Context, cfg *Config, p *DeployPlan) (DeployStats, error) {
+	if p.Version != deployPlanVersion {
+		return DeployStats{}, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	if p.Bucket != cfg.BucketName || p.Path != cfg.BucketPath {
+		return DeployStats{}, fmt.Errorf("the plan is for %q, not %q", pathJoin(p.Bucket, p.Path), pathJoin(cfg.BucketName, cfg.BucketPath))
+	}
+	return runDeploy(ctx, cfg, p)
+}
+
+// applyPlan enqueues the changes in p, verifying that the local files
+// are the same as when the plan was created.
+func (d *Deployer) applyPlan(ctx context.Context, p *DeployPlan) error {
+	defer close(d.filesToUpload)
+
+	var uploads, reconciles []*osFile
+	for _, u := range p.Uploads {
+		f, err := d.plannedFile(u)
+		if err != nil {
+			return err
+		}
+		if u.MetadataOnly {
+			f.reconcile = true
+			reconciles = append(reconciles, f)
+		} else {
+			uploads = append(uploads, f)
+		}
+	}
+	d.filesToDelete = p.Deletes
+	d.stats.RemoteFiles = p.RemoteFiles
+
+	return d.enqueuePlanned(ctx, uploads, reconciles)
+}
+
+// plannedFile opens the local file of u and verifies that it's unchanged.
+func (d *Deployer) plannedFile(u PlannedUpload) (*osFile, error) {
+	var (
+		abs string
+		fi  os.FileInfo
+		err error
+	)
+	if d.cfg.SourceFS != nil {
+		abs = u.Path
+		fi, err = fs.Stat(d.cfg.SourceFS, abs)
+	} else {
+		if abs, err = filepath.Abs(filepath.Join(d.cfg.SourcePath, filepath.FromSlash(u.Path))); err != nil {
+			return nil, err
+		}
+		fi, err = os.Stat(abs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s has changed since the plan was created: %w", u.Path, err)
+	}
+	f, err := newOSFile(d.cfg, u.Path, abs, fi)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg.IndexCopies && f.Key() != u.Key {
+		if c := f.indexCopy(); c != nil && c.Key() == u.Key {
+			f = c
+		}
+	}
+	if f.Key() != u.Key || f.Size() != u.Size || f.ETag() != u.ETag {
+		return nil, fmt.Errorf("%s has changed since the plan was created", u.Path)
+	}
+
+	f.reason = uploadReason(u.Reason)
+	f.copyFrom = u.CopyFrom
+	f.moveFrom = u.MoveFrom
+	f.stats = d.routeStatsFor(f)
+
+	return f, nil
+}
+
+// checkFreezeMarker returns an error if the remote freeze marker is present.
+// It's read from the remote, as it may have been added after the plan, the
+// checkpoint or the S3 Inventory report the remote files are read from.
+func (d *Deployer) checkFreezeMarker(ctx context.Context, baseStore remoteStore) error {
+	getter, ok := baseStore.(remoteObjectGetter)
+	if !ok {
+		return nil
+	}
+	freezeKey := pathJoin(d.cfg.BucketPath, freezeMarkerKey)
+	_, err := getter.GetObject(ctx, freezeKey)
+	if errors.Is(err, errObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return d.frozen(freezeKey)
+}
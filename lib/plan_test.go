@@ -0,0 +1,215 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	store, m := newTestStore(0, "")
+	newConfig := func() *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: testSourcePath(),
+			baseStore:  store,
+		}
+	}
+
+	p, err := PlanDeploy(ctx, newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Uploads, qt.HasLen, 3)
+	c.Assert(p.Deletes, qt.DeepEquals, []string{"deleteme.txt"})
+	c.Assert(p.Summary(), qt.Equals, "Plan: upload 3, delete 1")
+	// No remote changes.
+	c.Assert(m, qt.HasLen, 3)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	c.Assert(p.WriteFile(planFile), qt.IsNil)
+	p, err = ReadPlanFile(planFile)
+	c.Assert(err, qt.IsNil)
+
+	cfg := newConfig()
+	cfg.BucketName = "example.org"
+	_, err = ApplyPlan(ctx, cfg, p)
+	c.Assert(err, qt.ErrorMatches, `the plan is for "example.com", not "example.org"`)
+
+	stats, err := ApplyPlan(ctx, newConfig(), p)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 3, skipped 0 (100% changed)")
+	assertKeys(t, m, ".s3deploy.yml", "main.css", "index.html", "ab.txt")
+	c.Assert(m["deleteme.txt"], qt.IsNil)
+}
+
+func TestApplyPlanChangedLocalFile(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	source := c.TempDir()
+	writeTestFiles(c, source, map[string]string{
+		"index.html": "<h1>Hello</h1>",
+		"main.css":   "body { color: red; }",
+	})
+
+	store, m := newTestStore(0, "")
+	newConfig := func() *Config {
+		return &Config{
+			BucketName: "example.com",
+			RegionName: "eu-west-1",
+			MaxDelete:  300,
+			Silent:     true,
+			SourcePath: source,
+			baseStore:  store,
+		}
+	}
+
+	p, err := PlanDeploy(ctx, newConfig())
+	c.Assert(err, qt.IsNil)
+
+	writeTestFiles(c, source, map[string]string{"main.css": "body { color: blue; }"})
+	_, err = ApplyPlan(ctx, newConfig(), p)
+	c.Assert(err, qt.ErrorMatches, "main.css has changed since the plan was created")
+	c.Assert(m["index.html"], qt.IsNil)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+
+	// A freeze marker added after the plan was created.
+	writeTestFiles(c, source, map[string]string{"main.css": "body { color: red; }"})
+	m[freezeMarkerKey] = &testFile{key: freezeMarkerKey}
+	_, err = ApplyPlan(ctx, newConfig(), p)
+	c.Assert(err, qt.ErrorMatches, "deploys are frozen.*")
+	c.Assert(m["index.html"], qt.IsNil)
+}
+
+func TestDeployerPlanFilterApply(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	store, m := newTestStore(0, "")
+	d, err := New(&Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: testSourcePath(),
+		baseStore:  store,
+	})
+	c.Assert(err, qt.IsNil)
+
+	p, err := d.Plan(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Stats().Skipped, qt.Equals, uint64(1))
+	c.Assert(d.Stats().RemoteFiles, qt.Equals, uint64(3))
+
+	// Leave out index.html and the deletes.
+	var uploads []PlannedUpload
+	for _, u := range p.Uploads {
+		if u.Key != "index.html" {
+			uploads = append(uploads, u)
+		}
+	}
+	p.Uploads = uploads
+	p.Deletes = nil
+
+	stats, err := d.Apply(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Uploaded, qt.Equals, uint64(2))
+	c.Assert(d.Stats(), qt.DeepEquals, stats)
+	c.Assert(m["index.html"], qt.IsNil)
+	c.Assert(m["main.css"], qt.IsNotNil)
+	c.Assert(m["deleteme.txt"], qt.IsNotNil)
+}
+
+func TestDeployerPlanCaseConflict(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("needs a case-sensitive file system")
+	}
+	c := qt.New(t)
+
+	// More files to walk after the conflict.
+	source := c.TempDir()
+	writeTestFiles(c, source, map[string]string{
+		"About.html": "About",
+		"about.html": "about",
+		"b.html":     "b",
+		"c.html":     "c",
+		"d.html":     "d",
+	})
+
+	store, _ := newTestStore(0, "")
+	d, err := New(&Config{
+		BucketName:    "example.com",
+		RegionName:    "eu-west-1",
+		MaxDelete:     300,
+		Silent:        true,
+		SourcePath:    source,
+		CaseConflicts: caseConflictsError,
+		baseStore:     store,
+	})
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = d.Plan(ctx)
+	c.Assert(err, qt.ErrorMatches, `.* only differ by case, .*`)
+	c.Assert(ctx.Err(), qt.IsNil)
+}
+
+func TestPlanDeployFailsMidWalk(t *testing.T) {
+	c := qt.New(t)
+
+	source := c.TempDir()
+	page := strings.Repeat("<p>Hello</p>", 100)
+	writeTestFiles(c, source, map[string]string{
+		"a.html": page,
+		"b.html": page,
+		"c.html": page,
+	})
+
+	// The first file walked differs from the remote,
+	// and comparing the content fails.
+	store := newTestStoreFrom(map[string]file{
+		"a.html": failingMetadataFile{&testFile{key: "a.html", etag: `"changed"`}},
+	}, 0)
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "eu-west-1",
+		MaxDelete:  300,
+		Silent:     true,
+		SourcePath: source,
+		baseStore:  store,
+	}
+	cfg.fileConf.Routes = routes{{Route: "^.+\\.html$", Gzip: true}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := PlanDeploy(ctx, cfg)
+	c.Assert(err, qt.ErrorMatches, `failed to get metadata for "a.html": fail`)
+	c.Assert(ctx.Err(), qt.IsNil)
+}
+
+// failingMetadataFile is a remote file whose metadata can't be fetched.
+type failingMetadataFile struct {
+	*testFile
+}
+
+func (f failingMetadataFile) Metadata(ctx context.Context) (objectMetadata, error) {
+	return objectMetadata{}, errors.New("fail")
+}
@@ -0,0 +1,121 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// processor transforms the content of a file before it's compressed
+// and uploaded.
+type processor interface {
+	// process returns the processed content of a file with the given
+	// media type, or b if there's nothing to do.
+	process(mediaType string, b []byte) ([]byte, error)
+}
+
+// processorFunc adapts a function to the processor interface.
+type processorFunc func(mediaType string, b []byte) ([]byte, error)
+
+func (f processorFunc) process(mediaType string, b []byte) ([]byte, error) {
+	return f(mediaType, b)
+}
+
+// processors are the processors available in the route's process option.
+var processors = map[string]func() (processor, error){
+	"optimize-png": func() (processor, error) {
+		return processorFunc(optimizePNG), nil
+	},
+	"mozjpeg": func() (processor, error) {
+		return newCommandProcessor("image/jpeg", "jpegtran", "-copy", "all", "-optimize")
+	},
+}
+
+func newProcessor(name string) (processor, error) {
+	newp, found := processors[name]
+	if !found {
+		var names []string
+		for k := range processors {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown processor %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	p, err := newp()
+	if err != nil {
+		return nil, fmt.Errorf("processor %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// processContent runs the processors in order on b,
+// keeping a result only if it's smaller.
+func processContent(processors []processor, mediaType string, b []byte) ([]byte, error) {
+	for _, p := range processors {
+		processed, err := p.process(mediaType, b)
+		if err != nil {
+			return nil, err
+		}
+		if len(processed) < len(b) {
+			b = processed
+		}
+	}
+	return b, nil
+}
+
+// optimizePNG re-encodes PNG images with the best compression.
+// The pixels are unchanged, but ancillary chunks (e.g. text and
+// color profiles) are dropped.
+func optimizePNG(mediaType string, b []byte) ([]byte, error) {
+	if mediaType != "image/png" {
+		return b, nil
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// commandProcessor pipes the content through an external command.
+type commandProcessor struct {
+	mediaType string
+	path      string
+	args      []string
+}
+
+func newCommandProcessor(mediaType, name string, args ...string) (processor, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return &commandProcessor{mediaType: mediaType, path: path, args: args}, nil
+}
+
+func (p *commandProcessor) process(mediaType string, b []byte) ([]byte, error) {
+	if mediaType != p.mediaType {
+		return b, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(p.path, p.args...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", p.path, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
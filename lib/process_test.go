@@ -0,0 +1,97 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func testPNG(c *qt.C) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	c.Assert(enc.Encode(&buf, img), qt.IsNil)
+	return buf.Bytes()
+}
+
+func TestOptimizePNG(t *testing.T) {
+	c := qt.New(t)
+
+	b := testPNG(c)
+	optimized, err := optimizePNG("image/png", b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(optimized) < len(b), qt.IsTrue)
+
+	img1, err := png.Decode(bytes.NewReader(b))
+	c.Assert(err, qt.IsNil)
+	img2, err := png.Decode(bytes.NewReader(optimized))
+	c.Assert(err, qt.IsNil)
+	c.Assert(img2.Bounds(), qt.Equals, img1.Bounds())
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			c.Assert(img2.At(x, y), qt.DeepEquals, img1.At(x, y))
+		}
+	}
+
+	// Not a PNG.
+	same, err := optimizePNG("image/jpeg", []byte("jpeg"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(same), qt.Equals, "jpeg")
+
+	_, err = optimizePNG("image/png", []byte("not a png"))
+	c.Assert(err, qt.IsNotNil)
+}
+
+func TestNewProcessor(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := newProcessor("optimize-png")
+	c.Assert(err, qt.IsNil)
+	_, err = newProcessor("nope")
+	c.Assert(err, qt.ErrorMatches, `unknown processor "nope", must be one of mozjpeg, optimize-png`)
+
+	if _, lerr := exec.LookPath("jpegtran"); lerr != nil {
+		_, err = newProcessor("mozjpeg")
+		c.Assert(err, qt.ErrorMatches, `processor "mozjpeg": .*`)
+	}
+}
+
+func TestOSFileProcess(t *testing.T) {
+	c := qt.New(t)
+
+	b := testPNG(c)
+	filename := filepath.Join(t.TempDir(), "image.png")
+	c.Assert(os.WriteFile(filename, b, 0o644), qt.IsNil)
+	fi, err := os.Stat(filename)
+	c.Assert(err, qt.IsNil)
+
+	cfg := &Config{BucketName: "example.com"}
+	cfg.fileConf.Routes = routes{{Route: `\.png$`, Process: []string{"optimize-png"}}}
+	c.Assert(cfg.Init(), qt.IsNil)
+
+	of, err := newOSFile(cfg, "image.png", filename, fi)
+	c.Assert(err, qt.IsNil)
+	c.Assert(of.Size() < int64(len(b)), qt.IsTrue)
+	c.Assert(of.rawSize, qt.Equals, of.Size())
+
+	cfg = &Config{BucketName: "example.com"}
+	cfg.fileConf.Routes = routes{{Route: `\.png$`, Process: []string{"nope"}}}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `.*: unknown processor "nope".*`)
+}
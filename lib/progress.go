@@ -0,0 +1,70 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ProgressEventType is the type of a ProgressEvent.
+type ProgressEventType string
+
+const (
+	// A file was uploaded, or copied server side.
+	ProgressFileUploaded ProgressEventType = "fileUploaded"
+	// A file was unchanged.
+	ProgressFileSkipped ProgressEventType = "fileSkipped"
+	// A batch of remote files was deleted.
+	ProgressDeleteBatch ProgressEventType = "deleteBatch"
+	// A CDN invalidation was created.
+	ProgressInvalidationCreated ProgressEventType = "invalidationCreated"
+)
+
+// ProgressEvent is sent on Config.Progress during a deploy.
+type ProgressEvent struct {
+	Type ProgressEventType
+
+	// The remote key of the file uploaded or skipped,
+	// and the reason it was uploaded.
+	Key    string
+	Reason string
+
+	// The remote keys deleted in the batch.
+	Keys []string
+
+	// The CDN distribution and the invalidation created in it.
+	DistributionID string
+	InvalidationID string
+
+	// The number of files uploaded, skipped and deleted so far.
+	Uploaded uint64
+	Skipped  uint64
+	Deleted  uint64
+}
+
+// progress sends ev to Config.Progress, if set.
+func (d *Deployer) progress(ev ProgressEvent) {
+	if d.cfg.Progress == nil {
+		return
+	}
+	ev.Uploaded = atomic.LoadUint64(&d.stats.Uploaded)
+	ev.Skipped = atomic.LoadUint64(&d.stats.Skipped)
+	ev.Deleted = atomic.LoadUint64(&d.stats.Deleted)
+	d.cfg.Progress <- ev
+}
+
+// progressInvalidations sends an event for each of the CDN invalidations created.
+func (d *Deployer) progressInvalidations(ids map[string]string) {
+	distributionIDs := make([]string, 0, len(ids))
+	for id := range ids {
+		distributionIDs = append(distributionIDs, id)
+	}
+	sort.Strings(distributionIDs)
+	for _, id := range distributionIDs {
+		d.progress(ProgressEvent{Type: ProgressInvalidationCreated, DistributionID: id, InvalidationID: ids[id]})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Prune deletes the remote files below the bucket path not found in the
+// source, as a deploy would, but without uploading anything. With patterns
+// (regular expressions matched against the keys relative to the bucket
+// path), the remote files matching any of them are deleted instead, with
+// the source not used. Ignored and kept remote files are never deleted.
+//
+// At most PruneMaxDelete files are deleted, and none with Try.
+func Prune(ctx context.Context, cfg *Config, patterns ...string) (DeployStats, error) {
+	var stats DeployStats
+
+	if err := cfg.Init(); err != nil {
+		return stats, err
+	}
+
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return stats, fmt.Errorf("invalid prune pattern %q: %w", pattern, err)
+		}
+		res[i] = re
+	}
+
+	var keys []string
+	if len(res) == 0 {
+		p, err := PlanDeploy(ctx, cfg)
+		if err != nil {
+			return stats, err
+		}
+		keys = p.Deletes
+		stats.RemoteFiles = p.RemoteFiles
+	}
+
+	if err := cfg.initSession(ctx); err != nil {
+		return stats, cfg.checkExpiredCredentials(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.Silent {
+		out = io.Discard
+	}
+	printer := newPrinter(out)
+
+	s := cfg.baseStore
+	if s == nil {
+		var err error
+		s, err = newTargetStore(cfg, printer)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if len(res) > 0 {
+		files, err := s.FileMap(ctx)
+		if err != nil {
+			return stats, cfg.checkExpiredCredentials(err)
+		}
+		stats.RemoteFiles = uint64(len(files))
+		keys = pruneMatches(cfg, files, res)
+	}
+	sort.Strings(keys)
+
+	if cfg.Try {
+		s = newNoUpdateStore(s)
+		printer.Println("This is a trial run, with no remote updates.")
+	}
+
+	err := newStore(cfg, s).DeleteObjects(
+		ctx,
+		keys,
+		withDeleteStats(&stats),
+		withMaxDelete(cfg.PruneMaxDelete),
+		withDeleteScope(cfg.DeleteScope))
+	if err != nil {
+		return stats, cfg.checkExpiredCredentials(err)
+	}
+
+	// The files are deleted in order, stopping at PruneMaxDelete.
+	stats.DeletedKeys = keys[:stats.Deleted]
+	for _, key := range stats.DeletedKeys {
+		printer.Printf("%s deleted\n", key)
+	}
+	if stats.Stale > 0 {
+		printer.Printf("WARNING: %d remote file(s) were left, as deleting them would exceed -prune-max-delete=%d\n", stats.Stale, cfg.PruneMaxDelete)
+	}
+
+	if len(stats.DeletedKeys) > 0 && !cfg.Try && len(cfg.CDNDistributionIDs) > 0 {
+		if cdn, ok := s.(remoteCDN); ok {
+			if err := cdn.InvalidateCDNCache(ctx, stats.DeletedKeys...); err != nil {
+				return stats, cfg.checkExpiredCredentials(err)
+			}
+			if c, ok := s.(remoteCDNPaths); ok {
+				stats.InvalidationPaths = c.InvalidatedPaths()
+				stats.Invalidations = c.InvalidationIDs()
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// pruneMatches returns the keys of the remote files below the bucket
+// path matching any of res, except for the ignored and kept files.
+func pruneMatches(cfg *Config, files map[string]file, res []*regexp.Regexp) []string {
+	// Not blog-old/ for blog.
+	prefix := strings.Trim(cfg.BucketPath, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var keys []string
+	for key := range files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if cfg.shouldIgnoreRemote(key) || cfg.shouldKeepRemote(key) {
+			continue
+		}
+		sub := key[len(prefix):]
+		for _, re := range res {
+			if re.MatchString(sub) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,93 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPrune(t *testing.T) {
+	c := qt.New(t)
+	source := testSourcePath()
+
+	store, m := newTestStore(0, "")
+	cfg := &Config{
+		BucketName:         "example.com",
+		ConfigFile:         filepath.Join(source, ".s3deploy.yml"),
+		SourcePath:         source,
+		MaxDelete:          0,
+		PruneMaxDelete:     10,
+		CDNDistributionIDs: Strings{"EABC123"},
+		Silent:             true,
+		baseStore:          store,
+	}
+	stats, err := Prune(context.Background(), cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(1))
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, []string{"deleteme.txt"})
+	c.Assert(stats.RemoteFiles, qt.Equals, uint64(3))
+	// Nothing uploaded.
+	assertKeys(t, m, "main.css", "ab.txt")
+	c.Assert(m["main.css"].ETag(), qt.Equals, `"changed"`)
+	c.Assert(store.(*testStore).invalidated, qt.DeepEquals, []string{"/deleteme.txt"})
+
+	newPatternStore := func() (remoteStore, map[string]file) {
+		m := map[string]file{
+			"site/index.html":     &testFile{key: "site/index.html"},
+			"site/old/a.html":     &testFile{key: "site/old/a.html"},
+			"site/old/b.html":     &testFile{key: "site/old/b.html"},
+			"site/tmp.txt":        &testFile{key: "site/tmp.txt"},
+			"site/keep/old/a.txt": &testFile{key: "site/keep/old/a.txt"},
+			"other/old/a.html":    &testFile{key: "other/old/a.html"},
+		}
+		return newTestStoreFrom(m, 0), m
+	}
+
+	store, m = newPatternStore()
+	cfg = &Config{
+		BucketName:     "example.com",
+		BucketPath:     "site",
+		PruneMaxDelete: 10,
+		Keep:           Strings{"^keep/"},
+		Silent:         true,
+		baseStore:      store,
+	}
+	stats, err = Prune(context.Background(), cfg, "^old/", `\.txt$`, "^keep/")
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, []string{"site/old/a.html", "site/old/b.html", "site/tmp.txt"})
+	assertKeys(t, m, "site/index.html", "site/keep/old/a.txt", "other/old/a.html")
+
+	store, m = newPatternStore()
+	cfg = &Config{BucketName: "example.com", BucketPath: "site", PruneMaxDelete: 1, MaxDelete: 10, Silent: true, baseStore: store}
+	stats, err = Prune(context.Background(), cfg, "^old/")
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(1))
+	c.Assert(stats.Stale, qt.Equals, uint64(1))
+	c.Assert(m, qt.HasLen, 5)
+
+	store, m = newPatternStore()
+	cfg = &Config{BucketName: "example.com", BucketPath: "site", PruneMaxDelete: 10, Try: true, Silent: true, baseStore: store}
+	stats, err = Prune(context.Background(), cfg, "^old/")
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(2))
+	c.Assert(m, qt.HasLen, 6)
+
+	// Only sharing the prefix of the bucket path.
+	store, m = newPatternStore()
+	m["site-old/a.txt"] = &testFile{key: "site-old/a.txt"}
+	cfg = &Config{BucketName: "example.com", BucketPath: "site", PruneMaxDelete: 10, Silent: true, baseStore: store}
+	stats, err = Prune(context.Background(), cfg, `\.txt$`)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stats.DeletedKeys, qt.DeepEquals, []string{"site/keep/old/a.txt", "site/tmp.txt"})
+	c.Assert(m["site-old/a.txt"], qt.IsNotNil)
+
+	_, err = Prune(context.Background(), &Config{BucketName: "example.com", Silent: true, baseStore: store}, "(")
+	c.Assert(err, qt.ErrorMatches, `invalid prune pattern "\(": .*`)
+}
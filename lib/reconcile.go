@@ -0,0 +1,220 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errMetadataNotSupported = errors.New("the remote store does not support metadata reconciliation")
+
+// contentMD5Header is the user metadata key (x-amz-meta-s3deploy-content-md5)
+// holding the MD5 of the uncompressed content of compressed files.
+const contentMD5Header = "S3deploy-Content-Md5"
+
+// mtimeHeader is the user metadata key (x-amz-meta-mtime) holding the
+// modification time of the local file (-preserve-mtime), in seconds since
+// the Unix epoch, the same as rclone uses.
+const mtimeHeader = "Mtime"
+
+// formatMtime formats t as seconds since the Unix epoch with
+// up to nanosecond precision, e.g. "1700000000.5".
+func formatMtime(t time.Time) string {
+	s := fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// objectMetadata is the part of a remote object's metadata
+// that is checked when reconciling.
+type objectMetadata struct {
+	ContentType     string
+	ContentEncoding string
+	// The MD5 of the uncompressed content, if stored by s3deploy.
+	ContentMD5 string
+	// The other headers (e.g. Cache-Control) and the user metadata,
+	// with canonical keys.
+	Headers map[string]string
+
+	// The size and ETag of the stored content.
+	Size int64
+	ETag string
+}
+
+// remoteMetadataReconciler is implemented by stores that can read and
+// replace the metadata of existing objects.
+type remoteMetadataReconciler interface {
+	HeadObject(ctx context.Context, key string) (objectMetadata, error)
+	// UpdateMetadata replaces the metadata of the remote object
+	// with the metadata of f, without uploading the content.
+	UpdateMetadata(ctx context.Context, f localFile) error
+}
+
+// metadataFile is implemented by remote files that can provide
+// their metadata, possibly fetched on demand.
+type metadataFile interface {
+	Metadata(ctx context.Context) (objectMetadata, error)
+}
+
+func localFileMetadata(f localFile) objectMetadata {
+	headers := f.Headers()
+	m := objectMetadata{
+		ContentType:     f.ContentType(),
+		ContentEncoding: headers["Content-Encoding"],
+		ContentMD5:      headers[contentMD5Header],
+		Headers:         make(map[string]string),
+		Size:            f.Size(),
+		ETag:            f.ETag(),
+	}
+	for k, v := range headers {
+		k = http.CanonicalHeaderKey(k)
+		switch k {
+		case "Content-Type", "Content-Encoding":
+		case "Expires":
+			m.Headers[k] = normalizeExpires(v)
+		default:
+			m.Headers[k] = v
+		}
+	}
+	return m
+}
+
+// normalizeExpires formats an Expires header the same way as S3 does,
+// or returns it as is if it can't be parsed.
+func normalizeExpires(s string) string {
+	t, err := time.Parse(time.RFC1123, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// diff returns a human readable description of the differences
+// between m and the wanted metadata, or an empty string if none.
+func (m objectMetadata) diff(wanted objectMetadata) string {
+	var s string
+	if !sameContentType(m.ContentType, wanted.ContentType) {
+		s += fmt.Sprintf("Content-Type %q => %q", m.ContentType, wanted.ContentType)
+	}
+	if m.ContentEncoding != wanted.ContentEncoding {
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("Content-Encoding %q => %q", m.ContentEncoding, wanted.ContentEncoding)
+	}
+
+	keys := make(map[string]bool)
+	for k := range m.Headers {
+		keys[k] = true
+	}
+	for k := range wanted.Headers {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		if k == mtimeHeader {
+			// The remote mtime is kept as long as the content is unchanged.
+			continue
+		}
+		if m.Headers[k] == wanted.Headers[k] {
+			continue
+		}
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s %q => %q", k, m.Headers[k], wanted.Headers[k])
+	}
+
+	return s
+}
+
+func sameContentType(a, b string) bool {
+	if a == b {
+		return true
+	}
+	mta, csa, erra := splitContentType(a)
+	mtb, csb, errb := splitContentType(b)
+	if erra != nil || errb != nil {
+		return false
+	}
+	return mta == mtb && csa == csb
+}
+
+// reconcileMetadata checks the metadata of the remote object for f
+// against the current rules, and fixes it if they disagree.
+func (d *Deployer) reconcileMetadata(ctx context.Context, f *osFile) error {
+	atomic.AddUint64(&d.stats.Skipped, uint64(1))
+	atomic.AddUint64(&f.stats.Skipped, uint64(1))
+
+	r, ok := d.store.(remoteMetadataReconciler)
+	if !ok {
+		return errMetadataNotSupported
+	}
+
+	remote, err := d.remoteMetadata(ctx, f)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata for %q: %w", f.Key(), err)
+	}
+
+	diff := remote.diff(localFileMetadata(f))
+	if diff == "" {
+		return nil
+	}
+
+	d.Printf("%s (metadata) %s\n", f.keyPath, diff)
+
+	if err := r.UpdateMetadata(ctx, f); err != nil {
+		return fmt.Errorf("failed to update metadata for %q: %w", f.Key(), err)
+	}
+
+	atomic.AddUint64(&d.stats.Reconciled, uint64(1))
+
+	return nil
+}
+
+// sameContent reports whether the remote object for f has the same
+// uncompressed content as f, even if the compressed content differs,
+// e.g. because it was compressed by another version of s3deploy.
+// With a hasher set (-hash), the hash in the metadata is compared instead.
+func (d *Deployer) sameContent(ctx context.Context, f *osFile) (bool, error) {
+	if f.contentMD5 == "" && f.hasher == nil {
+		return false, nil
+	}
+	remote, err := d.remoteMetadata(ctx, f)
+	if err != nil {
+		if errors.Is(err, errMetadataNotSupported) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get metadata for %q: %w", f.Key(), err)
+	}
+	if f.hasher != nil {
+		return remote.Headers[hashHeader(f.hasher)] == strings.Trim(f.ETag(), `"`), nil
+	}
+	return remote.ContentMD5 == f.contentMD5 && remote.ContentEncoding == f.contentEncoding, nil
+}
+
+// remoteMetadata returns the metadata of the remote object for f,
+// from the remote file itself if possible.
+func (d *Deployer) remoteMetadata(ctx context.Context, f *osFile) (objectMetadata, error) {
+	if mf, ok := f.remote.(metadataFile); ok {
+		return mf.Metadata(ctx)
+	}
+	r, ok := d.store.(remoteMetadataReconciler)
+	if !ok {
+		return objectMetadata{}, errMetadataNotSupported
+	}
+	return r.HeadObject(ctx, f.Key())
+}
@@ -0,0 +1,73 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var errCopyNotSupported = errors.New("the remote store does not support copying from a reference")
+
+// remoteCopier is implemented by stores that can copy objects
+// server side, e.g. from a reference bucket.
+type remoteCopier interface {
+	// CopyFrom copies srcBucket/srcKey to f's key,
+	// with the metadata of f.
+	CopyFrom(ctx context.Context, srcBucket, srcKey string, f localFile) error
+}
+
+// newReferenceStore creates a read-only store for the reference
+// bucket and path.
+func newReferenceStore(cfg *Config) (remoteStore, error) {
+	awsConfig, err := newAWSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{svc: s3.NewFromConfig(awsConfig), bucket: cfg.ReferenceBucket, bucketPath: cfg.ReferencePath}, nil
+}
+
+// referenceFileMap lists the files in the reference store, if configured.
+func (d *Deployer) referenceFileMap(ctx context.Context) (map[string]file, error) {
+	if !d.cfg.hasReference() {
+		return nil, nil
+	}
+
+	s := d.cfg.referenceStore
+	if s == nil {
+		var err error
+		s, err = newReferenceStore(d.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := s.FileMap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reference %s/%s: %w", d.cfg.ReferenceBucket, d.cfg.ReferencePath, err)
+	}
+	d.printf("Found %d reference files\n", len(m))
+
+	return m, nil
+}
+
+func (d *Deployer) copyFromReference(ctx context.Context, f *osFile) error {
+	c, ok := d.store.(remoteCopier)
+	if !ok {
+		return errCopyNotSupported
+	}
+	if err := c.CopyFrom(ctx, d.cfg.ReferenceBucket, f.copyFrom, f); err != nil {
+		return fmt.Errorf("failed to copy %q from reference: %w", f.copyFrom, err)
+	}
+	atomic.AddUint64(&d.stats.Copied, uint64(1))
+	atomic.AddUint64(&f.stats.Copied, uint64(1))
+	d.recordChange(f.Key(), "copied")
+	return nil
+}
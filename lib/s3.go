@@ -7,7 +7,14 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
@@ -15,12 +22,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	_ remoteStore = (*s3Store)(nil)
-	_ remoteCDN   = (*s3Store)(nil)
-	_ file        = (*s3File)(nil)
+	_ remoteStore              = (*s3Store)(nil)
+	_ remoteCDN                = (*s3Store)(nil)
+	_ remoteCanary             = (*s3Store)(nil)
+	_ remoteEdgeFunction       = (*s3Store)(nil)
+	_ remoteWebsite            = (*s3Store)(nil)
+	_ remoteBucketCreator      = (*s3Store)(nil)
+	_ remoteACLChecker         = (*s3Store)(nil)
+	_ remoteCDNPaths           = (*s3Store)(nil)
+	_ remoteObjectGetter       = (*s3Store)(nil)
+	_ remoteMetadataReconciler = (*s3Store)(nil)
+	_ remoteLister             = (*s3Store)(nil)
+	_ remoteCopier             = (*s3Store)(nil)
+	_ remoteInventoryReader    = (*s3Store)(nil)
+	_ file                     = (*s3File)(nil)
+	_ metadataFile             = (*s3File)(nil)
 )
 
 type s3Store struct {
@@ -29,11 +49,37 @@ type s3Store struct {
 	r          routes
 	svc        *s3.Client
 	acl        string
+	grants     map[string]string
 	cfc        *cloudFrontClient
+	canary     *canaryClient
+
+	edgeFunction *edgeFunctionClient
+
+	// Set to "requester" for requester-pays buckets.
+	requestPayer types.RequestPayer
+	// The account ID that must own the bucket, if set.
+	expectedBucketOwner *string
+
+	listConcurrency int
 }
 
 type s3File struct {
 	o types.Object
+
+	// Used to fetch the metadata on demand.
+	s        *s3Store
+	metaInit sync.Once
+	meta     objectMetadata
+	metaErr  error
+}
+
+// Metadata returns the object's metadata, fetched with a HEAD request
+// the first time it's needed.
+func (f *s3File) Metadata(ctx context.Context) (objectMetadata, error) {
+	f.metaInit.Do(func() {
+		f.meta, f.metaErr = f.s.HeadObject(ctx, f.Key())
+	})
+	return f.meta, f.metaErr
 }
 
 func (f *s3File) Key() string {
@@ -66,74 +112,380 @@ func newRemoteStore(cfg *Config, logger printer) (*s3Store, error) {
 		}
 	}
 
+	var edgeFunction *edgeFunctionClient
+	if cfg.CloudFrontFunction != "" {
+		edgeFunction, err = newEdgeFunctionClient(cf, logger, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var canary *canaryClient
+	if cfg.CanaryPolicyID != "" {
+		canary, err = newCanaryClient(cf, logger, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	acl := "private"
-	if cfg.ACL != "" {
+	if len(cfg.fileConf.grantHeaders) > 0 {
+		// Explicit grants and a canned ACL cannot be combined.
+		acl = ""
+	} else if cfg.ACL != "" {
 		acl = cfg.ACL
 	} else if cfg.PublicReadACL {
 		acl = "public-read"
 	}
 
-	client := s3.NewFromConfig(awsConfig)
+	client := newS3Client(cfg, awsConfig)
 
-	s = &s3Store{svc: client, cfc: cfc, acl: acl, bucket: cfg.BucketName, r: cfg.fileConf.Routes, bucketPath: cfg.BucketPath}
+	s = &s3Store{svc: client, cfc: cfc, canary: canary, edgeFunction: edgeFunction, acl: acl, bucket: cfg.BucketName, r: cfg.fileConf.Routes, bucketPath: cfg.BucketPath, grants: cfg.fileConf.grantHeaders, listConcurrency: cfg.ListConcurrency, requestPayer: types.RequestPayer(cfg.RequestPayer), expectedBucketOwner: aws.String(cfg.ExpectedBucketOwner)}
 
 	return s, nil
 }
 
+// newS3Client creates the S3 client for the bucket, with the
+// endpoint options in cfg.
+func newS3Client(cfg *Config, awsConfig aws.Config) *s3.Client {
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UseARNRegion = cfg.UseARNRegion
+		o.UseAccelerate = cfg.Accelerate
+		if cfg.DualStack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+		o.UsePathStyle = usePathStyle(cfg.EndpointURL)
+	})
+}
+
+// usePathStyle reports whether the bucket must be in the path of the
+// requests to endpoint, e.g. a local MinIO, as there's no DNS for
+// virtual-hosted buckets on localhost or IP addresses.
+func usePathStyle(endpoint string) bool {
+	if endpoint == "" {
+		return false
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	return host == "localhost" || strings.HasSuffix(host, ".localhost") || net.ParseIP(host) != nil
+}
+
 func (s *s3Store) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
-	m := make(map[string]file)
+	if s.listConcurrency > 1 {
+		return s.fileMapConcurrent(ctx)
+	}
 
-	listObjectsV2Response, err := s.svc.ListObjectsV2(ctx,
-		&s3.ListObjectsV2Input{
-			Bucket: aws.String(s.bucket),
-			Prefix: aws.String(s.bucketPath),
-		})
+	m := make(map[string]file)
 
+	var token string
 	for {
+		files, next, err := s.ListPage(ctx, token)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, o := range listObjectsV2Response.Contents {
-			m[*o.Key] = &s3File{o: o}
+		for _, f := range files {
+			m[f.Key()] = f
 		}
 
-		if listObjectsV2Response.IsTruncated {
-			listObjectsV2Response, err = s.svc.ListObjectsV2(ctx,
-				&s3.ListObjectsV2Input{
-					Bucket:            aws.String(s.bucket),
-					Prefix:            aws.String(s.bucketPath),
-					ContinuationToken: listObjectsV2Response.NextContinuationToken,
-				},
-			)
-		} else {
+		if next == "" {
 			break
 		}
+		token = next
+	}
 
+	return m, nil
+}
+
+// fileMapConcurrent lists the top level prefixes (directories) below
+// the bucket path concurrently, which is much faster than listing
+// page by page for buckets with many files spread over many prefixes.
+func (s *s3Store) fileMapConcurrent(ctx context.Context) (map[string]file, error) {
+	var (
+		mu       sync.Mutex
+		m        = make(map[string]file)
+		prefixes []string
+	)
+
+	// The files directly below the bucket path and the top level prefixes.
+	p := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(s.bucket),
+		Prefix:              aws.String(s.bucketPath),
+		Delimiter:           aws.String("/"),
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range out.Contents {
+			m[*o.Key] = &s3File{o: o, s: s}
+		}
+		for _, cp := range out.CommonPrefixes {
+			prefixes = append(prefixes, aws.ToString(cp.Prefix))
+		}
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.listConcurrency)
+
+	for _, prefix := range prefixes {
+		prefix := prefix
+		g.Go(func() error {
+			p := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+				Bucket:              aws.String(s.bucket),
+				Prefix:              aws.String(prefix),
+				RequestPayer:        s.requestPayer,
+				ExpectedBucketOwner: s.expectedBucketOwner,
+			})
+			for p.HasMorePages() {
+				out, err := p.NextPage(ctx)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				for _, o := range out.Contents {
+					m[*o.Key] = &s3File{o: o, s: s}
+				}
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
 
 	return m, nil
 }
 
+func (s *s3Store) ListPage(ctx context.Context, token string) ([]file, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:              aws.String(s.bucket),
+		Prefix:              aws.String(s.bucketPath),
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+
+	out, err := s.svc.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := make([]file, len(out.Contents))
+	for i, o := range out.Contents {
+		files[i] = &s3File{o: o, s: s}
+	}
+
+	var next string
+	if out.IsTruncated {
+		next = aws.ToString(out.NextContinuationToken)
+	}
+
+	return files, next, nil
+}
+
+func (s *s3Store) GetObject(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
 func (s *s3Store) Put(ctx context.Context, f localFile, opts ...opOption) error {
 	input := &s3.PutObjectInput{
-		Bucket:        aws.String(s.bucket),
-		Key:           aws.String(f.Key()),
-		Body:          f.Content(),
-		ACL:           types.ObjectCannedACL(s.acl),
-		ContentType:   aws.String(f.ContentType()),
-		ContentLength: f.Size(),
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(f.Key()),
+		ACL:                 types.ObjectCannedACL(s.acl),
+		ContentType:         aws.String(f.ContentType()),
+		ContentLength:       f.Size(),
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
 	}
 
+	s.applyGrantsToPutObjectInput(input)
+
 	if err := s.applyMetadataToPutObjectInput(input, f); err != nil {
 		return err
 	}
 
+	var blocks deltaBlocks
+	if df, ok := f.(deltaFile); ok {
+		blocks = df.deltaBlocks()
+	}
+	if blocks != nil {
+		conf, err := optsToConfig(opts...)
+		if err != nil {
+			return err
+		}
+		copied, err := putDelta(ctx, s.svc, input, f.Content(), blocks)
+		if err == nil {
+			conf.deltaCollector(copied)
+		}
+		return err
+	}
+
+	// Set last, as the metadata may be calculated from the content.
+	input.Body = f.Content()
+
 	_, err := s.svc.PutObject(ctx, input)
 
 	return err
 }
 
+func (s *s3Store) GetBucketObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Store) ListBucketPrefixes(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	paginator := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.CommonPrefixes {
+			prefixes = append(prefixes, aws.ToString(p.Prefix))
+		}
+	}
+	return prefixes, nil
+}
+
+func (s *s3Store) HeadObject(ctx context.Context, key string) (objectMetadata, error) {
+	out, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
+	})
+	if err != nil {
+		return objectMetadata{}, err
+	}
+	m := objectMetadata{
+		ContentType:     aws.ToString(out.ContentType),
+		ContentEncoding: aws.ToString(out.ContentEncoding),
+		Headers:         make(map[string]string),
+		Size:            out.ContentLength,
+		ETag:            aws.ToString(out.ETag),
+	}
+	for k, v := range map[string]*string{
+		"Cache-Control":       out.CacheControl,
+		"Content-Disposition": out.ContentDisposition,
+		"Content-Language":    out.ContentLanguage,
+	} {
+		if v != nil {
+			m.Headers[k] = *v
+		}
+	}
+	if out.Expires != nil {
+		m.Headers["Expires"] = out.Expires.UTC().Format(http.TimeFormat)
+	}
+	for k, v := range out.Metadata {
+		k = http.CanonicalHeaderKey(k)
+		if k == contentMD5Header {
+			m.ContentMD5 = v
+		}
+		m.Headers[k] = v
+	}
+	return m, nil
+}
+
+func (s *s3Store) UpdateMetadata(ctx context.Context, f localFile) error {
+	return s.copyObject(ctx, s.bucket, f.Key(), f)
+}
+
+func (s *s3Store) CopyFrom(ctx context.Context, srcBucket, srcKey string, f localFile) error {
+	return s.copyObject(ctx, srcBucket, srcKey, f)
+}
+
+// copyObject copies srcBucket/srcKey to f's key, replacing the metadata with f's.
+func (s *s3Store) copyObject(ctx context.Context, srcBucket, srcKey string, f localFile) error {
+	// Build the metadata the same way as for a regular upload.
+	put := &s3.PutObjectInput{
+		ACL:         types.ObjectCannedACL(s.acl),
+		ContentType: aws.String(f.ContentType()),
+	}
+	s.applyGrantsToPutObjectInput(put)
+	if err := s.applyMetadataToPutObjectInput(put, f); err != nil {
+		return err
+	}
+
+	in := &s3.CopyObjectInput{
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(f.Key()),
+		CopySource:          aws.String(url.PathEscape(srcBucket + "/" + srcKey)),
+		MetadataDirective:   types.MetadataDirectiveReplace,
+		ACL:                 put.ACL,
+		ContentType:         put.ContentType,
+		CacheControl:        put.CacheControl,
+		ContentDisposition:  put.ContentDisposition,
+		ContentEncoding:     put.ContentEncoding,
+		ContentLanguage:     put.ContentLanguage,
+		Expires:             put.Expires,
+		Metadata:            put.Metadata,
+		GrantRead:           put.GrantRead,
+		GrantReadACP:        put.GrantReadACP,
+		GrantWriteACP:       put.GrantWriteACP,
+		GrantFullControl:    put.GrantFullControl,
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
+	}
+	if srcBucket == s.bucket {
+		in.ExpectedSourceBucketOwner = s.expectedBucketOwner
+	}
+
+	_, err := s.svc.CopyObject(ctx, in)
+
+	return err
+}
+
+func (s *s3Store) applyGrantsToPutObjectInput(input *s3.PutObjectInput) {
+	for permission, grantees := range s.grants {
+		switch permission {
+		case "READ":
+			input.GrantRead = aws.String(grantees)
+		case "READ_ACP":
+			input.GrantReadACP = aws.String(grantees)
+		case "WRITE_ACP":
+			input.GrantWriteACP = aws.String(grantees)
+		case "FULL_CONTROL":
+			input.GrantFullControl = aws.String(grantees)
+		}
+	}
+}
+
 func (s *s3Store) applyMetadataToPutObjectInput(input *s3.PutObjectInput, f localFile) error {
 	m := f.Headers()
 	if len(m) == 0 {
@@ -181,6 +533,8 @@ func (s *s3Store) DeleteObjects(ctx context.Context, keys []string, opts ...opOp
 		Delete: &types.Delete{
 			Objects: ids,
 		},
+		RequestPayer:        s.requestPayer,
+		ExpectedBucketOwner: s.expectedBucketOwner,
 	})
 	return err
 }
@@ -195,3 +549,31 @@ func (s *s3Store) InvalidateCDNCache(ctx context.Context, paths ...string) error
 	}
 	return s.cfc.InvalidateCDNCache(ctx, paths...)
 }
+
+func (s *s3Store) InvalidatedPaths() []string {
+	if s.cfc == nil {
+		return nil
+	}
+	return s.cfc.invalidated
+}
+
+func (s *s3Store) InvalidationIDs() map[string]string {
+	if s.cfc == nil {
+		return nil
+	}
+	return s.cfc.invalidationIDs
+}
+
+func (s *s3Store) UpdateEdgeFunction(ctx context.Context, code []byte) error {
+	if s.edgeFunction == nil {
+		return nil
+	}
+	return s.edgeFunction.UpdateEdgeFunction(ctx, code)
+}
+
+func (s *s3Store) UpdateCanaryTraffic(ctx context.Context, percent float64) error {
+	if s.canary == nil {
+		return nil
+	}
+	return s.canary.UpdateCanaryTraffic(ctx, percent)
+}
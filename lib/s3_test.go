@@ -4,6 +4,7 @@ import (
 	"io"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	qt "github.com/frankban/quicktest"
 )
 
@@ -71,3 +72,48 @@ func TestNewRemoteStoreDeprecatedPublicReadACLFlaglProvided(t *testing.T) {
 
 	c.Assert("public-read", qt.Equals, s.acl)
 }
+
+func TestNewRemoteStoreGrants(t *testing.T) {
+	c := qt.New(t)
+
+	cfg := &Config{
+		BucketName: "example.com",
+		RegionName: "us-east-1",
+		Silent:     true,
+	}
+	cfg.fileConf.Grants = map[string]string{
+		"id=abc":                  "read",
+		"emailAddress=a@b.com":    "READ",
+		"id=def":                  "FULL_CONTROL",
+		"uri=http://example.com/": "READ_ACP",
+	}
+	c.Assert(cfg.fileConf.init(), qt.IsNil)
+
+	s, err := newRemoteStore(cfg, newPrinter(io.Discard))
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.acl, qt.Equals, "")
+
+	input := &s3.PutObjectInput{}
+	s.applyGrantsToPutObjectInput(input)
+	c.Assert(*input.GrantRead, qt.Equals, `emailAddress="a@b.com", id="abc"`)
+	c.Assert(*input.GrantFullControl, qt.Equals, `id="def"`)
+	c.Assert(*input.GrantReadACP, qt.Equals, `uri="http://example.com/"`)
+	c.Assert(input.GrantWriteACP, qt.IsNil)
+
+	cfg.fileConf.Grants = map[string]string{"id=abc": "WRITE"}
+	c.Assert(cfg.fileConf.init(), qt.IsNotNil)
+	cfg.fileConf.Grants = map[string]string{"foo=abc": "READ"}
+	c.Assert(cfg.fileConf.init(), qt.IsNotNil)
+}
+
+func TestUsePathStyle(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(usePathStyle(""), qt.IsFalse)
+	c.Assert(usePathStyle("https://s3.eu-north-1.amazonaws.com"), qt.IsFalse)
+	c.Assert(usePathStyle("https://minio.example.org"), qt.IsFalse)
+	c.Assert(usePathStyle("http://localhost:9000"), qt.IsTrue)
+	c.Assert(usePathStyle("http://minio.localhost"), qt.IsTrue)
+	c.Assert(usePathStyle("http://127.0.0.1:9000"), qt.IsTrue)
+	c.Assert(usePathStyle("http://[::1]:9000"), qt.IsTrue)
+}
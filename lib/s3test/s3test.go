@@ -0,0 +1,543 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package s3test provides an in-memory fake S3 server for tests, with
+// the requests needed to deploy a site and to read it back.
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websitePrefix is the path prefix of the website endpoints. Bucket
+// names can't start with an underscore.
+const websitePrefix = "_website"
+
+// The object headers stored with PutObject and CopyObject, besides the
+// user metadata (x-amz-meta-*).
+var objectHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+	"X-Amz-Website-Redirect-Location",
+}
+
+// Server is an in-memory fake S3 server answering path-style requests,
+// e.g. with -endpoint-url set to URL.
+//
+// It supports HeadBucket, GetBucketLocation, GetBucketOwnershipControls
+// (ACLs are enabled), ListObjectsV2, PutObject,
+// CopyObject, GetObject, HeadObject, DeleteObject and DeleteObjects,
+// and responds with 501 Not Implemented to anything else. Requests must
+// be signed with the access key, but the signatures aren't verified.
+type Server struct {
+	// URL is the endpoint URL of the server.
+	URL string
+
+	// Region is returned by GetBucketLocation.
+	Region string
+
+	accessKey string
+	srv       *httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+}
+
+type object struct {
+	data         []byte
+	etag         string
+	header       http.Header
+	lastModified time.Time
+}
+
+// NewServer starts a server with the given empty buckets, accepting
+// requests signed with accessKey. It must be closed with Close.
+func NewServer(accessKey string, buckets ...string) *Server {
+	s := &Server{
+		Region:    "us-east-1",
+		accessKey: accessKey,
+		buckets:   make(map[string]map[string]*object),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// WebsiteURL returns the URL of the static website of bucket, serving
+// index.html for paths ending in a slash, like the S3 website endpoints.
+func (s *Server) WebsiteURL(bucket string) string {
+	return s.URL + "/" + websitePrefix + "/" + bucket
+}
+
+// Keys returns the sorted keys in bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the content and the headers of the object key in bucket.
+func (s *Server) Object(bucket, key string) ([]byte, http.Header, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, found := s.buckets[bucket][key]
+	if !found {
+		return nil, nil, false
+	}
+	return o.data, o.header.Clone(), true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(p, websitePrefix+"/") {
+		s.serveWebsite(w, r, strings.TrimPrefix(p, websitePrefix+"/"))
+		return
+	}
+
+	if code, message := s.authorize(r); code != "" {
+		writeError(w, r, http.StatusForbidden, code, message)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(p, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, found := s.buckets[bucket]
+	if !found {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	q := r.URL.Query()
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && q.Has("location"):
+			s.getBucketLocation(w)
+		case r.Method == http.MethodGet && q.Has("ownershipControls"):
+			// No Object Ownership configured, so ACLs are enabled.
+			writeError(w, r, http.StatusNotFound, "OwnershipControlsNotFoundError", "The bucket ownership controls were not found")
+		case r.Method == http.MethodGet && q.Get("list-type") == "2":
+			listObjects(w, r, bucket, objects)
+		case r.Method == http.MethodPost && q.Has("delete"):
+			deleteObjects(w, r, objects)
+		default:
+			writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by s3test")
+		}
+		return
+	}
+
+	for _, sub := range []string{"acl", "tagging", "uploads", "uploadId", "attributes", "retention", "legal-hold"} {
+		if q.Has(sub) {
+			writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Not implemented by s3test")
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			s.copyObject(w, r, objects, key)
+			return
+		}
+		putObject(w, r, objects, key)
+	case http.MethodGet, http.MethodHead:
+		o, found := objects[key]
+		if !found {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		writeObject(w, r, o)
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// authorize returns the error code and message if r isn't signed with the access key.
+func (s *Server) authorize(r *http.Request) (string, string) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		// Presigned.
+		auth = "Credential=" + r.URL.Query().Get("X-Amz-Credential")
+	}
+	i := strings.Index(auth, "Credential=")
+	if i < 0 || len(auth) == i+len("Credential=") {
+		return "AccessDenied", "Access Denied"
+	}
+	accessKey, _, _ := strings.Cut(auth[i+len("Credential="):], "/")
+	if accessKey != s.accessKey {
+		return "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."
+	}
+	return "", ""
+}
+
+func (s *Server) getBucketLocation(w http.ResponseWriter) {
+	region := s.Region
+	if region == "us-east-1" {
+		// The classic region has no location constraint.
+		region = ""
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		Region  string   `xml:",chardata"`
+	}{Region: region})
+}
+
+type listContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+func listObjects(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*object) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := 1000
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return
+		}
+		after = string(b)
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var (
+		contents  []listContent
+		prefixes  []listPrefix
+		last      string
+		truncated bool
+	)
+	for _, key := range keys {
+		if key <= last {
+			// Below the last common prefix.
+			continue
+		}
+		if len(contents)+len(prefixes) == maxKeys {
+			truncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				prefixes = append(prefixes, listPrefix{Prefix: p})
+				// No key with the prefix p sorts after this.
+				last = p + "\xff"
+				continue
+			}
+		}
+		o := objects[key]
+		contents = append(contents, listContent{
+			Key:          key,
+			LastModified: o.lastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         o.etag,
+			Size:         int64(len(o.data)),
+			StorageClass: "STANDARD",
+		})
+		last = key
+	}
+
+	result := struct {
+		XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		MaxKeys               int
+		KeyCount              int
+		IsTruncated           bool
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		Contents              []listContent
+		CommonPrefixes        []listPrefix
+	}{
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		KeyCount:          len(contents) + len(prefixes),
+		IsTruncated:       truncated,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+		Contents:          contents,
+		CommonPrefixes:    prefixes,
+	}
+	if truncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+	}
+	writeXML(w, result)
+}
+
+func putObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	data, err := readBody(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := md5.Sum(data)
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		writeError(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+		return
+	}
+
+	o := &object{
+		data:         data,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		header:       objectHeader(r.Header),
+		lastModified: time.Now().UTC(),
+	}
+	objects[key] = o
+	w.Header().Set("ETag", o.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	source, _, _ = strings.Cut(source, "?versionId=")
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src, found := s.buckets[srcBucket][srcKey]
+	if !found {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	header := src.header.Clone()
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		header = objectHeader(r.Header)
+	}
+	o := &object{data: src.data, etag: src.etag, header: header, lastModified: time.Now().UTC()}
+	objects[key] = o
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: o.etag, LastModified: o.lastModified.Format("2006-01-02T15:04:05.000Z")})
+}
+
+func deleteObjects(w http.ResponseWriter, r *http.Request, objects map[string]*object) {
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	type deletedKey struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+		Deleted []deletedKey
+	}{}
+	for _, o := range req.Objects {
+		delete(objects, o.Key)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedKey{Key: o.Key})
+		}
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) serveWebsite(w http.ResponseWriter, r *http.Request, p string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	bucket, key, _ := strings.Cut(p, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "index.html"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, found := s.buckets[bucket][key]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	writeObject(w, r, o)
+}
+
+func writeObject(w http.ResponseWriter, r *http.Request, o *object) {
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Last-Modified", o.lastModified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(o.data)
+	}
+}
+
+// objectHeader returns the object headers and the user metadata in h.
+func objectHeader(h http.Header) http.Header {
+	header := make(http.Header)
+	for _, k := range objectHeaders {
+		if v := h.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			header[k] = v
+		}
+	}
+
+	// Added by the SDK for streaming uploads.
+	if encoding := header.Get("Content-Encoding"); strings.Contains(encoding, "aws-chunked") {
+		var encodings []string
+		for _, e := range strings.Split(encoding, ",") {
+			if e = strings.TrimSpace(e); e != "aws-chunked" {
+				encodings = append(encodings, e)
+			}
+		}
+		header.Del("Content-Encoding")
+		if len(encodings) > 0 {
+			header.Set("Content-Encoding", strings.Join(encodings, ","))
+		}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "binary/octet-stream")
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		// Stored in the same format as S3 does.
+		if t, err := time.Parse(time.RFC1123, expires); err == nil {
+			header.Set("Expires", t.UTC().Format(http.TimeFormat))
+		}
+	}
+	return header
+}
+
+// readBody reads the body of r, decoding the aws-chunked encoding
+// used by the SDK for streaming uploads.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var (
+		buf bytes.Buffer
+		br  = bufio.NewReader(r.Body)
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		hexSize, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(hexSize, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", hexSize)
+		}
+		if size == 0 {
+			// Any trailers are ignored.
+			return buf.Bytes(), nil
+		}
+		if _, err := io.CopyN(&buf, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
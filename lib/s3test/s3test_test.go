@@ -0,0 +1,116 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	qt "github.com/frankban/quicktest"
+)
+
+func newTestClient(srv *Server, key string) *s3.Client {
+	return s3.NewFromConfig(aws.Config{
+		Region:      srv.Region,
+		Credentials: credentials.NewStaticCredentialsProvider(key, "secret", ""),
+	}, func(o *s3.Options) {
+		o.EndpointResolver = s3.EndpointResolverFromURL(srv.URL)
+		o.UsePathStyle = true
+	})
+}
+
+func TestServer(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := NewServer("mykey", "mybucket")
+	defer srv.Close()
+	client := newTestClient(srv, "mykey")
+
+	for i := 0; i < 5; i++ {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:          aws.String("mybucket"),
+			Key:             aws.String(fmt.Sprintf("dir%d/file.txt", i%2)),
+			Body:            strings.NewReader("content"),
+			ContentType:     aws.String("text/plain"),
+			ContentEncoding: aws.String("gzip"),
+			Metadata:        map[string]string{"foo": "bar"},
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("mybucket"),
+		Key:    aws.String("index.html"),
+		Body:   bytes.NewReader([]byte("<h1>Hi</h1>")),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.Keys("mybucket"), qt.DeepEquals, []string{"dir0/file.txt", "dir1/file.txt", "index.html"})
+
+	data, header, found := srv.Object("mybucket", "dir0/file.txt")
+	c.Assert(found, qt.IsTrue)
+	c.Assert(string(data), qt.Equals, "content")
+	c.Assert(header.Get("Content-Encoding"), qt.Equals, "gzip")
+	c.Assert(header.Get("X-Amz-Meta-Foo"), qt.Equals, "bar")
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("mybucket"), Key: aws.String("dir1/file.txt")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(*head.ETag, qt.Equals, `"9a0364b9e99bb480dd25e1f0284c8555"`)
+	c.Assert(*head.ContentType, qt.Equals, "text/plain")
+	c.Assert(head.Metadata, qt.DeepEquals, map[string]string{"foo": "bar"})
+
+	// Paginated, with the directories as common prefixes.
+	var keys []string
+	var prefixes []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String("mybucket"), MaxKeys: 1, Delimiter: aws.String("/")})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		c.Assert(err, qt.IsNil)
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, *p.Prefix)
+		}
+	}
+	c.Assert(keys, qt.DeepEquals, []string{"index.html"})
+	c.Assert(prefixes, qt.DeepEquals, []string{"dir0/", "dir1/"})
+
+	_, err = client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("mybucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("dir0/file.txt")}, {Key: aws.String("dir1/file.txt")}}},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.Keys("mybucket"), qt.DeepEquals, []string{"index.html"})
+
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("mybucket"), Key: aws.String("dir0/file.txt")})
+	var nsk *types.NoSuchKey
+	c.Assert(errors.As(err, &nsk), qt.IsTrue)
+
+	res, err := http.Get(srv.WebsiteURL("mybucket") + "/")
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "<h1>Hi</h1>")
+
+	var apiErr smithy.APIError
+	_, err = newTestClient(srv, "otherkey").HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String("mybucket")})
+	c.Assert(err, qt.IsNotNil)
+	_, err = newTestClient(srv, "otherkey").GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("mybucket"), Key: aws.String("index.html")})
+	c.Assert(errors.As(err, &apiErr), qt.IsTrue)
+	c.Assert(apiErr.ErrorCode(), qt.Equals, "InvalidAccessKeyId")
+}
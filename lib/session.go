@@ -7,8 +7,10 @@ package lib
 
 import (
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 )
 
@@ -18,6 +20,12 @@ func newAWSConfig(cfg *Config) (aws.Config, error) {
 		Credentials: createCredentials(cfg),
 	}
 
+	config.APIOptions = append(config.APIOptions, awsmiddleware.AddUserAgentKey(userAgent(cfg)))
+
+	if cfg.tracer != nil {
+		config.APIOptions = append(config.APIOptions, cfg.tracer.addToStack)
+	}
+
 	if cfg.EndpointURL != "" {
 		resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 			return aws.Endpoint{
@@ -33,9 +41,26 @@ func newAWSConfig(cfg *Config) (aws.Config, error) {
 func createCredentials(cfg *Config) aws.CredentialsProvider {
 
 	if cfg.AccessKey != "" {
-		return credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, os.Getenv("AWS_SESSION_TOKEN"))
+		sessionToken := cfg.sessionToken
+		if sessionToken == "" {
+			sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		return credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, sessionToken)
 	}
 
 	// Use AWS default
 	return nil
 }
+
+// userAgent returns the s3deploy part of the User-Agent sent with all AWS requests.
+func userAgent(cfg *Config) string {
+	version := strings.Trim(cfg.Version, "()")
+	if version == "" {
+		version = "devel"
+	}
+	ua := "s3deploy/" + version
+	if cfg.DeployID != "" {
+		ua += " (" + cfg.DeployID + ")"
+	}
+	return ua
+}
@@ -0,0 +1,203 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// A setting can be set as a flag, as an environment variable prefixed with
+// S3DEPLOY_ and as a key in the config file, all with the same name.
+type setting struct {
+	// The flag name, e.g. "max-delete".
+	name string
+	// The name of the Config field set, e.g. "MaxDelete".
+	field string
+	// The default value, as it would be set on the command line,
+	// empty for the zero value.
+	def   string
+	usage string
+}
+
+// settings is the one definition of the flags and the config file keys,
+// both are generated from it. The settings of the config file not in this
+// table (e.g. routes) are the fields of fileConfig.
+var settings = []setting{
+	{"key", "AccessKey", "", "access key ID for AWS"},
+	{"secret", "SecretKey", "", "secret access key for AWS"},
+	{"region", "RegionName", "", "name of AWS region"},
+	{"use-arn-region", "UseARNRegion", "", "use the region of the access point ARN set in -bucket, even if it's not -region"},
+	{"expected-bucket-owner", "ExpectedBucketOwner", "", "the AWS account ID that must own the bucket, all requests to a bucket owned by another account fail"},
+	{"request-payer", "RequestPayer", "", "set to 'requester' to deploy to a requester-pays bucket, confirming that you will be charged for the requests"},
+	{"accelerate", "Accelerate", "", "use the S3 Transfer Acceleration endpoint, which must be enabled on the bucket"},
+	{"dualstack", "DualStack", "", "use the S3 dual-stack (IPv4 and IPv6) endpoints"},
+	{"bucket", "BucketName", "", "destination bucket name on AWS"},
+	{"path", "BucketPath", "", "optional bucket sub path"},
+	{"target", "Target", "", "URL of a local directory, a WebDAV server or an SFTP server to deploy to instead of the bucket, e.g. file:///srv/www, webdavs://user@example.org/site or sftp://user@example.org/srv/www, with the password in the URL or in S3DEPLOY_TARGET_PASSWORD"},
+	{"source", "SourcePath", ".", "path of files to upload"},
+	{"distribution-id", "CDNDistributionIDs", "", "optional CDN distribution ID for cache invalidation, repeat flag for multiple distributions; use ID:/path to set the origin path"},
+	{"cloudfront-function", "CloudFrontFunction", "", "name of a CloudFront Function to update with the redirects in the config file and publish"},
+	{"cloudfront-function-clean-urls", "CloudFrontFunctionCleanURLs", "", "also rewrite directory requests to their index.html in the CloudFront Function"},
+	{"invalidate-sitemap", "InvalidateSitemap", "", "sitemap (relative to -source) used to invalidate changed HTML pages by their page URLs, e.g. sitemap.xml"},
+	{"endpoint-url", "EndpointURL", "", "optional endpoint URL, e.g. of an S3 compatible server; requests to localhost or an IP address use path-style bucket addressing"},
+	{"config", "ConfigFile", ".s3deploy.yml", "optional config file"},
+	{"config-identity", "ConfigIdentity", "", "age identity file to decrypt an age or SOPS encrypted config file with"},
+	{"env", "Environment", "", "environment in the environments section of the config file to deploy, e.g. production"},
+	{"routes-file", "RoutesFile", "", "optional file with the routes (and mergeRoutes) to use instead of those in the config file"},
+	{"env-file", "EnvFile", "", "optional file with environment variables (KEY=value lines) to load, e.g. S3DEPLOY_BUCKET=example.com"},
+	{"max-delete", "MaxDelete", "256", "maximum number of files to delete per deploy"},
+	{"max-delete-percent", "MaxDeletePercent", "", "delete no files if more than this percentage of the remote files are to be deleted, instead of limiting the number with -max-delete"},
+	{"force-delete-all", "ForceDeleteAll", "", "deploy even if it would delete most of the remote files while uploading only a few, which is refused as the source looks empty or the path doesn't match"},
+	{"prune-max-delete", "PruneMaxDelete", "256", "maximum number of files to delete with the prune command, which doesn't use -max-delete"},
+	{"fail-on-stale", "FailOnStale", "", "fail the deploy (after uploading and deleting up to -max-delete files) if any remote files not found in source were left because of -max-delete or -max-delete-percent"},
+	{"max-errors", "MaxErrors", "", "keep going when up to this number of files fail to upload, retrying them once at the end"},
+	{"continue-on-error", "ContinueOnError", "", "keep going when any number of files fail to upload, retrying them once at the end"},
+	{"delete-scope", "DeleteScope", "", "never delete remote files outside of this prefix (default the bucket path)"},
+	{"public-access", "PublicReadACL", "", "DEPRECATED: please set -acl='public-read'"},
+	{"strip-index-html", "StripIndexHTML", "", "strip index.html from all directories expect for the root entry"},
+	{"website-index-document", "WebsiteIndexDocument", "", "set the index document suffix of the S3 static website configuration, e.g. index.html"},
+	{"website-error-document", "WebsiteErrorDocument", "", "set the error document (relative to -path) of the S3 static website configuration, e.g. 404.html"},
+	{"create-bucket", "CreateBucket", "", "create the bucket in -region if it doesn't exist, with public access blocked unless -create-bucket-public is set"},
+	{"create-bucket-versioning", "CreateBucketVersioning", "", "enable versioning on the bucket created with -create-bucket"},
+	{"create-bucket-public", "CreateBucketPublic", "", "don't block public access (ACLs and bucket policies) on the bucket created with -create-bucket"},
+	{"index-copies", "IndexCopies", "", "also upload every <dir>/index.html as <dir>, for extensionless URLs without edge functions"},
+	{"hash", "Hash", hashMD5, "the hash used to detect changed files, one of 'md5' (compared with the ETags), 'sha256' and 'xxhash' (stored in the object metadata)"},
+	{"detect-moves", "DetectMoves", "", "copy new files server side from remote files with the same content that are deleted, instead of uploading them"},
+	{"dedupe", "Dedupe", "", "upload files with the same content once, and copy them server side to the other keys"},
+	{"acl", "ACL", "", "provide an ACL for uploaded objects. to make objects public, set to 'public-read'. all possible values are listed here: https://docs.aws.amazon.com/AmazonS3/latest/userguide/acl-overview.html#canned-acl (default \"private\")"},
+	{"acl-fallback", "ACLFallback", "", "upload without ACL, with a warning, if ACLs are disabled on the bucket (Object Ownership \"Bucket owner enforced\") instead of failing"},
+	{"preserve-mtime", "PreserveMtime", "", "store the modification time of the local files in the object metadata (x-amz-meta-mtime), the same as rclone"},
+	{"force", "Force", "", "upload even if the etags match"},
+	{"ignore", "Ignore", "", "regexp pattern for ignoring files, repeat flag for multiple patterns,"},
+	{"include", "Include", "", "regexp pattern of the only files to deploy, remote files not matching are never deleted, repeat flag for multiple patterns"},
+	{"keep", "Keep", "", "regexp pattern for remote files to never delete, repeat flag for multiple patterns"},
+	{"skip-local-files", "SkipLocalFiles", "", fmt.Sprintf("regexp pattern of files to ignore when walking the local directory, repeat flag for multiple patterns, default %q", defaultSkipLocalFiles)},
+	{"ignore-file", "IgnoreFile", ".s3deployignore", "file in the source directory with gitignore patterns of local files to not deploy"},
+	{"follow-symlinks", "FollowSymlinks", symlinksFollow, "how to handle symlinks in the source directory, one of 'follow' (upload the target file or directory), 'skip' and 'error'"},
+	{"max-file-size", "MaxFileSize", "", "fail the deploy if a local file is larger than this many bytes, e.g. to avoid deploying build artifacts by accident (default no limit)"},
+	{"max-buffer", "MaxBuffer", "", "the maximum total size of the local files held in memory waiting to be uploaded, e.g. '256MB' (default no limit)"},
+	{"max-file-size-action", "MaxFileSizeAction", maxFileSizeError, "what to do with files larger than -max-file-size, one of 'error' and 'skip' (with a warning)"},
+	{"case-conflicts", "CaseConflicts", caseConflictsWarn, "how to handle local files with keys only differing by case, one of 'warn', 'error' and 'ignore'"},
+	{"normalize", "Normalize", normalizeNFC, "the Unicode normalization of the keys of the local files, one of 'nfc', 'nfd' and 'none'"},
+	{"skip-local-dirs", "SkipLocalDirs", "", fmt.Sprintf("regexp pattern of files of directories to ignore when walking the local directory, repeat flag for multiple patterns, default %q", defaultSkipLocalDirs)},
+	{"try", "Try", "", "trial run, no remote updates"},
+	{"verify-user-agent", "VerifyUserAgent", defaultVerifyUserAgent, "User-Agent used in verification requests against the deployed site"},
+	{"verify", "Verify", "", "check the size, ETag and Content-Type of the uploaded files after the upload, failing the deploy on mismatches"},
+	{"verify-url", "VerifyURL", "", "base URL of the deployed site to verify the uploaded files against with GET requests (-verify), instead of using HeadObject"},
+	{"checks-url", "ChecksURL", "", "base URL of the deployed site to run the checks in the config file against after the deploy"},
+	{"checks-rollback", "ChecksRollback", "", "disable the canary if the checks fail (requires -canary-percent)"},
+	{"verify-cache-buster", "VerifyCacheBuster", "s3deploy", "name of the cache-busting query parameter added to verification requests, set to empty to disable"},
+	{"resume", "Resume", "", "write a local checkpoint of completed uploads, and resume an interrupted deploy from it"},
+	{"checkpoint-file", "CheckpointFile", "", "checkpoint file used with -resume (default a file below the user cache dir)"},
+	{"etag-cache", "ETagCache", "", "cache the ETags of the local files by path, size and modification time, to skip reading unchanged files in the next deploy"},
+	{"etag-cache-file", "ETagCacheFile", "", "cache file used with -etag-cache (default a file below the user cache dir)"},
+	{"gzip-level", "GzipLevel", strconv.Itoa(gzip.DefaultCompression), "default gzip compression level (1-9, -1 for the default level) for routes with gzip enabled"},
+	{"prefer-system-mime", "PreferSystemMIME", "", "look up content types in the system MIME database (e.g. /etc/mime.types) before the one embedded in s3deploy"},
+	{"snapshot-file", "SnapshotFile", "s3deploy-snapshot.jsonl.gz", "file to write the remote file list to in 's3deploy snapshot'"},
+	{"ls-metadata", "ListMetadata", "", "also print the Content-Type, Cache-Control and the other headers with the ls command (one HEAD request per remote file)"},
+	{"snapshot-metadata", "SnapshotMetadata", "", "include Content-Type, Content-Encoding and the other headers in the snapshot (one HEAD request per remote file)"},
+	{"json", "JSON", "", "print the deploy stats (including per route stats) and the 's3deploy diff-manifests' result as JSON (implies -quiet)"},
+	{"deploy-id", "DeployID", "", "ID of this deploy, added to the User-Agent of all AWS requests and used in the STS session name (default a generated ULID)"},
+	{"role-arn", "RoleARN", "", "IAM role to assume for the deploy"},
+	{"session-tag", "SessionTags", "", "STS session tag on the form key=value when assuming -role-arn, repeat flag for multiple tags"},
+	{"source-identity", "SourceIdentity", "", "STS source identity when assuming -role-arn, e.g. the user or CI job starting the deploy"},
+	{"mint-session", "MintSession", "", "exchange the access key and secret for short-lived STS session credentials at startup and use only those for the deploy"},
+	{"session-duration", "SessionDuration", "1h", "how long the credentials minted with -mint-session are valid (15m to 36h)"},
+	{"sso-profile", "SSOProfile", "", "AWS SSO profile to get the credentials for from the AWS CLI (aws configure export-credentials)"},
+	{"sso-login", "SSOLogin", "", "run 'aws sso login' for -sso-profile if the SSO session has expired and running in a terminal"},
+	{"reference-bucket", "ReferenceBucket", "", "bucket to compare local files against, unchanged files are copied from there instead of uploaded (default the target bucket if -reference-path is set)"},
+	{"reference-path", "ReferencePath", "", "bucket sub path to compare local files against, see -reference-bucket"},
+	{"metrics-pushgateway", "MetricsPushgatewayURL", "", "Prometheus Pushgateway URL to push deploy metrics to, e.g. http://pushgateway:9091"},
+	{"metrics-otlp", "MetricsOTLPURL", "", "OTLP/HTTP endpoint to send deploy metrics to, e.g. http://otel-collector:4318"},
+	{"metrics-job", "MetricsJob", "s3deploy", "job name used for pushed metrics"},
+	{"trace-otlp", "TraceOTLPURL", "", "OTLP/HTTP endpoint to send a trace of all AWS API calls to, e.g. http://jaeger:4318"},
+	{"timeout", "Timeout", "", "maximum duration of the whole deploy, e.g. 30m (default no limit)"},
+	{"put-timeout", "PutTimeout", "", "maximum duration of each file upload, e.g. 2m (default no limit)"},
+	{"inventory", "Inventory", "", "read the remote file list from an S3 Inventory report instead of listing the bucket, either s3://bucket/path/manifest.json or the inventory configuration folder to use its latest report"},
+	{"fingerprint-manifest", "FingerprintManifest", "", "write a JSON file mapping the paths of fingerprinted files to their fingerprinted paths"},
+	{"reconcile-metadata", "ReconcileMetadata", "", "check the headers (e.g. Content-Type and Cache-Control) of unchanged remote files against the current rules and fix them (use with -try for a dry-run listing)"},
+	{"lock", "Lock", "", "hold an advisory lock (" + lockKey + ") below the bucket path while deploying, refuse to deploy if held by someone else"},
+	{"lock-ttl", "LockTTL", "30m", "how long a deploy lock is valid if not released"},
+	{"lock-timeout", "LockTimeout", "", "how long to wait for a deploy lock held by someone else"},
+	{"plan", "PlanFile", "", "write the planned changes to this JSON file instead of deploying, see -apply"},
+	{"apply", "ApplyFile", "", "deploy the changes in this plan file written by -plan, failing if any of the local files have changed"},
+	{"confirm", "Confirm", "", "print the planned changes and ask for confirmation before uploading or deleting"},
+	{"upload-order", "UploadOrder", "", "upload the files in order of size, either \"" + uploadOrderSmallFirst + "\" or \"" + uploadOrderLargeFirst + "\" (default the order they're found in)"},
+	{"canary-policy-id", "CanaryPolicyID", "", "experimental: CloudFront continuous deployment policy ID used for canary deploys"},
+	{"canary-percent", "CanaryPercent", "", "experimental: deploy to the canary prefix and send this percentage (max 15) of the traffic to the staging distribution"},
+	{"canary-prefix", "CanaryPrefix", "canary", "experimental: bucket sub path below -path to deploy canaries to"},
+	{"canary-promote", "CanaryPromote", "", "experimental: deploy to -path and disable the continuous deployment policy"},
+	{"deploy-window", "DeployWindow", "", "only allow deploys inside this weekly time window, e.g. \"Mon-Fri 09:00-17:00 Europe/Oslo\""},
+	{"wait-for-window", "WaitForWindow", "", "wait for the deploy window to open instead of failing"},
+	{"override-freeze", "OverrideFreeze", "", "deploy even if the remote freeze marker (" + freezeMarkerKey + ") is present"},
+	{"github-summary", "GitHubSummary", "", "append a Markdown summary of the deploy to $GITHUB_STEP_SUMMARY when running in GitHub Actions"},
+	{"v", "Verbose", "", "enable verbose logging"},
+	{"no-color", "NoColor", "", "disable the colors in the output, which are only used when writing to a terminal (also disabled by the NO_COLOR environment variable)"},
+	{"quiet", "Silent", "", "enable silent mode"},
+	{"brief", "Brief", "", "print only warnings, the files deleted and the summary, not a line per file uploaded, e.g. for the CI logs of large sites"},
+	{"V", "PrintVersion", "", "print version and exit"},
+	{"upload-workers", "UploadWorkers", "-1", "number of workers to upload files, -1 means the number of CPUs"},
+	{"delete-workers", "DeleteWorkers", "4", "number of concurrent delete requests, each deleting up to 1000 files"},
+	{"hash-workers", "HashWorkers", "-1", "number of workers to hash the local files while planning, -1 means the number of CPUs"},
+	{"list-concurrency", "ListConcurrency", "1", "number of top level prefixes (directories) to list concurrently when listing the remote files"},
+	{"workers", "NumberOfWorkers", "-1", "DEPRECATED: please use -upload-workers"},
+	{"h", "Help", "", "help"},
+}
+
+// lookupSetting returns the setting with the given name.
+func lookupSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// repeatable reports whether s can be set more than once, e.g. -ignore.
+func (s setting) repeatable() bool {
+	f, _ := reflect.TypeOf(Config{}).FieldByName(s.field)
+	return f.Type == reflect.TypeOf(Strings{})
+}
+
+// define adds s to f as a flag setting its field in cfg.
+func (s setting) define(f *flag.FlagSet, cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem().FieldByName(s.field)
+	if !v.IsValid() {
+		panic(fmt.Sprintf("flag %q: no field %q in Config", s.name, s.field))
+	}
+	switch p := v.Addr().Interface().(type) {
+	case *string:
+		f.StringVar(p, s.name, "", s.usage)
+	case *bool:
+		f.BoolVar(p, s.name, false, s.usage)
+	case *int:
+		f.IntVar(p, s.name, 0, s.usage)
+	case *int64:
+		f.Int64Var(p, s.name, 0, s.usage)
+	case *float64:
+		f.Float64Var(p, s.name, 0, s.usage)
+	case *time.Duration:
+		f.DurationVar(p, s.name, 0, s.usage)
+	case flag.Value:
+		f.Var(p, s.name, s.usage)
+	default:
+		panic(fmt.Sprintf("flag %q: unsupported type %T", s.name, p))
+	}
+	if s.def == "" {
+		return
+	}
+	fl := f.Lookup(s.name)
+	if err := fl.Value.Set(s.def); err != nil {
+		panic(fmt.Sprintf("flag %q: invalid default %q: %s", s.name, s.def, err))
+	}
+	fl.DefValue = fl.Value.String()
+}
@@ -0,0 +1,360 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	_ remoteStore        = (*sftpStore)(nil)
+	_ remoteObjectGetter = (*sftpStore)(nil)
+)
+
+// targetKnownHostsEnv holds the known_hosts file used to verify the
+// host key of an SFTP -target, ~/.ssh/known_hosts if not set.
+const targetKnownHostsEnv = "S3DEPLOY_TARGET_KNOWN_HOSTS"
+
+// sftpStore is a remoteStore deploying to an SFTP server, see -target.
+type sftpStore struct {
+	target     *url.URL
+	root       string
+	bucketPath string
+
+	// The index, loaded in FileMap, as SFTP has no ETags.
+	index *targetIndex
+
+	mu sync.Mutex
+	// The connection, opened on first use.
+	client *sftp.Client
+	conn   io.Closer
+}
+
+func newSFTPStore(cfg *Config, target *url.URL) *sftpStore {
+	return &sftpStore{
+		target:     target,
+		root:       sftpRoot(target),
+		bucketPath: cfg.BucketPath,
+		index:      newTargetIndex(),
+	}
+}
+
+// sftpRoot returns the directory on the server of the SFTP URL u,
+// e.g. /srv/www for sftp://example.org/srv/www and www in the home
+// directory for sftp://example.org/~/www.
+func sftpRoot(u *url.URL) string {
+	p := u.Path
+	if p == "/~" || strings.HasPrefix(p, "/~/") {
+		// Relative to the home directory.
+		p = strings.TrimLeft(strings.TrimPrefix(p, "/~"), "/")
+	}
+	if p == "" {
+		return "."
+	}
+	return path.Clean(p)
+}
+
+type sftpFile struct {
+	key  string
+	etag string
+	size int64
+}
+
+func (f *sftpFile) Key() string {
+	return f.key
+}
+
+func (f *sftpFile) ETag() string {
+	return f.etag
+}
+
+func (f *sftpFile) Size() int64 {
+	return f.size
+}
+
+func (s *sftpStore) filename(key string) string {
+	return path.Join(s.root, key)
+}
+
+// key returns the key of the file p on the server.
+func (s *sftpStore) key(p string) string {
+	if s.root == "." {
+		return p
+	}
+	return strings.TrimPrefix(p, strings.TrimSuffix(s.root, "/")+"/")
+}
+
+// connect returns the client, connecting to the server if needed.
+// ctx bounds the connect, not the connection.
+func (s *sftpStore) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	config, agentConn, err := sftpClientConfig(s.target)
+	if err != nil {
+		return nil, err
+	}
+	if agentConn != nil {
+		// Only needed to authenticate.
+		defer agentConn.Close()
+	}
+
+	addr := s.target.Host
+	if s.target.Port() == "" {
+		addr = net.JoinHostPort(s.target.Hostname(), "22")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	// The SSH handshake doesn't take a context, so stop it by closing conn.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", addr, err)
+	}
+	s.client, s.conn = client, sshClient
+	return client, nil
+}
+
+// sftpClientConfig returns the SSH config for the SFTP URL u. It
+// authenticates with the password if set, else with the SSH agent and
+// the default keys in ~/.ssh, and only trusts host keys in known_hosts.
+// The connection to the SSH agent, if any, must be closed after connecting.
+func sftpClientConfig(u *url.URL) (*ssh.ClientConfig, io.Closer, error) {
+	home, _ := os.UserHomeDir()
+
+	knownHostsFile := os.Getenv(targetKnownHostsEnv)
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, nil, fmt.Errorf("missing user in -target: %w", err)
+		}
+		username = current.Username
+	}
+
+	var (
+		auth      []ssh.AuthMethod
+		agentConn net.Conn
+	)
+	if password := targetPassword(u); password != "" {
+		auth = append(auth, ssh.Password(password))
+	} else {
+		var signers []ssh.Signer
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				agentConn = conn
+				if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+					signers = append(signers, agentSigners...)
+				}
+			}
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			b, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			// Keys with a passphrase need the agent.
+			if signer, err := ssh.ParsePrivateKey(b); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, agentConn, nil
+}
+
+func (s *sftpStore) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.index.load(func() ([]byte, error) { return s.GetObject(ctx, targetIndexKey) }); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]file)
+	walker := client.Walk(s.filename(s.bucketPath))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Not created yet.
+				continue
+			}
+			return nil, err
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+		key := s.key(walker.Path())
+		if key == targetIndexKey {
+			continue
+		}
+		size := walker.Stat().Size()
+		m[key] = &sftpFile{key: key, etag: s.index.etag(key, size), size: size}
+	}
+
+	return m, nil
+}
+
+func (s *sftpStore) Put(ctx context.Context, f localFile, opts ...opOption) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	filename := s.filename(f.Key())
+	if err := client.MkdirAll(path.Dir(filename)); err != nil {
+		return err
+	}
+	if err := sftpWriteFileAtomic(client, filename, f.Content()); err != nil {
+		return err
+	}
+
+	s.index.put(f)
+
+	return nil
+}
+
+func (s *sftpStore) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := client.Remove(s.filename(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removeEmptyDirs(key, func(dir string) error {
+			return client.RemoveDirectory(s.filename(dir))
+		})
+		s.index.delete(key)
+	}
+	return nil
+}
+
+// Finalize writes the index if any files were uploaded or deleted,
+// and closes the connection.
+func (s *sftpStore) Finalize(ctx context.Context) error {
+	defer s.close()
+
+	return s.index.save(func(b []byte) error {
+		client, err := s.connect(ctx)
+		if err != nil {
+			return err
+		}
+		if err := client.MkdirAll(s.root); err != nil {
+			return err
+		}
+		return sftpWriteFileAtomic(client, s.filename(targetIndexKey), bytes.NewReader(b))
+	})
+}
+
+// close closes the connection, which is opened again if needed.
+func (s *sftpStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return
+	}
+	s.client.Close()
+	s.conn.Close()
+	s.client, s.conn = nil, nil
+}
+
+func (s *sftpStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(s.filename(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// sftpWriteFileAtomic writes the content of r to filename via a temporary
+// file, so the web server never serves a partially written file.
+func sftpWriteFileAtomic(client *sftp.Client, filename string, r io.Reader) error {
+	tmp := filename + ".tmp"
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		client.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	if err := client.PosixRename(tmp, filename); err != nil {
+		// Servers without the OpenSSH extension can't replace a file.
+		client.Remove(filename)
+		if err := client.Rename(tmp, filename); err != nil {
+			client.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestDeploySFTP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test server needs Unix paths")
+	}
+	c := qt.New(t)
+	source := testSourcePath()
+
+	root := filepath.ToSlash(t.TempDir())
+	writeTestFiles(c, root, map[string]string{"site/old.txt": "old", "site/ab.txt": "AB"})
+	addr := newSFTPTestServer(c, "secret")
+
+	t.Setenv(targetPasswordEnv, "secret")
+	newConfig := func() *Config {
+		return &Config{
+			Target:     "sftp://user@" + addr + root + "/site",
+			BucketPath: "blog",
+			ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+			SourcePath: source,
+			MaxDelete:  300,
+			Silent:     true,
+		}
+	}
+	read := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(root, "site", name))
+		return string(b)
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(read("blog/ab.txt"), qt.Equals, "AB")
+	c.Assert(read("ab.txt"), qt.Equals, "AB")
+
+	index := newTargetIndex()
+	c.Assert(index.load(func() ([]byte, error) { return []byte(read(targetIndexKey)), nil }), qt.IsNil)
+	c.Assert(index.etag("blog/ab.txt", 2), qt.Equals, `"b86fc6b051f63d73de262d4c34e3a0a9"`)
+
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 4 (0% changed)")
+
+	// Replaced on the server, and a stale file.
+	writeTestFiles(c, filepath.Join(root, "site"), map[string]string{"blog/ab.txt": "ABC", "blog/stale/deleteme.txt": "stale"})
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 1, skipped 3 (40% changed)")
+	c.Assert(read("blog/ab.txt"), qt.Equals, "AB")
+	_, err = os.Stat(filepath.Join(root, "site", "blog", "stale"))
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	t.Setenv(targetPasswordEnv, "wrong")
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `failed to connect to .*: ssh: handshake failed: .*unable to authenticate.*`)
+
+	// Unknown host key.
+	t.Setenv(targetPasswordEnv, "secret")
+	t.Setenv(targetKnownHostsEnv, filepath.Join(t.TempDir(), "known_hosts"))
+	c.Assert(os.WriteFile(os.Getenv(targetKnownHostsEnv), nil, 0o644), qt.IsNil)
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `failed to connect to .*: ssh: handshake failed: knownhosts: key is unknown`)
+}
+
+func TestDeploySFTPTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	// Accepts connections, but never starts the SSH handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	c.Assert(os.WriteFile(knownHosts, nil, 0o644), qt.IsNil)
+	t.Setenv(targetKnownHostsEnv, knownHosts)
+	t.Setenv(targetPasswordEnv, "secret")
+
+	start := time.Now()
+	_, err = Deploy(&Config{
+		Target:     "sftp://user@" + l.Addr().String() + "/site",
+		SourcePath: testSourcePath(),
+		MaxDelete:  300,
+		Silent:     true,
+		Timeout:    100 * time.Millisecond,
+	})
+	c.Assert(err, qt.ErrorMatches, `failed to connect to .*: context deadline exceeded`)
+	c.Assert(time.Since(start) < 10*time.Second, qt.IsTrue)
+}
+
+func TestSFTPRoot(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		target string
+		root   string
+	}{
+		{"sftp://example.org/srv/www/", "/srv/www"},
+		{"sftp://example.org/~/www", "www"},
+		{"sftp://example.org/~", "."},
+		{"sftp://example.org", "."},
+	} {
+		u, err := url.Parse(test.target)
+		c.Assert(err, qt.IsNil)
+		c.Assert(sftpRoot(u), qt.Equals, test.root, qt.Commentf(test.target))
+	}
+}
+
+// newSFTPTestServer starts an SSH server with the SFTP subsystem on the
+// local file system, accepting any user with password, and adds its host
+// key to a known_hosts file set in the environment. It returns its address.
+func newSFTPTestServer(c *qt.C, password string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+	signer, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, qt.IsNil)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+			if string(pw) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr := l.Addr().String()
+	knownHosts := filepath.Join(c.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, signer.PublicKey())
+	c.Assert(os.WriteFile(knownHosts, []byte(line+"\n"), 0o644), qt.IsNil)
+	c.Setenv(targetKnownHostsEnv, knownHosts)
+
+	return addr
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the length prefixed subsystem name.
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						defer channel.Close()
+						server, err := sftp.NewServer(channel)
+						if err != nil {
+							return
+						}
+						server.Serve()
+					}()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sitemapXML is a sitemap or a sitemap index.
+type sitemapXML struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// sitemapPages holds the page URL paths listed in a sitemap.
+type sitemapPages map[string]bool
+
+// loadSitemapPages reads the page URL paths from the sitemap filename in
+// the source fsys. The sitemaps listed in a sitemap index are read from
+// the local file with the same path.
+func loadSitemapPages(fsys fs.FS, filename string) (sitemapPages, error) {
+	pages := make(sitemapPages)
+	if err := pages.load(fsys, filename, 0); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func (pages sitemapPages) load(fsys fs.FS, filename string, depth int) error {
+	if depth > 1 {
+		// Sitemap indexes cannot be nested.
+		return nil
+	}
+
+	b, err := fs.ReadFile(fsys, strings.TrimPrefix(path.Clean(filepath.ToSlash(filename)), "/"))
+	if err != nil {
+		return err
+	}
+
+	var sm sitemapXML
+	if err := xml.Unmarshal(b, &sm); err != nil {
+		return fmt.Errorf("invalid sitemap %q: %w", filename, err)
+	}
+
+	for _, u := range sm.URLs {
+		if p, ok := sitemapPath(u.Loc); ok {
+			pages[p] = true
+		}
+	}
+	for _, s := range sm.Sitemaps {
+		p, ok := sitemapPath(s.Loc)
+		if !ok {
+			continue
+		}
+		if err := pages.load(fsys, p, depth+1); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sitemapPath returns the URL path of the sitemap location loc.
+func sitemapPath(loc string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(loc))
+	if err != nil {
+		return "", false
+	}
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// invalidationPaths maps the changed HTML files in paths to all the page
+// URLs that can serve them, if they're listed in the sitemap, e.g.
+// "/blog/index.html" to "/blog/", "/blog" and "/blog/index.html". Other
+// paths are returned unchanged.
+func (pages sitemapPages) invalidationPaths(paths []string) []string {
+	var mapped []string
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		variants := pageVariants(p)
+		found := false
+		for _, v := range variants {
+			if pages[v] {
+				found = true
+				break
+			}
+		}
+		if found {
+			mapped = append(mapped, variants...)
+		} else {
+			mapped = append(mapped, p)
+		}
+	}
+	return uniqueStrings(mapped)
+}
+
+// pageVariants returns the URL paths a page stored as p may be served
+// from, e.g. with URL rewrites in the CDN.
+func pageVariants(p string) []string {
+	switch {
+	case strings.HasSuffix(p, "/index.html"):
+		dir := strings.TrimSuffix(p, "index.html")
+		return pageDirVariants(dir, p)
+	case strings.HasSuffix(p, "/"):
+		return pageDirVariants(p, p+"index.html")
+	case strings.HasSuffix(p, ".html"):
+		base := strings.TrimSuffix(p, ".html")
+		return []string{p, base, base + "/"}
+	}
+	return nil
+}
+
+func pageDirVariants(dir, index string) []string {
+	variants := []string{dir, index}
+	if dir != "/" {
+		variants = append(variants, strings.TrimSuffix(dir, "/"))
+	}
+	return variants
+}
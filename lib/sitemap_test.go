@@ -0,0 +1,56 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSitemapPages(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755), qt.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644), qt.IsNil)
+	}
+
+	writeFile("sitemap.xml", `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.org/en/sitemap.xml</loc></sitemap>
+  <sitemap><loc>https://example.org/missing/sitemap.xml</loc></sitemap>
+</sitemapindex>`)
+	writeFile("en/sitemap.xml", `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.org/</loc></url>
+  <url><loc>https://example.org/blog/</loc></url>
+  <url><loc>https://example.org/about</loc></url>
+</urlset>`)
+
+	pages, err := loadSitemapPages(os.DirFS(dir), "sitemap.xml")
+	c.Assert(err, qt.IsNil)
+	c.Assert(pages, qt.DeepEquals, sitemapPages{"/": true, "/blog/": true, "/about": true})
+
+	c.Assert(pages.invalidationPaths([]string{"index.html", "blog/index.html", "/about.html", "/css/main.css", "/404.html", "/docs/"}), qt.DeepEquals, []string{
+		"/", "/index.html",
+		"/blog/", "/blog/index.html", "/blog",
+		"/about.html", "/about", "/about/",
+		"/css/main.css",
+		"/404.html",
+		"/docs/",
+	})
+
+	_, err = loadSitemapPages(os.DirFS(dir), "nosuch.xml")
+	c.Assert(err, qt.IsNotNil)
+
+	writeFile("invalid.xml", "<urlset><url>")
+	_, err = loadSitemapPages(os.DirFS(dir), "invalid.xml")
+	c.Assert(err, qt.ErrorMatches, `invalid sitemap "invalid.xml".*`)
+}
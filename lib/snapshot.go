@@ -0,0 +1,247 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// remoteLister is implemented by stores that can list the remote
+// files one page at a time.
+type remoteLister interface {
+	// ListPage lists the page of remote files starting at token,
+	// where an empty token means the first page. The returned token
+	// is empty when there are no more pages.
+	ListPage(ctx context.Context, token string) ([]file, string, error)
+}
+
+type snapshotHeader struct {
+	Bucket  string    `json:"bucket"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+// snapshotEntry is a remote file in a snapshot.
+type snapshotEntry struct {
+	remoteFileInfo
+	LastModified    *time.Time `json:"lastModified,omitempty"`
+	StorageClass    string     `json:"storageClass,omitempty"`
+	ContentType     string     `json:"contentType,omitempty"`
+	ContentEncoding string     `json:"contentEncoding,omitempty"`
+	// Other headers and user metadata, e.g. Cache-Control.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// snapshotState is stored next to a partial snapshot after every page,
+// so an interrupted snapshot can be resumed.
+type snapshotState struct {
+	Header snapshotHeader `json:"header"`
+	Token  string         `json:"token"`
+	Count  int            `json:"count"`
+	// Set when the last page has been written.
+	Complete bool `json:"complete"`
+	// The size of the partial snapshot when Token was stored.
+	Offset int64 `json:"offset"`
+}
+
+// Snapshot writes the remote file map to a gzipped JSON lines file,
+// a header followed by one entry per remote file.
+// The listing is written one page at a time, and if interrupted, running
+// it again resumes from the last page written.
+func Snapshot(ctx context.Context, cfg *Config) error {
+	if err := cfg.Init(); err != nil {
+		return err
+	}
+	if err := cfg.initSession(ctx); err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.Silent {
+		out = io.Discard
+	}
+	p := newPrinter(out)
+
+	s := cfg.baseStore
+	if s == nil {
+		var err error
+		s, err = newTargetStore(cfg, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	lister, ok := s.(remoteLister)
+	if !ok {
+		return errors.New("the remote store does not support snapshots")
+	}
+
+	var metadata remoteMetadataReconciler
+	if cfg.SnapshotMetadata {
+		if metadata, ok = s.(remoteMetadataReconciler); !ok {
+			return errMetadataNotSupported
+		}
+	}
+
+	filename := cfg.SnapshotFile
+	partialFilename := filename + ".partial"
+	stateFilename := filename + ".state"
+
+	state, err := loadSnapshotState(stateFilename, cfg)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if state == nil {
+		state = &snapshotState{Header: snapshotHeader{Bucket: cfg.BucketName, Path: cfg.BucketPath, Created: time.Now().UTC()}}
+		flags |= os.O_TRUNC
+	} else {
+		p.Printf("Resuming snapshot %s after %d files\n", partialFilename, state.Count)
+	}
+
+	f, err := os.OpenFile(partialFilename, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Drop anything written after the last completed page.
+	if err := f.Truncate(state.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(state.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Each page is written as a separate gzip member;
+	// gzip readers handle multiple members transparently.
+	writePage := func(v ...interface{}) error {
+		gz := gzip.NewWriter(f)
+		enc := json.NewEncoder(gz)
+		for _, vv := range v {
+			if err := enc.Encode(vv); err != nil {
+				return err
+			}
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		state.Offset = offset
+		return nil
+	}
+
+	if state.Offset == 0 {
+		if err := writePage(state.Header); err != nil {
+			return err
+		}
+		if err := saveSnapshotState(stateFilename, state); err != nil {
+			return err
+		}
+	}
+
+	for !state.Complete {
+		files, next, err := lister.ListPage(ctx, state.Token)
+		if err != nil {
+			return err
+		}
+
+		entries := make([]interface{}, len(files))
+		for i, rf := range files {
+			e := snapshotEntry{remoteFileInfo: remoteFileInfo{K: rf.Key(), S: rf.Size(), E: rf.ETag()}}
+			if sf, ok := rf.(*s3File); ok {
+				e.LastModified = sf.o.LastModified
+				e.StorageClass = string(sf.o.StorageClass)
+			}
+			if metadata != nil {
+				var m objectMetadata
+				var err error
+				if mf, ok := rf.(metadataFile); ok {
+					m, err = mf.Metadata(ctx)
+				} else {
+					m, err = metadata.HeadObject(ctx, rf.Key())
+				}
+				if err != nil {
+					return fmt.Errorf("failed to get metadata for %q: %w", rf.Key(), err)
+				}
+				e.ContentType, e.ContentEncoding, e.Headers = m.ContentType, m.ContentEncoding, m.Headers
+			}
+			entries[i] = e
+		}
+
+		if err := writePage(entries...); err != nil {
+			return err
+		}
+
+		state.Token = next
+		state.Count += len(files)
+		state.Complete = next == ""
+		if err := saveSnapshotState(stateFilename, state); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partialFilename, filename); err != nil {
+		return err
+	}
+	if err := os.Remove(stateFilename); err != nil {
+		return err
+	}
+
+	p.Printf("Wrote %d files to %s\n", state.Count, filename)
+
+	return nil
+}
+
+// loadSnapshotState returns the state of a partial snapshot for cfg,
+// or nil if there is none.
+func loadSnapshotState(filename string, cfg *Config) (*snapshotState, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state snapshotState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("invalid snapshot state %q: %w", filename, err)
+	}
+	if state.Header.Bucket != cfg.BucketName || state.Header.Path != cfg.BucketPath {
+		// A snapshot of something else.
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func saveSnapshotState(filename string, state *snapshotState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
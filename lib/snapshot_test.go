@@ -0,0 +1,68 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := qt.New(t)
+
+	m := make(map[string]file)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("file%d.txt", i)
+		m[key] = &testFile{key: key, etag: fmt.Sprintf(`"etag%d"`, i), size: int64(i)}
+	}
+	store := newTestStoreFrom(m, 0).(*testStore)
+	store.pageSize = 2
+	store.listFailAt = 2
+
+	filename := filepath.Join(c.TempDir(), "snapshot.jsonl.gz")
+	cfg := &Config{
+		BucketName:   "example.com",
+		RegionName:   "eu-west-1",
+		Silent:       true,
+		SnapshotFile: filename,
+		baseStore:    store,
+	}
+
+	c.Assert(Snapshot(context.Background(), cfg), qt.ErrorMatches, "fail")
+	_, err := os.Stat(filename)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	// Resume.
+	c.Assert(Snapshot(context.Background(), cfg), qt.IsNil)
+	_, err = os.Stat(filename + ".state")
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+
+	f, err := os.Open(filename)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	c.Assert(err, qt.IsNil)
+	dec := json.NewDecoder(gz)
+
+	var header snapshotHeader
+	c.Assert(dec.Decode(&header), qt.IsNil)
+	c.Assert(header.Bucket, qt.Equals, "example.com")
+
+	var keys []string
+	for dec.More() {
+		var e snapshotEntry
+		c.Assert(dec.Decode(&e), qt.IsNil)
+		keys = append(keys, e.Key())
+	}
+	c.Assert(keys, qt.DeepEquals, []string{"file0.txt", "file1.txt", "file2.txt", "file3.txt", "file4.txt"})
+}
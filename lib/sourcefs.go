@@ -0,0 +1,86 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// sourceFS returns the file system with the files to deploy,
+// SourceFS if set, else the SourcePath directory.
+func (cfg *Config) sourceFS() fs.FS {
+	if cfg.SourceFS != nil {
+		return cfg.SourceFS
+	}
+	return os.DirFS(cfg.SourcePath)
+}
+
+// openSource opens the local file at abs, as passed to the walkLocal callback.
+func (cfg *Config) openSource(abs string) (fs.File, error) {
+	if cfg.SourceFS != nil {
+		return cfg.SourceFS.Open(abs)
+	}
+	return os.Open(abs)
+}
+
+// readSource reads the local file at abs, see openSource.
+func (cfg *Config) readSource(abs string) ([]byte, error) {
+	f, err := cfg.openSource(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// walkSourceFS walks SourceFS like walkLocalDir walks the source directory,
+// calling fn with the slash separated path in SourceFS as the absolute path.
+// Symlinks, if the file system has any, are not followed.
+func (cfg *Config) walkSourceFS(rules ignoreRules, fn func(rel, abs string, info os.FileInfo) error) error {
+	return fs.WalkDir(cfg.SourceFS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		pathUnix := "/" + name
+		if name == "." {
+			pathUnix = name
+		}
+
+		if d.IsDir() {
+			if cfg.skipLocalDirs(pathUnix) || (name != "." && rules.match(name, true)) {
+				return fs.SkipDir
+			}
+			if name == "." || cfg.fileConf.DirectoryMarkers != directoryMarkersCreate || !isEmptyFSDir(cfg.SourceFS, name) {
+				return nil
+			}
+		} else {
+			if cfg.skipLocalFiles(pathUnix) || name == cfg.IgnoreFile || rules.match(name, false) {
+				return nil
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel := cfg.normalizePath(filepath.FromSlash(name))
+		if cfg.shouldIgnoreLocal(rel) {
+			return nil
+		}
+
+		return fn(rel, name, info)
+	})
+}
+
+func isEmptyFSDir(fsys fs.FS, name string) bool {
+	entries, err := fs.ReadDir(fsys, name)
+	return err == nil && len(entries) == 0
+}
@@ -0,0 +1,62 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeploySourceFS(t *testing.T) {
+	c := qt.New(t)
+	store, m := newTestStore(0, "")
+
+	cfg := &Config{
+		BucketName: "example.com",
+		ConfigFile: filepath.Join(testSourcePath(), ".s3deploy.yml"),
+		MaxDelete:  300,
+		IgnoreFile: ".s3deployignore",
+		Silent:     true,
+		SourceFS: fstest.MapFS{
+			"ab.txt":           {Data: []byte("AB")},
+			"main.css":         {Data: []byte("body { color: red; }")},
+			"blog/index.html":  {Data: []byte("<h1>Blog</h1>")},
+			"drafts/post.html": {Data: []byte("<h1>Draft</h1>")},
+			".hidden/x.txt":    {Data: []byte("hidden")},
+			".s3deployignore":  {Data: []byte("drafts/\n")},
+		},
+		baseStore: store,
+	}
+
+	stats, err := Deploy(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 2, skipped 1 (75% changed)")
+	assertKeys(t, m, "ab.txt", "main.css", "blog/index.html")
+
+	b, err := io.ReadAll(m["blog/index.html"].(*osFile).Content())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "<h1>Blog</h1>")
+	c.Assert(m["main.css"].(*osFile).ContentType(), qt.Equals, "text/css; charset=utf-8")
+
+	cfg = &Config{BucketName: "example.com", SourceFS: fstest.MapFS{}, ETagCache: true}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "-etag-cache cannot be combined with a source file system")
+}
+
+func TestLoadSitemapPagesSourceFS(t *testing.T) {
+	c := qt.New(t)
+
+	fsys := fstest.MapFS{
+		"sitemap.xml":    {Data: []byte(`<sitemapindex><sitemap><loc>https://example.org/en/sitemap.xml</loc></sitemap></sitemapindex>`)},
+		"en/sitemap.xml": {Data: []byte(`<urlset><url><loc>https://example.org/blog/</loc></url></urlset>`)},
+	}
+	pages, err := loadSitemapPages(fsys, "/sitemap.xml")
+	c.Assert(err, qt.IsNil)
+	c.Assert(pages, qt.DeepEquals, sitemapPages{"/blog/": true})
+}
@@ -0,0 +1,109 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// awsCLIRunner runs the AWS CLI with args and returns what it writes to
+// stdout. If interactive is set, it's run in the terminal instead, e.g.
+// for the browser based `aws sso login`.
+type awsCLIRunner func(ctx context.Context, interactive bool, args ...string) ([]byte, error)
+
+func runAWSCLI(ctx context.Context, interactive bool, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("aws"); err != nil {
+		return nil, fmt.Errorf("-sso-profile requires the AWS CLI: %w", err)
+	}
+	if interactive {
+		cmd := exec.CommandContext(ctx, "aws", args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return nil, cmd.Run()
+	}
+	return runCommand(ctx, "aws", args...)
+}
+
+// initSSOCredentials gets the credentials for SSOProfile from the AWS CLI.
+// If the SSO session has expired and SSOLogin is set, it runs `aws sso login`
+// first when running in a terminal.
+func (cfg *Config) initSSOCredentials(ctx context.Context) error {
+	run := cfg.awsCLI
+	if run == nil {
+		run = runAWSCLI
+	}
+	exportCredentials := func() ([]byte, error) {
+		return run(ctx, false, "configure", "export-credentials", "--profile", cfg.SSOProfile, "--format", "process")
+	}
+
+	b, err := exportCredentials()
+	if err != nil && isSSOLoginRequired(err) && cfg.SSOLogin && cfg.isInteractive() {
+		if _, lerr := run(ctx, true, "sso", "login", "--profile", cfg.SSOProfile); lerr != nil {
+			return fmt.Errorf("aws sso login failed: %w", lerr)
+		}
+		b, err = exportCredentials()
+	}
+	if err != nil {
+		if isSSOLoginRequired(err) {
+			return fmt.Errorf("the AWS SSO session has expired, %s: %w", ssoLoginHint(cfg.SSOProfile), err)
+		}
+		return fmt.Errorf("failed to get the credentials for profile %q: %w", cfg.SSOProfile, err)
+	}
+
+	creds, err := parseProcessCredentials(b)
+	if err != nil {
+		return fmt.Errorf("failed to get the credentials for profile %q: %w", cfg.SSOProfile, err)
+	}
+	cfg.setProcessCredentials(creds)
+	return nil
+}
+
+// isInteractive reports whether s3deploy is running in a terminal.
+func (cfg *Config) isInteractive() bool {
+	if cfg.stdin != nil {
+		return true
+	}
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// isSSOLoginRequired reports whether err from the AWS CLI
+// means that the SSO session has expired or was never started.
+func isSSOLoginRequired(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "sso") && (strings.Contains(msg, "expired") || strings.Contains(msg, "does not exist"))
+}
+
+// ssoLoginHint returns what to run to start a new SSO session for profile.
+func ssoLoginHint(profile string) string {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "<profile>"
+	}
+	return fmt.Sprintf("run \"aws sso login --profile %s\" and try again", profile)
+}
+
+// checkExpiredCredentials adds what to do to err if
+// it's an AWS error caused by expired credentials.
+func (cfg *Config) checkExpiredCredentials(err error) error {
+	var apiErr smithy.APIError
+	if err == nil || !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException":
+		return fmt.Errorf("the AWS credentials have expired, if they're from an SSO session %s: %w", ssoLoginHint(cfg.SSOProfile), err)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInitSSOCredentials(t *testing.T) {
+	c := qt.New(t)
+
+	var calls []string
+	loggedIn := false
+	cli := func(ctx context.Context, interactive bool, args ...string) ([]byte, error) {
+		calls = append(calls, fmt.Sprintf("%t %s", interactive, strings.Join(args, " ")))
+		if args[0] == "sso" {
+			loggedIn = true
+			return nil, nil
+		}
+		if !loggedIn {
+			return nil, errors.New("Error when retrieving token from sso: Token has expired and refresh failed")
+		}
+		return []byte(`{"Version": 1, "AccessKeyId": "ssokey", "SecretAccessKey": "ssosecret", "SessionToken": "ssotoken"}`), nil
+	}
+
+	cfg := &Config{BucketName: "example.com", SSOProfile: "dev", awsCLI: cli}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.ErrorMatches, `the AWS SSO session has expired, run "aws sso login --profile dev" and try again: .*Token has expired.*`)
+
+	calls = nil
+	cfg = &Config{BucketName: "example.com", SSOProfile: "dev", SSOLogin: true, awsCLI: cli, stdin: strings.NewReader("")}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(calls, qt.DeepEquals, []string{
+		"false configure export-credentials --profile dev --format process",
+		"true sso login --profile dev",
+		"false configure export-credentials --profile dev --format process",
+	})
+	creds, err := createCredentials(cfg).Retrieve(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(creds.AccessKeyID, qt.Equals, "ssokey")
+	c.Assert(creds.SessionToken, qt.Equals, "ssotoken")
+
+	// Only once.
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(calls, qt.HasLen, 3)
+
+	cfg = &Config{BucketName: "example.com", SSOProfile: "dev", AccessKey: "key", SecretKey: "secret"}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "-sso-profile cannot be combined with an access key and a secret key")
+	cfg = &Config{BucketName: "example.com", SSOLogin: true}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "-sso-login requires -sso-profile")
+}
+
+func TestCheckExpiredCredentials(t *testing.T) {
+	c := qt.New(t)
+
+	t.Setenv("AWS_PROFILE", "prod")
+	cfg := &Config{}
+	expired := fmt.Errorf("operation error S3: ListObjectsV2: %w", &smithy.GenericAPIError{Code: "ExpiredToken", Message: "The provided token has expired."})
+	c.Assert(cfg.checkExpiredCredentials(expired), qt.ErrorMatches, `the AWS credentials have expired, if they're from an SSO session run "aws sso login --profile prod" and try again: .*`)
+	c.Assert(errors.Is(cfg.checkExpiredCredentials(expired), expired), qt.IsTrue)
+
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+	c.Assert(cfg.checkExpiredCredentials(denied), qt.Equals, error(denied))
+	c.Assert(cfg.checkExpiredCredentials(nil), qt.IsNil)
+}
@@ -7,28 +7,148 @@ package lib
 
 import (
 	"fmt"
+	"time"
 )
 
 // DeployStats contains some simple stats about the deployment.
 type DeployStats struct {
 	// Number of files deleted.
-	Deleted uint64
+	Deleted uint64 `json:"deleted"`
 	// Number of files on remote not present locally (-max-delete threshold reached)
-	Stale uint64
+	Stale uint64 `json:"stale"`
 	// Number of files uploaded.
-	Uploaded uint64
+	Uploaded uint64 `json:"uploaded"`
 	// Number of files skipped (i.e. not changed)
-	Skipped uint64
+	Skipped uint64 `json:"skipped"`
+	// Number of skipped files with their remote metadata fixed (-reconcile-metadata).
+	Reconciled uint64 `json:"reconciled"`
+	// Number of files copied from the reference bucket instead of uploaded.
+	Copied uint64 `json:"copied"`
+	// Number of files copied server side from an uploaded file
+	// with the same content instead of uploaded (-dedupe).
+	Deduplicated uint64 `json:"deduplicated"`
+	// Number of files copied server side from a deleted remote file
+	// with the same content instead of uploaded (-detect-moves).
+	Moved uint64 `json:"moved"`
+	// Number of files that failed to upload (-max-errors, -continue-on-error).
+	Failed uint64 `json:"failed"`
+
+	// Number of bytes uploaded, before and after compression.
+	BytesUploadedRaw        uint64 `json:"bytesUploadedRaw"`
+	BytesUploadedCompressed uint64 `json:"bytesUploadedCompressed"`
+	// Number of the bytes uploaded that were copied server side from
+	// the previous version of the files instead (delta routes).
+	BytesDeltaCopied uint64 `json:"bytesDeltaCopied"`
+
+	// Number of remote files considered.
+	RemoteFiles uint64 `json:"remoteFiles"`
+
+	// Wall-clock duration of each phase of the deploy.
+	// Planning and uploading run concurrently.
+	ListDuration       time.Duration `json:"listDuration"`
+	PlanDuration       time.Duration `json:"planDuration"`
+	UploadDuration     time.Duration `json:"uploadDuration"`
+	DeleteDuration     time.Duration `json:"deleteDuration"`
+	InvalidateDuration time.Duration `json:"invalidateDuration"`
+
+	// The stats per route, in the order the routes were first matched.
+	Routes []*RouteStats `json:"routes,omitempty"`
+
+	// The stats per top level directory, e.g. "blog/", with "/"
+	// for the files at the root.
+	Directories map[string]*DirectoryStats `json:"directories,omitempty"`
+
+	// The files changed, only collected with -github-summary.
+	Changes []FileChange `json:"changes,omitempty"`
+
+	// The keys of the files deleted, sorted.
+	DeletedKeys []string `json:"deletedKeys,omitempty"`
+
+	// The CDN paths invalidated.
+	InvalidationPaths []string `json:"invalidationPaths,omitempty"`
+	// The CloudFront invalidation ID per distribution ID.
+	Invalidations map[string]string `json:"invalidations,omitempty"`
+}
+
+// FileChange is a remote file changed by the deploy.
+type FileChange struct {
+	Key string `json:"key"`
+	// One of "uploaded", "copied", "moved" and "deleted".
+	Action string `json:"action"`
+}
+
+// RouteStats contains the stats for the local files matching a route.
+type RouteStats struct {
+	// The route pattern, empty for files not matching any route.
+	Route string `json:"route"`
+
+	Uploaded uint64 `json:"uploaded"`
+	Skipped  uint64 `json:"skipped"`
+	Copied   uint64 `json:"copied"`
+
+	BytesUploadedRaw        uint64 `json:"bytesUploadedRaw"`
+	BytesUploadedCompressed uint64 `json:"bytesUploadedCompressed"`
+}
+
+// DirectoryStats contains the stats for the files in a directory.
+type DirectoryStats struct {
+	Uploaded uint64 `json:"uploaded"`
+	Skipped  uint64 `json:"skipped"`
+	Deleted  uint64 `json:"deleted"`
 }
 
 // Summary returns formatted summary of the stats.
 func (d DeployStats) Summary() string {
-	return fmt.Sprintf("Deleted %d of %d, uploaded %d, skipped %d (%.0f%% changed)", d.Deleted, (d.Deleted + d.Stale), d.Uploaded, d.Skipped, d.PercentageChanged())
+	s := fmt.Sprintf("Deleted %d of %d, uploaded %d, skipped %d (%.0f%% changed)", d.Deleted, (d.Deleted + d.Stale), d.Uploaded, d.Skipped, d.PercentageChanged())
+	if d.Copied > 0 {
+		s += fmt.Sprintf(", copied %d from reference", d.Copied)
+	}
+	if d.Deduplicated > 0 {
+		s += fmt.Sprintf(", copied %d duplicates", d.Deduplicated)
+	}
+	if d.Moved > 0 {
+		s += fmt.Sprintf(", moved %d", d.Moved)
+	}
+	if d.BytesDeltaCopied > 0 {
+		s += fmt.Sprintf(", copied %s of unchanged blocks", formatBytes(d.BytesDeltaCopied))
+	}
+	if d.Reconciled > 0 {
+		s += fmt.Sprintf(", fixed metadata of %d", d.Reconciled)
+	}
+	if d.Failed > 0 {
+		s += fmt.Sprintf(", failed %d", d.Failed)
+	}
+	s += fmt.Sprintf("\nUploaded %s (%s compressed), %d remote files; list %s, plan %s, upload %s, delete %s, invalidate %s",
+		formatBytes(d.BytesUploadedRaw), formatBytes(d.BytesUploadedCompressed), d.RemoteFiles,
+		formatDuration(d.ListDuration), formatDuration(d.PlanDuration), formatDuration(d.UploadDuration),
+		formatDuration(d.DeleteDuration), formatDuration(d.InvalidateDuration))
+	return s
+}
+
+// RouteSummary returns a formatted summary of the stats per route,
+// one line per route.
+func (d DeployStats) RouteSummary() string {
+	var s string
+	for i, r := range d.Routes {
+		if i > 0 {
+			s += "\n"
+		}
+		if r.Route == "" {
+			s += "No route"
+		} else {
+			s += fmt.Sprintf("Route %q", r.Route)
+		}
+		s += fmt.Sprintf(": uploaded %d (%s, %s compressed), skipped %d", r.Uploaded, formatBytes(r.BytesUploadedRaw), formatBytes(r.BytesUploadedCompressed), r.Skipped)
+		if r.Copied > 0 {
+			s += fmt.Sprintf(", copied %d", r.Copied)
+		}
+	}
+	return s
 }
 
 // FileCountChanged returns the total number of files changed on server.
 func (d DeployStats) FileCountChanged() uint64 {
-	return d.Deleted + d.Uploaded
+	return d.Deleted + d.Uploaded + d.Copied + d.Deduplicated + d.Moved
 }
 
 // FileCount returns the total number of files both locally and remote.
@@ -43,3 +163,20 @@ func (d DeployStats) PercentageChanged() float32 {
 	}
 	return (float32(d.FileCountChanged()) / float32(d.FileCount()) * 100)
 }
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
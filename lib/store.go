@@ -8,14 +8,29 @@ package lib
 import (
 	"context"
 	"fmt"
+	"io"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	_ remoteStore = (*store)(nil)
-	_ remoteCDN   = (*noUpdateStore)(nil)
+	_ remoteStore              = (*store)(nil)
+	_ remoteMetadataReconciler = (*store)(nil)
+	_ remoteCopier             = (*store)(nil)
+	_ remoteInventoryReader    = (*store)(nil)
+	_ remoteCDN                = (*noUpdateStore)(nil)
+	_ remoteCanary             = (*noUpdateStore)(nil)
+	_ remoteEdgeFunction       = (*noUpdateStore)(nil)
+	_ remoteWebsite            = (*noUpdateStore)(nil)
+	_ remoteBucketCreator      = (*noUpdateStore)(nil)
+	_ remoteACLChecker         = (*noUpdateStore)(nil)
+	_ remoteMetadataReconciler = (*noUpdateStore)(nil)
+	_ remoteCopier             = (*noUpdateStore)(nil)
+	_ remoteInventoryReader    = (*noUpdateStore)(nil)
 )
 
 type remoteStore interface {
@@ -29,6 +44,14 @@ type remoteCDN interface {
 	InvalidateCDNCache(ctx context.Context, paths ...string) error
 }
 
+// remoteCDNPaths is implemented by stores that can tell
+// which CDN paths were invalidated.
+type remoteCDNPaths interface {
+	InvalidatedPaths() []string
+	// InvalidationIDs returns the invalidation ID per distribution ID.
+	InvalidationIDs() map[string]string
+}
+
 type store struct {
 	cfg      *Config
 	delegate remoteStore
@@ -52,8 +75,39 @@ func (s *store) FileMap(ctx context.Context, opts ...opOption) (map[string]file,
 }
 
 func (s *store) Finalize(ctx context.Context) error {
+	if err := s.delegate.Finalize(ctx); err != nil {
+		return err
+	}
+	if w := s.cfg.fileConf.Website; w != nil {
+		if ws, ok := s.delegate.(remoteWebsite); ok {
+			if err := ws.UpdateWebsite(ctx, w); err != nil {
+				return fmt.Errorf("failed to update the website configuration: %w", err)
+			}
+		}
+	}
+	if s.cfg.CloudFrontFunction != "" {
+		if ef, ok := s.delegate.(remoteEdgeFunction); ok {
+			code, err := edgeFunctionCode(s.cfg.fileConf.Redirects, s.cfg.CloudFrontFunctionCleanURLs)
+			if err != nil {
+				return err
+			}
+			if err := ef.UpdateEdgeFunction(ctx, code); err != nil {
+				return fmt.Errorf("failed to update CloudFront Function %q: %w", s.cfg.CloudFrontFunction, err)
+			}
+		}
+	}
 	if cdn, ok := s.delegate.(remoteCDN); ok {
-		return cdn.InvalidateCDNCache(ctx, s.changedKeys...)
+		if err := cdn.InvalidateCDNCache(ctx, s.changedKeys...); err != nil {
+			return err
+		}
+	}
+	if canary, ok := s.delegate.(remoteCanary); ok {
+		switch {
+		case s.cfg.CanaryPercent > 0:
+			return canary.UpdateCanaryTraffic(ctx, s.cfg.CanaryPercent)
+		case s.cfg.CanaryPromote:
+			return canary.UpdateCanaryTraffic(ctx, 0)
+		}
 	}
 	return nil
 }
@@ -74,6 +128,54 @@ func (s *store) Put(ctx context.Context, f localFile, opts ...opOption) error {
 	return err
 }
 
+func (s *store) GetBucketObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	r, ok := s.delegate.(remoteInventoryReader)
+	if !ok {
+		return nil, errInventoryNotSupported
+	}
+	return r.GetBucketObject(ctx, bucket, key)
+}
+
+func (s *store) ListBucketPrefixes(ctx context.Context, bucket, prefix string) ([]string, error) {
+	r, ok := s.delegate.(remoteInventoryReader)
+	if !ok {
+		return nil, errInventoryNotSupported
+	}
+	return r.ListBucketPrefixes(ctx, bucket, prefix)
+}
+
+func (s *store) HeadObject(ctx context.Context, key string) (objectMetadata, error) {
+	r, ok := s.delegate.(remoteMetadataReconciler)
+	if !ok {
+		return objectMetadata{}, errMetadataNotSupported
+	}
+	return r.HeadObject(ctx, key)
+}
+
+func (s *store) UpdateMetadata(ctx context.Context, f localFile) error {
+	r, ok := s.delegate.(remoteMetadataReconciler)
+	if !ok {
+		return errMetadataNotSupported
+	}
+	if err := r.UpdateMetadata(ctx, f); err != nil {
+		return err
+	}
+	s.trackChanged(f.Key())
+	return nil
+}
+
+func (s *store) CopyFrom(ctx context.Context, srcBucket, srcKey string, f localFile) error {
+	c, ok := s.delegate.(remoteCopier)
+	if !ok {
+		return errCopyNotSupported
+	}
+	if err := c.CopyFrom(ctx, srcBucket, srcKey, f); err != nil {
+		return err
+	}
+	s.trackChanged(f.Key())
+	return nil
+}
+
 func (s *store) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
 	if len(keys) == 0 {
 		return nil
@@ -85,33 +187,59 @@ func (s *store) DeleteObjects(ctx context.Context, keys []string, opts ...opOpti
 	}
 
 	if conf.maxDelete <= 0 {
-		// Nothing to do.
+		// Nothing to do, all the files are left.
+		conf.statsCollector(0, len(keys))
 		return nil
 	}
 
+	for _, key := range keys {
+		if !inDeleteScope(conf.deleteScope, key) {
+			return fmt.Errorf("refusing to delete %q: outside of delete scope %q", key, conf.deleteScope)
+		}
+	}
+
 	chunkSize := 1000 // This is the maximum supported by the AWS SDK.
 	if conf.maxDelete < chunkSize {
 		chunkSize = conf.maxDelete
 	}
 
 	keyChunks := chunkStrings(keys, chunkSize)
-	deleted := 0
 
-	for i := 0; i < len(keyChunks); i++ {
-		keyChunk := keyChunks[i]
+	// Only delete as many chunks as needed to reach maxDelete.
+	numChunks := (conf.maxDelete + chunkSize - 1) / chunkSize
+	if numChunks > len(keyChunks) {
+		numChunks = len(keyChunks)
+	}
 
-		err := s.delegate.DeleteObjects(ctx, keyChunk, opts...)
-		if err != nil {
-			return err
-		}
+	workers := s.cfg.DeleteWorkers
+	if workers <= 0 {
+		workers = 1
+	}
 
-		s.trackChanged(keyChunk...)
-		deleted += len(keyChunk)
-		conf.statsCollector(deleted, 0)
-		if deleted >= conf.maxDelete {
-			conf.statsCollector(0, len(keys)-deleted)
-			break
-		}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+
+	var deleted int64
+	for _, keyChunk := range keyChunks[:numChunks] {
+		keyChunk := keyChunk
+		g.Go(func() error {
+			if err := s.delegate.DeleteObjects(ctx, keyChunk, opts...); err != nil {
+				return err
+			}
+			s.trackChanged(keyChunk...)
+			atomic.AddInt64(&deleted, int64(len(keyChunk)))
+			conf.statsCollector(len(keyChunk), 0)
+			conf.batchCollector(keyChunk)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if stale := len(keys) - int(deleted); stale > 0 {
+		conf.statsCollector(0, stale)
 	}
 
 	return nil
@@ -140,6 +268,46 @@ func (s *noUpdateStore) DeleteObjects(ctx context.Context, keys []string, opts .
 	return nil
 }
 
+func (s *noUpdateStore) HeadObject(ctx context.Context, key string) (objectMetadata, error) {
+	r, ok := s.readOps.(remoteMetadataReconciler)
+	if !ok {
+		return objectMetadata{}, errMetadataNotSupported
+	}
+	return r.HeadObject(ctx, key)
+}
+
+func (s *noUpdateStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	g, ok := s.readOps.(remoteObjectGetter)
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return g.GetObject(ctx, key)
+}
+
+func (s *noUpdateStore) GetBucketObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	r, ok := s.readOps.(remoteInventoryReader)
+	if !ok {
+		return nil, errInventoryNotSupported
+	}
+	return r.GetBucketObject(ctx, bucket, key)
+}
+
+func (s *noUpdateStore) ListBucketPrefixes(ctx context.Context, bucket, prefix string) ([]string, error) {
+	r, ok := s.readOps.(remoteInventoryReader)
+	if !ok {
+		return nil, errInventoryNotSupported
+	}
+	return r.ListBucketPrefixes(ctx, bucket, prefix)
+}
+
+func (s *noUpdateStore) UpdateMetadata(ctx context.Context, f localFile) error {
+	return nil
+}
+
+func (s *noUpdateStore) CopyFrom(ctx context.Context, srcBucket, srcKey string, f localFile) error {
+	return nil
+}
+
 func (s *noUpdateStore) Finalize(ctx context.Context) error {
 	if s.readOps != nil {
 		return s.readOps.Finalize(ctx)
@@ -153,9 +321,24 @@ func (s *noUpdateStore) InvalidateCDNCache(ctx context.Context, paths ...string)
 	return nil
 }
 
+func (s *noUpdateStore) UpdateEdgeFunction(ctx context.Context, code []byte) error {
+	fmt.Printf("\nUpdate CloudFront Function (%d bytes)\n", len(code))
+	return nil
+}
+
+func (s *noUpdateStore) UpdateCanaryTraffic(ctx context.Context, percent float64) error {
+	fmt.Printf("\nUpdate canary traffic: %.2f%%\n", percent)
+	return nil
+}
+
 type opConfig struct {
 	maxDelete      int
+	deleteScope    string
 	statsCollector func(handled, skipped int)
+	// Called with the bytes copied server side in a delta upload.
+	deltaCollector func(copied int64)
+	// Called with each batch of keys deleted.
+	batchCollector func(keys []string)
 }
 
 type opOption func(c *opConfig) error
@@ -167,12 +350,22 @@ func withMaxDelete(count int) opOption {
 	}
 }
 
+func withDeleteScope(scope string) opOption {
+	return func(c *opConfig) error {
+		c.deleteScope = scope
+		return nil
+	}
+}
+
 func withUploadStats(stats *DeployStats) opOption {
 	return func(c *opConfig) error {
 		c.statsCollector = func(handled, skipped int) {
 			atomic.AddUint64(&stats.Uploaded, uint64(handled))
 			atomic.AddUint64(&stats.Skipped, uint64(skipped))
 		}
+		c.deltaCollector = func(copied int64) {
+			atomic.AddUint64(&stats.BytesDeltaCopied, uint64(copied))
+		}
 		return nil
 	}
 }
@@ -187,6 +380,13 @@ func withDeleteStats(stats *DeployStats) opOption {
 	}
 }
 
+func withDeleteBatches(fn func(keys []string)) opOption {
+	return func(c *opConfig) error {
+		c.batchCollector = fn
+		return nil
+	}
+}
+
 func optsToConfig(opts ...opOption) (*opConfig, error) {
 	c := &opConfig{}
 	for _, opt := range opts {
@@ -198,10 +398,32 @@ func optsToConfig(opts ...opOption) (*opConfig, error) {
 	if c.statsCollector == nil {
 		c.statsCollector = func(handled, skipped int) {}
 	}
+	if c.deltaCollector == nil {
+		c.deltaCollector = func(copied int64) {}
+	}
+	if c.batchCollector == nil {
+		c.batchCollector = func(keys []string) {}
+	}
 
 	return c, nil
 }
 
+// inDeleteScope reports whether key is inside the given scope.
+// A scope not ending with a slash is treated as a directory.
+func inDeleteScope(scope, key string) bool {
+	scope = strings.TrimPrefix(scope, "/")
+	if scope == "" {
+		return true
+	}
+	if !strings.HasSuffix(scope, "/") {
+		if key == scope {
+			return true
+		}
+		scope += "/"
+	}
+	return strings.HasPrefix(key, scope)
+}
+
 func chunkStrings(s []string, size int) [][]string {
 	if len(s) == 0 {
 		return nil
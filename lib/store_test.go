@@ -7,6 +7,7 @@ package lib
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -32,3 +33,50 @@ func TestNoUpdateStore(t *testing.T) {
 	c.Assert(store.DeleteObjects(context.Background(), nil), qt.IsNil)
 	c.Assert(store.Put(context.Background(), nil), qt.IsNil)
 }
+
+func TestInDeleteScope(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(inDeleteScope("", "a/b.txt"), qt.IsTrue)
+	c.Assert(inDeleteScope("a", "a/b.txt"), qt.IsTrue)
+	c.Assert(inDeleteScope("/a", "a/b.txt"), qt.IsTrue)
+	c.Assert(inDeleteScope("a/", "a/b.txt"), qt.IsTrue)
+	c.Assert(inDeleteScope("a", "ab/b.txt"), qt.IsFalse)
+	c.Assert(inDeleteScope("a/b", "a/c.txt"), qt.IsFalse)
+}
+
+func TestStoreDeleteObjectsOutOfScope(t *testing.T) {
+	c := qt.New(t)
+
+	ts, m := newTestStore(0, "my/path")
+	s := newStore(&Config{}, ts)
+
+	err := s.DeleteObjects(context.Background(), []string{"my/path/deleteme.txt", "my/pathology/a.txt"}, withMaxDelete(10), withDeleteScope("my/path"))
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(err.Error(), qt.Contains, "outside of delete scope")
+	c.Assert(m["my/path/deleteme.txt"], qt.IsNotNil)
+
+	c.Assert(s.DeleteObjects(context.Background(), []string{"my/path/deleteme.txt"}, withMaxDelete(10), withDeleteScope("my/path")), qt.IsNil)
+	c.Assert(m["my/path/deleteme.txt"], qt.IsNil)
+}
+
+func TestStoreDeleteObjectsConcurrent(t *testing.T) {
+	c := qt.New(t)
+
+	m := make(map[string]file)
+	keys := make([]string, 3500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("file%d.txt", i)
+		m[keys[i]] = &testFile{key: keys[i]}
+	}
+
+	stats := &DeployStats{}
+	s := newStore(&Config{DeleteWorkers: 3}, newTestStoreFrom(m, 0))
+	c.Assert(s.DeleteObjects(context.Background(), keys, withMaxDelete(2500), withDeleteStats(stats)), qt.IsNil)
+	c.Assert(stats.Deleted, qt.Equals, uint64(3000))
+	c.Assert(stats.Stale, qt.Equals, uint64(500))
+	c.Assert(m, qt.HasLen, 500)
+
+	s = newStore(&Config{DeleteWorkers: 3}, newTestStoreFrom(m, 3))
+	c.Assert(s.DeleteObjects(context.Background(), keys[3000:], withMaxDelete(2500)), qt.ErrorMatches, "fail")
+}
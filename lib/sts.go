@@ -0,0 +1,158 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// stsHandler is the subset of the STS API used by s3deploy.
+type stsHandler interface {
+	GetSessionToken(ctx context.Context, params *sts.GetSessionTokenInput, optFns ...func(*sts.Options)) (*sts.GetSessionTokenOutput, error)
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+var invalidRoleSessionNameRe = regexp.MustCompile(`[^\w+=,.@-]`)
+
+func newSTSClient(cfg *Config) (stsHandler, error) {
+	awsConfig, err := newAWSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if awsConfig.Region == "" {
+		// STS is a global service.
+		awsConfig.Region = "us-east-1"
+	}
+	return sts.NewFromConfig(awsConfig), nil
+}
+
+// initSession sets up the credentials, see initSessionCredentials, and
+// resolves any Multi-Region Access Point alias set as the bucket.
+func (cfg *Config) initSession(ctx context.Context) error {
+	if err := cfg.initSessionCredentials(ctx); err != nil {
+		return err
+	}
+	return cfg.resolveMRAPAlias(ctx)
+}
+
+// initSessionCredentials gets the credentials for SSOProfile or from the
+// credentials command in the config file if set, or exchanges the configured
+// long-lived keys for short-lived session credentials if MintSession is set,
+// and then assumes RoleARN if set.
+// All AWS clients created after this will use the session credentials.
+func (cfg *Config) initSessionCredentials(ctx context.Context) error {
+	if cfg.SSOProfile != "" && cfg.AccessKey == "" {
+		if err := cfg.initSSOCredentials(ctx); err != nil {
+			return err
+		}
+		if cfg.RoleARN == "" {
+			return nil
+		}
+	} else if cfg.fileConf.Credentials != nil && cfg.AccessKey == "" {
+		if err := cfg.initProcessCredentials(ctx); err != nil {
+			return err
+		}
+		if !cfg.MintSession && cfg.RoleARN == "" {
+			return nil
+		}
+	} else if (!cfg.MintSession && cfg.RoleARN == "") || cfg.sessionToken != "" {
+		return nil
+	}
+
+	stsClient := func() (stsHandler, error) {
+		if cfg.stsClient != nil {
+			return cfg.stsClient, nil
+		}
+		return newSTSClient(cfg)
+	}
+
+	if cfg.MintSession {
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return errors.New("-mint-session requires an access key and a secret key")
+		}
+
+		client, err := stsClient()
+		if err != nil {
+			return err
+		}
+
+		out, err := client.GetSessionToken(ctx, &sts.GetSessionTokenInput{
+			DurationSeconds: aws.Int32(int32(cfg.SessionDuration.Seconds())),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mint session credentials: %w", err)
+		}
+		if err := cfg.setSessionCredentials(out.Credentials); err != nil {
+			return fmt.Errorf("failed to mint session credentials: %w", err)
+		}
+	}
+
+	if cfg.RoleARN != "" {
+		// Create a new client, as the credentials may have changed above.
+		client, err := stsClient()
+		if err != nil {
+			return err
+		}
+
+		input := &sts.AssumeRoleInput{
+			RoleArn:         aws.String(cfg.RoleARN),
+			RoleSessionName: aws.String(roleSessionName(cfg.DeployID)),
+		}
+		if cfg.SourceIdentity != "" {
+			input.SourceIdentity = aws.String(cfg.SourceIdentity)
+		}
+		keys := make([]string, 0, len(cfg.sessionTags))
+		for k := range cfg.sessionTags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			input.Tags = append(input.Tags, types.Tag{Key: aws.String(k), Value: aws.String(cfg.sessionTags[k])})
+		}
+
+		out, err := client.AssumeRole(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to assume role %q: %w", cfg.RoleARN, err)
+		}
+		if err := cfg.setSessionCredentials(out.Credentials); err != nil {
+			return fmt.Errorf("failed to assume role %q: %w", cfg.RoleARN, err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) setSessionCredentials(creds *types.Credentials) error {
+	if creds == nil {
+		return errors.New("no credentials returned")
+	}
+	cfg.AccessKey = aws.ToString(creds.AccessKeyId)
+	cfg.SecretKey = aws.ToString(creds.SecretAccessKey)
+	cfg.sessionToken = aws.ToString(creds.SessionToken)
+	if runningInGitHubActions() {
+		cfg.maskSecrets(os.Stderr)
+	}
+	return nil
+}
+
+// roleSessionName returns a valid STS role session name for deployID.
+func roleSessionName(deployID string) string {
+	name := "s3deploy-" + invalidRoleSessionNameRe.ReplaceAllString(deployID, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
@@ -0,0 +1,133 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInitSession(t *testing.T) {
+	c := qt.New(t)
+
+	handler := &mockSTSHandler{}
+	cfg := &Config{
+		BucketName:  "example.com",
+		AccessKey:   "longlivedkey",
+		SecretKey:   "longlivedsecret",
+		MintSession: true,
+		stsClient:   handler,
+	}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(handler.duration, qt.Equals, int32(3600))
+
+	creds, err := createCredentials(cfg).Retrieve(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(creds.AccessKeyID, qt.Equals, "sessionkey")
+	c.Assert(creds.SecretAccessKey, qt.Equals, "sessionsecret")
+	c.Assert(creds.SessionToken, qt.Equals, "sessiontoken")
+
+	// Only minted once.
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(handler.calls, qt.Equals, 1)
+
+	cfg = &Config{BucketName: "example.com", MintSession: true, stsClient: handler}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.ErrorMatches, "-mint-session requires an access key and a secret key")
+
+	cfg = &Config{BucketName: "example.com", MintSession: true, SessionDuration: time.Minute}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "session duration must be between 15m and 36h")
+}
+
+func TestInitSessionAssumeRole(t *testing.T) {
+	c := qt.New(t)
+
+	handler := &mockSTSHandler{}
+	cfg := &Config{
+		BucketName:     "example.com",
+		AccessKey:      "longlivedkey",
+		SecretKey:      "longlivedsecret",
+		DeployID:       "gh/run 1234",
+		RoleARN:        "arn:aws:iam::123456789012:role/deployer",
+		SessionTags:    Strings{"repo=bep/s3deploy", "commit=abc123"},
+		SourceIdentity: "bep",
+		MintSession:    true,
+		stsClient:      handler,
+	}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(handler.calls, qt.Equals, 2)
+
+	input := handler.assumeRoleInput
+	c.Assert(*input.RoleSessionName, qt.Equals, "s3deploy-gh-run-1234")
+	c.Assert(*input.SourceIdentity, qt.Equals, "bep")
+	c.Assert(input.Tags, qt.HasLen, 2)
+	c.Assert(*input.Tags[0].Key, qt.Equals, "commit")
+	c.Assert(*input.Tags[0].Value, qt.Equals, "abc123")
+	c.Assert(cfg.sessionToken, qt.Equals, "roletoken")
+
+	cfg = &Config{BucketName: "example.com", SessionTags: Strings{"a=b"}}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "session tags and source identity require a role to assume")
+
+	cfg = &Config{BucketName: "example.com", RoleARN: "arn", SessionTags: Strings{"ab"}}
+	c.Assert(cfg.Init(), qt.ErrorMatches, `invalid session tag "ab", must be on the form key=value`)
+}
+
+func TestUserAgent(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(userAgent(&Config{Version: "v2.12.0", DeployID: "01H"}), qt.Equals, "s3deploy/v2.12.0 (01H)")
+	c.Assert(userAgent(&Config{Version: "(devel)"}), qt.Equals, "s3deploy/devel")
+
+	cfg := &Config{BucketName: "example.com"}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.DeployID, qt.HasLen, 26)
+}
+
+type mockSTSHandler struct {
+	calls    int
+	duration int32
+
+	assumeRoleInput *sts.AssumeRoleInput
+}
+
+func (m *mockSTSHandler) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	m.calls++
+	m.assumeRoleInput = params
+	return &sts.AssumeRoleOutput{
+		Credentials: &types.Credentials{
+			AccessKeyId:     aws.String("rolekey"),
+			SecretAccessKey: aws.String("rolesecret"),
+			SessionToken:    aws.String("roletoken"),
+		},
+	}, nil
+}
+
+func (m *mockSTSHandler) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	m.calls++
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+	}, nil
+}
+
+func (m *mockSTSHandler) GetSessionToken(ctx context.Context, params *sts.GetSessionTokenInput, optFns ...func(*sts.Options)) (*sts.GetSessionTokenOutput, error) {
+	m.calls++
+	m.duration = aws.ToInt32(params.DurationSeconds)
+	return &sts.GetSessionTokenOutput{
+		Credentials: &types.Credentials{
+			AccessKeyId:     aws.String("sessionkey"),
+			SecretAccessKey: aws.String("sessionsecret"),
+			SessionToken:    aws.String("sessiontoken"),
+		},
+	}, nil
+}
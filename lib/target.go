@@ -0,0 +1,201 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// The URL schemes supported in -target.
+const (
+	targetFile    = "file"
+	targetWebDAV  = "webdav"
+	targetWebDAVS = "webdavs"
+	targetSFTP    = "sftp"
+)
+
+// targetPasswordEnv holds the password for -target if it's not in the URL.
+const targetPasswordEnv = "S3DEPLOY_TARGET_PASSWORD"
+
+// targetIndexKey is the file in a -target with the metadata of the
+// uploaded files, as only S3 keeps it with the files.
+const targetIndexKey = ".s3deploy-index.json"
+
+// targetIndex is the metadata of the files uploaded to a -target by key,
+// stored in targetIndexKey, as only S3 keeps it with the files. It's safe
+// for concurrent use.
+type targetIndex struct {
+	mu      sync.Mutex
+	files   map[string]objectMetadata
+	changed bool
+}
+
+func newTargetIndex() *targetIndex {
+	return &targetIndex{files: make(map[string]objectMetadata)}
+}
+
+// load reads the index with read, which returns errObjectNotFound if it
+// doesn't exist yet. All of the files are read, also outside of the
+// bucket path, as the index is written back as a whole.
+func (idx *targetIndex) load(read func() ([]byte, error)) error {
+	b, err := read()
+	if errors.Is(err, errObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]objectMetadata)
+	if err := json.Unmarshal(b, &files); err != nil {
+		return fmt.Errorf("invalid %s: %w", targetIndexKey, err)
+	}
+
+	idx.mu.Lock()
+	idx.files = files
+	idx.mu.Unlock()
+
+	return nil
+}
+
+// save writes the index with write if any files were uploaded or deleted.
+func (idx *targetIndex) save(write func(b []byte) error) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !idx.changed {
+		return nil
+	}
+	b, err := json.Marshal(idx.files)
+	if err != nil {
+		return err
+	}
+	if err := write(b); err != nil {
+		return fmt.Errorf("failed to write the index: %w", err)
+	}
+	idx.changed = false
+	return nil
+}
+
+// get returns the metadata of the file key.
+func (idx *targetIndex) get(key string) (objectMetadata, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	m, found := idx.files[key]
+	return m, found
+}
+
+// etag returns the ETag of the file key in the index. It's only trusted
+// if the size still matches, to catch most files replaced by others since.
+func (idx *targetIndex) etag(key string, size int64) string {
+	if m, found := idx.get(key); found && m.Size == size {
+		return m.ETag
+	}
+	return ""
+}
+
+// put records the metadata of the uploaded file f.
+func (idx *targetIndex) put(f localFile) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.files[f.Key()] = localFileMetadata(f)
+	idx.changed = true
+}
+
+// delete removes the deleted file key.
+func (idx *targetIndex) delete(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.files, key)
+	idx.changed = true
+}
+
+// removeEmptyDirs removes the directories of key in a -target with
+// removeDir, innermost first, as long as they're empty.
+func removeEmptyDirs(key string, removeDir func(dir string) error) {
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if removeDir(dir) != nil {
+			// Not empty.
+			return
+		}
+	}
+}
+
+// parseTarget parses and validates the -target URL s.
+func parseTarget(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -target: %w", err)
+	}
+	switch u.Scheme {
+	case targetFile:
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("invalid -target %q: only local files are supported", s)
+		}
+		if targetDir(u) == "" {
+			return nil, fmt.Errorf("invalid -target %q: missing path", s)
+		}
+	case targetWebDAV, targetWebDAVS, targetSFTP:
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid -target %q: missing host", s)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported -target scheme %q, must be one of file, webdav, webdavs and sftp", u.Scheme)
+	}
+	return u, nil
+}
+
+// targetDir returns the directory of the file URL u, e.g. /srv/www
+// for file:///srv/www, C:\www for file:///C:/www and public for file:public.
+func targetDir(u *url.URL) string {
+	if u.Opaque != "" {
+		return filepath.FromSlash(u.Opaque)
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// targetPassword returns the password for the -target URL u.
+func targetPassword(u *url.URL) string {
+	if password := os.Getenv(targetPasswordEnv); password != "" {
+		return password
+	}
+	password, _ := u.User.Password()
+	return password
+}
+
+// newTargetStore returns the store for -target, or for the bucket if not set.
+func newTargetStore(cfg *Config, logger printer) (remoteStore, error) {
+	if cfg.target == nil {
+		s, err := newRemoteStore(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	switch cfg.target.Scheme {
+	case targetFile:
+		return newDirStore(cfg, targetDir(cfg.target)), nil
+	case targetSFTP:
+		return newSFTPStore(cfg, cfg.target), nil
+	default:
+		return newWebDAVStore(cfg, cfg.target), nil
+	}
+}
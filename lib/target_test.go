@@ -0,0 +1,43 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseTarget(t *testing.T) {
+	c := qt.New(t)
+
+	u, err := parseTarget("webdavs://user:pw@example.org/site")
+	c.Assert(err, qt.IsNil)
+	c.Assert(targetPassword(u), qt.Equals, "pw")
+	s := newWebDAVStore(&Config{}, u)
+	c.Assert(s.base.String(), qt.Equals, "https://example.org/site/")
+	c.Assert(s.user, qt.Equals, "user")
+
+	u, err = parseTarget("file:///srv/www")
+	c.Assert(err, qt.IsNil)
+	c.Assert(targetDir(u), qt.Equals, filepath.FromSlash("/srv/www"))
+	u, err = parseTarget("file:public")
+	c.Assert(err, qt.IsNil)
+	c.Assert(targetDir(u), qt.Equals, "public")
+	_, err = parseTarget("file://example.org/www")
+	c.Assert(err, qt.ErrorMatches, `invalid -target "file://example.org/www": only local files are supported`)
+
+	_, err = parseTarget("ftp://example.org/site")
+	c.Assert(err, qt.ErrorMatches, `unsupported -target scheme "ftp", must be one of file, webdav, webdavs and sftp`)
+	_, err = parseTarget("sftp:///srv/www")
+	c.Assert(err, qt.ErrorMatches, `invalid -target "sftp:///srv/www": missing host`)
+	_, err = parseTarget("webdav:///site")
+	c.Assert(err, qt.ErrorMatches, `invalid -target "webdav:///site": missing host`)
+
+	cfg := &Config{Target: "webdav://example.org", CDNDistributionIDs: Strings{"E1"}}
+	c.Assert(cfg.Init(), qt.ErrorMatches, "-target cannot be combined with -distribution-id")
+}
@@ -0,0 +1,194 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+type span struct {
+	id       string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    [][2]string
+	err      error
+}
+
+// tracer records a span for every AWS API call made during a deploy,
+// all children of one root span, and sends them to an OTLP/HTTP endpoint.
+type tracer struct {
+	endpoint string
+	service  string
+
+	traceID string
+	root    span
+
+	mu    sync.Mutex
+	spans []span
+}
+
+func newTracer(endpoint, service, rootName string) *tracer {
+	return &tracer{
+		endpoint: endpoint,
+		service:  service,
+		traceID:  randomHex(16),
+		root:     span{id: randomHex(8), name: rootName, kind: spanKindInternal, start: time.Now()},
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (t *tracer) add(s span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+}
+
+// addToStack adds the tracing middleware to an AWS client's middleware stack.
+func (t *tracer) addToStack(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("s3deployTrace", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+		s := span{
+			id:       randomHex(8),
+			parentID: t.root.id,
+			name:     service + "." + operation,
+			kind:     spanKindClient,
+			start:    time.Now(),
+			attrs: [][2]string{
+				{"rpc.system", "aws-api"},
+				{"rpc.service", service},
+				{"rpc.method", operation},
+				{"cloud.region", awsmiddleware.GetRegion(ctx)},
+			},
+		}
+
+		out, metadata, err := next.HandleInitialize(ctx, in)
+
+		s.end = time.Now()
+		s.err = err
+		if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+			s.attrs = append(s.attrs, [2]string{"http.status_code", strconv.Itoa(resp.StatusCode)})
+		}
+		if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			s.attrs = append(s.attrs, [2]string{"aws.request_id", requestID})
+		}
+		t.add(s)
+
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// finish ends the root span and sends all spans to the OTLP endpoint.
+func (t *tracer) finish(ctx context.Context, err error) error {
+	t.root.end = time.Now()
+	t.root.err = err
+
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		Name              string      `json:"name"`
+		Kind              int         `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []attribute `json:"attributes,omitempty"`
+		Status            status      `json:"status"`
+	}
+
+	t.mu.Lock()
+	spans := append([]span{t.root}, t.spans...)
+	t.mu.Unlock()
+
+	var ss []otlpSpan
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, attribute{Key: a[0], Value: value{a[1]}})
+		}
+		if s.err != nil {
+			o.Status = status{Code: spanStatusError, Message: s.err.Error()}
+		}
+		ss = append(ss, o)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []attribute{{Key: "service.name", Value: value{t.service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "s3deploy"},
+						"spans": ss,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(t.endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+
+	return doTelemetryRequest(ctx, http.MethodPost, u, "application/json", bytes.NewReader(b))
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTracer(t *testing.T) {
+	c := qt.New(t)
+
+	var userAgent string
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "text/xml")
+		w.Header().Set("X-Amzn-Requestid", "myrequestid")
+		io.WriteString(w, `<GetSessionTokenResponse><GetSessionTokenResult><Credentials>
+<AccessKeyId>sessionkey</AccessKeyId><SecretAccessKey>sessionsecret</SecretAccessKey><SessionToken>sessiontoken</SessionToken>
+<Expiration>2030-01-01T00:00:00Z</Expiration></Credentials></GetSessionTokenResult>
+<ResponseMetadata><RequestId>myrequestid</RequestId></ResponseMetadata></GetSessionTokenResponse>`)
+	}))
+	defer aws.Close()
+
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, qt.Equals, "/v1/traces")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+
+	cfg := &Config{
+		BucketName:  "example.com",
+		RegionName:  "eu-west-1",
+		AccessKey:   "longlivedkey",
+		SecretKey:   "longlivedsecret",
+		EndpointURL: aws.URL,
+		MintSession: true,
+		DeployID:    "mydeploy",
+		Version:     "v2.0.0",
+		tracer:      newTracer(collector.URL, "s3deploy", "s3deploy deploy"),
+	}
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.initSession(context.Background()), qt.IsNil)
+	c.Assert(cfg.sessionToken, qt.Equals, "sessiontoken")
+	c.Assert(userAgent, qt.Contains, "s3deploy/v2.0.0 (mydeploy)")
+	c.Assert(cfg.tracer.finish(context.Background(), nil), qt.IsNil)
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Attributes   []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	c.Assert(json.Unmarshal(body, &payload), qt.IsNil)
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, qt.HasLen, 2)
+	c.Assert(spans[0].Name, qt.Equals, "s3deploy deploy")
+	c.Assert(spans[1].Name, qt.Equals, "STS.GetSessionToken")
+	c.Assert(spans[1].TraceID, qt.Equals, spans[0].TraceID)
+	c.Assert(spans[1].ParentSpanID, qt.Not(qt.Equals), "")
+
+	attrs := make(map[string]string)
+	for _, a := range spans[1].Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	c.Assert(attrs["http.status_code"], qt.Equals, "200")
+	c.Assert(attrs["aws.request_id"], qt.Equals, "myrequestid")
+}
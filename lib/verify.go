@@ -0,0 +1,226 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultVerifyUserAgent = "s3deploy-verify"
+
+// verifyClient is used for synthetic verification and warm-up requests
+// against the deployed site. The requests are sent with a custom User-Agent
+// and a unique cache-busting query parameter, so they are never served from
+// a cache and are easy to filter out in the access logs.
+type verifyClient struct {
+	userAgent   string
+	cacheBuster string
+
+	client *http.Client
+
+	// Used to make the cache-busting value unique.
+	prefix  string
+	counter uint64
+}
+
+func newVerifyClient(cfg *Config) *verifyClient {
+	userAgent := cfg.VerifyUserAgent
+	if userAgent == "" {
+		userAgent = defaultVerifyUserAgent
+	}
+	return &verifyClient{
+		userAgent:   userAgent,
+		cacheBuster: cfg.VerifyCacheBuster,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		prefix:      strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// newRequest creates a new request for the given URL with the
+// User-Agent and cache-busting query parameter applied.
+func (c *verifyClient) newRequest(ctx context.Context, method, rawURL string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cacheBuster != "" {
+		q := u.Query()
+		q.Set(c.cacheBuster, c.prefix+"-"+strconv.FormatUint(atomic.AddUint64(&c.counter, 1), 10))
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Cache-Control", "no-cache")
+
+	return req, nil
+}
+
+// Do creates and sends a request for the given URL.
+func (c *verifyClient) Do(ctx context.Context, method, rawURL string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
+// recordVerify records f to be verified after the upload (-verify).
+func (d *Deployer) recordVerify(f *osFile) {
+	if !d.cfg.Verify || d.cfg.Try {
+		return
+	}
+	d.verifyMu.Lock()
+	defer d.verifyMu.Unlock()
+	d.toVerify = append(d.toVerify, f)
+}
+
+// verifyUploads checks that the size, ETag and Content-Type of the uploaded
+// files match what was sent, either with HeadObject or, if VerifyURL is set,
+// with GET requests against the deployed site.
+func (d *Deployer) verifyUploads(ctx context.Context) error {
+	if len(d.toVerify) == 0 {
+		return nil
+	}
+
+	var check func(ctx context.Context, f *osFile) (string, error)
+	if d.cfg.VerifyURL != "" {
+		client := newVerifyClient(d.cfg)
+		check = func(ctx context.Context, f *osFile) (string, error) {
+			return client.verifyFile(ctx, d.cfg.VerifyURL, f)
+		}
+	} else {
+		r, ok := d.store.(remoteMetadataReconciler)
+		if !ok {
+			return errMetadataNotSupported
+		}
+		check = func(ctx context.Context, f *osFile) (string, error) {
+			m, err := r.HeadObject(ctx, f.Key())
+			if err != nil {
+				return "", err
+			}
+			etag := f.remoteETag(m.ETag, func(key string) string { return m.Headers[key] })
+			return verifyDiff(f, m.Size, etag, m.ContentType, m.Headers[mtimeHeader]), nil
+		}
+	}
+
+	d.Printf("Verifying %d file(s) …\n", len(d.toVerify))
+
+	workers := d.cfg.UploadWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+
+	var (
+		mu         sync.Mutex
+		mismatches []string
+	)
+	for _, f := range d.toVerify {
+		f := f
+		g.Go(func() error {
+			diff, err := check(ctx, f)
+			if err != nil {
+				return fmt.Errorf("failed to verify %q: %w", f.Key(), err)
+			}
+			if diff != "" {
+				mu.Lock()
+				mismatches = append(mismatches, f.Key()+": "+diff)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("verification failed for %d file(s):\n  %s", len(mismatches), strings.Join(mismatches, "\n  "))
+	}
+
+	return nil
+}
+
+// verifyFile fetches f from the site at baseURL and
+// returns any differences from what was uploaded.
+func (c *verifyClient) verifyFile(ctx context.Context, baseURL string, f *osFile) (string, error) {
+	rawURL := strings.TrimSuffix(baseURL, "/") + "/" + (&url.URL{Path: f.keyPath}).EscapedPath()
+	req, err := c.newRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return "", err
+	}
+	// Setting this prevents the client from decompressing the
+	// content, so the size can be compared with what was uploaded.
+	if f.contentEncoding != "" {
+		req.Header.Set("Accept-Encoding", f.contentEncoding)
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Sprintf("status %d", resp.StatusCode), nil
+	}
+
+	size, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// Weak ETags (e.g. from a CDN compressing the content) can't be compared.
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		etag = ""
+	}
+
+	etag = f.remoteETag(etag, func(key string) string { return resp.Header.Get("X-Amz-Meta-" + key) })
+
+	return verifyDiff(f, size, etag, resp.Header.Get("Content-Type"), resp.Header.Get("X-Amz-Meta-"+mtimeHeader)), nil
+}
+
+// verifyDiff returns a description of the differences between f and the
+// remote size, ETag, Content-Type and mtime (-preserve-mtime), or an empty
+// string if they match. An empty ETag or mtime is not compared.
+func verifyDiff(f *osFile, size int64, etag, contentType, mtime string) string {
+	var diffs []string
+	if size != f.Size() {
+		diffs = append(diffs, fmt.Sprintf("size %d, expected %d", size, f.Size()))
+	}
+	if etag != "" && etag != f.ETag() {
+		diffs = append(diffs, fmt.Sprintf("ETag %s, expected %s", etag, f.ETag()))
+	}
+	if !sameContentType(contentType, f.ContentType()) {
+		diffs = append(diffs, fmt.Sprintf("Content-Type %q, expected %q", contentType, f.ContentType()))
+	}
+	if mtime != "" && f.mtime != "" && mtime != f.mtime {
+		diffs = append(diffs, fmt.Sprintf("mtime %s, expected %s", mtime, f.mtime))
+	}
+	return strings.Join(diffs, ", ")
+}
@@ -0,0 +1,100 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestVerifyClient(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		userAgent string
+		buster    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		buster = r.URL.Query().Get("cb")
+		c.Check(r.URL.Query().Get("a"), qt.Equals, "b")
+	}))
+	defer srv.Close()
+
+	client := newVerifyClient(&Config{VerifyCacheBuster: "cb", VerifyUserAgent: "my-agent"})
+
+	resp, err := client.Do(context.Background(), http.MethodHead, srv.URL+"/foo/?a=b")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(userAgent, qt.Equals, "my-agent")
+	first := buster
+	c.Assert(first, qt.Not(qt.Equals), "")
+
+	resp, err = client.Do(context.Background(), http.MethodHead, srv.URL+"/foo/?a=b")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(buster, qt.Not(qt.Equals), first)
+
+	client = newVerifyClient(&Config{})
+	req, err := client.newRequest(context.Background(), http.MethodGet, "https://example.com/a.html")
+	c.Assert(err, qt.IsNil)
+	c.Assert(req.URL.String(), qt.Equals, "https://example.com/a.html")
+	c.Assert(req.UserAgent(), qt.Equals, defaultVerifyUserAgent)
+}
+
+func TestVerifyFile(t *testing.T) {
+	c := qt.New(t)
+
+	f, err := openTestFile("main.css")
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(f.Content())
+	c.Assert(err, qt.IsNil)
+
+	p := "/" + f.keyPath
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case p:
+			w.Header().Set("Content-Type", f.ContentType())
+			w.Header().Set("ETag", f.ETag())
+			w.Write(b)
+		case "/weak" + p:
+			w.Header().Set("Content-Type", f.ContentType())
+			w.Header().Set("ETag", `W/"abc"`)
+			w.Write(b)
+		case "/bad" + p:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", `"abc"`)
+			w.Write(b[:1])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := newVerifyClient(&Config{})
+	ctx := context.Background()
+
+	diff, err := client.verifyFile(ctx, srv.URL+"/", f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.Equals, "")
+
+	diff, err = client.verifyFile(ctx, srv.URL+"/weak", f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.Equals, "")
+
+	diff, err = client.verifyFile(ctx, srv.URL+"/bad", f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.Matches, `size 1, expected \d+, ETag "abc", expected ".*", Content-Type "text/plain", expected "text/css.*"`)
+
+	diff, err = client.verifyFile(ctx, srv.URL+"/missing", f)
+	c.Assert(err, qt.IsNil)
+	c.Assert(diff, qt.Equals, "status 404")
+}
@@ -0,0 +1,319 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	_ remoteStore        = (*webdavStore)(nil)
+	_ remoteObjectGetter = (*webdavStore)(nil)
+)
+
+// webdavStore is a remoteStore deploying to a WebDAV server, see -target.
+type webdavStore struct {
+	client     *http.Client
+	base       *url.URL
+	user       string
+	password   string
+	bucketPath string
+
+	// The index, loaded in FileMap, as WebDAV servers have their own ETags.
+	index *targetIndex
+
+	mu sync.Mutex
+	// The collections known to exist.
+	dirs map[string]bool
+}
+
+func newWebDAVStore(cfg *Config, target *url.URL) *webdavStore {
+	base := *target
+	base.User = nil
+	base.Scheme = "http"
+	if target.Scheme == targetWebDAVS {
+		base.Scheme = "https"
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawPath = ""
+
+	return &webdavStore{
+		client:     http.DefaultClient,
+		base:       &base,
+		user:       target.User.Username(),
+		password:   targetPassword(target),
+		bucketPath: cfg.BucketPath,
+		index:      newTargetIndex(),
+		dirs:       map[string]bool{"": true},
+	}
+}
+
+type webdavFile struct {
+	key  string
+	etag string
+	size int64
+}
+
+func (f *webdavFile) Key() string {
+	return f.key
+}
+
+func (f *webdavFile) ETag() string {
+	return f.etag
+}
+
+func (f *webdavFile) Size() int64 {
+	return f.size
+}
+
+// webdavMultistatus is a PROPFIND response.
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64 `xml:"getcontentlength"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/></prop></propfind>`
+
+func (s *webdavStore) FileMap(ctx context.Context, opts ...opOption) (map[string]file, error) {
+	if err := s.index.load(func() ([]byte, error) { return s.GetObject(ctx, targetIndexKey) }); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]file)
+	// Depth: infinity is disabled on most servers, walk one level at a time.
+	dirs := []string{strings.Trim(s.bucketPath, "/")}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		ms, err := s.propfind(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		if ms == nil {
+			// Not created yet.
+			continue
+		}
+		s.dirs[dir] = true
+
+		for _, r := range ms.Responses {
+			key, err := s.hrefKey(r.Href)
+			if err != nil {
+				return nil, err
+			}
+			if key == dir || key == targetIndexKey || len(r.Propstat) == 0 {
+				continue
+			}
+			prop := r.Propstat[0].Prop
+			if prop.ResourceType.Collection != nil {
+				dirs = append(dirs, key)
+				continue
+			}
+			m[key] = &webdavFile{key: key, etag: s.index.etag(key, prop.ContentLength), size: prop.ContentLength}
+		}
+	}
+
+	return m, nil
+}
+
+// propfind lists the collection dir, returning nil if it doesn't exist.
+func (s *webdavStore) propfind(ctx context.Context, dir string) (*webdavMultistatus, error) {
+	req, err := s.newRequest(ctx, "PROPFIND", dir+"/", strings.NewReader(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError(req, res)
+	}
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %q: %w", dir+"/", err)
+	}
+	return &ms, nil
+}
+
+// hrefKey returns the key of href in a PROPFIND response, which
+// can be a path or a full URL.
+func (s *webdavStore) hrefKey(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href %q in PROPFIND response: %w", href, err)
+	}
+	if !strings.HasPrefix(u.Path+"/", s.base.Path) {
+		return "", fmt.Errorf("href %q in PROPFIND response is outside of %s", href, s.base.Path)
+	}
+	return strings.Trim(strings.TrimPrefix(u.Path, s.base.Path), "/"), nil
+}
+
+func (s *webdavStore) Put(ctx context.Context, f localFile, opts ...opOption) error {
+	if err := s.mkdirAll(ctx, path.Dir(f.Key())); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, f.Key(), f.Content())
+	if err != nil {
+		return err
+	}
+	req.ContentLength = f.Size()
+	req.Header.Set("Content-Type", f.ContentType())
+
+	if err := s.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+		return err
+	}
+
+	s.index.put(f)
+
+	return nil
+}
+
+// mkdirAll creates the collection dir and any parents that don't exist.
+func (s *webdavStore) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	s.mu.Lock()
+	exists := s.dirs[dir]
+	s.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, "MKCOL", dir+"/", nil)
+	if err != nil {
+		return err
+	}
+	// 405 Method Not Allowed if it already exists.
+	if err := s.do(req, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.dirs[dir] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *webdavStore) DeleteObjects(ctx context.Context, keys []string, opts ...opOption) error {
+	for _, key := range keys {
+		req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound); err != nil {
+			return err
+		}
+		s.index.delete(key)
+	}
+	return nil
+}
+
+// Finalize writes the index if any files were uploaded or deleted.
+func (s *webdavStore) Finalize(ctx context.Context) error {
+	return s.index.save(func(b []byte) error {
+		req, err := s.newRequest(ctx, http.MethodPut, targetIndexKey, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return s.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	})
+}
+
+func (s *webdavStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(res.Body)
+	case http.StatusNotFound:
+		return nil, errObjectNotFound
+	default:
+		return nil, webdavError(req, res)
+	}
+}
+
+func (s *webdavStore) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u := s.base.ResolveReference(&url.URL{Path: strings.TrimPrefix(key, "/")})
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return req, nil
+}
+
+// do sends req, returning an error if the response status is not one of ok.
+func (s *webdavStore) do(req *http.Request, ok ...int) error {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	for _, code := range ok {
+		if res.StatusCode == code {
+			return nil
+		}
+	}
+	return webdavError(req, res)
+}
+
+func webdavError(req *http.Request, res *http.Response) error {
+	return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), res.Status)
+}
@@ -0,0 +1,173 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployWebDAV(t *testing.T) {
+	c := qt.New(t)
+	source := testSourcePath()
+
+	dav := &webdavTestServer{
+		files: map[string][]byte{"/site/old.txt": []byte("old"), "/site/ab.txt": []byte("AB")},
+		dirs:  map[string]bool{"/": true, "/site/": true},
+	}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	t.Setenv(targetPasswordEnv, "secret")
+	newConfig := func() *Config {
+		return &Config{
+			Target:     "webdav://user@" + srv.Listener.Addr().String() + "/site",
+			BucketPath: "blog",
+			ConfigFile: filepath.Join(source, ".s3deploy.yml"),
+			SourcePath: source,
+			MaxDelete:  300,
+			Silent:     true,
+		}
+	}
+
+	stats, err := Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 4, skipped 0 (100% changed)")
+	c.Assert(dav.paths(), qt.DeepEquals, []string{
+		"/site/.s3deploy-index.json", "/site/ab.txt", "/site/blog/.s3deploy.yml",
+		"/site/blog/ab.txt", "/site/blog/index.html", "/site/blog/main.css", "/site/old.txt",
+	})
+	c.Assert(string(dav.files["/site/blog/ab.txt"]), qt.Equals, "AB")
+
+	index := newTargetIndex()
+	c.Assert(index.load(func() ([]byte, error) { return dav.files["/site/.s3deploy-index.json"], nil }), qt.IsNil)
+	c.Assert(index.etag("blog/ab.txt", 2), qt.Equals, `"b86fc6b051f63d73de262d4c34e3a0a9"`)
+
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 0 of 0, uploaded 0, skipped 4 (0% changed)")
+
+	// Replaced on the server, and a stale file.
+	dav.files["/site/blog/ab.txt"] = []byte("ABC")
+	dav.files["/site/blog/deleteme.txt"] = []byte("stale")
+	stats, err = Deploy(newConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(firstLine(stats.Summary()), qt.Equals, "Deleted 1 of 1, uploaded 1, skipped 3 (40% changed)")
+	c.Assert(string(dav.files["/site/blog/ab.txt"]), qt.Equals, "AB")
+	c.Assert(dav.files["/site/blog/deleteme.txt"], qt.IsNil)
+
+	t.Setenv(targetPasswordEnv, "wrong")
+	_, err = Deploy(newConfig())
+	c.Assert(err, qt.ErrorMatches, `GET http://.*/site/blog/.s3deploy.freeze: 401 Unauthorized`)
+}
+
+// webdavTestServer is a minimal WebDAV server keeping the files in memory.
+type webdavTestServer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// The collections, with a trailing slash.
+	dirs map[string]bool
+}
+
+func (s *webdavTestServer) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *webdavTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := r.URL.Path
+	parent := path.Dir(strings.TrimSuffix(p, "/")) + "/"
+	if parent == "//" {
+		parent = "/"
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		if !s.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		response := func(href, prop string) {
+			fmt.Fprintf(w, `<D:response><D:href>%s</D:href><D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, href, prop)
+		}
+		response(p, `<D:resourcetype><D:collection/></D:resourcetype>`)
+		for dir := range s.dirs {
+			if dir != p && strings.HasPrefix(dir, p) && !strings.Contains(strings.TrimSuffix(dir[len(p):], "/"), "/") {
+				response(dir, `<D:resourcetype><D:collection/></D:resourcetype>`)
+			}
+		}
+		for name, b := range s.files {
+			if strings.HasPrefix(name, p) && !strings.Contains(name[len(p):], "/") {
+				response(name, fmt.Sprintf(`<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>`, len(b)))
+			}
+		}
+		fmt.Fprint(w, `</D:multistatus>`)
+	case "MKCOL":
+		switch {
+		case s.dirs[p]:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !s.dirs[parent]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			s.dirs[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodPut:
+		if !s.dirs[parent] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.files[p] = b
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		b, found := s.files[p]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		if _, found := s.files[p]; !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
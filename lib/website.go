@@ -0,0 +1,144 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// websiteConfig is the S3 static website configuration of the bucket,
+// set in the website section of the config file and the -website-* flags.
+type websiteConfig struct {
+	// The index document suffix, default index.html.
+	IndexDocument string `yaml:"indexDocument"`
+	// The key of the error document, relative to the bucket path.
+	ErrorDocument string         `yaml:"errorDocument"`
+	RedirectRules []redirectRule `yaml:"redirectRules"`
+}
+
+// redirectRule is an S3 website routing rule.
+type redirectRule struct {
+	// The conditions, a key prefix (relative to the bucket path)
+	// and/or an HTTP error code.
+	KeyPrefix string `yaml:"keyPrefix"`
+	ErrorCode int    `yaml:"errorCode"`
+
+	// The redirect.
+	HostName             string `yaml:"hostName"`
+	Protocol             string `yaml:"protocol"`
+	ReplaceKeyPrefixWith string `yaml:"replaceKeyPrefixWith"`
+	ReplaceKeyWith       string `yaml:"replaceKeyWith"`
+	// The HTTP redirect code, default 301.
+	Status int `yaml:"status"`
+}
+
+func (w *websiteConfig) init() error {
+	if w.IndexDocument == "" {
+		w.IndexDocument = "index.html"
+	}
+	if strings.Contains(w.IndexDocument, "/") {
+		return fmt.Errorf("website: indexDocument %q cannot contain a slash", w.IndexDocument)
+	}
+	for i := range w.RedirectRules {
+		if err := w.RedirectRules[i].init(); err != nil {
+			return fmt.Errorf("website: redirect rule %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *redirectRule) init() error {
+	if r.ReplaceKeyPrefixWith != "" && r.ReplaceKeyWith != "" {
+		return errors.New("replaceKeyPrefixWith cannot be combined with replaceKeyWith")
+	}
+	if r.HostName == "" && r.Protocol == "" && r.ReplaceKeyPrefixWith == "" && r.ReplaceKeyWith == "" {
+		return errors.New("one of hostName, protocol, replaceKeyPrefixWith and replaceKeyWith must be set")
+	}
+	switch r.Protocol {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid protocol %q", r.Protocol)
+	}
+	if r.Status == 0 {
+		r.Status = 301
+	}
+	if r.Status < 300 || r.Status > 399 {
+		return fmt.Errorf("invalid status %d", r.Status)
+	}
+	return nil
+}
+
+// toS3 returns the S3 website configuration, with the keys
+// relative to bucketPath.
+func (w *websiteConfig) toS3(bucketPath string) *types.WebsiteConfiguration {
+	wc := &types.WebsiteConfiguration{
+		IndexDocument: &types.IndexDocument{Suffix: aws.String(w.IndexDocument)},
+	}
+	if w.ErrorDocument != "" {
+		wc.ErrorDocument = &types.ErrorDocument{Key: aws.String(pathJoin(bucketPath, w.ErrorDocument))}
+	}
+	for _, r := range w.RedirectRules {
+		rule := types.RoutingRule{
+			Redirect: &types.Redirect{
+				HttpRedirectCode: aws.String(strconv.Itoa(r.Status)),
+				Protocol:         types.Protocol(r.Protocol),
+			},
+		}
+		if r.HostName != "" {
+			rule.Redirect.HostName = aws.String(r.HostName)
+		}
+		if r.ReplaceKeyPrefixWith != "" {
+			rule.Redirect.ReplaceKeyPrefixWith = aws.String(pathJoin(bucketPath, r.ReplaceKeyPrefixWith))
+		}
+		if r.ReplaceKeyWith != "" {
+			rule.Redirect.ReplaceKeyWith = aws.String(pathJoin(bucketPath, r.ReplaceKeyWith))
+		}
+		if r.KeyPrefix != "" || r.ErrorCode != 0 || bucketPath != "" {
+			rule.Condition = &types.Condition{}
+			if r.KeyPrefix != "" || bucketPath != "" {
+				keyPrefix := r.KeyPrefix
+				if keyPrefix == "" {
+					// Only match keys below the bucket path.
+					keyPrefix = "/"
+				}
+				rule.Condition.KeyPrefixEquals = aws.String(pathJoin(bucketPath, keyPrefix))
+			}
+			if r.ErrorCode != 0 {
+				rule.Condition.HttpErrorCodeReturnedEquals = aws.String(strconv.Itoa(r.ErrorCode))
+			}
+		}
+		wc.RoutingRules = append(wc.RoutingRules, rule)
+	}
+	return wc
+}
+
+// remoteWebsite is implemented by stores that can set
+// the static website configuration of the bucket.
+type remoteWebsite interface {
+	UpdateWebsite(ctx context.Context, w *websiteConfig) error
+}
+
+func (s *s3Store) UpdateWebsite(ctx context.Context, w *websiteConfig) error {
+	_, err := s.svc.PutBucketWebsite(ctx, &s3.PutBucketWebsiteInput{
+		Bucket:               aws.String(s.bucket),
+		WebsiteConfiguration: w.toS3(s.bucketPath),
+		ExpectedBucketOwner:  s.expectedBucketOwner,
+	})
+	return err
+}
+
+func (s *noUpdateStore) UpdateWebsite(ctx context.Context, w *websiteConfig) error {
+	fmt.Printf("\nUpdate website configuration: index document %q, error document %q, %d redirect rule(s)\n", w.IndexDocument, w.ErrorDocument, len(w.RedirectRules))
+	return nil
+}
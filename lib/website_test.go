@@ -0,0 +1,96 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWebsiteConfig(t *testing.T) {
+	c := qt.New(t)
+
+	w := &websiteConfig{
+		ErrorDocument: "404.html",
+		RedirectRules: []redirectRule{
+			{KeyPrefix: "docs/", ReplaceKeyPrefixWith: "documents/"},
+			{ErrorCode: 404, HostName: "example.org", Protocol: "https", ReplaceKeyWith: "index.html", Status: 302},
+		},
+	}
+	c.Assert(w.init(), qt.IsNil)
+	c.Assert(w.IndexDocument, qt.Equals, "index.html")
+	c.Assert(w.RedirectRules[0].Status, qt.Equals, 301)
+
+	wc := w.toS3("")
+	c.Assert(*wc.IndexDocument.Suffix, qt.Equals, "index.html")
+	c.Assert(*wc.ErrorDocument.Key, qt.Equals, "404.html")
+	c.Assert(wc.RoutingRules, qt.HasLen, 2)
+	c.Assert(*wc.RoutingRules[0].Condition.KeyPrefixEquals, qt.Equals, "docs/")
+	c.Assert(wc.RoutingRules[0].Condition.HttpErrorCodeReturnedEquals, qt.IsNil)
+	c.Assert(*wc.RoutingRules[0].Redirect.HttpRedirectCode, qt.Equals, "301")
+	c.Assert(*wc.RoutingRules[0].Redirect.ReplaceKeyPrefixWith, qt.Equals, "documents/")
+	c.Assert(wc.RoutingRules[1].Condition.KeyPrefixEquals, qt.IsNil)
+	c.Assert(*wc.RoutingRules[1].Condition.HttpErrorCodeReturnedEquals, qt.Equals, "404")
+	c.Assert(*wc.RoutingRules[1].Redirect.HttpRedirectCode, qt.Equals, "302")
+	c.Assert(*wc.RoutingRules[1].Redirect.HostName, qt.Equals, "example.org")
+	c.Assert(wc.RoutingRules[1].Redirect.Protocol, qt.Equals, types.ProtocolHttps)
+	c.Assert(*wc.RoutingRules[1].Redirect.ReplaceKeyWith, qt.Equals, "index.html")
+
+	// The keys are relative to the bucket path.
+	wc = w.toS3("blog")
+	c.Assert(*wc.ErrorDocument.Key, qt.Equals, "blog/404.html")
+	c.Assert(*wc.RoutingRules[0].Condition.KeyPrefixEquals, qt.Equals, "blog/docs/")
+	c.Assert(*wc.RoutingRules[0].Redirect.ReplaceKeyPrefixWith, qt.Equals, "blog/documents/")
+	c.Assert(*wc.RoutingRules[1].Condition.KeyPrefixEquals, qt.Equals, "blog/")
+	c.Assert(*wc.RoutingRules[1].Redirect.ReplaceKeyWith, qt.Equals, "blog/index.html")
+
+	for _, test := range []struct {
+		w   *websiteConfig
+		err string
+	}{
+		{&websiteConfig{IndexDocument: "a/index.html"}, `website: indexDocument "a/index.html" cannot contain a slash`},
+		{&websiteConfig{RedirectRules: []redirectRule{{KeyPrefix: "a/"}}}, `website: redirect rule 1: one of hostName, protocol, replaceKeyPrefixWith and replaceKeyWith must be set`},
+		{&websiteConfig{RedirectRules: []redirectRule{{ReplaceKeyWith: "a", ReplaceKeyPrefixWith: "b"}}}, `website: redirect rule 1: replaceKeyPrefixWith cannot be combined with replaceKeyWith`},
+		{&websiteConfig{RedirectRules: []redirectRule{{Protocol: "ftp"}}}, `website: redirect rule 1: invalid protocol "ftp"`},
+		{&websiteConfig{RedirectRules: []redirectRule{{Protocol: "https", Status: 200}}}, `website: redirect rule 1: invalid status 200`},
+	} {
+		c.Assert(test.w.init(), qt.ErrorMatches, test.err)
+	}
+}
+
+func TestWebsiteConfigFromArgs(t *testing.T) {
+	c := qt.New(t)
+
+	configFile := filepath.Join(t.TempDir(), "s3deploy.yml")
+	c.Assert(os.WriteFile(configFile, []byte(`
+website:
+  errorDocument: 404.html
+  redirectRules:
+    - keyPrefix: old/
+      replaceKeyPrefixWith: new/
+`), 0o644), qt.IsNil)
+
+	cfg, err := ConfigFromArgs([]string{"-bucket=mybucket", "-config=" + configFile, "-website-error-document=error.html"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.fileConf.Website.IndexDocument, qt.Equals, "index.html")
+	c.Assert(cfg.fileConf.Website.ErrorDocument, qt.Equals, "error.html")
+	c.Assert(cfg.fileConf.Website.RedirectRules, qt.HasLen, 1)
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-config=nosuch.yml", "-website-index-document=default.htm"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.fileConf.Website, qt.DeepEquals, &websiteConfig{IndexDocument: "default.htm"})
+
+	cfg, err = ConfigFromArgs([]string{"-bucket=mybucket", "-config=nosuch.yml"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Init(), qt.IsNil)
+	c.Assert(cfg.fileConf.Website, qt.IsNil)
+}
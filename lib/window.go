@@ -0,0 +1,132 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// deployWindow is a weekly recurring time window where deploys are allowed,
+// e.g. "Mon-Fri 09:00-17:00 Europe/Oslo".
+type deployWindow struct {
+	days [7]bool
+
+	// Minutes since midnight.
+	start int
+	end   int
+
+	loc *time.Location
+}
+
+// parseDeployWindow parses a window on the form "<days> <HH:MM>-<HH:MM> [timezone]",
+// where days is a comma separated list of days or day ranges, e.g. "Mon-Fri" or "Mon,Wed,Sat-Sun".
+// If the end time is before the start time, the window spans midnight.
+func parseDeployWindow(s string) (*deployWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid deploy window %q: must be on the form \"Mon-Fri 09:00-17:00 [timezone]\"", s)
+	}
+
+	w := &deployWindow{loc: time.Local}
+
+	for _, part := range strings.Split(fields[0], ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		d1, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return nil, fmt.Errorf("invalid deploy window %q: unknown day %q", s, from)
+		}
+		d2 := d1
+		if isRange {
+			d2, ok = weekdays[strings.ToLower(to)]
+			if !ok {
+				return nil, fmt.Errorf("invalid deploy window %q: unknown day %q", s, to)
+			}
+		}
+		for d := d1; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == d2 {
+				break
+			}
+		}
+	}
+
+	from, to, found := strings.Cut(fields[1], "-")
+	if !found {
+		return nil, fmt.Errorf("invalid deploy window %q: time range must be on the form HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, fmt.Errorf("invalid deploy window %q: %s", s, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, fmt.Errorf("invalid deploy window %q: %s", s, err)
+	}
+
+	if len(fields) == 3 {
+		w.loc, err = time.LoadLocation(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid deploy window %q: %s", s, err)
+		}
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t is inside the window.
+func (w *deployWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minutes := t.Hour()*60 + t.Minute()
+
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minutes >= w.start && minutes < w.end
+	}
+
+	// Spans midnight.
+	if minutes >= w.start {
+		return w.days[t.Weekday()]
+	}
+	return minutes < w.end && w.days[(t.Weekday()+6)%7]
+}
+
+// next returns the next time, starting at t, that is inside the window.
+func (w *deployWindow) next(t time.Time) time.Time {
+	if w.contains(t) {
+		return t
+	}
+	t = t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		d := t.AddDate(0, 0, i)
+		if !w.days[d.Weekday()] {
+			continue
+		}
+		start := time.Date(d.Year(), d.Month(), d.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+		if start.After(t) {
+			return start
+		}
+	}
+	// No days in the window.
+	return time.Time{}
+}
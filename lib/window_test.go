@@ -0,0 +1,47 @@
+// Copyright © 2022 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeployWindow(t *testing.T) {
+	c := qt.New(t)
+
+	w, err := parseDeployWindow("Mon-Fri 09:00-17:00 UTC")
+	c.Assert(err, qt.IsNil)
+
+	// 2024-06-03 is a Monday.
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2024, 6, 3, hour, minute, 0, 0, time.UTC)
+	}
+
+	c.Assert(w.contains(monday(9, 0)), qt.IsTrue)
+	c.Assert(w.contains(monday(16, 59)), qt.IsTrue)
+	c.Assert(w.contains(monday(17, 0)), qt.IsFalse)
+	c.Assert(w.contains(monday(8, 0)), qt.IsFalse)
+	c.Assert(w.contains(monday(12, 0).AddDate(0, 0, 5)), qt.IsFalse) // Saturday
+
+	c.Assert(w.next(monday(8, 0)), qt.Equals, monday(9, 0))
+	c.Assert(w.next(monday(10, 0)), qt.Equals, monday(10, 0))
+	c.Assert(w.next(monday(18, 0)), qt.Equals, monday(9, 0).AddDate(0, 0, 1))
+	c.Assert(w.next(monday(18, 0).AddDate(0, 0, 4)), qt.Equals, monday(9, 0).AddDate(0, 0, 7)) // Friday evening
+
+	w, err = parseDeployWindow("Sat,Sun 22:00-02:00 UTC")
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.contains(monday(1, 0)), qt.IsTrue) // Sunday night
+	c.Assert(w.contains(monday(23, 0)), qt.IsFalse)
+	c.Assert(w.contains(monday(23, 0).AddDate(0, 0, 5)), qt.IsTrue) // Saturday
+
+	for _, s := range []string{"", "Mon-Fri", "Foo 09:00-17:00", "Mon 09:00", "Mon 9-17", "Mon 09:00-17:00 Nowhere/City"} {
+		_, err = parseDeployWindow(s)
+		c.Assert(err, qt.IsNotNil, qt.Commentf(s))
+	}
+}
@@ -6,9 +6,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/debug"
 
 	"github.com/bep/s3deploy/v2/lib"
@@ -28,20 +31,68 @@ func main() {
 	}
 }
 
+// commands are the subcommands, run as e.g. "s3deploy plan -bucket=example.com".
+// Running s3deploy without a subcommand deploys, as before there were any.
+var commands = []struct {
+	name        string
+	description string
+}{
+	{"deploy", "deploy the source to the bucket (the default)"},
+	{"plan", "print the changes a deploy would make, and write them to the -plan file if set"},
+	{"validate", "check the flags and the config file, without connecting to AWS"},
+	{"doctor", "check the configuration, the credentials and the AWS permissions needed to deploy"},
+	{"invalidate", "invalidate the given paths (default everything) in the -distribution-id CDNs"},
+	{"prune", "delete the remote files not found in the source, or matching the given patterns, up to -prune-max-delete"},
+	{"ls", "list the remote files below the given prefix, with -ls-metadata also their headers"},
+	{"snapshot", "write the remote file list to -snapshot-file"},
+	{"diff-manifests", "compare two fingerprint manifests"},
+	{"version", "print the version"},
+	{"help", "print this help"},
+}
+
+func isCommand(name string) bool {
+	for _, c := range commands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func parseAndRun(args []string) error {
+	command := "deploy"
+	if len(args) > 0 && isCommand(args[0]) {
+		command, args = args[0], args[1:]
+	}
+
 	cfg, err := lib.ConfigFromArgs(args)
 	if err != nil {
 		return err
 	}
 
 	initVersionInfo()
+	cfg.Version = tag
+
+	switch command {
+	case "diff-manifests":
+		// Keep the output clean for piping to other tools.
+		return lib.DiffManifests(cfg, os.Stdout)
+	case "version":
+		fmt.Println(versionInfo())
+		return nil
+	}
+
+	if cfg.JSON {
+		// Keep stdout valid JSON.
+		cfg.Silent = true
+	}
 
 	if !cfg.Silent {
-		fmt.Printf("s3deploy %v, commit %v, built at %v\n", tag, commit, date)
+		fmt.Println(versionInfo())
 	}
 
-	if cfg.Help {
-		cfg.Usage()
+	if cfg.Help || command == "help" {
+		usage(cfg)
 		return nil
 	}
 
@@ -49,18 +100,167 @@ func parseAndRun(args []string) error {
 		return nil
 	}
 
-	stats, err := lib.Deploy(cfg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch command {
+	case "snapshot":
+		return lib.Snapshot(ctx, cfg)
+	case "ls":
+		return lib.List(ctx, cfg, os.Stdout)
+	case "validate":
+		return validate(cfg)
+	case "doctor":
+		return doctor(ctx, cfg)
+	case "invalidate":
+		return invalidate(ctx, cfg)
+	case "prune":
+		return prune(ctx, cfg)
+	case "plan":
+		return plan(ctx, cfg)
+	}
+
+	if cfg.PlanFile != "" {
+		return plan(ctx, cfg)
+	}
+
+	return deploy(ctx, cfg)
+}
+
+func usage(cfg *lib.Config) {
+	fmt.Fprintf(os.Stderr, "Usage: s3deploy [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s%s\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr)
+	cfg.Usage()
+}
+
+func deploy(ctx context.Context, cfg *lib.Config) error {
+	var (
+		stats lib.DeployStats
+		err   error
+	)
+	if cfg.ApplyFile != "" {
+		p, err := lib.ReadPlanFile(cfg.ApplyFile)
+		if err != nil {
+			return err
+		}
+		stats, err = lib.ApplyPlan(ctx, cfg, p)
+		if err != nil {
+			return err
+		}
+	} else {
+		stats, err = lib.DeployWithContext(ctx, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	if !cfg.Silent {
+		fmt.Println(stats.Summary())
+		if cfg.Verbose {
+			fmt.Println(stats.RouteSummary())
+			fmt.Println(stats.DirectorySummary())
+		}
+	}
+
+	return nil
+}
+
+func plan(ctx context.Context, cfg *lib.Config) error {
+	p, err := lib.PlanDeploy(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	if cfg.PlanFile != "" {
+		if err := p.WriteFile(cfg.PlanFile); err != nil {
+			return err
+		}
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+	if !cfg.Silent {
+		fmt.Println(p.Summary())
+		if cfg.PlanFile != "" {
+			fmt.Printf("Plan written to %s\n", cfg.PlanFile)
+		}
+	}
+	return nil
+}
 
+func validate(cfg *lib.Config) error {
+	if err := cfg.Init(); err != nil {
+		return err
+	}
 	if !cfg.Silent {
-		fmt.Println(stats.Summary())
+		fmt.Println("The flags and the config file are valid.")
 	}
+	return nil
+}
 
+func doctor(ctx context.Context, cfg *lib.Config) error {
+	r, err := lib.Doctor(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	} else if !cfg.Silent {
+		fmt.Println(r)
+	}
+	if n := r.Failures(); n > 0 {
+		return fmt.Errorf("%d of %d checks failed", n, len(r.Checks))
+	}
 	return nil
 }
 
+func invalidate(ctx context.Context, cfg *lib.Config) error {
+	ids, err := lib.Invalidate(ctx, cfg, cfg.Args...)
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ids)
+	}
+	return nil
+}
+
+func prune(ctx context.Context, cfg *lib.Config) error {
+	stats, err := lib.Prune(ctx, cfg, cfg.Args...)
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	if !cfg.Silent {
+		fmt.Printf("Pruned %d of %d files\n", stats.Deleted, stats.Deleted+stats.Stale)
+	}
+	return nil
+}
+
+func versionInfo() string {
+	return fmt.Sprintf("s3deploy %v, commit %v, built at %v", tag, commit, date)
+}
+
 func initVersionInfo() {
 	bi, ok := debug.ReadBuildInfo()
 	if !ok {
@@ -8,6 +8,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -18,6 +19,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bep/s3deploy/v2/lib/s3test"
 	"github.com/oklog/ulid/v2"
 
 	"github.com/rogpeppe/go-internal/testscript"
@@ -26,14 +29,75 @@ import (
 const s3IntegrationTestHttpRoot = "http://s3deployintegrationtest.s3-website.eu-north-1.amazonaws.com"
 
 func TestIntegration(t *testing.T) {
-	if os.Getenv("S3DEPLOY_TEST_KEY") == "" {
-		t.Skip("S3DEPLOY_TEST_KEY not set")
+	if endpoint := os.Getenv("S3DEPLOY_TEST_ENDPOINT_URL"); endpoint != "" {
+		// Run against an S3 compatible server, e.g. MinIO started
+		// with docker-compose.minio.yml.
+		if err := createTestBucket(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("S3DEPLOY_ENDPOINT_URL", endpoint)
+		t.Setenv("S3DEPLOY_TEST_URL", strings.TrimSuffix(endpoint, "/")+"/"+testBucket)
+	} else if os.Getenv("S3DEPLOY_TEST_KEY") == "" {
+		// Run against a fake S3 server.
+		srv := s3test.NewServer("s3deployfakekey", testBucket)
+		srv.Region = testRegion
+		t.Cleanup(srv.Close)
+		t.Setenv("S3DEPLOY_TEST_KEY", "s3deployfakekey")
+		t.Setenv("S3DEPLOY_TEST_SECRET", "s3deployfakesecret")
+		t.Setenv("S3DEPLOY_ENDPOINT_URL", srv.URL)
+		t.Setenv("S3DEPLOY_TEST_URL", srv.WebsiteURL(testBucket))
 	}
 	p := commonTestScriptsParam
 	p.Dir = "testscripts"
 	testscript.Run(t, p)
 }
 
+// createTestBucket creates the test bucket on the S3 compatible server
+// at endpoint if it doesn't exist, readable by anyone for the head command.
+func createTestBucket(endpoint string) error {
+	key, secret := os.Getenv("S3DEPLOY_TEST_KEY"), os.Getenv("S3DEPLOY_TEST_SECRET")
+	if key == "" || secret == "" {
+		return fmt.Errorf("S3DEPLOY_TEST_KEY and S3DEPLOY_TEST_SECRET must be set with S3DEPLOY_TEST_ENDPOINT_URL")
+	}
+	client := newTestS3Client(endpoint, key, secret)
+	ctx := context.Background()
+
+	_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{
+		Bucket: aws.String(testBucket),
+		CreateBucketConfiguration: &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(testRegion),
+		},
+	})
+	var exists *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &exists) {
+		return fmt.Errorf("failed to create bucket %q: %w", testBucket, err)
+	}
+
+	policy := fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::%s/*"]}]}`, testBucket)
+	if _, err := client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
+		Bucket: aws.String(testBucket),
+		Policy: aws.String(policy),
+	}); err != nil {
+		return fmt.Errorf("failed to make bucket %q public: %w", testBucket, err)
+	}
+	return nil
+}
+
+// newTestS3Client creates a client for the test bucket, with the
+// bucket in the path when running against endpoint.
+func newTestS3Client(endpoint, key, secret string) *s3.Client {
+	config := aws.Config{
+		Region:      testRegion,
+		Credentials: credentials.NewStaticCredentialsProvider(key, secret, os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	return s3.NewFromConfig(config, func(o *s3.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
 // Tests in development can be put in "testscripts/unfinished".
 func TestUnfinished(t *testing.T) {
 	if os.Getenv("CI") != "" {
@@ -69,7 +133,14 @@ func setup(env *testscript.Env) error {
 	env.Setenv("S3DEPLOY_TEST_SECRET", os.Getenv("S3DEPLOY_TEST_SECRET"))
 	env.Setenv("S3DEPLOY_TEST_BUCKET", testBucket)
 	env.Setenv("S3DEPLOY_TEST_REGION", testRegion)
-	env.Setenv("S3DEPLOY_TEST_URL", s3IntegrationTestHttpRoot)
+	testURL := os.Getenv("S3DEPLOY_TEST_URL")
+	if testURL == "" {
+		testURL = s3IntegrationTestHttpRoot
+	}
+	env.Setenv("S3DEPLOY_TEST_URL", testURL)
+	if endpoint := os.Getenv("S3DEPLOY_ENDPOINT_URL"); endpoint != "" {
+		env.Setenv("S3DEPLOY_ENDPOINT_URL", endpoint)
+	}
 	env.Setenv("S3DEPLOY_TEST_ID", strings.ToLower(ulid.Make().String()))
 	return nil
 }
@@ -83,20 +154,34 @@ func gtKeySecret(ts *testscript.TestScript) (string, string) {
 	return key, secret
 }
 
+// headIgnoreHeaders are left out by the head command, as they differ
+// between S3 and S3 compatible servers.
+var headIgnoreHeaders = map[string]bool{
+	"Accept-Ranges":             true,
+	"Content-Security-Policy":   true,
+	"Strict-Transport-Security": true,
+	"Vary":                      true,
+	"X-Content-Type-Options":    true,
+	"X-Xss-Protection":          true,
+}
+
 var commonTestScriptsParam = testscript.Params{
 	Setup: func(env *testscript.Env) error {
 		return setup(env)
 	},
+	// [endpoint] is set when running against an S3 compatible server,
+	// see S3DEPLOY_TEST_ENDPOINT_URL.
+	Condition: func(cond string) (bool, error) {
+		if cond == "endpoint" {
+			return os.Getenv("S3DEPLOY_TEST_ENDPOINT_URL") != "", nil
+		}
+		return false, fmt.Errorf("unknown condition %q", cond)
+	},
 	Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
 		"s3get": func(ts *testscript.TestScript, neg bool, args []string) {
 			key := args[0]
 			testKey, testSecret := gtKeySecret(ts)
-			config := aws.Config{
-				Region:      testRegion,
-				Credentials: credentials.NewStaticCredentialsProvider(testKey, testSecret, os.Getenv("AWS_SESSION_TOKEN")),
-			}
-
-			client := s3.NewFromConfig(config)
+			client := newTestS3Client(ts.Getenv("S3DEPLOY_ENDPOINT_URL"), testKey, testSecret)
 
 			obj, err := client.GetObject(
 				context.Background(),
@@ -132,7 +217,11 @@ var commonTestScriptsParam = testscript.Params{
 		// head executes HTTP HEAD on the given URL and prints the response status code and
 		// headers to stdout.
 		"head": func(ts *testscript.TestScript, neg bool, args []string) {
-			url := s3IntegrationTestHttpRoot + args[0]
+			url := ts.Getenv("S3DEPLOY_TEST_URL") + args[0]
+			if strings.HasSuffix(url, "/") && os.Getenv("S3DEPLOY_TEST_ENDPOINT_URL") != "" {
+				// No website endpoint serving the index document.
+				url += "index.html"
+			}
 			fmt.Fprintln(ts.Stdout(), "head", url)
 			resp, err := http.DefaultClient.Head(url)
 			if err != nil {
@@ -143,6 +232,9 @@ var commonTestScriptsParam = testscript.Params{
 			// Print headers
 			var headers []string
 			for k, v := range resp.Header {
+				if headIgnoreHeaders[k] {
+					continue
+				}
 				headers = append(headers, fmt.Sprintf("%s: %s", k, v[0]))
 			}
 			sort.Strings(headers)